@@ -5,6 +5,7 @@ go 1.21
 require (
 	github.com/denisenkom/go-mssqldb v0.12.3
 	github.com/joho/godotenv v1.5.1
+	golang.org/x/oauth2 v0.15.0
 	google.golang.org/api v0.155.0
 )
 
@@ -29,7 +30,6 @@ require (
 	go.opentelemetry.io/otel/trace v1.21.0 // indirect
 	golang.org/x/crypto v0.17.0 // indirect
 	golang.org/x/net v0.19.0 // indirect
-	golang.org/x/oauth2 v0.15.0 // indirect
 	golang.org/x/sys v0.15.0 // indirect
 	golang.org/x/text v0.14.0 // indirect
 	google.golang.org/appengine v1.6.8 // indirect
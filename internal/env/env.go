@@ -0,0 +1,48 @@
+// Package env reads the settings shared by the backup-otomatis packages from
+// the environment, which pipeline.LoadSettings fills from flags, .env and the config
+// files.
+package env
+
+import (
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// Or returns the named environment variable, or def when it is unset.
+func Or(name, def string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+	return def
+}
+
+// Duration reads a Go duration (e.g. "30m") from the named environment variable,
+// returning def when it is unset or invalid.
+func Duration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("warning: invalid %s %q: %v, using %s", name, v, err, def)
+		return def
+	}
+	return d
+}
+
+// LoadLocation returns the named IANA timezone; empty, "Local" and unknown
+// names yield the local timezone.
+func LoadLocation(tz string) *time.Location {
+	if tz == "" || strings.EqualFold(tz, "Local") {
+		return time.Local
+	}
+	loc, err := time.LoadLocation(tz)
+	if err != nil {
+		log.Printf("warning: unable to load timezone %s: %v, using Local", tz, err)
+		return time.Local
+	}
+	return loc
+}
@@ -6,851 +6,50 @@
 package main
 
 import (
-	"context"
-	"fmt"
-	"io"
 	"log"
 	"os"
-	"os/exec"
-	"path/filepath"
-	"strconv"
 	"strings"
 	"time"
 
-	"github.com/joho/godotenv"
-	"google.golang.org/api/drive/v3"
-	"google.golang.org/api/option"
-	"google.golang.org/api/sheets/v4"
-)
-
-const (
-	minFileSize = 10 * 1024
-	// main is the entry point of the backup-otomatis application.
-	//
-	// It loads environment variables, authenticates with Google services,
-	// retrieves files from Drive, processes each file by downloading, extracting,
-	// restoring to database, running updates, and cleaning up.
-	maxAgeForDeletion = 10 * time.Minute
+	"backup-otomatis/pkg/pipeline"
 )
 
+// main is the entry point of the backup-otomatis application.
+//
+// It loads the settings from flags, .env and the config files, then runs the
+// maintenance subcommand given, or the backup processing of package pipeline.
 func main() {
-	log.Println("Starting backup-otomatis application")
-
-	// Load .env file
-	log.Println("Loading .env file...")
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatalf("Error loading .env file: %v", err)
-	}
-	log.Println(".env file loaded successfully")
-
-	// Get environment variables
-	log.Println("Reading environment variables...")
-	dbHost := os.Getenv("DB_HOST")
-	dbUser := os.Getenv("DB_USER")
-	dbPass := os.Getenv("DB_PASS")
-	dbName := os.Getenv("DB_NAME")
-	sevenZPassword := os.Getenv("SEVENZ_PASSWORD")
-	updateQuery := os.Getenv("UPDATE_QUERY")
-	quarantineFolderID := os.Getenv("QUARANTINE_FOLDER_ID")
-	serviceAccountFile := os.Getenv("SERVICE_ACCOUNT_FILE")
-	spreadsheetID := os.Getenv("SPREADSHEET_ID")
-
-	log.Printf("DB_HOST: %s", dbHost)
-	log.Printf("DB_USER: %s", dbUser)
-	log.Printf("DB_PASS: %s", strings.Repeat("*", len(dbPass))) // Hide password
-	log.Printf("DB_NAME: %s", dbName)
-	log.Printf("SEVENZ_PASSWORD: %s", strings.Repeat("*", len(sevenZPassword)))
-
-	log.Printf("SERVICE_ACCOUNT_FILE: %s", serviceAccountFile)
-	log.Printf("SPREADSHEET_ID: %s", spreadsheetID)
-
-	if dbHost == "" || dbName == "" || sevenZPassword == "" || updateQuery == "" || serviceAccountFile == "" || spreadsheetID == "" {
-		log.Fatal("Missing required environment variables")
-	}
-	log.Println("All required environment variables are set")
-
-	// Ensure required external tools are available in PATH before proceeding.
-	// This fails fast with a clear message so the operator can fix the environment.
-	if _, err := exec.LookPath("7z"); err != nil {
-		log.Fatalf("7z not found in PATH: %v. Please install 7-Zip and ensure '7z' is available in PATH.", err)
-	}
-	if _, err := exec.LookPath("sqlcmd"); err != nil {
-		log.Fatalf("sqlcmd not found in PATH: %v. Please install SQL Server Command Line Utilities (sqlcmd) and ensure it's available in PATH.", err)
-	}
+	started := time.Now()
+	log.Printf("Starting backup-otomatis application %s", pipeline.Version())
 
-	// Authenticate with Google Drive and Sheets
-	log.Println("Authenticating with Google Drive and Sheets...")
-	ctx := context.Background()
-	srv, err := drive.NewService(ctx, option.WithCredentialsFile(serviceAccountFile))
-	if err != nil {
-		log.Fatalf("Unable to retrieve Drive client: %v", err)
-	}
-	sheetsSrv, err := sheets.NewService(ctx, option.WithCredentialsFile(serviceAccountFile))
+	// Load settings from flags, .env and the user and machine config files
+	args, loaded, err := pipeline.LoadSettings(os.Args[1:])
 	if err != nil {
-		log.Fatalf("Unable to retrieve Sheets client: %v", err)
-	}
-	log.Println("Google Drive and Sheets authentication successful")
-
-	// Get files from folder
-	log.Println("Retrieving files from Google Drive...")
-	files, err := getFilesFromFolder(srv, dbName)
-	if err != nil {
-		log.Fatalf("Unable to get files: %v", err)
-	}
-	log.Printf("Found %d files to process", len(files))
-
-	// Process each file
-	for i, file := range files {
-		log.Printf("Processing file %d/%d: %s (ID: %s)", i+1, len(files), file.Name, file.Id)
-		err := processFile(srv, sheetsSrv, spreadsheetID, file, dbHost, dbUser, dbPass, dbName, sevenZPassword, updateQuery, quarantineFolderID)
-		if err != nil {
-			log.Printf("Error processing file %s: %v", file.Name, err)
-			continue
-		}
-		log.Printf("Successfully processed file %s", file.Name)
-
-		// After successful processing, drop the restored database to free space.
-		if derr := dropDatabase(dbHost, dbUser, dbPass); derr != nil {
-			log.Printf("Warning: failed to drop database %s after processing %s: %v", dbName, file.Name, derr)
-		} else {
-			log.Printf("Dropped database %s after processing %s", dbName, file.Name)
-		}
-	}
-
-	log.Println("Backup-otomatis application completed")
-
-	// Optionally empty the quarantine folder based on environment settings.
-	emptyQuarantineStr := os.Getenv("EMPTY_QUARANTINE")
-	if strings.EqualFold(emptyQuarantineStr, "true") {
-		// parse options
-		deleteAll := strings.EqualFold(os.Getenv("QUARANTINE_DELETE_ALL"), "true")
-		maxAgeHours := 24 * 7 // default: 7 days
-		if v := os.Getenv("QUARANTINE_MAX_AGE_HOURS"); v != "" {
-			if pv, err := strconv.Atoi(v); err == nil && pv >= 0 {
-				maxAgeHours = pv
-			}
-		}
-		if err := emptyQuarantine(srv, sheetsSrv, quarantineFolderID, deleteAll, maxAgeHours); err != nil {
-			log.Printf("Warning: failed to empty quarantine folder %s: %v", quarantineFolderID, err)
-		}
-	}
-}
-
-func getFilesFromFolder(srv *drive.Service, dbName string) ([]*drive.File, error) {
-	query := fmt.Sprintf("trashed = false and mimeType != 'application/vnd.google-apps.folder' and name contains '%s'", dbName)
-	log.Printf("Executing Drive query: %s", query)
-	fileList, err := srv.Files.List().Q(query).PageSize(1000).Fields("nextPageToken, files(id, name, createdTime, size, parents)").OrderBy("createdTime").Do()
-	if err != nil {
-		return nil, fmt.Errorf("Drive API error: %v", err)
-	}
-	log.Printf("Drive API returned %d files", len(fileList.Files))
-	return fileList.Files, nil
-}
-
-func processFile(srv *drive.Service, sheetsSrv *sheets.Service, spreadsheetID string, file *drive.File, dbHost, dbUser, dbPass, dbName, password, updateQuery, quarantineFolderID string) error {
-	log.Printf("Starting processing for file: %s", file.Name)
-
-	if file.Size < minFileSize {
-		return deleteSmallFile(srv, file)
-	}
-
-	tempDir, err := createTempDir()
-	if err != nil {
-		return err
-	}
-	defer os.RemoveAll(tempDir)
-
-	bakFile, err := downloadAndExtract(srv, file, tempDir, password)
-	// deleteSmallFile deletes a file from Google Drive if it is smaller than the minimum size.
-	//
-	// Parameters:
-	//   - srv: Google Drive service client.
-	//   - file: the file to delete.
-	//
-	// Returns:
-	//   - error: any error encountered during deletion.
-	if err != nil {
-		// If quarantineFolderID is set, move the Drive file there for later inspection.
-		if quarantineFolderID != "" {
-			if mErr := moveFileToFolder(srv, file.Id, quarantineFolderID); mErr != nil {
-				log.Printf("Warning: failed to move file %s to quarantine: %v", file.Name, mErr)
-			} else {
-				log.Printf("Moved file %s to quarantine folder %s", file.Name, quarantineFolderID)
-			}
-		} else {
-			if shouldDelete(file) {
-				if dErr := deleteFileAndUpdateSpreadsheet(srv, sheetsSrv, spreadsheetID, file); dErr != nil {
-					log.Printf("Warning: failed to delete small file %s: %v", file.Name, dErr)
-				}
-			} else {
-				log.Printf("File %s is less than 10 minutes old, skipping deletion", file.Name)
-			}
-		}
-		return err
-	}
-
-	grantPermissions(bakFile, dbHost)
-
-	err = restoreDB(dbHost, dbUser, dbPass, bakFile)
-	if err != nil {
-		// If restore failed because the database was in use (exclusive access could not be obtained),
-		// attempt to force-drop the database and retry once.
-		lower := strings.ToLower(err.Error())
-		if strings.Contains(lower, "exclusive access could not be obtained") || strings.Contains(lower, "msg 3101") || strings.Contains(lower, "database is in use") {
-			log.Printf("Restore failed due to database in use: %v. Attempting force drop and retry...", err)
-			if derr := dropDatabase(dbHost, dbUser, dbPass); derr != nil {
-				log.Printf("Warning: failed to drop database: %v", derr)
-			} else {
-				// small pause before retrying
-				time.Sleep(3 * time.Second)
-				rerr := restoreDB(dbHost, dbUser, dbPass, bakFile)
-				if rerr == nil {
-					log.Printf("Restore succeeded after dropping database %s", dbName)
-				} else {
-					log.Printf("Retry restore failed: %v", rerr)
-					err = rerr
-				}
-			}
-		}
-
-		if err != nil {
-			if quarantineFolderID != "" {
-				// rename the file to include parent folder name instead of dbName
-				parentName, pErr := getParentFolderName(srv, file)
-				if pErr == nil && parentName != "" {
-					newName := strings.Replace(file.Name, dbName, parentName, -1)
-					if rErr := renameDriveFile(srv, file.Id, newName); rErr != nil {
-						log.Printf("Warning: failed to rename file %s before quarantine: %v", file.Name, rErr)
-					} else {
-						log.Printf("Renamed file %s -> %s before moving to quarantine", file.Name, newName)
-						file.Name = newName
-					}
-				}
-				if mErr := moveFileToFolder(srv, file.Id, quarantineFolderID); mErr != nil {
-					log.Printf("Warning: failed to move file %s to quarantine: %v", file.Name, mErr)
-				} else {
-					log.Printf("Moved file %s to quarantine folder %s", file.Name, quarantineFolderID)
-				}
-			}
-			return err
-		}
+		log.Fatalf("Error loading settings: %v", err)
 	}
-
-	err = runUpdateQuery(dbHost, dbUser, dbPass, dbName, updateQuery)
-	if err != nil {
-		// grantPermissions grants SQL Server service permissions on the backup file and its directory.
-		//
-		// It determines the appropriate service account based on the database host and uses icacls
-		// to grant full control permissions.
-		//
-		// Parameters:
-		//   - bakFile: path to the .bak file.
-		//   - dbHost: SQL Server host, used to determine the service account.
-		return err
-	}
-
-	// shouldDelete determines if a file should be deleted based on its age.
-	//
-	// Files older than maxAgeForDeletion (10 minutes) are eligible for deletion.
-	//
-	// Parameters:
-	//   - file: the Google Drive file to check.
-	//
-	// Returns:
-	//   - bool: true if the file should be deleted, false otherwise.
-	// formatCreatedTime formats the file creation time according to the configured timezone.
-	//
-	// If SPREADSHEET_TIMEZONE is set, it uses that timezone; otherwise, uses local time.
-	// Falls back to the original string if parsing fails.
-	//
-	// Parameters:
-	//   - createdTimeStr: RFC3339 formatted creation time string.
-	//
-	// Returns:
-	//   - string: formatted time string in "1/2/2006 15:04:05" format.
-	err = deleteFileAndUpdateSpreadsheet(srv, sheetsSrv, spreadsheetID, file)
-	if err != nil {
-		return err
-	}
-
-	log.Printf("Processing completed for file: %s", file.Name)
-	return nil
-}
-func deleteSmallFile(srv *drive.Service, file *drive.File) error {
-	log.Printf("File %s is smaller than 10KB (%d bytes), deleting from Drive", file.Name, file.Size)
-	err := srv.Files.Delete(file.Id).Do()
-	// deleteFileAndUpdateSpreadsheet deletes a file from Google Drive and updates the tracking spreadsheet.
-	//
-	// It retrieves the parent folder name, formats the creation time, and either updates an existing
-	// row in the spreadsheet or appends a new one.
-	//
-	// Parameters:
-	//   - srv: Google Drive service client.
-	//   - sheetsSrv: Google Sheets service client.
-	//   - spreadsheetID: ID of the Google Sheet.
-	//   - file: the file being processed.
-	//
-	// Returns:
-	//   - error: any error encountered during deletion or spreadsheet update.
-	if err != nil {
-		return fmt.Errorf("failed to delete small file: %v", err)
-	}
-	log.Println("Small file deleted from Google Drive")
-	return nil
-}
-
-func createTempDir() (string, error) {
-	tempDir, err := os.MkdirTemp("", "backup-*")
-	if err != nil {
-		return "", fmt.Errorf("failed to create temp dir: %v", err)
-	}
-	log.Printf("Temporary directory created: %s", tempDir)
-	return tempDir, nil
-}
-
-func downloadAndExtract(srv *drive.Service, file *drive.File, tempDir, password string) (string, error) {
-	downloadedFile := filepath.Join(tempDir, file.Name)
-	log.Printf("Downloading file to: %s", downloadedFile)
-	err := downloadFile(srv, file.Id, downloadedFile)
-	// downloadFile downloads a file from Google Drive to the specified destination path.
-	//
-	// Parameters:
-	//   - srv: Google Drive service client.
-	//   - fileID: ID of the file to download.
-	//   - destPath: local path where the file will be saved.
-	//
-	// Returns:
-	//   - error: any error encountered during download.
-	if err != nil {
-		return "", fmt.Errorf("failed to download file: %v", err)
-	}
-	log.Println("File downloaded successfully")
-
-	extractDir := filepath.Join(tempDir, "extracted")
-	log.Printf("Extracting 7z archive to: %s", extractDir)
-	err = extract7z(downloadedFile, extractDir, password)
-	// extract7z extracts a 7z archive to the specified directory using the provided password.
-	//
-	// Parameters:
-	//   - archivePath: path to the 7z archive file.
-	//   - destDir: destination directory for extraction.
-	// findBakFile searches for a .bak file within the specified directory.
-	//
-	// It recursively walks the directory and returns the path of the first .bak file found.
-	//
-	// Parameters:
-	//   - dir: directory to search in.
-	//
-	// Returns:
-	//   - string: path to the .bak file.
-	//   - error: error if no .bak file is found or if walking fails.
-	//   - password: password for the archive.
-	//
-	// Returns:
-	//   - error: any error encountered during extraction.
-	if err != nil {
-		return "", fmt.Errorf("failed to extract 7z: %v", err)
-	}
-	log.Println("7z extraction completed")
-
-	log.Println("Searching for .bak file...")
-	// restoreDB restores a SQL Server database from a .bak file.
-	//
-	// It performs a full restore with move operations, setting the database to single-user mode
-	// during the process and back to multi-user afterward. It detects logical file names and
-	// uses the instance's default data path.
-	//
-	// Parameters:
-	//   - host: SQL Server host.
-	//   - user: database username (empty for Windows auth).
-	//   - pass: database password (empty for Windows auth).
-	//   - dbName: name of the database to restore.
-	//   - bakPath: path to the .bak file.
-	//
-	// Returns:
-	//   - error: any error encountered during the restore process.
-	bakFile, err := findBakFile(extractDir)
-	if err != nil {
-		return "", fmt.Errorf("failed to find .bak file: %v", err)
-	}
-	log.Printf("Found .bak file: %s", bakFile)
-	return bakFile, nil
-}
-
-func grantPermissions(bakFile, dbHost string) {
-	log.Println("Granting permissions to SQL Server service on bak file and folder...")
-	serviceAcct := "NT SERVICE\\MSSQLSERVER"
-	if strings.Contains(dbHost, "\\") {
-		parts := strings.SplitN(dbHost, "\\", 2)
-		instance := parts[1]
-		serviceAcct = "NT SERVICE\\MSSQL$" + instance
-	}
-	cmd := exec.Command("icacls", bakFile, "/grant", serviceAcct+":F")
-	err := cmd.Run()
-	if err != nil {
-		log.Printf("Failed to grant permissions on bak file: %v", err)
-	}
-	extractFolder := filepath.Dir(bakFile)
-	cmd = exec.Command("icacls", extractFolder, "/grant", serviceAcct+":F", "/T")
-	err = cmd.Run()
-	if err != nil {
-		log.Printf("Failed to grant permissions on extract folder: %v", err)
-	}
-}
-
-func shouldDelete(file *drive.File) bool {
-	createdTime, err := time.Parse(time.RFC3339, file.CreatedTime)
-	if err != nil {
-		log.Printf("Error parsing created time for %s: %v, proceeding without deletion", file.Name, err)
-		return false
-	}
-	return time.Since(createdTime) >= maxAgeForDeletion
-}
-
-func formatCreatedTime(createdTimeStr string) string {
-	t, err := time.Parse(time.RFC3339, createdTimeStr)
-	if err != nil {
-		return createdTimeStr
-	}
-	tz := os.Getenv("SPREADSHEET_TIMEZONE")
-	var loc *time.Location
-	if tz == "" || strings.EqualFold(tz, "Local") {
-		loc = time.Local
+	if len(loaded) == 0 {
+		log.Println("No .env or config file found, using the environment only")
 	} else {
-		l, lerr := time.LoadLocation(tz)
-		if lerr != nil {
-			log.Printf("warning: unable to load timezone %s: %v, using Local", tz, lerr)
-			loc = time.Local
-		} else {
-			loc = l
-		}
+		log.Printf("Settings loaded from %s", strings.Join(loaded, ", "))
 	}
-	return t.In(loc).Format("1/2/2006 15:04:05")
-}
 
-func deleteFileAndUpdateSpreadsheet(srv *drive.Service, sheetsSrv *sheets.Service, spreadsheetID string, file *drive.File) error {
-	log.Printf("Deleting file from Google Drive: %s", file.Id)
-	err := srv.Files.Delete(file.Id).Do()
+	p, err := pipeline.New(pipeline.ConfigFromEnv())
 	if err != nil {
-		return fmt.Errorf("failed to delete Drive file: %v", err)
+		log.Fatalf("Unable to open state file: %v", err)
 	}
-	log.Println("File deleted from Google Drive")
 
-	parentName, pErr := getParentFolderName(srv, file)
-	log.Printf("Parent folder name: %s", parentName)
-	if pErr != nil {
-		log.Printf("Warning: failed to get parent folder name: %v", pErr)
-	} else {
-		createdStr := formatCreatedTime(file.CreatedTime)
-		if uErr := upsertSpreadsheetRow(sheetsSrv, spreadsheetID, parentName, createdStr); uErr != nil {
-			log.Printf("Warning: failed to update spreadsheet: %v", uErr)
-		} else {
-			log.Printf("Spreadsheet updated for Kab=%s with Susenas=%s", parentName, createdStr)
+	if len(args) > 0 {
+		if err := p.RunCommand(args[0], args[1:]); err != nil {
+			log.Fatalf("%s: %v", args[0], err)
 		}
+		return
 	}
-	return nil
-}
-
-// moveFileToFolder moves a Drive file to a different folder by updating its parents.
-// It will set the parent to the quarantine folder and remove existing parents.
-func moveFileToFolder(srv *drive.Service, fileID, quarantineFolderID string) error {
-	// Get current parents
-	f, err := srv.Files.Get(fileID).Fields("parents").Do()
-	if err != nil {
-		return fmt.Errorf("failed to get file parents: %v", err)
-	}
-	var remove string
-	if len(f.Parents) > 0 {
-		remove = strings.Join(f.Parents, ",")
-	}
-	_, err = srv.Files.Update(fileID, &drive.File{}).AddParents(quarantineFolderID).RemoveParents(remove).Fields("id, parents").Do()
-	if err != nil {
-		return fmt.Errorf("failed to move file to quarantine: %v", err)
-	}
-	return nil
-}
 
-// renameDriveFile renames a Drive file by updating its name field.
-func renameDriveFile(srv *drive.Service, fileID, newName string) error {
-	f := &drive.File{Name: newName}
-	_, err := srv.Files.Update(fileID, f).Fields("id, name").Do()
+	exitCode, err := p.Run(started)
 	if err != nil {
-		return fmt.Errorf("failed to rename file: %v", err)
+		log.Fatal(err)
 	}
-	return nil
-}
-
-// emptyQuarantine lists files in the specified quarantine folder and deletes them
-// according to the options. If deleteAll is true, all files are removed. Otherwise
-// files older than maxAgeHours are deleted. For each deletion, the spreadsheet is
-// updated via deleteFileAndUpdateSpreadsheet.
-func emptyQuarantine(srv *drive.Service, sheetsSrv *sheets.Service, quarantineFolderID string, deleteAll bool, maxAgeHours int) error {
-	if quarantineFolderID == "" {
-		return fmt.Errorf("no quarantine folder configured")
-	}
-	// list files in folder
-	q := fmt.Sprintf("trashed = false and '%s' in parents and mimeType != 'application/vnd.google-apps.folder'", quarantineFolderID)
-	pageToken := ""
-	for {
-		req := srv.Files.List().Q(q).Fields("nextPageToken, files(id, name, createdTime, size, parents)")
-		if pageToken != "" {
-			req = req.PageToken(pageToken)
-		}
-		resp, err := req.Do()
-		if err != nil {
-			return fmt.Errorf("failed to list quarantine files: %v", err)
-		}
-		for _, f := range resp.Files {
-			deleteIt := deleteAll
-			if !deleteAll {
-				ct, err := time.Parse(time.RFC3339, f.CreatedTime)
-				if err != nil {
-					// unable to parse time; skip deletion of this file
-					log.Printf("Warning: unable to parse createdTime for %s: %v", f.Name, err)
-					continue
-				}
-				if time.Since(ct) >= time.Duration(maxAgeHours)*time.Hour {
-					deleteIt = true
-				}
-			}
-			if deleteIt {
-				// call deleteFileAndUpdateSpreadsheet to delete and update sheet
-				if err := deleteFileAndUpdateSpreadsheet(srv, sheetsSrv, os.Getenv("SPREADSHEET_ID"), f); err != nil {
-					log.Printf("Warning: failed to delete quarantine file %s: %v", f.Name, err)
-				} else {
-					log.Printf("Deleted quarantine file: %s", f.Name)
-				}
-			}
-		}
-		if resp.NextPageToken == "" {
-			break
-		}
-		pageToken = resp.NextPageToken
-	}
-	return nil
-}
-
-func downloadFile(srv *drive.Service, fileID, destPath string) error {
-	resp, err := srv.Files.Get(fileID).Download()
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-
-	out, err := os.Create(destPath)
-	if err != nil {
-		return err
-	}
-	defer out.Close()
-
-	_, err = io.Copy(out, resp.Body)
-	return err
-}
-
-func extract7z(archivePath, destDir, password string) error {
-	cmd := exec.Command("7z", "x", "-p"+password, archivePath, "-o"+destDir)
-	return cmd.Run()
-}
-
-func findBakFile(dir string) (string, error) {
-	// runUpdateQuery executes a SQL query on the specified database.
-	//
-	// Parameters:
-	//   - host: SQL Server host.
-	//   - user: database username (empty for Windows auth).
-	//   - pass: database password (empty for Windows auth).
-	//   - dbName: target database name.
-	//   - query: SQL query to execute.
-	//
-	// Returns:
-	//   - error: any error encountered during query execution.
-	var bakFile string
-	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return err
-		}
-		if strings.HasSuffix(info.Name(), ".bak") {
-			bakFile = path
-		}
-		return nil
-	})
-	if err != nil {
-		return "", err
-	}
-	if bakFile == "" {
-		return "", fmt.Errorf("no .bak file found")
-	}
-	return bakFile, nil
-}
-
-func restoreDB(host, user, pass, bakPath string) error {
-	dbName := "Temp"
-	args := []string{"-S", host, "-d", "master"}
-	if user == "" && pass == "" {
-		args = append(args, "-E")
-	} else {
-		args = append(args, "-U", user, "-P", pass)
-	}
-
-	// First, get logical file names from the backup using RESTORE FILELISTONLY
-	argsList := append(args, "-h", "-1", "-W", "-s", "|", "-Q", fmt.Sprintf("SET NOCOUNT ON; RESTORE FILELISTONLY FROM DISK='%s'", bakPath))
-	cmd := exec.Command("sqlcmd", argsList...)
-	out, err := cmd.Output()
-	if err != nil {
-		return fmt.Errorf("failed to run RESTORE FILELISTONLY: %v", err)
-	}
-	// If sqlcmd returned output that looks like an error message (for example
-	// messages starting with "Msg" or containing "error"/"failed"), treat
-	// it as a failure even if the process exit code is 0.
-	if has, txt := sqlOutputHasError(out); has {
-		return fmt.Errorf("RESTORE FILELISTONLY reported error: %s", txt)
-	}
-	listOut := strings.TrimSpace(string(out))
-	var dataLogical, logLogical string
-	if listOut != "" {
-		lines := strings.Split(listOut, "\n")
-		for _, l := range lines {
-			l = strings.TrimSpace(l)
-			if l == "" {
-				continue
-			}
-			cols := strings.Split(l, "|")
-			for i := range cols {
-				cols[i] = strings.TrimSpace(cols[i])
-			}
-			if len(cols) < 3 {
-				continue
-			}
-			typ := strings.ToUpper(cols[2])
-			if strings.HasPrefix(typ, "L") {
-				logLogical = cols[0]
-			} else {
-				// treat as data
-				dataLogical = cols[0]
-			}
-		}
-	}
-
-	// Next, query the instance default data path. Use SET NOCOUNT ON and suppress headers/rowcounts.
-	argsPath := append(args, "-h", "-1", "-W", "-Q", "SET NOCOUNT ON; SELECT SERVERPROPERTY('InstanceDefaultDataPath')")
-	cmd = exec.Command("sqlcmd", argsPath...)
-	out, err = cmd.Output()
-	if err != nil {
-		// If we can't get the instance path, fall back to the backup's directory
-		log.Printf("warning: failed to get instance data path: %v", err)
-	} else {
-		// check output for error-like content
-		if has, txt := sqlOutputHasError(out); has {
-			log.Printf("warning: RESTORE PATH query reported messages: %s", txt)
-			// continue; don't abort here because we can still fall back to bak dir
-		}
-	}
-	dataPath := strings.TrimSpace(string(out))
-	// sqlcmd may return the literal "NULL" when the property is not set.
-	if dataPath == "" || strings.EqualFold(dataPath, "NULL") {
-		// fallback to directory of the .bak file
-		dataPath = filepath.Dir(bakPath)
-		log.Printf("Data path empty or NULL, falling back to bak directory: %s", dataPath)
-	} else {
-		log.Printf("Data path: %s", dataPath)
-	}
-
-	// Use detected logical names or sensible defaults
-	if dataLogical == "" {
-		dataLogical = dbName
-	}
-	if logLogical == "" {
-		logLogical = dbName + "_log"
-	}
-
-	// Set database to single user mode to close all other connections
-	// Database set to single user mode is handled by caller if needed
-
-	// Build RESTORE ... WITH MOVE statement
-	mdfTarget := filepath.Join(dataPath, dbName+".mdf")
-	ldfTarget := filepath.Join(dataPath, dbName+"_log.ldf")
-	query := fmt.Sprintf("RESTORE DATABASE %s FROM DISK='%s' WITH REPLACE, MOVE '%s' TO '%s', MOVE '%s' TO '%s'", dbName, bakPath, dataLogical, mdfTarget, logLogical, ldfTarget)
-	argsRestore := append(args, "-Q", query)
-	cmd = exec.Command("sqlcmd", argsRestore...)
-	output, err := cmd.CombinedOutput()
-	log.Printf("sqlcmd output: %s", string(output))
-	if err != nil {
-		log.Printf("sqlcmd output: %s", string(output))
-		return fmt.Errorf("restore failed: %v", err)
-	}
-	if has, txt := sqlOutputHasError(output); has {
-		log.Printf("sqlcmd output: %s", string(output))
-		return fmt.Errorf("restore reported errors: %s", txt)
-	}
-	log.Println("Database restore completed")
-
-	// // Set database back to multi user mode
-	// Set database back to multi user mode is handled by caller if needed
-
-	return nil
-}
-
-func runUpdateQuery(host, user, pass, dbName, query string) error {
-	args := []string{"-S", host, "-d", dbName}
-	if user == "" && pass == "" {
-		args = append(args, "-E")
-	} else {
-		args = append(args, "-U", user, "-P", pass)
-	}
-	args = append(args, "-Q", query)
-	// log.Printf("Running sqlcmd with args: %v", args)
-	cmd := exec.Command("sqlcmd", args...)
-	output, err := cmd.CombinedOutput()
-	log.Printf("sqlcmd output: %s", string(output))
-	if err != nil {
-		return err
-	}
-	if has, txt := sqlOutputHasError(output); has {
-		return fmt.Errorf("sql update reported error: %s", txt)
-	}
-	return nil
-}
-
-// sqlOutputHasError inspects sqlcmd output for common SQL Server error patterns.
-// It returns true and a shortened text snippet when it detects likely errors.
-func sqlOutputHasError(output []byte) (bool, string) {
-	s := string(output)
-	if s == "" {
-		return false, ""
-	}
-	lower := strings.ToLower(s)
-	// Look for SQL Server message prefix (e.g., "Msg 12345") or common error words.
-	if strings.Contains(s, "Msg ") || strings.Contains(lower, "error") || strings.Contains(lower, "failed") || strings.Contains(lower, "cannot") {
-		// return a trimmed snippet (first 1024 chars) to avoid huge error messages
-		snippet := s
-		if len(snippet) > 1024 {
-			snippet = snippet[:1024] + "..."
-		}
-		return true, snippet
-	}
-	return false, ""
-}
-
-// dropDatabase drops the given database using sqlcmd. It will attempt to set
-// the database to single user with rollback immediate before dropping to ensure
-// no active connections block the drop.
-func dropDatabase(host, user, pass string) error {
-	dbName := "Temp"
-	args := []string{"-S", host, "-d", "master"}
-	if user == "" && pass == "" {
-		args = append(args, "-E")
-	} else {
-		args = append(args, "-U", user, "-P", pass)
-	}
-
-	// Set single user with rollback immediate, then drop database
-	cmdText := fmt.Sprintf("ALTER DATABASE %s SET SINGLE_USER WITH ROLLBACK IMMEDIATE; DROP DATABASE %s;", dbName, dbName)
-	args = append(args, "-Q", cmdText)
-	cmd := exec.Command("sqlcmd", args...)
-	output, err := cmd.CombinedOutput()
-	log.Printf("sqlcmd output (dropDatabase): %s", string(output))
-	if err != nil {
-		return fmt.Errorf("sqlcmd error while dropping database: %v", err)
-	}
-	if has, txt := sqlOutputHasError(output); has {
-		return fmt.Errorf("drop database reported errors: %s", txt)
-	}
-	return nil
-}
-
-// GetParentFolderName returns the name of the first parent folder for the file.
-//
-// It attempts to retrieve the parent folder name using the file's parents field.
-// Falls back to querying the Drive API if necessary.
-//
-// Parameters:
-//   - srv: Google Drive service client.
-//   - file: the Google Drive file.
-//
-// Returns:
-//   - string: name of the parent folder, or empty string if not found.
-//   - error: any error encountered during the API calls.
-func getParentFolderName(srv *drive.Service, file *drive.File) (string, error) {
-	if len(file.Parents) > 0 {
-		parentID := file.Parents[0]
-		f, err := srv.Files.Get(parentID).Fields("id, name").Do()
-		if err != nil {
-			return "", err
-		}
-		return f.Name, nil
-	}
-	// fallback: try to retrieve parents via drive API
-	fi, err := srv.Files.Get(file.Id).Fields("parents").Do()
-	if err != nil {
-		return "", err
-	}
-	if len(fi.Parents) > 0 {
-		p, err := srv.Files.Get(fi.Parents[0]).Fields("name").Do()
-		if err != nil {
-			return "", err
-		}
-		return p.Name, nil
-	}
-	return "", nil
-}
-
-// UpsertSpreadsheetRow finds or creates a row in the spreadsheet for the given kab and createdTime.
-//
-// It searches for an existing row where column A matches the kab value.
-// If found, it updates column B with the createdTime. If not found, it appends a new row.
-//
-// Parameters:
-//   - srv: Google Sheets service client.
-//   - spreadsheetID: ID of the Google Sheet.
-//   - kab: value for column A (e.g., parent folder name).
-//   - createdTime: formatted time string for column B.
-//
-// Returns:
-//   - error: any error encountered during read, update, or append operations.
-func upsertSpreadsheetRow(srv *sheets.Service, spreadsheetID, kab, createdTime string) error {
-	// Read the sheet values (assume sheet1, columns A:B)
-	readRange := "A:B"
-	resp, err := srv.Spreadsheets.Values.Get(spreadsheetID, readRange).Do()
-	if err != nil {
-		return fmt.Errorf("failed to read spreadsheet: %v", err)
-	}
-	log.Printf("Spreadsheet returned %d rows", len(resp.Values))
-
-	// Search for kab in column A
-	rowIndex := -1
-	if resp.Values != nil {
-		for i, row := range resp.Values {
-			if len(row) > 0 {
-				if s, ok := row[0].(string); ok && strings.TrimSpace(s) == strings.TrimSpace(kab) {
-					rowIndex = i // 0-based index in resp.Values
-					break
-				}
-			}
-		}
-	}
-
-	if rowIndex >= 0 {
-		// Update cell in column B at rowIndex+1 (Sheets rows are 1-based)
-		a1 := fmt.Sprintf("B%d", rowIndex+1)
-		vr := &sheets.ValueRange{
-			Range:  a1,
-			Values: [][]interface{}{{createdTime}},
-		}
-		_, err = srv.Spreadsheets.Values.Update(spreadsheetID, a1, vr).ValueInputOption("USER_ENTERED").Do()
-		if err != nil {
-			return fmt.Errorf("failed to update spreadsheet cell %s: %v", a1, err)
-		}
-		return nil
-	}
-
-	// Append new row
-	vr := &sheets.ValueRange{
-		Values: [][]interface{}{{kab, createdTime}},
-	}
-	_, err = srv.Spreadsheets.Values.Append(spreadsheetID, "A:B", vr).ValueInputOption("USER_ENTERED").InsertDataOption("INSERT_ROWS").Do()
-	if err != nil {
-		return fmt.Errorf("failed to append row to spreadsheet: %v", err)
+	if exitCode != 0 {
+		os.Exit(exitCode)
 	}
-	return nil
 }
@@ -0,0 +1,337 @@
+// Package archive unpacks the backup archives uploaded by the kabs.
+package archive
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Extractor unpacks one archive format into a directory.
+type Extractor interface {
+	Extract(archivePath, destDir, password string) error
+	// List returns the tool's listing of the archive contents.
+	List(archivePath, password string) (string, error)
+}
+
+// Selective is implemented by extractors that can unpack part of an archive.
+type Selective interface {
+	// ExtractMatching lists the archive and unpacks only the files whose base
+	// name matches one of patterns (filepath.Match syntax, case-insensitive).
+	// It returns the number of files extracted and in the archive.
+	ExtractMatching(archivePath, destDir, password string, patterns []string) (int, int, error)
+}
+
+// matchAny reports whether the base name of the archive member matches one of patterns.
+func matchAny(member string, patterns []string) bool {
+	base := strings.ToLower(path.Base(strings.ReplaceAll(member, "\\", "/")))
+	for _, p := range patterns {
+		if ok, _ := path.Match(strings.ToLower(p), base); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// writeListFile writes the member names, one per line, to a temporary file
+// for the extractor's list file option and returns its path.
+func writeListFile(members []string) (string, error) {
+	f, err := os.CreateTemp("", "archive-members-*.txt")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := f.WriteString(strings.Join(members, "\n") + "\n"); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
+
+// listOutput runs a listing command and returns its trimmed output.
+func listOutput(name string, args ...string) (string, error) {
+	out, err := exec.Command(name, args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s failed: %v: %s", name, err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// SevenZipPath is the 7-Zip binary run by SevenZip, e.g. from FindSevenZip.
+var SevenZipPath = "7z"
+
+// sevenZipNames are the names 7-Zip's command line tool is installed under:
+// the full 7z, the standalone 7za and the 7-Zip 21+ 7zz.
+var sevenZipNames = []string{"7z", "7za", "7zz"}
+
+// FindSevenZip returns the first 7-Zip binary found in PATH or, on Windows, in
+// the default install folders under Program Files.
+func FindSevenZip() (string, error) {
+	for _, name := range sevenZipNames {
+		if p, err := exec.LookPath(name); err == nil {
+			return p, nil
+		}
+	}
+	if runtime.GOOS == "windows" {
+		for _, env := range []string{"ProgramFiles", "ProgramFiles(x86)", "ProgramW6432"} {
+			dir := os.Getenv(env)
+			if dir == "" {
+				continue
+			}
+			p := filepath.Join(dir, "7-Zip", "7z.exe")
+			if _, err := os.Stat(p); err == nil {
+				return p, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("none of %s found in PATH or the 7-Zip install folder", strings.Join(sevenZipNames, ", "))
+}
+
+// ErrWrongPassword is returned when 7-Zip cannot decrypt an archive. 7z
+// archives with encrypted headers (created with -mhe=on) cannot even be listed
+// without the right password, so listing reports it as well.
+var ErrWrongPassword = errors.New("wrong archive password")
+
+// sevenZip runs 7-Zip and returns its trimmed output. The password is always
+// passed and stdin left empty, so 7-Zip never waits for a password prompt,
+// which it would show for encrypted headers and AES-256 zip entries alike.
+func sevenZip(command string, args ...string) (string, error) {
+	cmd := exec.Command(SevenZipPath, append([]string{command, "-y", "-bd"}, args...)...)
+	out, err := cmd.CombinedOutput()
+	text := strings.TrimSpace(string(out))
+	if err != nil {
+		return "", sevenZipError(err, text)
+	}
+	return text, nil
+}
+
+// sevenZipError returns the error of a failed 7-Zip run from its output:
+// ErrWrongPassword when 7-Zip could not decrypt the data ("Wrong password") or
+// the encrypted headers ("Can not open encrypted archive").
+func sevenZipError(runErr error, text string) error {
+	lower := strings.ToLower(text)
+	if strings.Contains(lower, "wrong password") || strings.Contains(lower, "encrypted archive") {
+		return fmt.Errorf("%w: %s", ErrWrongPassword, lastLine(text))
+	}
+	return fmt.Errorf("7z failed: %v: %s", runErr, text)
+}
+
+// lastLine returns the last non-empty line of text, where 7-Zip puts its error.
+func lastLine(text string) string {
+	lines := strings.Split(strings.TrimSpace(text), "\n")
+	return strings.TrimSpace(lines[len(lines)-1])
+}
+
+// SevenZip handles password-protected 7z and zip archives and single-file .xz
+// streams through the 7z binary, including 7z archives with encrypted headers
+// and zips with AES-256 or ZipCrypto entries.
+type SevenZip struct{}
+
+func (SevenZip) Extract(archivePath, destDir, password string) error {
+	_, err := sevenZip("x", "-p"+password, archivePath, "-o"+destDir)
+	return err
+}
+
+func (SevenZip) List(archivePath, password string) (string, error) {
+	return sevenZip("l", "-ba", "-p"+password, archivePath)
+}
+
+func (SevenZip) ExtractMatching(archivePath, destDir, password string, patterns []string) (int, int, error) {
+	listing, err := sevenZip("l", "-ba", "-slt", "-p"+password, archivePath)
+	if err != nil {
+		return 0, 0, err
+	}
+	members := listedFiles(listing)
+	var matched []string
+	for _, name := range members {
+		if matchAny(name, patterns) {
+			matched = append(matched, name)
+		}
+	}
+	if len(matched) == 0 {
+		return 0, len(members), nil
+	}
+	list, err := writeListFile(matched)
+	if err != nil {
+		return 0, len(members), err
+	}
+	defer os.Remove(list)
+	if _, err := sevenZip("x", "-p"+password, "-scsUTF-8", archivePath, "-o"+destDir, "@"+list); err != nil {
+		return 0, len(members), err
+	}
+	return len(matched), len(members), nil
+}
+
+// listedFiles returns the files of a 7-Zip technical listing (-slt), which has
+// one block of "Key = Value" lines per member; folders are left out.
+func listedFiles(listing string) []string {
+	var files []string
+	var name string
+	var dir bool
+	flush := func() {
+		if name != "" && !dir {
+			files = append(files, name)
+		}
+		name, dir = "", false
+	}
+	for _, line := range strings.Split(listing, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "Path = "):
+			flush()
+			name = strings.TrimPrefix(line, "Path = ")
+		case line == "Folder = +", strings.HasPrefix(line, "Attributes = D"):
+			dir = true
+		}
+	}
+	flush()
+	return files
+}
+
+// Command is an extractor defined by command templates, for formats or tools
+// the built-in extractors do not cover. In every argument {archive}, {dest} and
+// {password} are replaced by the archive path, destination directory and password.
+type Command struct {
+	ExtractArgs []string `json:"extract"`
+	// ListArgs is optional; without it listing the archive fails.
+	ListArgs []string `json:"list"`
+}
+
+// Commands are the command extractors by archive name suffix, e.g. ".rar";
+// they take precedence over the built-in extractors.
+var Commands = map[string]Command{}
+
+// expand returns the command line of the template for one archive.
+func expand(template []string, archivePath, destDir, password string) []string {
+	r := strings.NewReplacer("{archive}", archivePath, "{dest}", destDir, "{password}", password)
+	args := make([]string, len(template))
+	for i, a := range template {
+		args[i] = r.Replace(a)
+	}
+	return args
+}
+
+func (c Command) Extract(archivePath, destDir, password string) error {
+	if len(c.ExtractArgs) == 0 {
+		return fmt.Errorf("extractor command has no extract template")
+	}
+	if err := os.MkdirAll(destDir, 0o755); err != nil {
+		return err
+	}
+	args := expand(c.ExtractArgs, archivePath, destDir, password)
+	out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %v: %s", args[0], err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (c Command) List(archivePath, password string) (string, error) {
+	if len(c.ListArgs) == 0 {
+		return "", fmt.Errorf("extractor command has no list template")
+	}
+	args := expand(c.ListArgs, archivePath, "", password)
+	return listOutput(args[0], args[1:]...)
+}
+
+// Tar handles compressed tarballs (.tar.zst, .tar.xz, ...). tar detects the
+// compression itself, using the zstd or xz tools when needed.
+type Tar struct{}
+
+func (Tar) Extract(archivePath, destDir, password string) error {
+	if err := os.MkdirAll(destDir, 0o755); err != nil {
+		return err
+	}
+	out, err := exec.Command("tar", "-xf", archivePath, "-C", destDir).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("tar failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (Tar) List(archivePath, password string) (string, error) {
+	return listOutput("tar", "-tvf", archivePath)
+}
+
+func (Tar) ExtractMatching(archivePath, destDir, password string, patterns []string) (int, int, error) {
+	listing, err := listOutput("tar", "-tf", archivePath)
+	if err != nil {
+		return 0, 0, err
+	}
+	var members, matched []string
+	for _, name := range strings.Split(listing, "\n") {
+		name = strings.TrimRight(name, "\r")
+		if name == "" || strings.HasSuffix(name, "/") {
+			continue
+		}
+		members = append(members, name)
+		if matchAny(name, patterns) {
+			matched = append(matched, name)
+		}
+	}
+	if len(matched) == 0 {
+		return 0, len(members), nil
+	}
+	if err := os.MkdirAll(destDir, 0o755); err != nil {
+		return 0, len(members), err
+	}
+	list, err := writeListFile(matched)
+	if err != nil {
+		return 0, len(members), err
+	}
+	defer os.Remove(list)
+	out, err := exec.Command("tar", "-xf", archivePath, "-C", destDir, "-T", list).CombinedOutput()
+	if err != nil {
+		return 0, len(members), fmt.Errorf("tar failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return len(matched), len(members), nil
+}
+
+// Zstd decompresses a single-file .zst stream (e.g. backup.bak.zst).
+type Zstd struct{}
+
+func (Zstd) Extract(archivePath, destDir, password string) error {
+	if err := os.MkdirAll(destDir, 0o755); err != nil {
+		return err
+	}
+	target := filepath.Join(destDir, strings.TrimSuffix(filepath.Base(archivePath), filepath.Ext(archivePath)))
+	out, err := exec.Command("zstd", "-d", "-q", "-f", archivePath, "-o", target).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("zstd failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+func (Zstd) List(archivePath, password string) (string, error) {
+	return listOutput("zstd", "-l", archivePath)
+}
+
+// For selects the extractor for an archive by its file name: the entry of
+// Commands with the longest matching suffix, or else the built-in extractor.
+// Anything that is not a recognised tarball or zstd stream goes to 7z, which
+// keeps the historical behaviour for .7z uploads.
+func For(name string) Extractor {
+	lower := strings.ToLower(name)
+	best := ""
+	for suffix := range Commands {
+		if strings.HasSuffix(lower, strings.ToLower(suffix)) && len(suffix) > len(best) {
+			best = suffix
+		}
+	}
+	if best != "" {
+		return Commands[best]
+	}
+	switch {
+	case strings.HasSuffix(lower, ".tar.zst"), strings.HasSuffix(lower, ".tzst"),
+		strings.HasSuffix(lower, ".tar.xz"), strings.HasSuffix(lower, ".txz"):
+		return Tar{}
+	case strings.HasSuffix(lower, ".zst"):
+		return Zstd{}
+	}
+	return SevenZip{}
+}
@@ -0,0 +1,192 @@
+package archive
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSevenZipErrorWrongPassword(t *testing.T) {
+	runErr := errors.New("exit status 2")
+	tests := []struct {
+		name   string
+		output string
+		wrong  bool
+	}{
+		{
+			name:   "encrypted header, wrong password",
+			output: "Scanning the drive for archives:\n1 file, 287 bytes (1 KiB)\n\nExtracting archive: backup.7z\nERROR: backup.7z\nCan not open encrypted archive. Wrong password?\n\nERRORS:\nIs not archive",
+			wrong:  true,
+		},
+		{
+			name:   "encrypted header, no password",
+			output: "Listing archive: backup.7z\n\nERROR: backup.7z\nCan not open encrypted archive. Wrong password?",
+			wrong:  true,
+		},
+		{
+			name:   "AES-256 zip entry",
+			output: "Extracting archive: backup.zip\n--\nPath = backup.zip\nType = zip\n\nERROR: Wrong password : dbo.bak\n\nSub items Errors: 1",
+			wrong:  true,
+		},
+		{
+			name:   "older 7-Zip data error",
+			output: "Extracting  dbo.bak     Data Error in encrypted file. Wrong password?\n\nSub items Errors: 1",
+			wrong:  true,
+		},
+		{
+			name:   "not an archive",
+			output: "ERROR: backup.7z\nCan not open the file as archive\n\nErrors: 1",
+		},
+		{
+			name:   "truncated archive",
+			output: "ERROR: backup.7z\nbackup.7z\nOpen ERROR: Unexpected end of archive",
+		},
+		{
+			name:   "disk full",
+			output: "ERROR: There is not enough space on the disk : dbo.bak",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := sevenZipError(runErr, tt.output)
+			if got := errors.Is(err, ErrWrongPassword); got != tt.wrong {
+				t.Fatalf("errors.Is(%v, ErrWrongPassword) = %v, want %v", err, got, tt.wrong)
+			}
+			if tt.wrong && !strings.Contains(err.Error(), lastLine(tt.output)) {
+				t.Errorf("error %q does not name 7-Zip's message %q", err, lastLine(tt.output))
+			}
+		})
+	}
+}
+
+func TestListedFiles(t *testing.T) {
+	tests := []struct {
+		name    string
+		listing string
+		want    []string
+	}{
+		{
+			name:    "empty",
+			listing: "",
+		},
+		{
+			name: "7z with folders",
+			listing: strings.Join([]string{
+				"Path = backup",
+				"Size = 0",
+				"Attributes = D",
+				"",
+				"Path = backup\\dbo.bak",
+				"Size = 1048576",
+				"Attributes = A",
+				"",
+				"Path = backup\\photos",
+				"Attributes = D",
+				"",
+				"Path = backup\\photos\\0001.jpg",
+				"Size = 2048",
+				"Attributes = A",
+			}, "\n"),
+			want: []string{"backup\\dbo.bak", "backup\\photos\\0001.jpg"},
+		},
+		{
+			name: "zip marks folders with Folder",
+			listing: strings.Join([]string{
+				"Path = export/",
+				"Folder = +",
+				"",
+				"Path = export/data.csv",
+				"Folder = -",
+				"Size = 10",
+				"",
+				"Path = dbo.bak",
+				"Folder = -",
+				"Encrypted = +",
+				"Method = AES-256 Deflate",
+			}, "\r\n"),
+			want: []string{"export/data.csv", "dbo.bak"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := listedFiles(tt.listing); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("listedFiles() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// The fixtures hold one file, dbo.bak with fixtureContent, encrypted with
+// fixturePassword: encrypted-header.7z as 7zAES (AES-256) with the headers
+// encrypted too, as -mhe=on writes them, and aes256.zip as a WinZip AES-256
+// (AE-2) entry.
+const (
+	fixturePassword = "backup-pass"
+	fixtureContent  = "TAPE" +
+		"backup fixture for pkg/archive tests\n" +
+		"backup fixture for pkg/archive tests\n" +
+		"backup fixture for pkg/archive tests\n"
+)
+
+func TestSevenZipEncryptedFixtures(t *testing.T) {
+	p, err := FindSevenZip()
+	if err != nil {
+		t.Skip(err)
+	}
+	old := SevenZipPath
+	SevenZipPath = p
+	defer func() { SevenZipPath = old }()
+
+	for _, tt := range []struct {
+		file string
+		// encryptedHeader archives cannot be listed without the password.
+		encryptedHeader bool
+	}{
+		{file: "encrypted-header.7z", encryptedHeader: true},
+		{file: "aes256.zip"},
+	} {
+		t.Run(tt.file, func(t *testing.T) {
+			archive := filepath.Join("testdata", tt.file)
+
+			listing, err := SevenZip{}.List(archive, fixturePassword)
+			if err != nil {
+				t.Fatalf("List: %v", err)
+			}
+			if !strings.Contains(listing, "dbo.bak") {
+				t.Errorf("List = %q, want dbo.bak listed", listing)
+			}
+			_, err = SevenZip{}.List(archive, "wrong")
+			if tt.encryptedHeader && !errors.Is(err, ErrWrongPassword) {
+				t.Errorf("List with wrong password: err = %v, want ErrWrongPassword", err)
+			}
+
+			dest := t.TempDir()
+			if err := (SevenZip{}).Extract(archive, dest, fixturePassword); err != nil {
+				t.Fatalf("Extract: %v", err)
+			}
+			b, err := os.ReadFile(filepath.Join(dest, "dbo.bak"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(b) != fixtureContent {
+				t.Errorf("extracted %q, want %q", b, fixtureContent)
+			}
+
+			if err := (SevenZip{}).Extract(archive, t.TempDir(), "wrong"); !errors.Is(err, ErrWrongPassword) {
+				t.Errorf("Extract with wrong password: err = %v, want ErrWrongPassword", err)
+			}
+
+			dest = t.TempDir()
+			n, total, err := SevenZip{}.ExtractMatching(archive, dest, fixturePassword, []string{"*.BAK"})
+			if err != nil || n != 1 || total != 1 {
+				t.Fatalf("ExtractMatching = %d, %d, %v, want 1, 1, nil", n, total, err)
+			}
+			if _, err := os.Stat(filepath.Join(dest, "dbo.bak")); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package pipeline
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"backup-otomatis/internal/env"
+	"backup-otomatis/pkg/restore"
+)
+
+// An Agent job is polled every agentJobPollInterval while waited for, for up
+// to AGENT_JOB_TIMEOUT.
+const (
+	agentJobPollInterval   = 10 * time.Second
+	defaultAgentJobTimeout = 30 * time.Minute
+)
+
+// agentRunStatus names the run_status values of msdb.dbo.sysjobhistory.
+var agentRunStatus = map[string]string{"0": "failed", "1": "succeeded", "2": "retrying", "3": "canceled", "4": "in progress"}
+
+// agentJobName returns the SQL Agent job the job starts after every restore,
+// or that of AGENT_JOB_NAME.
+func (j *job) agentJobName() string {
+	if j.AgentJob != "" {
+		return j.AgentJob
+	}
+	return strings.TrimSpace(os.Getenv("AGENT_JOB_NAME"))
+}
+
+// runAgentJob starts the job's SQL Agent job on host with sp_start_job, for
+// sites that keep their transformation logic in Agent jobs. With
+// AGENT_JOB_WAIT=true it waits up to AGENT_JOB_TIMEOUT for the job to finish
+// and fails the file unless the job succeeded, with the job's outcome
+// message; otherwise the job keeps running on its own.
+func runAgentJob(host, user, pass string, j *job, fileName string) error {
+	name := j.agentJobName()
+	if name == "" {
+		return nil
+	}
+	// The driver is used rather than sqlcmd since job messages are full of
+	// words restore.OutputHasError takes for errors.
+	db, err := sql.Open("sqlserver", restore.ServerURL(host, user, pass, "msdb"))
+	if err != nil {
+		return fmt.Errorf("failed to open database: %v", err)
+	}
+	defer db.Close()
+	// Runs are matched by their request time on the server's clock, in the
+	// datetime precision of sysjobactivity.
+	var requested time.Time
+	if err := db.QueryRow("SELECT GETDATE()").Scan(&requested); err != nil {
+		return fmt.Errorf("failed to start Agent job %s: %v", name, err)
+	}
+	if _, err := db.Exec("EXEC dbo.sp_start_job @job_name = @p1", name); err != nil {
+		return fmt.Errorf("failed to start Agent job %s: %v", name, err)
+	}
+	log.Printf("Started Agent job %s on %s", name, host)
+	detail := fmt.Sprintf("%s on %s for %s (job %s)", name, host, fileName, j.Name)
+	if err := appendAudit(auditEntry{At: time.Now(), User: processedBy(), Role: "system", Action: "agent-job", Detail: detail}); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	if !strings.EqualFold(os.Getenv("AGENT_JOB_WAIT"), "true") {
+		return nil
+	}
+
+	timeout := env.Duration("AGENT_JOB_TIMEOUT", defaultAgentJobTimeout)
+	const query = `SELECT TOP 1 IIF(a.stop_execution_date IS NULL, 'running', CAST(ISNULL(h.run_status, 4) AS varchar(2))), ISNULL(h.message, '')
+FROM dbo.sysjobactivity a
+JOIN dbo.sysjobs s ON s.job_id = a.job_id
+LEFT JOIN dbo.sysjobhistory h ON h.instance_id = a.job_history_id
+WHERE s.name = @p1 AND a.run_requested_date >= @p2
+ORDER BY a.run_requested_date DESC`
+	start := time.Now()
+	for {
+		var status, message string
+		err := db.QueryRow(query, name, requested).Scan(&status, &message)
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("Warning: failed to read the status of Agent job %s: %v", name, err)
+		}
+		if err == nil && status != "running" {
+			if status != "1" {
+				return fmt.Errorf("Agent job %s %s: %s", name, agentRunStatus[status], message)
+			}
+			log.Printf("Agent job %s succeeded in %s: %s", name, time.Since(start).Round(time.Second), message)
+			return nil
+		}
+		if time.Since(start) >= timeout {
+			return fmt.Errorf("Agent job %s did not finish within %s; it keeps running on %s", name, timeout, host)
+		}
+		time.Sleep(agentJobPollInterval)
+	}
+}
@@ -0,0 +1,97 @@
+package pipeline
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"backup-otomatis/pkg/restore"
+)
+
+// maskRule replaces the values of one column in the restored database, e.g. to
+// strip names and NIK before a restore reaches the training server.
+type maskRule struct {
+	Table  string `json:"table"`  // e.g. "dbo.Penduduk"
+	Column string `json:"column"` // e.g. "NIK"
+	// Mask is one of "null", "fixed" (Value), "hash" (SHA-256 hex, cut to the
+	// original length) or "partial" (keeps the last Keep characters).
+	Mask  string `json:"mask"`
+	Value string `json:"value"`
+	Keep  int    `json:"keep"`
+	// Where optionally limits the rows, e.g. "StatusResponden = 1".
+	Where string `json:"where"`
+}
+
+// loadMaskRules reads the JSON array of rules in ANONYMIZE_RULES_FILE.
+func loadMaskRules() ([]maskRule, error) {
+	path := os.Getenv("ANONYMIZE_RULES_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read anonymization rules: %v", err)
+	}
+	var rules []maskRule
+	if err := json.Unmarshal(b, &rules); err != nil {
+		return nil, fmt.Errorf("failed to parse anonymization rules %s: %v", path, err)
+	}
+	return rules, nil
+}
+
+// statement returns the UPDATE applying the rule.
+func (r maskRule) statement() (string, error) {
+	if r.Table == "" || r.Column == "" {
+		return "", fmt.Errorf("anonymization rule needs a table and a column")
+	}
+	col := restore.QuoteName(r.Column)
+	var expr string
+	switch strings.ToLower(r.Mask) {
+	case "null":
+		expr = "NULL"
+	case "fixed":
+		expr = "N'" + strings.ReplaceAll(r.Value, "'", "''") + "'"
+	case "hash":
+		expr = fmt.Sprintf("LEFT(CONVERT(varchar(64), HASHBYTES('SHA2_256', CAST(%s AS nvarchar(max))), 2), LEN(%s))", col, col)
+	case "partial":
+		expr = fmt.Sprintf("REPLICATE('X', CASE WHEN LEN(%[1]s) > %[2]d THEN LEN(%[1]s) - %[2]d ELSE 0 END) + RIGHT(%[1]s, %[2]d)", col, r.Keep)
+	default:
+		return "", fmt.Errorf("unknown mask %q for %s.%s", r.Mask, r.Table, r.Column)
+	}
+	stmt := fmt.Sprintf("UPDATE %s SET %s = %s WHERE %s IS NOT NULL", restore.QuoteName(r.Table), col, expr, col)
+	if r.Where != "" {
+		stmt += " AND (" + r.Where + ")"
+	}
+	return stmt, nil
+}
+
+// anonymizeRestore applies ANONYMIZE_RULES_FILE to the restored Temp database.
+// It runs right after the restore so no step ever sees the original values;
+// any failure fails the file rather than letting unmasked data through.
+func anonymizeRestore(host, user, pass string) error {
+	rules, err := loadMaskRules()
+	if err != nil || len(rules) == 0 {
+		return err
+	}
+	db, err := sql.Open("sqlserver", restore.ServerURL(host, user, pass, "Temp"))
+	if err != nil {
+		return fmt.Errorf("failed to open database: %v", err)
+	}
+	defer db.Close()
+	for _, r := range rules {
+		stmt, err := r.statement()
+		if err != nil {
+			return err
+		}
+		res, err := db.Exec(stmt)
+		if err != nil {
+			return fmt.Errorf("failed to anonymize %s.%s: %v", r.Table, r.Column, err)
+		}
+		n, _ := res.RowsAffected()
+		log.Printf("Anonymized %s.%s (%s): %d row(s)", r.Table, r.Column, r.Mask, n)
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+package pipeline
+
+import (
+	"backup-otomatis/internal/env"
+)
+
+// quotaUser returns the quotaUser of the job's API requests.
+func (j *job) quotaUser() string {
+	if j.QuotaUser != "" {
+		return j.QuotaUser
+	}
+	return env.Or("GOOGLE_QUOTA_USER_PREFIX", "") + j.Name
+}
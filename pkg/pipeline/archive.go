@@ -0,0 +1,136 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"backup-otomatis/internal/env"
+	"backup-otomatis/pkg/source"
+	"google.golang.org/api/storage/v1"
+)
+
+// archiveBackup re-encrypts the downloaded archive and uploads it to the cold
+// storage bucket in ARCHIVE_DESTINATION (gs://bucket/prefix or s3://bucket/prefix),
+// so backups are retained long-term without keeping them in Drive. It does
+// nothing when ARCHIVE_DESTINATION is not set.
+//
+// Objects are stored as <prefix>/<kab>/<yyyy>/<mm>/<name> and tagged with the
+// kab, the Drive file ID and ARCHIVE_RETENTION (default "2y") for the bucket's
+// lifecycle rules.
+func (p *Pipeline) archiveBackup(file *source.File, downloadedFile string) error {
+	dest := os.Getenv("ARCHIVE_DESTINATION")
+	if dest == "" {
+		return nil
+	}
+	u, err := url.Parse(dest)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid ARCHIVE_DESTINATION %q", dest)
+	}
+	kab, err := file.Kab()
+	if err != nil {
+		return fmt.Errorf("failed to resolve kab for archive: %v", err)
+	}
+
+	// Archive the decrypted payload so only the archive key is needed to read it back.
+	plain := downloadedFile
+	if ext := encryptedSuffix(plain); ext != "" {
+		plain = plain[:len(plain)-len(ext)]
+	}
+	upload, err := encryptForArchive(plain)
+	if err != nil {
+		return err
+	}
+
+	name := path.Join(strings.Trim(u.Path, "/"), kab, time.Now().Format("2006/01"), filepath.Base(upload))
+	tags := map[string]string{
+		"retention":   env.Or("ARCHIVE_RETENTION", "2y"),
+		"kab":         kab,
+		"driveFileId": file.ID,
+	}
+	log.Printf("Archiving %s to %s://%s/%s", file.Name, u.Scheme, u.Host, name)
+	switch u.Scheme {
+	case "gs":
+		return uploadToGCS(p.ServiceAccountFile, u.Host, name, upload, env.Or("ARCHIVE_STORAGE_CLASS", "COLDLINE"), tags)
+	case "s3":
+		return uploadToS3(u.Host, name, upload, env.Or("ARCHIVE_STORAGE_CLASS", "GLACIER"), tags)
+	}
+	return fmt.Errorf("unsupported ARCHIVE_DESTINATION scheme %q (use gs:// or s3://)", u.Scheme)
+}
+
+// encryptForArchive encrypts path for ARCHIVE_AGE_RECIPIENT or, failing that,
+// ARCHIVE_GPG_RECIPIENT (which must be in the server's GPG keyring) and returns
+// the encrypted file. Without a recipient the archive is uploaded as is.
+func encryptForArchive(p string) (string, error) {
+	if r := os.Getenv("ARCHIVE_AGE_RECIPIENT"); r != "" {
+		out := p + ".age"
+		if b, err := exec.Command("age", "-r", r, "-o", out, p).CombinedOutput(); err != nil {
+			return "", fmt.Errorf("age encryption failed: %v: %s", err, strings.TrimSpace(string(b)))
+		}
+		return out, nil
+	}
+	if r := os.Getenv("ARCHIVE_GPG_RECIPIENT"); r != "" {
+		out := p + ".gpg"
+		cmd := exec.Command("gpg", "--batch", "--yes", "--trust-model", "always", "--recipient", r, "--output", out, "--encrypt", p)
+		if b, err := cmd.CombinedOutput(); err != nil {
+			return "", fmt.Errorf("gpg encryption failed: %v: %s", err, strings.TrimSpace(string(b)))
+		}
+		return out, nil
+	}
+	log.Printf("Warning: no archive recipient configured, archiving %s without re-encryption", filepath.Base(p))
+	return p, nil
+}
+
+// uploadToGCS uploads localPath with the given storage class. The service account authenticates as itself because
+// bucket access is granted to it, not to the impersonated workspace user.
+func uploadToGCS(serviceAccountFile, bucket, name, localPath, storageClass string, tags map[string]string) error {
+	ctx := context.Background()
+	opts, err := source.ClientOptions(ctx, serviceAccountFile, "", storage.DevstorageReadWriteScope)
+	if err != nil {
+		return err
+	}
+	srv, err := storage.NewService(ctx, opts...)
+	if err != nil {
+		return fmt.Errorf("unable to create Cloud Storage client: %v", err)
+	}
+	f, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	obj := &storage.Object{
+		Name:         name,
+		StorageClass: storageClass,
+		Metadata:     tags,
+	}
+	if _, err := srv.Objects.Insert(bucket, obj).Media(f).Do(); err != nil {
+		return fmt.Errorf("failed to upload to gs://%s/%s: %v", bucket, name, err)
+	}
+	return nil
+}
+
+// uploadToS3 uploads localPath with the aws CLI, which picks up credentials from
+// its usual environment and profile settings.
+func uploadToS3(bucket, key, localPath, storageClass string, tags map[string]string) error {
+	tagging := url.Values{}
+	for k, v := range tags {
+		tagging.Set(k, v)
+	}
+	cmd := exec.Command("aws", "s3api", "put-object",
+		"--bucket", bucket,
+		"--key", key,
+		"--body", localPath,
+		"--storage-class", storageClass,
+		"--tagging", tagging.Encode())
+	if b, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to upload to s3://%s/%s: %v: %s", bucket, key, err, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
@@ -0,0 +1,119 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// folderAudit is the permission check result for one kab folder.
+type folderAudit struct {
+	Name     string
+	ID       string
+	Files    int
+	List     bool
+	Download bool
+	Delete   bool
+	Err      error
+}
+
+// ok reports whether the account has every permission processing needs.
+func (a folderAudit) ok() bool {
+	return a.Err == nil && a.List && a.Download && a.Delete
+}
+
+// auditFolder checks that the account can list the folder and download and
+// delete every file in it. An empty folder only needs to be listable.
+func auditFolder(srv *drive.Service, folder *drive.File) folderAudit {
+	a := folderAudit{Name: folder.Name, ID: folder.Id}
+	f, err := srv.Files.Get(folder.Id).Fields("capabilities(canListChildren)").Do()
+	if err != nil {
+		a.Err = fmt.Errorf("failed to read folder capabilities: %v", err)
+		return a
+	}
+	a.List = f.Capabilities != nil && f.Capabilities.CanListChildren
+	a.Download, a.Delete = true, true
+	q := fmt.Sprintf("trashed = false and '%s' in parents and mimeType != 'application/vnd.google-apps.folder'", folder.Id)
+	pageToken := ""
+	for {
+		req := srv.Files.List().Q(q).PageSize(1000).Fields("nextPageToken, files(id, capabilities(canDownload, canDelete))")
+		if pageToken != "" {
+			req = req.PageToken(pageToken)
+		}
+		resp, err := req.Do()
+		if err != nil {
+			a.List = false
+			a.Err = fmt.Errorf("failed to list files: %v", err)
+			return a
+		}
+		for _, file := range resp.Files {
+			a.Files++
+			if file.Capabilities == nil || !file.Capabilities.CanDownload {
+				a.Download = false
+			}
+			if file.Capabilities == nil || !file.Capabilities.CanDelete {
+				a.Delete = false
+			}
+		}
+		if resp.NextPageToken == "" {
+			break
+		}
+		pageToken = resp.NextPageToken
+	}
+	return a
+}
+
+// auditDrive checks every kab folder under parentID, writes a report to w and
+// returns an error when any folder lacks a permission.
+func auditDrive(srv *drive.Service, parentID string, w io.Writer) error {
+	if parentID == "" {
+		return fmt.Errorf("KAB_PARENT_FOLDER_ID is not set")
+	}
+	folders, err := listKabFolders(srv, parentID)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "FOLDER\tFILES\tLIST\tDOWNLOAD\tDELETE\tSTATUS")
+	failed := 0
+	for _, folder := range folders {
+		a := auditFolder(srv, folder)
+		status := "ok"
+		if !a.ok() {
+			failed++
+			var missing []string
+			if a.Err != nil {
+				missing = append(missing, a.Err.Error())
+			} else {
+				if !a.List {
+					missing = append(missing, "list")
+				}
+				if !a.Download {
+					missing = append(missing, "download")
+				}
+				if !a.Delete {
+					missing = append(missing, "delete")
+				}
+			}
+			status = "MISSING: " + strings.Join(missing, ", ")
+		}
+		fmt.Fprintf(tw, "%s\t%d\t%s\t%s\t%s\t%s\n", a.Name, a.Files, yesNo(a.List), yesNo(a.Download), yesNo(a.Delete), status)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d folder(s) have missing permissions", failed, len(folders))
+	}
+	return nil
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
@@ -0,0 +1,45 @@
+package pipeline
+
+import (
+	"database/sql"
+	"fmt"
+
+	"backup-otomatis/pkg/restore"
+)
+
+// backupInfo runs RESTORE HEADERONLY or RESTORE FILELISTONLY (kind) on the
+// .bak file and returns one column-name-to-value map per result row. The
+// columns differ between SQL Server versions, so callers look them up by name.
+func backupInfo(host, user, pass, kind, bakPath string) ([]map[string]string, error) {
+	db, err := sql.Open("sqlserver", restore.ServerURL(host, user, pass, "master"))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %v", err)
+	}
+	defer db.Close()
+	rows, err := db.Query("RESTORE "+kind+" FROM DISK = @p1", bakPath)
+	if err != nil {
+		return nil, fmt.Errorf("RESTORE %s failed: %v", kind, err)
+	}
+	defer rows.Close()
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var out []map[string]string
+	for rows.Next() {
+		vals := make([]sql.NullString, len(cols))
+		ptrs := make([]interface{}, len(cols))
+		for i := range vals {
+			ptrs[i] = &vals[i]
+		}
+		if err := rows.Scan(ptrs...); err != nil {
+			return nil, fmt.Errorf("failed to read RESTORE %s: %v", kind, err)
+		}
+		row := make(map[string]string, len(cols))
+		for i, c := range cols {
+			row[c] = vals[i].String
+		}
+		out = append(out, row)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,83 @@
+package pipeline
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// bakCandidate is a .bak file found in an extracted archive.
+type bakCandidate struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// bakSelection returns BAK_SELECTION, the rule picking one of several .bak
+// files in an archive: "newest" (default) or "largest".
+func bakSelection() string {
+	switch v := strings.ToLower(os.Getenv("BAK_SELECTION")); v {
+	case "", "newest":
+		return "newest"
+	case "largest":
+		return "largest"
+	default:
+		log.Printf("Warning: invalid BAK_SELECTION %q, using newest", v)
+		return "newest"
+	}
+}
+
+// chooseBakFile picks the backup to restore when an archive holds several,
+// e.g. "Kab_3501/backup/old.bak" next to "Kab_3501/backup/new.bak". The newest
+// modification time wins, then the larger size, then the path in lexical
+// order, so the same archive always gives the same choice; with
+// BAK_SELECTION=largest size is compared before time. The candidates and the
+// reason for the choice are logged.
+func chooseBakFile(dir string, candidates []bakCandidate) string {
+	if len(candidates) == 1 {
+		return candidates[0].path
+	}
+	rule := bakSelection()
+	sort.Slice(candidates, func(i, k int) bool {
+		a, b := candidates[i], candidates[k]
+		newer, larger := a.modTime.After(b.modTime), a.size > b.size
+		sameTime, sameSize := a.modTime.Equal(b.modTime), a.size == b.size
+		if rule == "largest" && !sameSize {
+			return larger
+		}
+		if !sameTime {
+			return newer
+		}
+		if !sameSize {
+			return larger
+		}
+		return a.path < b.path
+	})
+	log.Printf("Archive holds %d .bak files:", len(candidates))
+	for _, c := range candidates {
+		rel, err := filepath.Rel(dir, c.path)
+		if err != nil {
+			rel = c.path
+		}
+		log.Printf("  %s (%s, modified %s)", rel, formatBytes(c.size), c.modTime.Format("2006-01-02 15:04:05"))
+	}
+	chosen, next := candidates[0], candidates[1]
+	var reason string
+	switch {
+	case rule == "largest" && chosen.size != next.size:
+		reason = "largest"
+	case !chosen.modTime.Equal(next.modTime) && rule == "largest":
+		reason = "newest of the largest"
+	case !chosen.modTime.Equal(next.modTime):
+		reason = "newest"
+	case chosen.size != next.size:
+		reason = "largest of the newest"
+	default:
+		reason = "first by path of identical candidates"
+	}
+	log.Printf("Using %s: %s (BAK_SELECTION=%s)", filepath.Base(chosen.path), reason, rule)
+	return chosen.path
+}
@@ -0,0 +1,193 @@
+package pipeline
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"backup-otomatis/pkg/restore"
+	"backup-otomatis/pkg/source"
+)
+
+// defaultCanaryTolerance is the largest relative change, in percent, of a
+// validation metric between update versions that still passes the canary.
+const defaultCanaryTolerance = 10.0
+
+// canaryResult is the canary outcome of the run for the run summary, nil
+// when no canary was pending, and canaryHeld counts the files held.
+var (
+	canaryResult msgData
+	canaryHeld   int
+)
+
+// canaryKab returns CANARY_KAB, the kab a changed update query or script is
+// tried on before the other kabs get it.
+func canaryKab() string {
+	return strings.TrimSpace(os.Getenv("CANARY_KAB"))
+}
+
+// updateVersion identifies the update query or scripts by a short hash of
+// their text.
+func (p *Pipeline) updateVersion() string {
+	h := sha256.New()
+	if p.UpdateScriptsDir != "" {
+		scripts, err := restore.LoadScripts(p.UpdateScriptsDir)
+		if err != nil {
+			log.Printf("Warning: %v", err)
+		}
+		for _, s := range scripts {
+			fmt.Fprintf(h, "%s %s\n", s.Version, s.Checksum)
+		}
+	} else if p.UpdateScriptFile != "" {
+		b, err := os.ReadFile(p.UpdateScriptFile)
+		if err != nil {
+			log.Printf("Warning: failed to read %s: %v", p.UpdateScriptFile, err)
+		}
+		h.Write(b)
+	} else {
+		h.Write([]byte(p.UpdateQuery))
+	}
+	return hex.EncodeToString(h.Sum(nil))[:12]
+}
+
+// canaryPending reports whether the current update version still has to pass
+// the canary. The version running when CANARY_KAB is first set is approved
+// as is.
+func (p *Pipeline) canaryPending() (bool, string) {
+	if canaryKab() == "" {
+		return false, ""
+	}
+	version := p.updateVersion()
+	approved := p.state.approvedUpdateVersion()
+	if approved == "" {
+		if err := p.state.approveUpdateVersion(version, nil); err != nil {
+			log.Printf("Warning: failed to save state: %v", err)
+		}
+		return false, version
+	}
+	return approved != version, version
+}
+
+// canaryFirst moves the canary kab's files to the front while a canary is
+// pending, so the other kabs can follow in the same run when it passes.
+func (p *Pipeline) canaryFirst(files []*source.File) []*source.File {
+	if pending, _ := p.canaryPending(); !pending {
+		return files
+	}
+	isCanary := func(f *source.File) bool {
+		kab, _ := f.Kab()
+		return strings.EqualFold(kab, canaryKab())
+	}
+	sort.SliceStable(files, func(a, b int) bool { return isCanary(files[a]) && !isCanary(files[b]) })
+	return files
+}
+
+// heldForCanary reports whether file must wait because the update version
+// has not passed the canary yet. Held files stay in their source and are
+// processed by a run after the canary passed.
+func (p *Pipeline) heldForCanary(file *source.File) (bool, string) {
+	pending, version := p.canaryPending()
+	if !pending {
+		return false, ""
+	}
+	kab, err := file.Kab()
+	if err == nil && strings.EqualFold(kab, canaryKab()) {
+		return false, ""
+	}
+	if canaryResult == nil {
+		canaryResult = msgData{"Version": version, "Kab": canaryKab(), "Status": "pending"}
+	}
+	canaryHeld++
+	return true, fmt.Sprintf("update version %s awaits the canary on kab %s", version, canaryKab())
+}
+
+// canarySummary returns the canary outcome for the run summary.
+func canarySummary() msgData {
+	if canaryResult == nil {
+		return nil
+	}
+	out := msgData{"Held": canaryHeld}
+	for k, v := range canaryResult {
+		out[k] = v
+	}
+	return out
+}
+
+// checkCanary runs after the update of the canary kab. It collects the
+// validation metrics of the updated database: the first number each of the
+// job's validation queries returns. For a new update version it compares them
+// with those of the approved version and approves the new version when every
+// query succeeds and no metric moved more than CANARY_TOLERANCE percent.
+// Otherwise the canary fails, the other kabs stay held and the file fails.
+// Under the approved version the metrics become the new baseline.
+func (p *Pipeline) checkCanary(j *job, kab string) error {
+	if canaryKab() == "" || !strings.EqualFold(kab, canaryKab()) {
+		return nil
+	}
+	pending, version := p.canaryPending()
+	queries, err := j.validationQueries()
+	if err != nil {
+		return err
+	}
+	metrics := map[string]float64{}
+	var problems []string
+	for _, q := range queries {
+		out, qErr := restore.Query(p.DBHost, p.DBUser, p.DBPass, j.DBName, q)
+		if qErr != nil {
+			problems = append(problems, fmt.Sprintf("%s: %v", q, qErr))
+			continue
+		}
+		for _, f := range strings.Fields(string(out)) {
+			if v, err := strconv.ParseFloat(f, 64); err == nil {
+				metrics[q] = v
+				break
+			}
+		}
+	}
+	if !pending {
+		if len(problems) == 0 {
+			if err := p.state.approveUpdateVersion(version, metrics); err != nil {
+				log.Printf("Warning: failed to save state: %v", err)
+			}
+		}
+		return nil
+	}
+
+	tolerance := defaultCanaryTolerance
+	if v, err := strconv.ParseFloat(os.Getenv("CANARY_TOLERANCE"), 64); err == nil && v >= 0 {
+		tolerance = v
+	}
+	baseline := p.state.canaryBaseline()
+	for q, before := range baseline {
+		after, ok := metrics[q]
+		if !ok {
+			continue
+		}
+		change := math.Abs(after-before) * 100
+		if before != 0 {
+			change /= math.Abs(before)
+		}
+		if change > tolerance {
+			problems = append(problems, fmt.Sprintf("%s: %g -> %g (%.1f%%)", q, before, after, change))
+		}
+	}
+	canaryResult = msgData{"Version": version, "Kab": kab}
+	if len(problems) > 0 {
+		canaryResult["Status"] = "failed"
+		notifyMsg(levelError, "canary-failed", msgData{"Version": version, "Kab": kab, "Problems": problems})
+		return fmt.Errorf("canary of update version %s failed on kab %s: %s", version, kab, strings.Join(problems, "; "))
+	}
+	if err := p.state.approveUpdateVersion(version, metrics); err != nil {
+		log.Printf("Warning: failed to save state: %v", err)
+	}
+	canaryResult["Status"] = "passed"
+	notifyMsg(levelInfo, "canary-passed", msgData{"Version": version, "Kab": kab, "Metrics": len(metrics)})
+	log.Printf("Update version %s passed the canary on kab %s", version, kab)
+	return nil
+}
@@ -0,0 +1,114 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// discordMaxContent is the longest message content Discord accepts.
+const discordMaxContent = 2000
+
+// currentNotifyJob is the job whose chat webhooks receive notifications; it is
+// switched together with the quotaUser whenever processing moves to another job.
+var currentNotifyJob atomic.Value
+
+// setNotifyJob directs subsequent notifications to the job's chat webhooks.
+func setNotifyJob(j *job) {
+	currentNotifyJob.Store(j)
+}
+
+// chatWebhooks returns the Discord and Teams webhook URLs for the current job:
+// the job's own, or DISCORD_WEBHOOK_URL and TEAMS_WEBHOOK_URL.
+func chatWebhooks() (discord, teams string) {
+	discord, teams = os.Getenv("DISCORD_WEBHOOK_URL"), os.Getenv("TEAMS_WEBHOOK_URL")
+	if j, ok := currentNotifyJob.Load().(*job); ok && j != nil {
+		if j.DiscordWebhook != "" {
+			discord = j.DiscordWebhook
+		}
+		if j.TeamsWebhook != "" {
+			teams = j.TeamsWebhook
+		}
+	}
+	return discord, teams
+}
+
+// postJSON posts body as JSON and fails on a non-2xx answer.
+func postJSON(client *http.Client, url string, body interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %s", resp.Status)
+	}
+	return nil
+}
+
+// discordNotifier posts to a Discord channel webhook.
+type discordNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (d *discordNotifier) Notify(level, message string) error {
+	content := fmt.Sprintf("**[%s]** %s", level, message)
+	if len(content) > discordMaxContent {
+		content = content[:discordMaxContent-3] + "..."
+	}
+	return postJSON(d.client, d.url, map[string]string{"content": content})
+}
+
+func (d *discordNotifier) NotifySummary(level, message string) error {
+	return d.Notify(level, message)
+}
+
+// teamsNotifier posts a message card to a Microsoft Teams incoming webhook.
+type teamsNotifier struct {
+	url    string
+	client *http.Client
+}
+
+// teamsColors are the card accent colors per level.
+var teamsColors = map[string]string{levelInfo: "2EB886", levelWarning: "DAA038", levelError: "D00000"}
+
+func (t *teamsNotifier) Notify(level, message string) error {
+	summary, _, _ := strings.Cut(message, "\n")
+	return postJSON(t.client, t.url, map[string]string{
+		"@type":      "MessageCard",
+		"@context":   "https://schema.org/extensions",
+		"summary":    summary,
+		"themeColor": teamsColors[level],
+		"title":      "backup-otomatis " + level,
+		// Teams markdown needs a blank line for a line break.
+		"text": strings.ReplaceAll(message, "\n", "\n\n"),
+	})
+}
+
+func (t *teamsNotifier) NotifySummary(level, message string) error {
+	return t.Notify(level, message)
+}
+
+// chatNotifiers returns the Discord and Teams notifiers of the current job.
+func chatNotifiers() []notifier {
+	var ns []notifier
+	discord, teams := chatWebhooks()
+	client := &http.Client{Timeout: 10 * time.Second}
+	if discord != "" {
+		ns = append(ns, &discordNotifier{url: discord, client: client})
+	}
+	if teams != "" {
+		ns = append(ns, &teamsNotifier{url: teams, client: client})
+	}
+	return ns
+}
@@ -0,0 +1,65 @@
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"backup-otomatis/pkg/source"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/sheets/v4"
+)
+
+// RunCommand executes a maintenance subcommand given as the first CLI argument.
+// Without a subcommand the application runs the regular backup processing.
+func (p *Pipeline) RunCommand(name string, args []string) error {
+	switch name {
+	case "perf-report":
+		fmt.Println(formatPerfReport(findPerfRegressions(p.state.phaseHistory(), time.Now())))
+		return nil
+	case "init-sheet":
+		srv, sheetsSrv, err := p.commandServices()
+		if err != nil {
+			return err
+		}
+		kabs, err := expectedKabs(srv)
+		if err != nil {
+			return err
+		}
+		n, err := ensureSpreadsheetRows(sheetsSrv, p.SpreadsheetID, kabs)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("%d expected kab(s), %d row(s) added\n", len(kabs), n)
+		return nil
+	case "listen":
+		return p.listen()
+	case "serve":
+		return serve()
+	case "audit-drive":
+		srv, _, err := p.commandServices()
+		if err != nil {
+			return err
+		}
+		return auditDrive(srv, os.Getenv("KAB_PARENT_FOLDER_ID"), os.Stdout)
+	case "inspect":
+		return p.inspectCommand(args)
+	case "discover":
+		return discoverCommand(args, os.Stdout)
+	case "state":
+		return p.stateCommand(args)
+	case "reprocess":
+		return p.reprocessCommand(args, os.Stdout)
+	}
+	return fmt.Errorf("unknown command %q", name)
+}
+
+// commandServices creates the Google clients for subcommands with the same
+// settings the regular run uses.
+func (p *Pipeline) commandServices() (*drive.Service, *sheets.Service, error) {
+	if p.ServiceAccountFile == "" {
+		return nil, nil, fmt.Errorf("SERVICE_ACCOUNT_FILE is not set")
+	}
+	return source.NewServices(context.Background(), p.ServiceAccountFile, p.ImpersonateSubject)
+}
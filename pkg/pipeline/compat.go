@@ -0,0 +1,178 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"backup-otomatis/pkg/restore"
+)
+
+// sqlServerVersionNames maps major versions to product names for messages.
+var sqlServerVersionNames = map[int]string{
+	10: "SQL Server 2008", 11: "SQL Server 2012", 12: "SQL Server 2014", 13: "SQL Server 2016",
+	14: "SQL Server 2017", 15: "SQL Server 2019", 16: "SQL Server 2022",
+}
+
+// sqlServerVersionName returns the product name of a major version.
+func sqlServerVersionName(major int) string {
+	if n, ok := sqlServerVersionNames[major]; ok {
+		return n
+	}
+	return fmt.Sprintf("SQL Server version %d", major)
+}
+
+// incompatibleBackupError reports a backup that cannot be restored on the target
+// instance. Retrying does not help, so the file is skipped and the operator is
+// told what to change instead of being shown the raw sqlcmd output.
+type incompatibleBackupError struct {
+	Reason string
+	Action string
+}
+
+func (e *incompatibleBackupError) Error() string {
+	return fmt.Sprintf("backup is not compatible with the target server: %s; %s", e.Reason, e.Action)
+}
+
+// isIncompatibleBackup reports whether err is an incompatibleBackupError.
+func isIncompatibleBackup(err error) bool {
+	var ie *incompatibleBackupError
+	return errors.As(err, &ie)
+}
+
+// expressDataLimit is the per-database data size limit of SQL Server Express.
+const expressDataLimit = 10 << 30
+
+// targetServer describes the instance backups are restored on.
+type targetServer struct {
+	Edition string
+	Major   int
+}
+
+// queryTargetServer returns the edition and major version of the instance.
+func queryTargetServer(host, user, pass string) (targetServer, error) {
+	var t targetServer
+	v, err := restore.Scalar(host, user, pass, "master",
+		"SELECT CAST(SERVERPROPERTY('Edition') AS nvarchar(128)) + '|' + CAST(SERVERPROPERTY('ProductMajorVersion') AS nvarchar(8))")
+	if err != nil {
+		return t, fmt.Errorf("failed to query server edition: %v", err)
+	}
+	edition, major, _ := strings.Cut(v, "|")
+	t.Edition = edition
+	t.Major, _ = strconv.Atoi(strings.TrimSpace(major))
+	return t, nil
+}
+
+// checkBackupCompatibility compares the backup header with the target instance
+// before restoring. Problems reading the header are logged and leave the
+// decision to the restore itself.
+func checkBackupCompatibility(host, user, pass, bakPath string) error {
+	target, err := queryTargetServer(host, user, pass)
+	if err != nil {
+		log.Printf("Warning: skipping compatibility check: %v", err)
+		return nil
+	}
+	headers, err := backupInfo(host, user, pass, "HEADERONLY", bakPath)
+	if err != nil || len(headers) == 0 {
+		log.Printf("Warning: skipping compatibility check: %v", err)
+		return nil
+	}
+	h := headers[0]
+	if major, _ := strconv.Atoi(h["SoftwareVersionMajor"]); major > target.Major && target.Major > 0 {
+		return &incompatibleBackupError{
+			Reason: fmt.Sprintf("it was taken on %s but the target runs %s (%s)", sqlServerVersionName(major), sqlServerVersionName(target.Major), target.Edition),
+			Action: fmt.Sprintf("upgrade the target to %s or newer", sqlServerVersionName(major)),
+		}
+	}
+	if t := h["EncryptorThumbprint"]; t != "" && !strings.EqualFold(t, "NULL") {
+		return &incompatibleBackupError{
+			Reason: "the backup file is encrypted with a certificate",
+			Action: "import the kab's backup certificate into master or ask the kab to upload an unencrypted backup",
+		}
+	}
+	// Containment is 1 for partially contained databases (SQL Server 2012+).
+	if h["Containment"] == "1" {
+		if err := ensureContainedAuth(host, user, pass); err != nil {
+			return err
+		}
+	}
+	files, err := backupInfo(host, user, pass, "FILELISTONLY", bakPath)
+	if err != nil {
+		log.Printf("Warning: %v", err)
+		return nil
+	}
+	var dataSize int64
+	for _, f := range files {
+		if t := f["TDEThumbprint"]; t != "" && !strings.EqualFold(t, "NULL") {
+			return &incompatibleBackupError{
+				Reason: "the database uses Transparent Data Encryption",
+				Action: "import the kab's TDE certificate into master or ask the kab to disable TDE before backing up",
+			}
+		}
+		if !strings.EqualFold(f["Type"], "L") {
+			n, _ := strconv.ParseInt(f["Size"], 10, 64)
+			dataSize += n
+		}
+	}
+	if limit := target.dataLimit(); limit > 0 && dataSize > limit {
+		return &incompatibleBackupError{
+			Reason: fmt.Sprintf("its data files need %s but %s allows %s per database", formatBytes(dataSize), target.Edition, formatBytes(limit)),
+			Action: "shrink or archive the kab's database before backing up, or restore on a Standard instance",
+		}
+	}
+	return nil
+}
+
+// dataLimit returns the maximum data size of a restored database:
+// TARGET_DB_SIZE_LIMIT_GB when set, the Express limit on Express editions and
+// 0 (no limit) otherwise.
+func (t targetServer) dataLimit() int64 {
+	if v := os.Getenv("TARGET_DB_SIZE_LIMIT_GB"); v != "" {
+		gb, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			log.Printf("Warning: invalid TARGET_DB_SIZE_LIMIT_GB %q: %v", v, err)
+		} else {
+			return int64(gb * (1 << 30))
+		}
+	}
+	if strings.Contains(strings.ToLower(t.Edition), "express") {
+		return expressDataLimit
+	}
+	return 0
+}
+
+// classifyRestoreError turns the errors SQL Server raises for edition-specific
+// features and newer backup versions into an incompatibleBackupError. Other
+// errors are returned unchanged.
+func classifyRestoreError(err error) error {
+	if err == nil {
+		return nil
+	}
+	lower := strings.ToLower(err.Error())
+	switch {
+	case strings.Contains(lower, "cannot be started in this edition"), strings.Contains(lower, "msg 905"), strings.Contains(lower, "msg 909"):
+		return &incompatibleBackupError{
+			Reason: "the database uses features (e.g. partitioning, compression or columnstore) that the target edition does not support",
+			Action: "ask the kab to remove those features before backing up or restore on a Standard/Enterprise instance",
+		}
+	case strings.Contains(lower, "msg 1827"), strings.Contains(lower, "licensed limit"):
+		return &incompatibleBackupError{
+			Reason: "the database exceeds the size limit of the target edition",
+			Action: "shrink or archive the kab's database before backing up, or restore on a Standard instance",
+		}
+	case strings.Contains(lower, "msg 12824"), strings.Contains(lower, "'contained database authentication' must be set to 1"):
+		return &incompatibleBackupError{
+			Reason: "the database is partially contained and contained database authentication is off on the target",
+			Action: containedAuthAction,
+		}
+	case strings.Contains(lower, "msg 3169"), strings.Contains(lower, "was backed up on a server running version"):
+		return &incompatibleBackupError{
+			Reason: "the backup was taken on a newer SQL Server version",
+			Action: "upgrade the target instance",
+		}
+	}
+	return err
+}
@@ -0,0 +1,201 @@
+package pipeline
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"backup-otomatis/pkg/restore"
+	"github.com/joho/godotenv"
+)
+
+// Config holds the core settings of a Pipeline, read from the environment by
+// ConfigFromEnv or filled in by the caller. Optional feature settings are read
+// where they are used.
+type Config struct {
+	DBHost             string
+	DBUser             string
+	DBPass             string
+	DBName             string
+	SevenZPassword     string
+	UpdateQuery        string
+	UpdateScriptFile   string
+	UpdateScriptsDir   string
+	QuarantineFolderID string
+	ServiceAccountFile string
+	SpreadsheetID      string
+	ImpersonateSubject string
+	// StateFile is where the pipeline keeps its state between runs.
+	StateFile string
+}
+
+// ConfigFromEnv reads the core settings from the environment, as loaded by
+// LoadSettings.
+func ConfigFromEnv() *Config {
+	return &Config{
+		DBHost:             os.Getenv("DB_HOST"),
+		DBUser:             os.Getenv("DB_USER"),
+		DBPass:             os.Getenv("DB_PASS"),
+		DBName:             os.Getenv("DB_NAME"),
+		SevenZPassword:     os.Getenv("SEVENZ_PASSWORD"),
+		UpdateQuery:        os.Getenv("UPDATE_QUERY"),
+		UpdateScriptFile:   os.Getenv("UPDATE_SCRIPT_FILE"),
+		UpdateScriptsDir:   os.Getenv("UPDATE_SCRIPTS_DIR"),
+		QuarantineFolderID: os.Getenv("QUARANTINE_FOLDER_ID"),
+		ServiceAccountFile: os.Getenv("SERVICE_ACCOUNT_FILE"),
+		SpreadsheetID:      os.Getenv("SPREADSHEET_ID"),
+		ImpersonateSubject: os.Getenv("GOOGLE_IMPERSONATE_SUBJECT"),
+		StateFile:          stateFilePath(),
+	}
+}
+
+// update returns the update step of UPDATE_SCRIPTS_DIR, UPDATE_SCRIPT_FILE or
+// UPDATE_QUERY.
+func (c *Config) update() restore.Update {
+	return restore.Update{ScriptsDir: c.UpdateScriptsDir, ScriptFile: c.UpdateScriptFile, Query: c.UpdateQuery}
+}
+
+// validateConfig checks what processing needs before it takes any work: the
+// required settings and the external tools. It fails fast with a clear
+// message so the operator can fix the environment.
+func (p *Pipeline) validateConfig() error {
+	var missing []string
+	for _, s := range []struct{ name, value string }{
+		{"DB_HOST", p.DBHost},
+		{"DB_NAME", p.DBName},
+		{"SEVENZ_PASSWORD", p.SevenZPassword},
+		{"UPDATE_QUERY (or UPDATE_SCRIPT_FILE, UPDATE_SCRIPTS_DIR)", p.UpdateQuery + p.UpdateScriptFile + p.UpdateScriptsDir},
+		{"SERVICE_ACCOUNT_FILE", p.ServiceAccountFile},
+		{"SPREADSHEET_ID", p.SpreadsheetID},
+	} {
+		if s.value == "" {
+			missing = append(missing, s.name)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("Missing required environment variables: %s", strings.Join(missing, ", "))
+	}
+	if command := os.Getenv("DECRYPT_KEY_COMMAND"); command != "" && len(strings.Fields(command)) == 0 {
+		return fmt.Errorf("DECRYPT_KEY_COMMAND is blank: set it to the command printing the decryption key, or unset it")
+	}
+	if err := configureExtractors(); err != nil {
+		return err
+	}
+	if _, err := exec.LookPath("sqlcmd"); err != nil {
+		return fmt.Errorf("sqlcmd not found in PATH: %v. Please install SQL Server Command Line Utilities (sqlcmd) and ensure it's available in PATH.", err)
+	}
+	return nil
+}
+
+// configFileName is the name of the user and machine configuration files,
+// flat YAML with the same keys as .env (see readConfigYAML).
+const configFileName = "config.yaml"
+
+// machineConfigPath returns the machine-wide configuration file shared by every
+// account on the machine: %ProgramData%\backup-otomatis\config.yaml on
+// Windows and /etc/backup-otomatis/config.yaml elsewhere.
+func machineConfigPath() string {
+	if runtime.GOOS == "windows" {
+		dir := os.Getenv("ProgramData")
+		if dir == "" {
+			dir = `C:\ProgramData`
+		}
+		return filepath.Join(dir, "backup-otomatis", configFileName)
+	}
+	return filepath.Join("/etc", "backup-otomatis", configFileName)
+}
+
+// userConfigPath returns the configuration file of the current account, e.g.
+// %AppData%\backup-otomatis\config.yaml, or "" when there is no user directory.
+func userConfigPath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "backup-otomatis", configFileName)
+}
+
+// settingFlags collects repeated --set KEY=VALUE flags.
+type settingFlags []string
+
+func (s *settingFlags) String() string { return strings.Join(*s, ",") }
+
+func (s *settingFlags) Set(v string) error {
+	if !strings.Contains(v, "=") {
+		return fmt.Errorf("expected KEY=VALUE, got %q", v)
+	}
+	*s = append(*s, v)
+	return nil
+}
+
+// LoadSettings applies the global flags in args and fills the environment from
+// the configuration files and the registry. Precedence is flags > environment >
+// --config file > .env in the working directory > user config > machine config
+// > registryConfigKey: a setting is only taken from a later source when no
+// earlier one set it, so scheduled tasks running under different accounts see
+// the same machine settings. It returns the remaining arguments (the
+// subcommand and its flags) and the sources loaded.
+func LoadSettings(args []string) ([]string, []string, error) {
+	fs := flag.NewFlagSet("backup-otomatis", flag.ContinueOnError)
+	var sets settingFlags
+	fs.Var(&sets, "set", "override a setting, KEY=VALUE (repeatable)")
+	configFile := fs.String("config", "", "configuration file read before .env")
+	output := fs.String("output", "", `"json" prints a machine-readable run summary to stdout`)
+	watch := fs.Bool("watch", false, "keep running and poll for new backups every POLL_INTERVAL (same as RUN_MODE=daemon)")
+	if err := fs.Parse(args); err != nil {
+		return nil, nil, err
+	}
+	if *output != "" {
+		sets = append(sets, "OUTPUT_FORMAT="+*output)
+	}
+	if *watch {
+		sets = append(sets, "RUN_MODE=daemon")
+	}
+	for _, s := range sets {
+		k, v, _ := strings.Cut(s, "=")
+		if err := os.Setenv(strings.TrimSpace(k), v); err != nil {
+			return nil, nil, err
+		}
+	}
+	if *configFile != "" {
+		if _, err := os.Stat(*configFile); err != nil {
+			return nil, nil, fmt.Errorf("config file: %v", err)
+		}
+	}
+	var loaded []string
+	for _, path := range []string{*configFile, ".env", userConfigPath(), machineConfigPath()} {
+		if path == "" {
+			continue
+		}
+		if _, err := os.Stat(path); err != nil {
+			continue
+		}
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".yaml", ".yml":
+			settings, err := readConfigYAML(path)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to load %s: %v", path, err)
+			}
+			if err := setUnset(settings); err != nil {
+				return nil, nil, err
+			}
+		default:
+			// godotenv.Load never overrides variables that are already set.
+			if err := godotenv.Load(path); err != nil {
+				return nil, nil, fmt.Errorf("failed to load %s: %v", path, err)
+			}
+		}
+		loaded = append(loaded, path)
+	}
+	if settings := readRegistryConfig(); len(settings) > 0 {
+		if err := setUnset(settings); err != nil {
+			return nil, nil, err
+		}
+		loaded = append(loaded, registryConfigKey)
+	}
+	return fs.Args(), loaded, nil
+}
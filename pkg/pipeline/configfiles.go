@@ -0,0 +1,151 @@
+package pipeline
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// registryConfigKey holds machine-wide settings as values named like the
+// environment variables, for sites that push them by group policy.
+const registryConfigKey = `HKLM\SOFTWARE\backup-otomatis`
+
+// readConfigYAML reads a config.yaml: a flat mapping of setting names to
+// scalar values, e.g. `DB_HOST: localhost\SQLEXPRESS`. Values may be quoted
+// with " or ', and # starts a comment outside quotes. Nested mappings, lists
+// and block scalars are rejected rather than misread.
+func readConfigYAML(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	settings := map[string]string{}
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimRight(sc.Text(), " \t\r")
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") || trimmed == "---" {
+			continue
+		}
+		if line != trimmed || strings.HasPrefix(trimmed, "- ") {
+			return nil, fmt.Errorf("%s:%d: only top-level KEY: value lines are supported", path, n)
+		}
+		key, raw, ok := strings.Cut(trimmed, ":")
+		if !ok || key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("%s:%d: expected KEY: value", path, n)
+		}
+		value, err := yamlScalar(strings.TrimSpace(raw))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s: %v", path, n, key, err)
+		}
+		settings[key] = value
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return settings, nil
+}
+
+// yamlScalar returns the value of a YAML scalar written on one line.
+func yamlScalar(v string) (string, error) {
+	switch {
+	case strings.HasPrefix(v, `"`):
+		end := strings.LastIndex(v, `"`)
+		if end == 0 || strings.TrimSpace(stripYAMLComment(v[end+1:])) != "" {
+			return "", fmt.Errorf("unterminated double-quoted value")
+		}
+		return strconv.Unquote(v[:end+1])
+	case strings.HasPrefix(v, "'"):
+		end := strings.LastIndex(v, "'")
+		if end == 0 || strings.TrimSpace(stripYAMLComment(v[end+1:])) != "" {
+			return "", fmt.Errorf("unterminated single-quoted value")
+		}
+		return strings.ReplaceAll(v[1:end], "''", "'"), nil
+	case strings.HasPrefix(v, "|"), strings.HasPrefix(v, ">"), strings.HasPrefix(v, "["), strings.HasPrefix(v, "{"):
+		return "", fmt.Errorf("only single-line scalar values are supported")
+	}
+	v = strings.TrimSpace(stripYAMLComment(v))
+	if v == "~" || v == "null" {
+		return "", nil
+	}
+	return v, nil
+}
+
+// stripYAMLComment drops a trailing comment, which YAML starts with " #".
+func stripYAMLComment(v string) string {
+	if strings.HasPrefix(v, "#") {
+		return ""
+	}
+	if i := strings.Index(v, " #"); i >= 0 {
+		return v[:i]
+	}
+	return v
+}
+
+// regValue matches a value line of reg query output, and regEnvRef the
+// %NAME% references of a REG_EXPAND_SZ value.
+var (
+	regValue  = regexp.MustCompile(`^\s+(\S+)\s+(REG_SZ|REG_EXPAND_SZ|REG_DWORD)\s*(.*)$`)
+	regEnvRef = regexp.MustCompile(`%([^%]+)%`)
+)
+
+// readRegistryConfig returns the values of registryConfigKey. It returns
+// nothing outside Windows or when the key does not exist.
+func readRegistryConfig() map[string]string {
+	if runtime.GOOS != "windows" {
+		return nil
+	}
+	out, err := exec.Command("reg", "query", registryConfigKey).Output()
+	if err != nil {
+		return nil
+	}
+	return parseRegQuery(string(out))
+}
+
+// parseRegQuery reads the string and DWORD values of reg query output.
+func parseRegQuery(out string) map[string]string {
+	settings := map[string]string{}
+	for _, line := range strings.Split(out, "\n") {
+		m := regValue.FindStringSubmatch(strings.TrimRight(line, "\r"))
+		if m == nil {
+			continue
+		}
+		value := m[3]
+		switch m[2] {
+		case "REG_DWORD":
+			n, err := strconv.ParseUint(strings.TrimPrefix(value, "0x"), 16, 32)
+			if err != nil {
+				continue
+			}
+			value = strconv.FormatUint(n, 10)
+		case "REG_EXPAND_SZ":
+			value = regEnvRef.ReplaceAllStringFunc(value, func(ref string) string {
+				if v, ok := os.LookupEnv(ref[1 : len(ref)-1]); ok {
+					return v
+				}
+				return ref
+			})
+		}
+		settings[m[1]] = value
+	}
+	return settings
+}
+
+// setUnset sets the settings that no earlier source set.
+func setUnset(settings map[string]string) error {
+	for k, v := range settings {
+		if _, ok := os.LookupEnv(k); ok {
+			continue
+		}
+		if err := os.Setenv(k, v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package pipeline
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestReadConfigYAML(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	content := "# machine settings\n---\nDB_HOST: localhost\\SQLEXPRESS\nDB_NAME: Temp # restored here\nSEVENZ_PASSWORD: \"p#ss: word\"\nSPREADSHEET_RANGE: '''Uploads''!A:C'\nUPDATE_QUERY: ~\nPOLL_INTERVAL: 15m\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := readConfigYAML(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{
+		"DB_HOST":           `localhost\SQLEXPRESS`,
+		"DB_NAME":           "Temp",
+		"SEVENZ_PASSWORD":   "p#ss: word",
+		"SPREADSHEET_RANGE": "'Uploads'!A:C",
+		"UPDATE_QUERY":      "",
+		"POLL_INTERVAL":     "15m",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("readConfigYAML = %q, want %q", got, want)
+	}
+}
+
+func TestReadConfigYAMLRejectsNesting(t *testing.T) {
+	for _, content := range []string{"DB:\n  HOST: x\n", "JOBS:\n- a\n", "UPDATE_QUERY: |\n  UPDATE t\n", "KABS: [a, b]\n"} {
+		path := filepath.Join(t.TempDir(), "config.yaml")
+		if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := readConfigYAML(path); err == nil {
+			t.Errorf("readConfigYAML(%q) succeeded, want an error", content)
+		}
+	}
+}
+
+func TestParseRegQuery(t *testing.T) {
+	t.Setenv("ProgramData", `C:\ProgramData`)
+	out := "\r\nHKEY_LOCAL_MACHINE\\SOFTWARE\\backup-otomatis\r\n" +
+		"    DB_HOST    REG_SZ    localhost\\SQLEXPRESS\r\n" +
+		"    JOBS_FILE    REG_EXPAND_SZ    %ProgramData%\\backup-otomatis\\jobs.json\r\n" +
+		"    MAX_PARALLEL    REG_DWORD    0x4\r\n" +
+		"    SPREADSHEET_NAME_PREFIX    REG_SZ    Backup tracking 2025\r\n" +
+		"    BLOB    REG_BINARY    00FF\r\n\r\n"
+	want := map[string]string{
+		"DB_HOST":                 `localhost\SQLEXPRESS`,
+		"JOBS_FILE":               `C:\ProgramData\backup-otomatis\jobs.json`,
+		"MAX_PARALLEL":            "4",
+		"SPREADSHEET_NAME_PREFIX": "Backup tracking 2025",
+	}
+	if got := parseRegQuery(out); !reflect.DeepEqual(got, want) {
+		t.Errorf("parseRegQuery = %q, want %q", got, want)
+	}
+}
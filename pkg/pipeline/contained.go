@@ -0,0 +1,47 @@
+package pipeline
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"backup-otomatis/pkg/restore"
+)
+
+// containedAuthAction is what the operator has to do before partially
+// contained databases can be restored.
+const containedAuthAction = "run EXEC sp_configure 'contained database authentication', 1; RECONFIGURE; on the target, " +
+	"or set ENABLE_CONTAINED_AUTH=true so the tool does it (the login needs ALTER SETTINGS)"
+
+// ensureContainedAuth makes sure the target instance accepts a partially
+// contained database, whose restore SQL Server refuses while the
+// "contained database authentication" option is off. With
+// ENABLE_CONTAINED_AUTH=true the option is turned on; otherwise, or when that
+// is not permitted, the backup is reported as incompatible.
+func ensureContainedAuth(host, user, pass string) error {
+	v, err := restore.Scalar(host, user, pass, "master",
+		"SELECT CAST(value_in_use AS int) FROM sys.configurations WHERE name = 'contained database authentication'")
+	if err != nil {
+		log.Printf("Warning: could not read contained database authentication setting: %v", err)
+		return nil
+	}
+	if strings.TrimSpace(v) == "1" {
+		return nil
+	}
+	if !strings.EqualFold(os.Getenv("ENABLE_CONTAINED_AUTH"), "true") {
+		return &incompatibleBackupError{
+			Reason: "the database is partially contained and contained database authentication is off on the target",
+			Action: containedAuthAction,
+		}
+	}
+	log.Println("Backup is of a partially contained database; enabling contained database authentication")
+	query := "EXEC sp_configure 'contained database authentication', 1; RECONFIGURE;"
+	if _, err := restore.RunQuery(host, user, pass, "master", query); err != nil {
+		return &incompatibleBackupError{
+			Reason: fmt.Sprintf("the database is partially contained and enabling contained database authentication failed: %v", err),
+			Action: "grant the DB_USER login ALTER SETTINGS or " + containedAuthAction,
+		}
+	}
+	return nil
+}
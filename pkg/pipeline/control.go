@@ -0,0 +1,178 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"backup-otomatis/internal/env"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/sheets/v4"
+)
+
+// defaultControlFile is where dashboard actions are kept when CONTROL_FILE is
+// not set. It is separate from the state file because the HTTP server and the
+// processing runs are different processes that would overwrite each other's
+// copy of the state.
+const defaultControlFile = "backup-otomatis-control.json"
+
+// defaultAuditLogFile is where dashboard actions are logged when AUDIT_LOG_FILE
+// is not set.
+const defaultAuditLogFile = "backup-otomatis-audit.log"
+
+// controlData is the on-disk layout of the control file.
+type controlData struct {
+	Paused   bool             `json:"paused"`
+	PausedBy string           `json:"pausedBy,omitempty"`
+	PausedAt *time.Time       `json:"pausedAt,omitempty"`
+	Requests []controlRequest `json:"requests,omitempty"`
+}
+
+// controlRequest is a retry or re-restore requested from the dashboard.
+type controlRequest struct {
+	workRequest
+	RequestedBy string    `json:"requestedBy"`
+	At          time.Time `json:"at"`
+}
+
+// auditEntry records one operator action.
+type auditEntry struct {
+	At         time.Time `json:"at"`
+	User       string    `json:"user"`
+	Role       string    `json:"role"`
+	Action     string    `json:"action"`
+	Detail     string    `json:"detail,omitempty"`
+	RemoteAddr string    `json:"remoteAddr"`
+}
+
+// controlFilePath returns the configured control file location.
+func controlFilePath() string {
+	return env.Or("CONTROL_FILE", defaultControlFile)
+}
+
+// readControl loads the control file. A missing file yields an empty control.
+func readControl() (controlData, error) {
+	var c controlData
+	b, err := os.ReadFile(controlFilePath())
+	if os.IsNotExist(err) {
+		return c, nil
+	}
+	if err != nil {
+		return c, fmt.Errorf("failed to read control file: %v", err)
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return c, fmt.Errorf("failed to parse control file: %v", err)
+	}
+	return c, nil
+}
+
+// updateControl applies fn to the control file and writes it back atomically.
+func updateControl(fn func(c *controlData)) error {
+	c, err := readControl()
+	if err != nil {
+		return err
+	}
+	fn(&c)
+	b, err := json.MarshalIndent(&c, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := controlFilePath()
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("failed to create control directory: %v", err)
+		}
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return fmt.Errorf("failed to write control file: %v", err)
+	}
+	return os.Rename(tmp, path)
+}
+
+// processingPaused reports whether an operator paused processing. Errors
+// reading the control file are logged and treated as not paused.
+func processingPaused() bool {
+	c, err := readControl()
+	if err != nil {
+		log.Printf("Warning: %v", err)
+		return false
+	}
+	if c.Paused {
+		log.Printf("Processing is paused by %s", c.PausedBy)
+	}
+	return c.Paused
+}
+
+// takeControlRequests removes and returns the pending dashboard requests.
+func takeControlRequests() ([]controlRequest, error) {
+	var reqs []controlRequest
+	err := updateControl(func(c *controlData) {
+		reqs = c.Requests
+		c.Requests = nil
+	})
+	return reqs, err
+}
+
+// processControlRequests handles the retries and re-restores requested from
+// the dashboard.
+func (p *Pipeline) processControlRequests(srv *drive.Service, sheetsSrv *sheets.Service) {
+	reqs, err := takeControlRequests()
+	if err != nil {
+		log.Printf("Warning: %v", err)
+		return
+	}
+	for _, r := range reqs {
+		log.Printf("Handling dashboard request by %s (file=%q, kab=%q)", r.RequestedBy, r.FileID, r.Kab)
+		if err := p.handleWorkRequest(srv, sheetsSrv, r.workRequest); err != nil {
+			notifyMsg(levelError, "dashboard-request-failed", msgData{"User": r.RequestedBy, "FileID": r.FileID, "Kab": r.Kab, "Err": err})
+		}
+	}
+}
+
+// appendAudit appends an entry to AUDIT_LOG_FILE as one JSON line.
+func appendAudit(e auditEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(env.Or("AUDIT_LOG_FILE", defaultAuditLogFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %v", err)
+	}
+	defer f.Close()
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("failed to write audit log: %v", err)
+	}
+	return nil
+}
+
+// readAudit returns the last n entries of the audit log, oldest first.
+func readAudit(n int) ([]auditEntry, error) {
+	b, err := os.ReadFile(env.Or("AUDIT_LOG_FILE", defaultAuditLogFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %v", err)
+	}
+	var out []auditEntry
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var e auditEntry
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			continue
+		}
+		out = append(out, e)
+	}
+	if len(out) > n {
+		out = out[len(out)-n:]
+	}
+	return out, nil
+}
@@ -0,0 +1,88 @@
+package pipeline
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"backup-otomatis/pkg/source"
+)
+
+// Correlation IDs tie together everything one run, and one file within it,
+// leaves behind: log lines, notifications, the tracking sheet notes, the
+// restore log, published results, the run summary and the state file.
+//
+// The run ID is RUN_ID when a scheduler provides one, otherwise the start time
+// plus a random suffix, e.g. "20250614T0930-3f2a". Each file processed in the
+// run gets "<run ID>-<n>". Files are processed one at a time, so the current
+// IDs are process-wide.
+var correlation struct {
+	sync.Mutex
+	run  string
+	file string
+	seq  int
+}
+
+// newRunID returns RUN_ID or a fresh run ID.
+func newRunID() string {
+	if id := os.Getenv("RUN_ID"); id != "" {
+		return id
+	}
+	b := make([]byte, 2)
+	rand.Read(b)
+	return time.Now().Format("20060102T1504") + "-" + hex.EncodeToString(b)
+}
+
+// startRun begins a new run ID and returns it.
+func startRun() string {
+	id := newRunID()
+	correlation.Lock()
+	correlation.run, correlation.file, correlation.seq = id, "", 0
+	correlation.Unlock()
+	log.SetPrefix("[" + id + "] ")
+	return id
+}
+
+// currentRunID returns the ID of the current run, if any.
+func currentRunID() string {
+	correlation.Lock()
+	defer correlation.Unlock()
+	return correlation.run
+}
+
+// currentCorrelationID returns the ID of the file being processed or, between
+// files, the run ID.
+func currentCorrelationID() string {
+	correlation.Lock()
+	defer correlation.Unlock()
+	if correlation.file != "" {
+		return correlation.file
+	}
+	return correlation.run
+}
+
+// beginFile assigns the next correlation ID of the run to file and prefixes
+// log lines with it until the returned function is called.
+func beginFile(file *source.File) func() {
+	correlation.Lock()
+	if correlation.run == "" {
+		correlation.run = newRunID()
+	}
+	correlation.seq++
+	id := fmt.Sprintf("%s-%d", correlation.run, correlation.seq)
+	correlation.file = id
+	run := correlation.run
+	correlation.Unlock()
+	log.SetPrefix("[" + id + "] ")
+	log.Printf("Correlation ID %s: %s (%s)", id, file.Name, file.ID)
+	return func() {
+		correlation.Lock()
+		correlation.file = ""
+		correlation.Unlock()
+		log.SetPrefix("[" + run + "] ")
+	}
+}
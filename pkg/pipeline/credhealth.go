@@ -0,0 +1,216 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2/google"
+)
+
+// Credentials are warned about CREDENTIAL_WARN_DAYS before they expire and
+// service account keys are due for rotation SERVICE_ACCOUNT_KEY_MAX_DAYS after
+// their creation. A problem is reminded about once a day; listen checks once
+// an hour.
+const (
+	defaultCredentialWarnDays = 14
+	defaultKeyMaxDays         = 90
+	credentialRemind          = 24 * time.Hour
+	credentialCheckInterval   = time.Hour
+)
+
+// metricCredentialProblems counts the credentials found failing or close to
+// expiry by the last check.
+var metricCredentialProblems = expvar.NewInt("credential_problems")
+
+// lastCredentialCheck limits credential checks to one per
+// credentialCheckInterval in listen mode.
+var lastCredentialCheck time.Time
+
+// credentialHealth is the state of one credential a source depends on.
+type credentialHealth struct {
+	Name string
+	// Expires is when the credential stops working or is due for rotation;
+	// zero when unknown.
+	Expires time.Time
+	// Action tells the operator what to do before Expires.
+	Action string
+	// Err is set when the credential already fails.
+	Err error
+}
+
+// checkCredentialHealth checks the service account used for Drive, Sheets
+// and Cloud Storage and the SAS tokens of the Azure Blob jobs in JOBS_FILE.
+// Failing credentials are notified as errors and those expiring within
+// CREDENTIAL_WARN_DAYS as warnings, so the pipeline does not stop silently
+// when a token lapses. CREDENTIAL_CHECKS=false turns the check off.
+func (p *Pipeline) checkCredentialHealth() {
+	if strings.EqualFold(os.Getenv("CREDENTIAL_CHECKS"), "false") {
+		return
+	}
+	now := time.Now()
+	if now.Sub(lastCredentialCheck) < credentialCheckInterval {
+		return
+	}
+	lastCredentialCheck = now
+
+	creds := []credentialHealth{serviceAccountHealth(p.ServiceAccountFile)}
+	if path := os.Getenv("JOBS_FILE"); path != "" {
+		jobs, err := loadJobsFile(path, p.DBName)
+		if err != nil {
+			log.Printf("Warning: credential check skipped jobs: %v", err)
+		}
+		for _, j := range jobs {
+			if j.Azure != nil {
+				creds = append(creds, sasHealth(j))
+			}
+		}
+	}
+
+	warnDays := defaultCredentialWarnDays
+	if v, err := strconv.Atoi(os.Getenv("CREDENTIAL_WARN_DAYS")); err == nil && v > 0 {
+		warnDays = v
+	}
+	alerted := p.state.credentialAlerts()
+	var reminded []string
+	problems := 0
+	for _, c := range creds {
+		level, key, data := credentialAlert(c, now, warnDays)
+		if key == "" {
+			continue
+		}
+		problems++
+		if c.Err != nil {
+			log.Printf("Warning: %s is failing: %v", c.Name, c.Err)
+		} else {
+			log.Printf("Warning: %s expires %s", c.Name, c.Expires.Format("2006-01-02"))
+		}
+		if at, ok := alerted[c.Name]; ok && now.Sub(at) < credentialRemind {
+			continue
+		}
+		notifyMsg(level, key, data)
+		reminded = append(reminded, c.Name)
+	}
+	metricCredentialProblems.Set(int64(problems))
+	if len(reminded) > 0 {
+		if err := p.state.markCredentialAlerts(reminded, now); err != nil {
+			log.Printf("Warning: failed to save state: %v", err)
+		}
+	}
+}
+
+// credentialAlert returns the notification for c, or an empty key when c is
+// healthy.
+func credentialAlert(c credentialHealth, now time.Time, warnDays int) (level, key string, data msgData) {
+	if c.Err != nil {
+		return levelError, "credential-failed", msgData{"Credential": c.Name, "Err": c.Err}
+	}
+	if c.Expires.IsZero() {
+		return "", "", nil
+	}
+	left := c.Expires.Sub(now)
+	if left > time.Duration(warnDays)*24*time.Hour {
+		return "", "", nil
+	}
+	data = msgData{"Credential": c.Name, "Expires": c.Expires.Format("2006-01-02"), "Days": int(left.Hours() / 24), "Action": c.Action}
+	if left <= 0 {
+		return levelError, "credential-expired", data
+	}
+	return levelWarning, "credential-expiring", data
+}
+
+// serviceAccountHealth fetches a token with the service account key, which
+// fails when the key was deleted or disabled, and dates the key through the
+// IAM API. When the account may not read its own keys, the key file's
+// modification time stands in for the key's creation.
+func serviceAccountHealth(path string) credentialHealth {
+	c := credentialHealth{Name: "service account " + path, Action: "create a new key and replace " + path}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		c.Err = err
+		return c
+	}
+	var key struct {
+		ClientEmail  string `json:"client_email"`
+		PrivateKeyID string `json:"private_key_id"`
+	}
+	if err := json.Unmarshal(data, &key); err != nil {
+		c.Err = fmt.Errorf("invalid key file: %v", err)
+		return c
+	}
+	c.Name = fmt.Sprintf("service account %s key %s", key.ClientEmail, key.PrivateKeyID)
+	jwt, err := google.JWTConfigFromJSON(data, "https://www.googleapis.com/auth/cloud-platform")
+	if err != nil {
+		c.Err = fmt.Errorf("invalid key file: %v", err)
+		return c
+	}
+	ctx := context.Background()
+	if _, err := jwt.TokenSource(ctx).Token(); err != nil {
+		c.Err = fmt.Errorf("token refresh failed: %v", err)
+		return c
+	}
+
+	maxDays := defaultKeyMaxDays
+	if v, err := strconv.Atoi(os.Getenv("SERVICE_ACCOUNT_KEY_MAX_DAYS")); err == nil && v > 0 {
+		maxDays = v
+	}
+	var created, validBefore time.Time
+	resp, err := jwt.Client(ctx).Get(fmt.Sprintf("https://iam.googleapis.com/v1/projects/-/serviceAccounts/%s/keys/%s",
+		url.PathEscape(key.ClientEmail), url.PathEscape(key.PrivateKeyID)))
+	if err == nil {
+		var info struct {
+			ValidAfterTime  time.Time `json:"validAfterTime"`
+			ValidBeforeTime time.Time `json:"validBeforeTime"`
+		}
+		if resp.StatusCode == 200 && json.NewDecoder(resp.Body).Decode(&info) == nil {
+			created, validBefore = info.ValidAfterTime, info.ValidBeforeTime
+		}
+		resp.Body.Close()
+	}
+	if created.IsZero() {
+		if fi, err := os.Stat(path); err == nil {
+			created = fi.ModTime()
+		}
+	}
+	if !created.IsZero() {
+		c.Expires = created.AddDate(0, 0, maxDays)
+	}
+	// Keys without an expiry report a validBeforeTime in year 9999.
+	if !validBefore.IsZero() && (c.Expires.IsZero() || validBefore.Before(c.Expires)) {
+		c.Expires = validBefore
+	}
+	return c
+}
+
+// sasHealth reads the expiry (se) of an Azure Blob job's SAS token.
+func sasHealth(j *job) credentialHealth {
+	c := credentialHealth{Name: "SAS token of job " + j.Name, Action: "issue a new SAS token"}
+	if j.Azure.SASEnv != "" {
+		c.Action += " and update " + j.Azure.SASEnv
+	}
+	sas := j.Azure.Token()
+	if sas == "" {
+		c.Err = fmt.Errorf("no SAS token configured")
+		return c
+	}
+	q, err := url.ParseQuery(sas)
+	if err != nil {
+		c.Err = fmt.Errorf("invalid SAS token: %v", err)
+		return c
+	}
+	se := q.Get("se")
+	for _, layout := range []string{time.RFC3339, "2006-01-02T15:04Z", "2006-01-02"} {
+		if t, err := time.Parse(layout, se); err == nil {
+			c.Expires = t
+			break
+		}
+	}
+	return c
+}
@@ -0,0 +1,79 @@
+package pipeline
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"backup-otomatis/internal/env"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/sheets/v4"
+)
+
+// defaultPollInterval is how long the daemon waits between runs unless
+// POLL_INTERVAL says otherwise.
+const defaultPollInterval = 15 * time.Minute
+
+// shutdownCtx is cancelled once the daemon received SIGINT or SIGTERM; runs
+// then stop before the next job or file.
+var shutdownCtx = context.Background()
+
+// daemonMode reports whether RUN_MODE=daemon or --watch asked for a long-running
+// process instead of a single run.
+func daemonMode() bool {
+	return strings.EqualFold(os.Getenv("RUN_MODE"), "daemon")
+}
+
+// shutdownRequested reports whether the daemon was asked to stop.
+func shutdownRequested() bool {
+	return shutdownCtx.Err() != nil
+}
+
+// runDaemon repeats the regular run every POLL_INTERVAL until SIGINT or
+// SIGTERM. A signal lets the file being processed finish, leaves the rest for
+// the next start and ends the process with the exit code of the last run.
+// Like listen, the daemon pages prolonged outages and restarts itself above
+// MEMORY_CEILING_MB.
+func (p *Pipeline) runDaemon(srv *drive.Service, sheetsSrv *sheets.Service) int {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	shutdownCtx = ctx
+	interval := env.Duration("POLL_INTERVAL", defaultPollInterval)
+	log.Printf("Running as daemon, polling every %s", interval)
+	listenMode = true
+	startMetricsServer()
+
+	exitCode := 0
+	for cycle := 1; ctx.Err() == nil; cycle++ {
+		started := time.Now()
+		if cycle > 1 {
+			startRun()
+			p.maybeHousekeep()
+		}
+		canaryResult, canaryHeld = nil, 0
+		log.Printf("Cycle %d started", cycle)
+		exitCode = p.runCycle(srv, sheetsSrv, started)
+		p.checkPipelineDown()
+		next := time.Now().Add(interval)
+		log.Printf("Cycle %d finished in %s with exit code %d, next at %s",
+			cycle, time.Since(started).Round(time.Second), exitCode, next.Format("15:04:05"))
+		maybeLogResources()
+		if memoryOverCeiling() {
+			if err := restartAfterCeiling(); err != nil {
+				log.Printf("Warning: %v", err)
+				return 1
+			}
+			return exitCode
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(time.Until(next)):
+		}
+	}
+	log.Println("Daemon stopped")
+	return exitCode
+}
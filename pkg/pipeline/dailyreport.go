@@ -0,0 +1,176 @@
+package pipeline
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"backup-otomatis/pkg/track"
+	"google.golang.org/api/sheets/v4"
+)
+
+// sizeTrendPoints is the number of recent restore sizes shown per kab.
+const sizeTrendPoints = 7
+
+// sparkTicks are the bars of a text sparkline, from lowest to highest.
+var sparkTicks = []rune("▁▂▃▄▅▆▇█")
+
+// dailyReportRow is one kab in the daily report.
+type dailyReportRow struct {
+	Kab         string
+	LastUpload  string
+	LastRestore string
+	// SizesMB are the sizes of the latest restored backups, oldest first.
+	SizesMB   []string
+	Sparkline string
+	Failures  int
+}
+
+var dailyReportTemplate = template.Must(template.New("daily-report").Parse(`<!DOCTYPE html>
+<html><body style="font-family: sans-serif">
+<h2>Backup report {{.Date}}</h2>
+<p>{{len .Rows}} kab(s), {{.Failing}} with outstanding failures.</p>
+<table border="1" cellpadding="4" cellspacing="0" style="border-collapse: collapse">
+<tr><th>Kab</th><th>Last upload</th><th>Last restore</th><th>Size trend (MB)</th><th>Consecutive failures</th></tr>
+{{range .Rows}}<tr{{if .Failures}} style="background: #fde2e2"{{end}}>
+<td>{{.Kab}}</td><td>{{.LastUpload}}</td><td>{{.LastRestore}}</td>
+<td><span style="font-family: monospace">{{.Sparkline}}</span> {{range $i, $s := .SizesMB}}{{if $i}}, {{end}}{{$s}}{{end}}</td>
+<td>{{if .Failures}}{{.Failures}}{{end}}</td>
+</tr>
+{{end}}</table>
+</body></html>
+`))
+
+// dailyReportDue reports whether the daily report should be sent now: it is
+// past DAILY_REPORT_TIME (HH:MM, local time) and none was sent since then.
+func (p *Pipeline) dailyReportDue(now time.Time) bool {
+	at, err := time.Parse("15:04", os.Getenv("DAILY_REPORT_TIME"))
+	if err != nil {
+		log.Printf("Warning: invalid DAILY_REPORT_TIME %q: %v", os.Getenv("DAILY_REPORT_TIME"), err)
+		return false
+	}
+	due := time.Date(now.Year(), now.Month(), now.Day(), at.Hour(), at.Minute(), 0, 0, now.Location())
+	return !now.Before(due) && p.state.lastDailyReport().Before(due)
+}
+
+// maybeSendDailyReport emails the daily report to DAILY_REPORT_EMAIL once a day
+// after DAILY_REPORT_TIME.
+func (p *Pipeline) maybeSendDailyReport(sheetsSrv *sheets.Service, spreadsheetID string) {
+	to := splitAddresses(os.Getenv("DAILY_REPORT_EMAIL"))
+	if len(to) == 0 || os.Getenv("DAILY_REPORT_TIME") == "" {
+		return
+	}
+	now := time.Now()
+	if !p.dailyReportDue(now) {
+		return
+	}
+	rows, err := p.dailyReportRows(sheetsSrv, spreadsheetID)
+	if err != nil {
+		log.Printf("Warning: failed to build daily report: %v", err)
+		return
+	}
+	body, err := renderDailyReport(rows, now)
+	if err != nil {
+		log.Printf("Warning: failed to render daily report: %v", err)
+		return
+	}
+	if err := sendMail(to, "Backup report "+now.Format("2006-01-02"), "text/html", body); err != nil {
+		log.Printf("Warning: %v", err)
+		return
+	}
+	log.Printf("Sent daily report to %s", strings.Join(to, ", "))
+	if err := p.state.setLastDailyReport(now); err != nil {
+		log.Printf("Warning: failed to save state: %v", err)
+	}
+}
+
+// dailyReportRows combines the tracking sheet (kab and last upload columns)
+// with the restore history and failure streaks of the state file.
+func (p *Pipeline) dailyReportRows(sheetsSrv *sheets.Service, spreadsheetID string) ([]dailyReportRow, error) {
+	t, err := track.ReadTable(sheetsSrv, spreadsheetID)
+	if err != nil {
+		return nil, err
+	}
+	restores := p.state.lastRestores()
+	streaks := p.state.failureStreaks()
+	sizes := map[string][]int64{}
+	history := p.state.phaseHistory()
+	sort.Slice(history, func(i, j int) bool { return history[i].At.Before(history[j].At) })
+	for _, r := range history {
+		if r.Phase == "restore" && r.Kab != "" {
+			sizes[r.Kab] = append(sizes[r.Kab], r.Size)
+		}
+	}
+
+	var rows []dailyReportRow
+	seen := map[string]bool{}
+	for i := range t.Values {
+		kab := t.Cell(i, t.KabCol)
+		if kab == "" || seen[kab] {
+			continue
+		}
+		seen[kab] = true
+		row := dailyReportRow{Kab: kab, Failures: streaks[kab], LastUpload: t.Cell(i, t.UploadCol)}
+		if t, ok := restores[kab]; ok {
+			row.LastRestore = t.Format("2006-01-02 15:04")
+		}
+		s := sizes[kab]
+		if len(s) > sizeTrendPoints {
+			s = s[len(s)-sizeTrendPoints:]
+		}
+		for _, n := range s {
+			row.SizesMB = append(row.SizesMB, fmt.Sprintf("%.1f", float64(n)/(1024*1024)))
+		}
+		row.Sparkline = sparkline(s)
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// renderDailyReport renders the report rows as an HTML email body.
+func renderDailyReport(rows []dailyReportRow, now time.Time) (string, error) {
+	failing := 0
+	for _, r := range rows {
+		if r.Failures > 0 {
+			failing++
+		}
+	}
+	var buf bytes.Buffer
+	err := dailyReportTemplate.Execute(&buf, map[string]interface{}{
+		"Date":    now.Format("2006-01-02"),
+		"Rows":    rows,
+		"Failing": failing,
+	})
+	return buf.String(), err
+}
+
+// sparkline renders vals as a text sparkline scaled between their minimum and
+// maximum.
+func sparkline(vals []int64) string {
+	if len(vals) == 0 {
+		return ""
+	}
+	lo, hi := vals[0], vals[0]
+	for _, v := range vals {
+		if v < lo {
+			lo = v
+		}
+		if v > hi {
+			hi = v
+		}
+	}
+	var b strings.Builder
+	for _, v := range vals {
+		i := len(sparkTicks) / 2
+		if hi > lo {
+			i = int(float64(v-lo) / float64(hi-lo) * float64(len(sparkTicks)-1))
+		}
+		b.WriteRune(sparkTicks[i])
+	}
+	return b.String()
+}
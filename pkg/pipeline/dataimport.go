@@ -0,0 +1,244 @@
+package pipeline
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"backup-otomatis/internal/env"
+	"backup-otomatis/pkg/restore"
+	"backup-otomatis/pkg/source"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/sheets/v4"
+)
+
+// defaultStagingSchema holds the tables CSV and XLSX uploads are imported into.
+const defaultStagingSchema = "staging"
+
+// dataImportEnabled reports whether DATA_IMPORT routes CSV and XLSX uploads to
+// the import stage instead of extraction.
+func dataImportEnabled() bool {
+	return strings.EqualFold(os.Getenv("DATA_IMPORT"), "true")
+}
+
+// isDataFile reports whether name is a CSV or XLSX upload.
+func isDataFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".csv", ".xlsx":
+		return true
+	}
+	return false
+}
+
+// bulkLoadSpec describes how a delimited file is loaded into a table.
+type bulkLoadSpec struct {
+	// Table is the schema-qualified target table.
+	Table string
+	// Delimiter separates fields; empty means ",".
+	Delimiter string
+	// CodePage is the BULK INSERT code page, e.g. "65001" or "ACP"; empty means "65001".
+	CodePage string
+	// FirstRow is the first data row; 0 means 2, skipping the header.
+	FirstRow int
+	// Truncate empties an existing table before loading.
+	Truncate bool
+	// Columns, when set, (re)creates the table with these NVARCHAR(MAX) columns.
+	Columns []string
+}
+
+// statement returns the T-SQL batch performing the load and printing the
+// number of rows in the table.
+func (s bulkLoadSpec) statement(path string) string {
+	delim := s.Delimiter
+	if delim == "" {
+		delim = ","
+	}
+	codePage := s.CodePage
+	if codePage == "" {
+		codePage = "65001"
+	}
+	firstRow := s.FirstRow
+	if firstRow == 0 {
+		firstRow = 2
+	}
+	table := restore.QuoteName(s.Table)
+	var b strings.Builder
+	if len(s.Columns) > 0 {
+		if i := strings.LastIndex(s.Table, "."); i > 0 {
+			schema := strings.Trim(s.Table[:i], "[]")
+			fmt.Fprintf(&b, "IF SCHEMA_ID(N'%s') IS NULL EXEC(N'CREATE SCHEMA %s');\n", sqlString(schema), sqlString(restore.QuoteName(schema)))
+		}
+		fmt.Fprintf(&b, "IF OBJECT_ID(N'%s') IS NOT NULL DROP TABLE %s;\n", sqlString(table), table)
+		cols := make([]string, len(s.Columns))
+		for i, c := range s.Columns {
+			cols[i] = restore.QuoteName(c) + " NVARCHAR(MAX) NULL"
+		}
+		fmt.Fprintf(&b, "CREATE TABLE %s (%s);\n", table, strings.Join(cols, ", "))
+	} else if s.Truncate {
+		fmt.Fprintf(&b, "TRUNCATE TABLE %s;\n", table)
+	}
+	fmt.Fprintf(&b, "BULK INSERT %s FROM N'%s' WITH (FORMAT = 'CSV', FIRSTROW = %d, FIELDTERMINATOR = '%s', ROWTERMINATOR = '0x0a', CODEPAGE = '%s', TABLOCK);\n",
+		table, sqlString(path), firstRow, sqlString(delim), sqlString(codePage))
+	fmt.Fprintf(&b, "SELECT COUNT_BIG(*) FROM %s;", table)
+	return b.String()
+}
+
+// sqlString escapes s for use inside a T-SQL string literal.
+func sqlString(s string) string {
+	return strings.ReplaceAll(s, "'", "''")
+}
+
+// bulkLoad loads path into dbName on host as described by spec and returns the
+// number of rows in the table afterwards. The file must be readable by the SQL
+// Server service.
+func bulkLoad(host, user, pass, dbName string, spec bulkLoadSpec, path string) (int64, error) {
+	args := restore.ConnArgs(host, user, pass, dbName)
+	args = append(args, "-b", "-h", "-1", "-W", "-Q", "SET NOCOUNT ON; "+spec.statement(path))
+	output, err := exec.Command("sqlcmd", args...).CombinedOutput()
+	if err != nil {
+		return 0, fmt.Errorf("bulk load into %s failed: %v: %s", spec.Table, err, strings.TrimSpace(string(output)))
+	}
+	if has, txt := restore.OutputHasError(output); has {
+		return 0, fmt.Errorf("bulk load into %s reported error: %s", spec.Table, txt)
+	}
+	for _, l := range strings.Split(string(output), "\n") {
+		if n, err := strconv.ParseInt(strings.TrimSpace(l), 10, 64); err == nil {
+			return n, nil
+		}
+	}
+	return 0, fmt.Errorf("bulk load into %s returned no row count", spec.Table)
+}
+
+// readCSVHeader returns the column names in the first row of a delimited file,
+// made unique and non-empty.
+func readCSVHeader(path string, delim rune) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := csv.NewReader(f)
+	r.Comma = delim
+	r.LazyQuotes = true
+	r.FieldsPerRecord = -1
+	header, err := r.Read()
+	if err == io.EOF {
+		return nil, fmt.Errorf("%s is empty", filepath.Base(path))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header of %s: %v", filepath.Base(path), err)
+	}
+	seen := map[string]int{}
+	cols := make([]string, len(header))
+	for i, h := range header {
+		h = strings.TrimSpace(strings.TrimPrefix(h, "\ufeff"))
+		if h == "" {
+			h = fmt.Sprintf("col%d", i+1)
+		}
+		key := strings.ToLower(h)
+		if n := seen[key]; n > 0 {
+			h = fmt.Sprintf("%s_%d", h, n+1)
+		}
+		seen[key]++
+		cols[i] = h
+	}
+	return cols, nil
+}
+
+// stagingTableName derives the staging table of an upload from its kab and
+// file name, e.g. staging.[3201_Bogor_ruta].
+func stagingTableName(kab, fileName string) string {
+	base := strings.TrimSuffix(fileName, filepath.Ext(fileName))
+	if kab != "" {
+		base = kab + "_" + base
+	}
+	name := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' {
+			return r
+		}
+		return '_'
+	}, base)
+	return env.Or("IMPORT_STAGING_SCHEMA", defaultStagingSchema) + "." + name
+}
+
+// importDataFile downloads a CSV or XLSX upload and loads it into a fresh
+// staging table in IMPORT_DATABASE (default the job's database), then retires
+// the Drive file and updates the tracking sheet like a restored backup.
+func (p *Pipeline) importDataFile(srv *drive.Service, sheetsSrv *sheets.Service, file *source.File, j *job) error {
+	log.Printf("Importing data file: %s", file.Name)
+	tempDir, err := createTempDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+
+	downloaded := filepath.Join(tempDir, file.Name)
+	done := watchPhase(j, "download", file.Name, file.Size, fileSizeOnDisk(downloaded))
+	err = file.Download(downloaded)
+	done()
+	if err != nil {
+		return fmt.Errorf("failed to download file: %v", err)
+	}
+	csvPath := downloaded
+	if strings.EqualFold(filepath.Ext(file.Name), ".xlsx") {
+		csvPath = strings.TrimSuffix(downloaded, filepath.Ext(downloaded)) + ".csv"
+		if err := xlsxToCSV(downloaded, csvPath); err != nil {
+			return fmt.Errorf("failed to convert %s: %v", file.Name, err)
+		}
+	}
+	defer grantPermissions(csvPath, p.DBHost)()
+
+	// A loader mapping for the upload's name loads it into its designated table;
+	// anything else goes to a fresh staging table.
+	db := env.Or("IMPORT_DATABASE", j.DBName)
+	var spec bulkLoadSpec
+	mappings, err := loadLoaderMappings()
+	if err != nil {
+		return err
+	}
+	if m, ok := mappingFor(mappings, file.Name); ok {
+		spec = m.spec(m.Truncate)
+		if csvPath != downloaded {
+			// The converted workbook is always comma-separated UTF-8.
+			spec.Delimiter, spec.CodePage = ",", "65001"
+		}
+		if m.Database != "" {
+			db = m.Database
+		}
+	} else {
+		cols, err := readCSVHeader(csvPath, ',')
+		if err != nil {
+			return err
+		}
+		kab, err := file.Kab()
+		if err != nil {
+			log.Printf("Warning: failed to resolve kab for staging table: %v", err)
+		}
+		spec = bulkLoadSpec{Table: stagingTableName(kab, file.Name), Columns: cols}
+	}
+	n, err := bulkLoad(p.DBHost, p.DBUser, p.DBPass, db, spec, csvPath)
+	if err != nil {
+		return err
+	}
+	log.Printf("Imported %d row(s) from %s into %s", n, file.Name, spec.Table)
+
+	extras := map[string]interface{}{}
+	if col := os.Getenv("SPREADSHEET_NOTES_COLUMN"); col != "" {
+		extras[col] = fmt.Sprintf("import: %d row(s) into %s", n, spec.Table)
+	}
+	if col := os.Getenv("SPREADSHEET_PROCESSED_BY_COLUMN"); col != "" {
+		extras[col] = processedBy()
+	}
+	if col := os.Getenv("SPREADSHEET_RESTORED_AT_COLUMN"); col != "" {
+		extras[col] = time.Now().In(j.location()).Format(env.Or("SPREADSHEET_TIME_FORMAT", defaultSpreadsheetTimeFormat))
+	}
+	return p.deleteFileAndUpdateSpreadsheet(srv, sheetsSrv, j.spreadsheetID(p.Config), file, j.processedAction(), j.location(), extras)
+}
@@ -0,0 +1,83 @@
+package pipeline
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"backup-otomatis/pkg/restore"
+)
+
+// Database flags a job can have applied to Temp after every restore. They are
+// stored in the database, so a restore brings back whatever the kab had set.
+const (
+	dbFlagTrustworthy = "TRUSTWORTHY"
+	dbFlagChaining    = "DB_CHAINING"
+	// dbFlagOwner, as "OWNER=<login>", changes the database owner, which
+	// TRUSTWORTHY code runs as; restores leave the restoring login as owner.
+	dbFlagOwner = "OWNER"
+)
+
+// databaseFlags returns the job's post-restore database flags, or those of
+// POST_RESTORE_FLAGS, e.g. "TRUSTWORTHY,DB_CHAINING,OWNER=sa".
+func (j *job) databaseFlags() []string {
+	if len(j.DatabaseFlags) > 0 {
+		return j.DatabaseFlags
+	}
+	var out []string
+	for _, f := range strings.Split(os.Getenv("POST_RESTORE_FLAGS"), ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// databaseFlagStatements returns the statements setting flags on Temp.
+func databaseFlagStatements(flags []string) ([]string, error) {
+	var stmts []string
+	for _, f := range flags {
+		name, value, _ := strings.Cut(f, "=")
+		switch strings.ToUpper(strings.TrimSpace(name)) {
+		case dbFlagTrustworthy:
+			stmts = append(stmts, "ALTER DATABASE [Temp] SET TRUSTWORTHY ON;")
+		case dbFlagChaining:
+			stmts = append(stmts, "ALTER DATABASE [Temp] SET DB_CHAINING ON;")
+		case dbFlagOwner:
+			login := strings.TrimSpace(value)
+			if login == "" {
+				return nil, fmt.Errorf("database flag %q needs a login, e.g. OWNER=sa", f)
+			}
+			stmts = append(stmts, fmt.Sprintf("ALTER AUTHORIZATION ON DATABASE::[Temp] TO [%s];", strings.ReplaceAll(login, "]", "]]")))
+		default:
+			return nil, fmt.Errorf("unknown database flag %q, use TRUSTWORTHY, DB_CHAINING or OWNER=<login>", f)
+		}
+	}
+	return stmts, nil
+}
+
+// applyDatabaseFlags sets the job's post-restore flags on Temp on host and
+// records each change in the audit log, as the DBA's manual ALTER DATABASE
+// steps would have been. A flag that cannot be set fails the file, since the
+// scripts that follow depend on it.
+func applyDatabaseFlags(host, user, pass string, j *job, fileName string) error {
+	flags := j.databaseFlags()
+	if len(flags) == 0 {
+		return nil
+	}
+	stmts, err := databaseFlagStatements(flags)
+	if err != nil {
+		return err
+	}
+	if _, err := restore.RunQuery(host, user, pass, "master", strings.Join(stmts, " ")); err != nil {
+		return fmt.Errorf("failed to set database flags %s: %v", strings.Join(flags, ", "), err)
+	}
+	log.Printf("Set database flags %s on Temp on %s", strings.Join(flags, ", "), host)
+	detail := fmt.Sprintf("Temp on %s for %s (job %s): %s", host, fileName, j.Name, strings.Join(flags, ", "))
+	if err := appendAudit(auditEntry{At: time.Now(), User: processedBy(), Role: "system", Action: "database-flags", Detail: detail}); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package pipeline
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// encryptedSuffix returns the encryption suffix of name (".gpg", ".pgp" or ".age"),
+// or "" when the file is not encrypted.
+func encryptedSuffix(name string) string {
+	lower := strings.ToLower(name)
+	for _, ext := range []string{".gpg", ".pgp", ".age"} {
+		if strings.HasSuffix(lower, ext) {
+			return ext
+		}
+	}
+	return ""
+}
+
+// decryptionKeyFile returns a file holding the decryption key. The key comes from
+// the file named by fileEnv or, failing that, from the stdout of the command in
+// DECRYPT_KEY_COMMAND (for example a secret manager CLI), which is written to a
+// temporary file that cleanup removes.
+func decryptionKeyFile(fileEnv string) (path string, cleanup func(), err error) {
+	if p := os.Getenv(fileEnv); p != "" {
+		return p, func() {}, nil
+	}
+	command := os.Getenv("DECRYPT_KEY_COMMAND")
+	if command == "" {
+		return "", nil, fmt.Errorf("neither %s nor DECRYPT_KEY_COMMAND is set", fileEnv)
+	}
+	fields := strings.Fields(command)
+	if len(fields) == 0 {
+		return "", nil, fmt.Errorf("DECRYPT_KEY_COMMAND is blank")
+	}
+	key, err := exec.Command(fields[0], fields[1:]...).Output()
+	if err != nil {
+		return "", nil, fmt.Errorf("DECRYPT_KEY_COMMAND failed: %v", err)
+	}
+	f, err := os.CreateTemp("", "backup-key-*")
+	if err != nil {
+		return "", nil, err
+	}
+	defer f.Close()
+	if _, err := f.Write(key); err != nil {
+		os.Remove(f.Name())
+		return "", nil, err
+	}
+	return f.Name(), func() { os.Remove(f.Name()) }, nil
+}
+
+// decryptArchive decrypts an age- or GPG-encrypted download next to itself and
+// returns the path of the decrypted file. Files without an encryption suffix are
+// returned unchanged.
+func decryptArchive(archivePath string) (string, error) {
+	ext := encryptedSuffix(archivePath)
+	if ext == "" {
+		return archivePath, nil
+	}
+	out := archivePath[:len(archivePath)-len(ext)]
+	log.Printf("Decrypting %s to %s", filepath.Base(archivePath), filepath.Base(out))
+	var err error
+	if ext == ".age" {
+		err = decryptAge(archivePath, out)
+	} else {
+		err = decryptGPG(archivePath, out)
+	}
+	if err != nil {
+		return "", err
+	}
+	return out, nil
+}
+
+// decryptAge decrypts with the age identity from AGE_IDENTITY_FILE.
+func decryptAge(in, out string) error {
+	key, cleanup, err := decryptionKeyFile("AGE_IDENTITY_FILE")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	if b, err := exec.Command("age", "-d", "-i", key, "-o", out, in).CombinedOutput(); err != nil {
+		return fmt.Errorf("age decryption failed: %v: %s", err, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
+
+// decryptGPG imports the private key from GPG_KEY_FILE into a throwaway keyring
+// and decrypts with it, so the server's own keyring is never touched.
+// GPG_PASSPHRASE_FILE may hold the key's passphrase.
+func decryptGPG(in, out string) error {
+	key, cleanup, err := decryptionKeyFile("GPG_KEY_FILE")
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+	home, err := os.MkdirTemp("", "backup-gnupg-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(home)
+	if b, err := exec.Command("gpg", "--homedir", home, "--batch", "--import", key).CombinedOutput(); err != nil {
+		return fmt.Errorf("gpg key import failed: %v: %s", err, strings.TrimSpace(string(b)))
+	}
+	args := []string{"--homedir", home, "--batch", "--yes", "--pinentry-mode", "loopback"}
+	if pf := os.Getenv("GPG_PASSPHRASE_FILE"); pf != "" {
+		args = append(args, "--passphrase-file", pf)
+	}
+	args = append(args, "--output", out, "--decrypt", in)
+	if b, err := exec.Command("gpg", args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("gpg decryption failed: %v: %s", err, strings.TrimSpace(string(b)))
+	}
+	return nil
+}
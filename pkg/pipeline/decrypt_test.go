@@ -0,0 +1,11 @@
+package pipeline
+
+import "testing"
+
+func TestDecryptionKeyFileBlankCommand(t *testing.T) {
+	t.Setenv("AGE_IDENTITY_FILE", "")
+	t.Setenv("DECRYPT_KEY_COMMAND", "  \t ")
+	if _, _, err := decryptionKeyFile("AGE_IDENTITY_FILE"); err == nil {
+		t.Fatal("blank DECRYPT_KEY_COMMAND accepted")
+	}
+}
@@ -0,0 +1,87 @@
+package pipeline
+
+import (
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"backup-otomatis/internal/env"
+	"backup-otomatis/pkg/source"
+	"google.golang.org/api/drive/v3"
+)
+
+// dedupeWindow returns the configured DEDUP_WINDOW_HOURS, or 0 when deduplication is off.
+func dedupeWindow() time.Duration {
+	v := os.Getenv("DEDUP_WINDOW_HOURS")
+	if v == "" {
+		return 0
+	}
+	h, err := strconv.Atoi(v)
+	if err != nil || h < 0 {
+		log.Printf("warning: invalid DEDUP_WINDOW_HOURS %q, deduplication disabled", v)
+		return 0
+	}
+	return time.Duration(h) * time.Hour
+}
+
+// dedupeFiles drops older copies of files that were re-uploaded under the same
+// name into the same folder within window of a newer copy, so only the newest
+// upload is processed. Superseded copies are handled according to DEDUP_ACTION:
+// "delete" (default) removes them from Drive, "quarantine" moves them to the
+// quarantine folder and "skip" leaves them in place.
+func dedupeFiles(srv *drive.Service, files []*source.File, window time.Duration, quarantineFolderID string) []*source.File {
+	if window <= 0 {
+		return files
+	}
+	groups := map[string][]*source.File{}
+	for _, f := range files {
+		key := f.Name
+		if len(f.Parents) > 0 {
+			key = f.Parents[0] + "/" + f.Name
+		}
+		groups[key] = append(groups[key], f)
+	}
+	superseded := map[string]bool{}
+	for _, g := range groups {
+		if len(g) < 2 {
+			continue
+		}
+		sort.SliceStable(g, func(a, b int) bool { return g[a].CreatedTime > g[b].CreatedTime })
+		for i := 1; i < len(g); i++ {
+			newer, errN := time.Parse(time.RFC3339, g[i-1].CreatedTime)
+			older, errO := time.Parse(time.RFC3339, g[i].CreatedTime)
+			if errN != nil || errO != nil || newer.Sub(older) > window {
+				continue
+			}
+			superseded[g[i].ID] = true
+		}
+	}
+	if len(superseded) == 0 {
+		return files
+	}
+	action := strings.ToLower(env.Or("DEDUP_ACTION", "delete"))
+	kept := make([]*source.File, 0, len(files)-len(superseded))
+	for _, f := range files {
+		if !superseded[f.ID] {
+			kept = append(kept, f)
+			continue
+		}
+		log.Printf("File %s (ID: %s, created %s) was re-uploaded within %s, skipping older copy", f.Name, f.ID, f.CreatedTime, window)
+		switch action {
+		case "delete":
+			if err := deleteDriveFile(srv, f); err != nil {
+				log.Printf("Warning: failed to delete duplicate %s: %v", f.ID, err)
+			}
+		case "quarantine":
+			if quarantineFolderID == "" {
+				log.Printf("Warning: DEDUP_ACTION=quarantine but QUARANTINE_FOLDER_ID is not set, leaving %s", f.ID)
+			} else if err := source.Move(f, quarantineFolderID); err != nil {
+				log.Printf("Warning: failed to quarantine duplicate %s: %v", f.ID, err)
+			}
+		}
+	}
+	return kept
+}
@@ -0,0 +1,84 @@
+package pipeline
+
+import (
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// digestModeRun batches notifications per job run; any other NOTIFY_DIGEST
+// value is a time window such as "1h".
+const digestModeRun = "run"
+
+// digestItem is one notification held back for the digest.
+type digestItem struct {
+	Level   string
+	Message string
+	At      time.Time
+}
+
+// digest buffers info and warning notifications when NOTIFY_DIGEST is set.
+var digest struct {
+	mu    sync.Mutex
+	items []digestItem
+}
+
+// digestWindow returns whether digests are enabled and, for window mode, the
+// window length. Run mode returns a zero window.
+func digestWindow() (bool, time.Duration) {
+	v := strings.ToLower(strings.TrimSpace(os.Getenv("NOTIFY_DIGEST")))
+	switch v {
+	case "", "false", "off":
+		return false, 0
+	case digestModeRun:
+		return true, 0
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d <= 0 {
+		log.Printf("Warning: invalid NOTIFY_DIGEST %q, sending notifications immediately", v)
+		return false, 0
+	}
+	return true, d
+}
+
+// queueDigest holds back a notification for the digest and reports whether it
+// did. Errors are never held back.
+func queueDigest(level, message string) bool {
+	if level == levelError {
+		return false
+	}
+	if ok, _ := digestWindow(); !ok {
+		return false
+	}
+	digest.mu.Lock()
+	defer digest.mu.Unlock()
+	digest.items = append(digest.items, digestItem{Level: level, Message: message, At: time.Now()})
+	return true
+}
+
+// flushDigest sends the buffered notifications as one message at the level of
+// the most severe of them. Unless force is set, it only does so in window mode
+// once the oldest notification is a full window old.
+func flushDigest(force bool) {
+	_, window := digestWindow()
+	digest.mu.Lock()
+	items := digest.items
+	if len(items) == 0 || (!force && (window == 0 || time.Since(items[0].At) < window)) {
+		digest.mu.Unlock()
+		return
+	}
+	digest.items = nil
+	digest.mu.Unlock()
+
+	level := levelInfo
+	rows := make([]msgData, 0, len(items))
+	for _, it := range items {
+		if it.Level == levelWarning {
+			level = levelWarning
+		}
+		rows = append(rows, msgData{"Level": it.Level, "Message": it.Message, "At": it.At.Format("15:04")})
+	}
+	deliver(level, localize("notification-digest", msgData{"Since": items[0].At.Format("2006-01-02 15:04"), "Items": rows}))
+}
@@ -0,0 +1,162 @@
+package pipeline
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// sqlBrowserPort is the UDP port of the SQL Server Browser service.
+const sqlBrowserPort = 1434
+
+// sqlInstance is one SQL Server instance found on a machine.
+type sqlInstance struct {
+	Name   string // "MSSQLSERVER" for the default instance
+	Source string // "browser" or "registry"
+	TCP    string // TCP port announced by the browser, if any
+}
+
+// dbHost returns the DB_HOST value that connects to the instance on host.
+func (i sqlInstance) dbHost(host string) string {
+	if strings.EqualFold(i.Name, "MSSQLSERVER") {
+		return host
+	}
+	return host + `\` + i.Name
+}
+
+// discoverCommand implements `backup-otomatis discover [--host=name]`: it lists
+// the SQL Server instances on host and checks that DB_USER/DB_PASS can connect
+// to each, so operators can pick the right DB_HOST during setup.
+func discoverCommand(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("discover", flag.ContinueOnError)
+	host := fs.String("host", "localhost", "machine to look for instances on")
+	timeout := fs.Duration("timeout", 3*time.Second, "how long to wait for the SQL Browser answer")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	found := map[string]sqlInstance{}
+	browsed, err := browseSQLInstances(*host, *timeout)
+	if err != nil {
+		fmt.Fprintf(w, "SQL Browser on %s: %v\n", *host, err)
+	}
+	for _, i := range browsed {
+		found[strings.ToUpper(i.Name)] = i
+	}
+	if isLocalHost(*host) {
+		for _, i := range registrySQLInstances() {
+			if _, ok := found[strings.ToUpper(i.Name)]; !ok {
+				found[strings.ToUpper(i.Name)] = i
+			}
+		}
+	}
+	if len(found) == 0 {
+		return fmt.Errorf("no SQL Server instances found on %s", *host)
+	}
+	names := make([]string, 0, len(found))
+	for n := range found {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+
+	user, pass := os.Getenv("DB_USER"), os.Getenv("DB_PASS")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "DB_HOST\tSOURCE\tTCP\tVERSION\tSTATUS")
+	for _, n := range names {
+		i := found[n]
+		dbHost := i.dbHost(*host)
+		version, status := "", "ok"
+		if t, err := queryTargetServer(dbHost, user, pass); err != nil {
+			status = "FAILED: " + err.Error()
+		} else {
+			version = fmt.Sprintf("%s %s", sqlServerVersionName(t.Major), t.Edition)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", dbHost, i.Source, i.TCP, version, status)
+	}
+	return tw.Flush()
+}
+
+// isLocalHost reports whether host names this machine.
+func isLocalHost(host string) bool {
+	switch strings.ToLower(host) {
+	case "localhost", ".", "(local)", "127.0.0.1", "::1":
+		return true
+	}
+	name, err := os.Hostname()
+	return err == nil && strings.EqualFold(name, host)
+}
+
+// browseSQLInstances asks the SQL Browser service on host for its instances
+// (SSRP CLNT_UCAST_EX request).
+func browseSQLInstances(host string, timeout time.Duration) ([]sqlInstance, error) {
+	conn, err := net.Dial("udp", net.JoinHostPort(host, fmt.Sprint(sqlBrowserPort)))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write([]byte{0x03}); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, fmt.Errorf("no answer: %v", err)
+	}
+	if n < 3 || buf[0] != 0x05 {
+		return nil, fmt.Errorf("unexpected answer")
+	}
+	return parseSQLBrowserResponse(string(buf[3:n])), nil
+}
+
+// parseSQLBrowserResponse parses "ServerName;X;InstanceName;Y;...;tcp;1433;;"
+// records, one per instance.
+func parseSQLBrowserResponse(s string) []sqlInstance {
+	var out []sqlInstance
+	for _, rec := range strings.Split(s, ";;") {
+		fields := strings.Split(rec, ";")
+		var i sqlInstance
+		for k := 0; k+1 < len(fields); k += 2 {
+			switch strings.ToLower(fields[k]) {
+			case "instancename":
+				i.Name = fields[k+1]
+			case "tcp":
+				i.TCP = fields[k+1]
+			}
+		}
+		if i.Name != "" {
+			i.Source = "browser"
+			out = append(out, i)
+		}
+	}
+	return out
+}
+
+// registrySQLInstances lists the instances installed on this machine from the
+// registry. It returns nothing outside Windows.
+func registrySQLInstances() []sqlInstance {
+	if runtime.GOOS != "windows" {
+		return nil
+	}
+	out, err := exec.Command("reg", "query", `HKLM\SOFTWARE\Microsoft\Microsoft SQL Server\Instance Names\SQL`).Output()
+	if err != nil {
+		return nil
+	}
+	var instances []sqlInstance
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 3 && fields[1] == "REG_SZ" {
+			instances = append(instances, sqlInstance{Name: fields[0], Source: "registry"})
+		}
+	}
+	return instances
+}
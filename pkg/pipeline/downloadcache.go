@@ -0,0 +1,140 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"backup-otomatis/pkg/source"
+)
+
+// defaultDownloadCacheGB bounds the download cache when DOWNLOAD_CACHE_MAX_GB is not set.
+const defaultDownloadCacheGB = 20
+
+// downloadCache keeps downloaded archives on local disk, keyed by content
+// (Drive md5 checksum, or file ID when Drive reports none), so a retry after
+// a failed restore does not download the same gigabytes again. The least
+// recently used entries are evicted once the cache exceeds maxBytes.
+type downloadCache struct {
+	dir      string
+	maxBytes int64
+}
+
+// configuredDownloadCache returns the cache in DOWNLOAD_CACHE_DIR, or nil when
+// caching is disabled.
+func configuredDownloadCache() *downloadCache {
+	dir := os.Getenv("DOWNLOAD_CACHE_DIR")
+	if dir == "" {
+		return nil
+	}
+	gb := int64(defaultDownloadCacheGB)
+	if v := os.Getenv("DOWNLOAD_CACHE_MAX_GB"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+			gb = n
+		} else {
+			log.Printf("Warning: invalid DOWNLOAD_CACHE_MAX_GB %q, using %d", v, gb)
+		}
+	}
+	return &downloadCache{dir: dir, maxBytes: gb << 30}
+}
+
+// entryPath returns where the archive of file is cached.
+func (c *downloadCache) entryPath(file *source.File) string {
+	if file.MD5 != "" {
+		return filepath.Join(c.dir, "md5-"+file.MD5)
+	}
+	return filepath.Join(c.dir, "id-"+file.ID)
+}
+
+// fetch places a cached copy of file at destPath. It reports false when the
+// file is not cached or the cached copy has the wrong size.
+func (c *downloadCache) fetch(file *source.File, destPath string) bool {
+	p := c.entryPath(file)
+	fi, err := os.Stat(p)
+	if err != nil || fi.Size() != file.Size {
+		return false
+	}
+	if err := linkOrCopy(p, destPath); err != nil {
+		log.Printf("Warning: failed to use cached download %s: %v", p, err)
+		return false
+	}
+	now := time.Now()
+	os.Chtimes(p, now, now)
+	return true
+}
+
+// store adds the downloaded archive at srcPath to the cache and evicts old entries.
+func (c *downloadCache) store(file *source.File, srcPath string) error {
+	if err := os.MkdirAll(c.dir, 0o755); err != nil {
+		return fmt.Errorf("failed to create download cache: %v", err)
+	}
+	p := c.entryPath(file)
+	os.Remove(p)
+	if err := linkOrCopy(srcPath, p); err != nil {
+		return fmt.Errorf("failed to cache download: %v", err)
+	}
+	return c.evict()
+}
+
+// remove drops the cached archive of file, once it has been processed.
+func (c *downloadCache) remove(file *source.File) {
+	if err := os.Remove(c.entryPath(file)); err != nil && !os.IsNotExist(err) {
+		log.Printf("Warning: failed to remove cached download: %v", err)
+	}
+}
+
+// evict deletes the least recently used entries until the cache fits maxBytes.
+func (c *downloadCache) evict() error {
+	entries, err := os.ReadDir(c.dir)
+	if err != nil {
+		return err
+	}
+	var files []os.FileInfo
+	var total int64
+	for _, e := range entries {
+		fi, err := e.Info()
+		if err != nil || !fi.Mode().IsRegular() {
+			continue
+		}
+		files = append(files, fi)
+		total += fi.Size()
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].ModTime().Before(files[j].ModTime()) })
+	for _, fi := range files {
+		if total <= c.maxBytes {
+			break
+		}
+		if err := os.Remove(filepath.Join(c.dir, fi.Name())); err != nil {
+			return err
+		}
+		log.Printf("Evicted %s (%s) from the download cache", fi.Name(), formatBytes(fi.Size()))
+		total -= fi.Size()
+	}
+	return nil
+}
+
+// linkOrCopy hard-links src to dst, copying when both are on different volumes.
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,98 @@
+package pipeline
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sync"
+
+	"backup-otomatis/pkg/source"
+	"google.golang.org/api/drive/v3"
+)
+
+// What happens to a Drive file once it has been processed: it is deleted, tagged
+// with processed=true, or moved to PROCESSED_FOLDER_ID. The last two are for
+// sources where our account may not delete files.
+const (
+	processedActionDelete = "delete"
+	processedActionMark   = "mark"
+	processedActionMove   = "move"
+)
+
+// ownPermissionID caches the Drive permission ID of the account we run as.
+var ownPermissionID struct {
+	once sync.Once
+	id   string
+	err  error
+}
+
+// deleteDriveFile deletes a processed file from its source. Drive retries rate
+// limiting and server errors with backoff. When Drive refuses the delete because
+// the file belongs to someone else (403/404), the file is marked processed in its
+// appProperties, trashed or, failing that, our access to it is removed, and a
+// warning is sent. Either way the file no longer shows up in our listings and is
+// not processed again.
+func deleteDriveFile(srv *drive.Service, file *source.File) error {
+	err := file.Delete()
+	if _, onDrive := file.Object.(*source.DriveObject); !onDrive || err == nil {
+		return err
+	}
+	if code := source.ErrorCode(err); code != 403 && code != 404 {
+		return err
+	}
+
+	log.Printf("Not allowed to delete %s (%v), falling back", file.Name, err)
+	mErr := file.MarkProcessed()
+	if mErr != nil {
+		log.Printf("Warning: failed to mark %s as processed: %v", file.Name, mErr)
+	}
+	_, tErr := srv.Files.Update(file.ID, &drive.File{Trashed: true}).Fields("id").Do()
+	if tErr == nil {
+		notifyMsg(levelWarning, "drive-trashed", msgData{"File": file.Name, "Err": err})
+		return nil
+	}
+	log.Printf("Trashing %s failed: %v", file.Name, tErr)
+	if rErr := removeOwnAccess(srv, file.ID); rErr != nil {
+		if mErr == nil {
+			notifyMsg(levelWarning, "drive-marked", msgData{"File": file.Name, "Err": rErr})
+			return nil
+		}
+		notifyMsg(levelError, "drive-retire-failed", msgData{"File": file.Name, "Err": rErr})
+		return fmt.Errorf("failed to delete Drive file: %v", err)
+	}
+	notifyMsg(levelWarning, "drive-access-removed", msgData{"File": file.Name, "Err": err})
+	return nil
+}
+
+// removeOwnAccess deletes the permission through which our account sees the file.
+func removeOwnAccess(srv *drive.Service, fileID string) error {
+	ownPermissionID.once.Do(func() {
+		about, err := srv.About.Get().Fields("user(permissionId)").Do()
+		if err != nil {
+			ownPermissionID.err = fmt.Errorf("failed to look up own permission ID: %v", err)
+			return
+		}
+		ownPermissionID.id = about.User.PermissionId
+	})
+	if ownPermissionID.err != nil {
+		return ownPermissionID.err
+	}
+	return srv.Permissions.Delete(fileID, ownPermissionID.id).Do()
+}
+
+// retireDriveFile takes a processed file out of future listings according to action.
+func retireDriveFile(srv *drive.Service, file *source.File, action string) error {
+	switch action {
+	case processedActionMark:
+		log.Printf("Marking %s as processed", file.Name)
+		return file.MarkProcessed()
+	case processedActionMove:
+		folderID := os.Getenv("PROCESSED_FOLDER_ID")
+		if folderID == "" {
+			return fmt.Errorf("processed action is move but PROCESSED_FOLDER_ID is not set")
+		}
+		log.Printf("Moving %s to processed folder %s", file.Name, folderID)
+		return source.Move(file, folderID)
+	}
+	return deleteDriveFile(srv, file)
+}
@@ -0,0 +1,56 @@
+package pipeline
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"backup-otomatis/pkg/restore"
+)
+
+// requiredDataTables returns REQUIRED_DATA_TABLES, the comma-separated tables
+// a restored backup must have rows in to count as a real upload.
+func requiredDataTables() []string {
+	var tables []string
+	for _, t := range strings.Split(os.Getenv("REQUIRED_DATA_TABLES"), ",") {
+		if t = strings.TrimSpace(t); t != "" {
+			tables = append(tables, t)
+		}
+	}
+	return tables
+}
+
+// emptyRestore reports whether every table of REQUIRED_DATA_TABLES is empty or
+// missing in the restored Temp database, as in a backup of a fresh install.
+// It returns the row count found per table for the notification.
+func emptyRestore(host, user, pass string) (bool, string, error) {
+	tables := requiredDataTables()
+	if len(tables) == 0 {
+		return false, "", nil
+	}
+	counts := make([]string, 0, len(tables))
+	empty := true
+	for _, t := range tables {
+		name := restore.QuoteName(t)
+		v, err := restore.Scalar(host, user, pass, "Temp",
+			fmt.Sprintf("IF OBJECT_ID(N'%s') IS NULL SELECT -1 ELSE SELECT COUNT_BIG(*) FROM %s", sqlString(name), name))
+		if err != nil {
+			return false, "", fmt.Errorf("failed to count rows of %s: %v", t, err)
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return false, "", fmt.Errorf("unexpected row count %q for %s", v, t)
+		}
+		switch {
+		case n < 0:
+			counts = append(counts, t+" missing")
+		default:
+			counts = append(counts, fmt.Sprintf("%s=%d", t, n))
+			if n > 0 {
+				empty = false
+			}
+		}
+	}
+	return empty, strings.Join(counts, ", "), nil
+}
@@ -0,0 +1,129 @@
+package pipeline
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"backup-otomatis/internal/env"
+	"backup-otomatis/pkg/source"
+)
+
+// Escalation defaults: a kab is escalated to on-call after three consecutive
+// failures, and the pipeline is paged after an hour without a success.
+const (
+	defaultEscalateAfter = 3
+	defaultPageAfter     = time.Hour
+)
+
+// pagerDedupKey identifies the "pipeline down" incident so repeated pages and
+// the final resolve refer to the same incident.
+const pagerDedupKey = "backup-otomatis-pipeline-down"
+
+// listenMode is set while the process serves the work queue; only then is a
+// prolonged outage paged, since scheduled runs report through their exit code.
+var listenMode bool
+
+// escalateAfter returns the number of consecutive failures of one kab that
+// escalate to on-call (ESCALATE_AFTER_FAILURES).
+func escalateAfter() int {
+	if v := os.Getenv("ESCALATE_AFTER_FAILURES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+		log.Printf("Warning: invalid ESCALATE_AFTER_FAILURES %q, using %d", v, defaultEscalateAfter)
+	}
+	return defaultEscalateAfter
+}
+
+// recordFileOutcome records the kab's upload for staleness alerts and applies
+// the escalation policy to the result of one file: the first failure of a kab
+// goes to the chat channels, the ESCALATE_AFTER_FAILURES-th consecutive failure
+// also mentions on-call (ESCALATION_MENTION) and emails ONCALL_EMAIL. A success
+// resets the kab.
+func (p *Pipeline) recordFileOutcome(file *source.File, err error) {
+	kab, pErr := file.Kab()
+	if pErr != nil || kab == "" {
+		kab = file.Name
+	}
+	if uErr := p.state.recordUpload(kab, uploadTime(file)); uErr != nil {
+		log.Printf("Warning: failed to save state: %v", uErr)
+	}
+	streak, paged := p.state.recordOutcome(kab, err == nil, time.Now())
+	if err == nil {
+		if paged {
+			resolvePage()
+		}
+		return
+	}
+	// Escalation is checked first, so ESCALATE_AFTER_FAILURES=1 escalates the
+	// first failure instead of only posting it to the channels.
+	switch {
+	case streak == escalateAfter():
+		notifyMsg(levelError, "failure-escalated", msgData{"File": file.Name, "Kab": kab, "Count": streak,
+			"Mention": os.Getenv("ESCALATION_MENTION"), "Err": err})
+		if to := splitAddresses(os.Getenv("ONCALL_EMAIL")); len(to) > 0 && mailConfigured() {
+			subject := "backup-otomatis: " + kab + " failed " + strconv.Itoa(streak) + " times in a row"
+			body := localize("failure-escalated", msgData{"File": file.Name, "Kab": kab, "Count": streak, "Err": err})
+			if mErr := sendMail(to, subject, "text/plain", body); mErr != nil {
+				log.Printf("Warning: %v", mErr)
+			}
+		}
+	case streak == 1:
+		notifyMsg(levelError, "file-failed", msgData{"File": file.Name, "Kab": kab, "Err": err})
+	default:
+		log.Printf("%s failed %d time(s) in a row", kab, streak)
+	}
+}
+
+// checkPipelineDown pages PAGER_WEBHOOK_URL once, in listen mode, when no file
+// has succeeded for ESCALATION_PAGE_AFTER since the first failure.
+func (p *Pipeline) checkPipelineDown() {
+	url := os.Getenv("PAGER_WEBHOOK_URL")
+	if !listenMode || url == "" {
+		return
+	}
+	since, paged := p.state.pipelineDown()
+	if since.IsZero() || paged {
+		return
+	}
+	down := time.Since(since)
+	if down < env.Duration("ESCALATION_PAGE_AFTER", defaultPageAfter) {
+		return
+	}
+	summary := localize("pipeline-down", msgData{"Since": since.Format(time.RFC3339), "Down": down.Round(time.Minute)})
+	log.Printf("[%s] %s", levelError, summary)
+	if err := sendPage(url, "trigger", summary); err != nil {
+		log.Printf("Warning: failed to page: %v", err)
+		return
+	}
+	if err := p.state.setPaged(true); err != nil {
+		log.Printf("Warning: failed to save state: %v", err)
+	}
+}
+
+// resolvePage resolves the "pipeline down" incident after processing recovered.
+func resolvePage() {
+	if url := os.Getenv("PAGER_WEBHOOK_URL"); url != "" {
+		if err := sendPage(url, "resolve", localize("pipeline-recovered", nil)); err != nil {
+			log.Printf("Warning: failed to resolve page: %v", err)
+		}
+	}
+}
+
+// sendPage posts a PagerDuty Events API v2 compatible event. PAGER_ROUTING_KEY
+// is the integration key of the receiving service.
+func sendPage(url, action, summary string) error {
+	host, _ := os.Hostname()
+	event := map[string]interface{}{
+		"routing_key":  os.Getenv("PAGER_ROUTING_KEY"),
+		"event_action": action,
+		"dedup_key":    pagerDedupKey,
+	}
+	if action == "trigger" {
+		event["payload"] = map[string]string{"summary": summary, "source": host, "severity": "critical"}
+	}
+	return postJSON(&http.Client{Timeout: 10 * time.Second}, url, event)
+}
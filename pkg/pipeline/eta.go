@@ -0,0 +1,158 @@
+package pipeline
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"backup-otomatis/pkg/source"
+)
+
+// queuedFile is a file a run has listed and not finished yet, as published in
+// the state file for /api/queue.
+type queuedFile struct {
+	FileID  string     `json:"fileId"`
+	Name    string     `json:"name"`
+	Kab     string     `json:"kab"`
+	Size    int64      `json:"size"`
+	Started *time.Time `json:"started,omitempty"`
+	// Ref is the correlation ID of the file once its processing started.
+	Ref string `json:"ref,omitempty"`
+	// RestorePercent is the progress of the file's restore as reported by SQL Server.
+	RestorePercent int `json:"restorePercent,omitempty"`
+}
+
+// queueEntry is a queued file with its estimated completion.
+type queueEntry struct {
+	queuedFile
+	// EstimatedSeconds is the expected remaining processing time of the file
+	// itself; ETA includes the files ahead of it. Both are null without history.
+	EstimatedSeconds *float64   `json:"estimatedSeconds"`
+	ETA              *time.Time `json:"eta"`
+}
+
+// queueStatus is the response of /api/queue.
+type queueStatus struct {
+	Files        []queueEntry `json:"files"`
+	TotalSeconds float64      `json:"totalSeconds"`
+	ETA          *time.Time   `json:"eta"`
+}
+
+// secondsPerByte derives processing rates from the phase history: the median of
+// each file's total phase time divided by its size, per kab and over all kabs.
+func secondsPerByte(records []phaseRecord) (map[string]float64, float64) {
+	type fileTotal struct {
+		kab     string
+		size    int64
+		seconds float64
+	}
+	files := map[string]*fileTotal{}
+	for _, r := range records {
+		// A file processed again gets a new record set; keying by time keeps
+		// the attempts apart.
+		key := r.FileID + "|" + r.At.Format(time.RFC3339)
+		f, ok := files[key]
+		if !ok {
+			f = &fileTotal{kab: r.Kab, size: r.Size}
+			files[key] = f
+		}
+		f.seconds += r.Seconds
+	}
+	perKab := map[string][]float64{}
+	var all []float64
+	for _, f := range files {
+		if f.size <= 0 || f.seconds <= 0 {
+			continue
+		}
+		rate := f.seconds / float64(f.size)
+		perKab[f.kab] = append(perKab[f.kab], rate)
+		all = append(all, rate)
+	}
+	rates := make(map[string]float64, len(perKab))
+	for kab, v := range perKab {
+		rates[kab] = median(v)
+	}
+	if len(all) == 0 {
+		return rates, 0
+	}
+	return rates, median(all)
+}
+
+// estimateQueue estimates the completion of every queued file in order. Files
+// of kabs without history use the overall rate; without any history the
+// estimates stay empty.
+func estimateQueue(queue []queuedFile, records []phaseRecord, now time.Time) queueStatus {
+	rates, overall := secondsPerByte(records)
+	st := queueStatus{Files: make([]queueEntry, 0, len(queue))}
+	known := true
+	for _, f := range queue {
+		e := queueEntry{queuedFile: f}
+		rate, ok := rates[f.Kab]
+		if !ok {
+			rate = overall
+		}
+		if rate > 0 {
+			secs := rate * float64(f.Size)
+			if f.Started != nil {
+				secs -= now.Sub(*f.Started).Seconds()
+				if secs < 0 {
+					secs = 0
+				}
+			}
+			e.EstimatedSeconds = &secs
+			st.TotalSeconds += secs
+			if known {
+				eta := now.Add(time.Duration(st.TotalSeconds * float64(time.Second)))
+				e.ETA = &eta
+			}
+		} else {
+			known = false
+		}
+		st.Files = append(st.Files, e)
+	}
+	if known && len(queue) > 0 {
+		eta := now.Add(time.Duration(st.TotalSeconds * float64(time.Second)))
+		st.ETA = &eta
+	}
+	return st
+}
+
+// enqueueFiles publishes the files a job is about to process.
+func (p *Pipeline) enqueueFiles(files []*source.File) {
+	queued := make([]queuedFile, 0, len(files))
+	for _, f := range files {
+		kab, _ := f.Kab()
+		queued = append(queued, queuedFile{FileID: f.ID, Name: f.Name, Kab: kab, Size: f.Size})
+	}
+	if err := p.state.enqueue(queued); err != nil {
+		log.Printf("Warning: failed to save state: %v", err)
+	}
+}
+
+// trackQueuedFile marks file as started in the published queue and returns the
+// function removing it once processing is over.
+func (p *Pipeline) trackQueuedFile(file *source.File) func() {
+	if err := p.state.startQueued(file.ID, currentCorrelationID(), time.Now()); err != nil {
+		log.Printf("Warning: failed to save state: %v", err)
+	}
+	return func() {
+		if err := p.state.dequeue(file.ID); err != nil {
+			log.Printf("Warning: failed to save state: %v", err)
+		}
+	}
+}
+
+// handleQueue serves GET /api/queue: the files the current run still has to
+// process with their estimated completion times.
+func handleQueue(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	st, err := openState(stateFilePath())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, estimateQueue(st.queue(), st.phaseHistory(), time.Now()))
+}
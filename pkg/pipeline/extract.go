@@ -0,0 +1,117 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"backup-otomatis/pkg/archive"
+)
+
+// extractorsOnce configures the archive package once per process.
+var extractorsOnce struct {
+	sync.Once
+	err error
+}
+
+// configureExtractors locates 7-Zip, at SEVENZ_PATH or by archive.FindSevenZip,
+// and loads the command extractors of EXTRACTORS_FILE, a JSON object mapping
+// archive name suffixes to command templates:
+//
+//	{".rar": {"extract": ["unrar", "x", "-p{password}", "{archive}", "{dest}"], "list": ["unrar", "l", "{archive}"]}}
+func configureExtractors() error {
+	extractorsOnce.Do(func() {
+		extractorsOnce.err = loadExtractors()
+	})
+	return extractorsOnce.err
+}
+
+func loadExtractors() error {
+	if p := os.Getenv("SEVENZ_PATH"); p != "" {
+		resolved, err := exec.LookPath(p)
+		if err != nil {
+			return fmt.Errorf("SEVENZ_PATH %s is not usable: %v", p, err)
+		}
+		archive.SevenZipPath = resolved
+	} else {
+		p, err := archive.FindSevenZip()
+		if err != nil {
+			return fmt.Errorf("7-Zip not found: %v. Install 7-Zip or set SEVENZ_PATH", err)
+		}
+		archive.SevenZipPath = p
+	}
+	log.Printf("Using 7-Zip at %s", archive.SevenZipPath)
+
+	path := os.Getenv("EXTRACTORS_FILE")
+	if path == "" {
+		return nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read extractors: %v", err)
+	}
+	var commands map[string]archive.Command
+	if err := json.Unmarshal(b, &commands); err != nil {
+		return fmt.Errorf("failed to parse extractors %s: %v", path, err)
+	}
+	for suffix, c := range commands {
+		if len(c.ExtractArgs) == 0 {
+			return fmt.Errorf("extractor for %q has no extract command", suffix)
+		}
+	}
+	archive.Commands = commands
+	return nil
+}
+
+// extractArchive unpacks archivePath into destDir with the extractor matching its
+// name. age- and GPG-encrypted uploads (e.g. backup.tar.zst.gpg) are decrypted
+// first and the inner archive is selected by its remaining extension.
+func extractArchive(archivePath, destDir, password string) error {
+	if err := configureExtractors(); err != nil {
+		return err
+	}
+	plain, err := decryptArchive(archivePath)
+	if err != nil {
+		return err
+	}
+	ex := archive.For(plain)
+	if s, ok := ex.(archive.Selective); ok && selectiveExtract() {
+		patterns := extractPatterns()
+		n, total, err := s.ExtractMatching(plain, destDir, password, patterns)
+		if err != nil {
+			return err
+		}
+		log.Printf("Extracted %d of %d file(s) matching %s", n, total, strings.Join(patterns, ", "))
+		return nil
+	}
+	return ex.Extract(plain, destDir, password)
+}
+
+// selectiveExtract reports whether SELECTIVE_EXTRACT limits extraction to the
+// files the tool uses, leaving photos, exports and the like in the archive.
+func selectiveExtract() bool {
+	return strings.EqualFold(os.Getenv("SELECTIVE_EXTRACT"), "true")
+}
+
+// extractPatterns returns the file name patterns extracted by selective
+// extraction: backups, the files of the loader mappings, and EXTRACT_ALSO.
+func extractPatterns() []string {
+	patterns := []string{"*.bak"}
+	mappings, err := loadLoaderMappings()
+	if err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	for _, m := range mappings {
+		patterns = append(patterns, m.Pattern)
+	}
+	for _, p := range strings.Split(os.Getenv("EXTRACT_ALSO"), ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			patterns = append(patterns, p)
+		}
+	}
+	return patterns
+}
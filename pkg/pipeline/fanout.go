@@ -0,0 +1,156 @@
+package pipeline
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"backup-otomatis/internal/env"
+	"backup-otomatis/pkg/restore"
+)
+
+// restoreTarget is an additional SQL Server instance a job's backups are
+// restored onto besides DB_HOST, e.g. a reporting or DR server.
+type restoreTarget struct {
+	// Name identifies the target in logs and the tracking sheet.
+	Name string `json:"name"`
+	Host string `json:"host"`
+	// User and Password default to DB_USER and DB_PASS.
+	User     string `json:"user"`
+	Password string `json:"password"`
+	// DBName is the database the update runs against; empty uses the job's.
+	DBName string `json:"dbName"`
+	// BakDir is where the target's copy of the .bak is placed, a path the
+	// target instance can read such as a share on it; empty uses the work dir.
+	BakDir string `json:"bakDir"`
+	// StatusColumn is the tracking sheet column receiving the target's status.
+	StatusColumn string `json:"statusColumn"`
+	// Required makes a failure on this target fail the file, so it stays in
+	// Drive and is processed again.
+	Required bool `json:"required"`
+}
+
+// targetResult is the outcome of one restore target.
+type targetResult struct {
+	Target restoreTarget
+	Err    error
+	At     time.Time
+}
+
+// startFanOut restores bakFile onto every extra target of the job in parallel.
+// It returns immediately; the returned function waits for all targets.
+func (p *Pipeline) startFanOut(j *job, fileName, bakFile string, vars map[string]string) func() []targetResult {
+	if len(j.Targets) == 0 {
+		return func() []targetResult { return nil }
+	}
+	results := make([]targetResult, len(j.Targets))
+	var wg sync.WaitGroup
+	for i, t := range j.Targets {
+		wg.Add(1)
+		go func(i int, t restoreTarget) {
+			defer wg.Done()
+			err := p.restoreOnTarget(j, t, bakFile, vars)
+			results[i] = targetResult{Target: t, Err: err, At: time.Now()}
+			if err != nil {
+				log.Printf("Restore of %s on target %s failed: %v", fileName, t.Name, err)
+			} else {
+				log.Printf("Restore of %s on target %s completed", fileName, t.Name)
+			}
+		}(i, t)
+	}
+	return func() []targetResult {
+		wg.Wait()
+		return results
+	}
+}
+
+// restoreOnTarget copies the backup for the target, restores it into Temp on
+// the target instance, runs the update against the target database unless the
+// job skips it, and drops Temp again.
+func (p *Pipeline) restoreOnTarget(j *job, t restoreTarget, bakFile string, vars map[string]string) error {
+	user, pass := t.User, t.Password
+	if user == "" {
+		user, pass = p.DBUser, p.DBPass
+	}
+	dbName := t.DBName
+	if dbName == "" {
+		dbName = j.DBName
+	}
+	dir := t.BakDir
+	if dir == "" {
+		dir = filepath.Dir(bakFile)
+	}
+	bakCopy := filepath.Join(dir, t.Name+"_"+filepath.Base(bakFile))
+	if err := copyLocalFile(bakFile, bakCopy); err != nil {
+		return fmt.Errorf("failed to copy backup for target %s: %v", t.Name, err)
+	}
+	defer os.Remove(bakCopy)
+	defer grantPermissions(bakCopy, t.Host)()
+
+	if err := checkBackupCompatibility(t.Host, user, pass, bakCopy); err != nil {
+		return err
+	}
+	if err := classifyRestoreError(restore.Backup(t.Host, user, pass, bakCopy)); err != nil {
+		return err
+	}
+	if err := anonymizeRestore(t.Host, user, pass); err != nil {
+		return err
+	}
+	if err := applyDatabaseFlags(t.Host, user, pass, j, filepath.Base(bakFile)); err != nil {
+		return err
+	}
+	if j.runsStage(stageUpdate) {
+		if _, err := p.update().Run(t.Host, user, pass, dbName, vars); err != nil {
+			return err
+		}
+	}
+	if err := restore.Drop(t.Host, user, pass); err != nil {
+		log.Printf("Warning: failed to drop database on target %s: %v", t.Name, err)
+	}
+	return nil
+}
+
+// applyTargetResults records each target's status in its tracking column and
+// notifies about failures. It returns the first failure of a required target.
+func applyTargetResults(results []targetResult, fileName string, loc *time.Location, extras map[string]interface{}) error {
+	var requiredErr error
+	for _, r := range results {
+		status := "ok " + r.At.In(loc).Format(env.Or("SPREADSHEET_TIME_FORMAT", defaultSpreadsheetTimeFormat))
+		if r.Err != nil {
+			status = "failed: " + r.Err.Error()
+			notifyMsg(levelError, "target-restore-failed", msgData{"File": fileName, "Target": r.Target.Name, "Err": r.Err})
+			if r.Target.Required && requiredErr == nil {
+				requiredErr = fmt.Errorf("restore on required target %s failed: %v", r.Target.Name, r.Err)
+			}
+		}
+		if r.Target.StatusColumn != "" {
+			extras[r.Target.StatusColumn] = status
+		}
+	}
+	return requiredErr
+}
+
+// copyLocalFile copies src to dst, creating dst's directory.
+func copyLocalFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
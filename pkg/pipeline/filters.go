@@ -0,0 +1,71 @@
+package pipeline
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"time"
+
+	"backup-otomatis/pkg/source"
+)
+
+// envMegabytes reads a size in MB from name as a byte count, 0 when unset.
+func envMegabytes(name string) (int64, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0, nil
+	}
+	mb, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %v", name, v, err)
+	}
+	return int64(mb * 1024 * 1024), nil
+}
+
+// applyFileFilters keeps the files within FILE_MIN_SIZE_MB..FILE_MAX_SIZE_MB
+// whose name matches FILE_NAME_REGEX and that were created within
+// FILE_CREATED_AFTER..FILE_CREATED_BEFORE. Drive queries cannot express the
+// size and name filters, and the other sources support none of them, so they
+// are applied to the listing of every source.
+func applyFileFilters(files []*source.File) ([]*source.File, error) {
+	minSize, err := envMegabytes("FILE_MIN_SIZE_MB")
+	if err != nil {
+		return nil, err
+	}
+	maxSize, err := envMegabytes("FILE_MAX_SIZE_MB")
+	if err != nil {
+		return nil, err
+	}
+	var nameRe *regexp.Regexp
+	if v := os.Getenv("FILE_NAME_REGEX"); v != "" {
+		if nameRe, err = regexp.Compile(v); err != nil {
+			return nil, fmt.Errorf("invalid FILE_NAME_REGEX: %v", err)
+		}
+	}
+	after, before, err := source.CreatedWindow()
+	if err != nil {
+		return nil, err
+	}
+	if minSize == 0 && maxSize == 0 && nameRe == nil && after.IsZero() && before.IsZero() {
+		return files, nil
+	}
+	var kept []*source.File
+	for _, f := range files {
+		created, cErr := time.Parse(time.RFC3339, f.CreatedTime)
+		switch {
+		case minSize > 0 && f.Size < minSize, maxSize > 0 && f.Size > maxSize:
+			log.Printf("Skipping %s: size %s outside the configured range", f.Name, formatBytes(f.Size))
+		case nameRe != nil && !nameRe.MatchString(f.Name):
+			log.Printf("Skipping %s: name does not match FILE_NAME_REGEX", f.Name)
+		case (!after.IsZero() || !before.IsZero()) && cErr != nil:
+			log.Printf("Skipping %s: creation time %q unknown, FILE_CREATED_AFTER/BEFORE cannot be checked", f.Name, f.CreatedTime)
+		case !after.IsZero() && created.Before(after), !before.IsZero() && !created.Before(before):
+			log.Printf("Skipping %s: created %s, outside FILE_CREATED_AFTER/BEFORE", f.Name, f.CreatedTime)
+		default:
+			kept = append(kept, f)
+		}
+	}
+	return kept, nil
+}
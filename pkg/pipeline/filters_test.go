@@ -0,0 +1,32 @@
+package pipeline
+
+import (
+	"reflect"
+	"testing"
+
+	"backup-otomatis/pkg/source"
+)
+
+func TestApplyFileFiltersCreatedWindow(t *testing.T) {
+	t.Setenv("SPREADSHEET_TIMEZONE", "UTC")
+	t.Setenv("FILE_CREATED_AFTER", "2025-03-01")
+	t.Setenv("FILE_CREATED_BEFORE", "2025-03-02")
+	files := []*source.File{
+		{ID: "azblob:early", Name: "a.7z", CreatedTime: "2025-02-28T23:59:59Z"},
+		{ID: "azblob:first", Name: "b.7z", CreatedTime: "2025-03-01T00:00:00Z"},
+		{ID: "url:inside", Name: "c.7z", CreatedTime: "2025-03-01T12:00:00Z"},
+		{ID: "url:unknown", Name: "d.7z"},
+		{ID: "imap:late", Name: "e.7z", CreatedTime: "2025-03-02T00:00:00Z"},
+	}
+	kept, err := applyFileFilters(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, f := range kept {
+		ids = append(ids, f.ID)
+	}
+	if want := []string{"azblob:first", "url:inside"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("kept %v, want %v", ids, want)
+	}
+}
@@ -0,0 +1,192 @@
+package pipeline
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"backup-otomatis/internal/env"
+	"backup-otomatis/pkg/source"
+	"backup-otomatis/pkg/track"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/sheets/v4"
+)
+
+// Default layout of the Google Form response sheet. Column A holds the form's
+// submission timestamp.
+const (
+	defaultFormSheet         = "Form Responses 1"
+	defaultFormFileColumn    = "B"
+	defaultFormKabColumn     = "C"
+	defaultFormHandledColumn = "D"
+)
+
+// workRequest asks for one Drive file, or all backups of one kab, to be processed
+// outside the regular queue.
+type workRequest struct {
+	FileID string `json:"fileId"`
+	Kab    string `json:"kab"`
+}
+
+// formRequest is one unhandled submission from the form response sheet.
+type formRequest struct {
+	workRequest
+	Row int // 1-based sheet row
+}
+
+// driveIDPattern matches the file ID in the common Drive link formats
+// (".../file/d/<id>/..." and "...?id=<id>").
+var driveIDPattern = regexp.MustCompile(`(?:/d/|[?&]id=)([A-Za-z0-9_-]{10,})`)
+
+// bareDriveIDPattern matches a Drive file ID given on its own.
+var bareDriveIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{10,}$`)
+
+// driveFileIDFromText extracts a Drive file ID from a link or a bare ID.
+func driveFileIDFromText(s string) string {
+	s = strings.TrimSpace(s)
+	if m := driveIDPattern.FindStringSubmatch(s); m != nil {
+		return m[1]
+	}
+	if bareDriveIDPattern.MatchString(s) {
+		return s
+	}
+	return ""
+}
+
+// readFormRequests returns the submissions whose handled column is still empty.
+// The first row is treated as the header.
+func readFormRequests(srv *sheets.Service, spreadsheetID, sheet, fileCol, kabCol, handledCol string) ([]formRequest, error) {
+	fi, ki, hi := track.ColumnIndex(fileCol), track.ColumnIndex(kabCol), track.ColumnIndex(handledCol)
+	if fi < 0 || ki < 0 || hi < 0 {
+		return nil, fmt.Errorf("invalid form column configuration")
+	}
+	resp, err := srv.Spreadsheets.Values.Get(spreadsheetID, track.SheetRange(sheet, "A:ZZ")).Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read form responses: %v", err)
+	}
+	cell := func(row []interface{}, i int) string {
+		if i >= len(row) {
+			return ""
+		}
+		v, _ := row[i].(string)
+		return strings.TrimSpace(v)
+	}
+	var reqs []formRequest
+	for i, row := range resp.Values {
+		if i == 0 || cell(row, hi) != "" {
+			continue
+		}
+		r := formRequest{Row: i + 1, workRequest: workRequest{FileID: driveFileIDFromText(cell(row, fi)), Kab: cell(row, ki)}}
+		if r.FileID == "" && r.Kab == "" {
+			continue
+		}
+		reqs = append(reqs, r)
+	}
+	return reqs, nil
+}
+
+// markFormRequestHandled writes the outcome into the handled column of the row.
+func markFormRequestHandled(srv *sheets.Service, spreadsheetID, sheet, handledCol string, row int, result string) error {
+	a1 := track.SheetRange(sheet, fmt.Sprintf("%s%d", strings.ToUpper(handledCol), row))
+	vr := &sheets.ValueRange{Range: a1, Values: [][]interface{}{{result}}}
+	_, err := srv.Spreadsheets.Values.Update(spreadsheetID, a1, vr).ValueInputOption("USER_ENTERED").Do()
+	if err != nil {
+		return fmt.Errorf("failed to update form response row %d: %v", row, err)
+	}
+	return nil
+}
+
+// resolveWorkRequest returns the Drive files a request refers to and the job they
+// belong to. A file ID wins over a kab; a kab selects every backup in its folder
+// under KAB_PARENT_FOLDER_ID.
+func (p *Pipeline) resolveWorkRequest(srv *drive.Service, r workRequest) ([]*source.File, *job, error) {
+	template := os.Getenv("DB_NAME_TEMPLATE")
+	if r.FileID != "" {
+		df, err := srv.Files.Get(r.FileID).Fields(source.FileFields).Do()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get file %s: %v", r.FileID, err)
+		}
+		f := p.driveSource(srv, "").File(df)
+		j := defaultJob(p.DBName)
+		if template != "" {
+			if kab, err := f.Kab(); err == nil && kab != "" {
+				j = kabJob(kab, "", p.DBName, template)
+			}
+		}
+		return []*source.File{f}, j, nil
+	}
+	parentID := os.Getenv("KAB_PARENT_FOLDER_ID")
+	if parentID == "" {
+		return nil, nil, fmt.Errorf("kab %s given without a file and KAB_PARENT_FOLDER_ID is not set", r.Kab)
+	}
+	folders, err := listKabFolders(srv, parentID)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, folder := range folders {
+		if strings.EqualFold(strings.TrimSpace(folder.Name), r.Kab) {
+			j := kabJob(folder.Name, folder.Id, p.DBName, template)
+			files, err := p.driveSource(srv, j.FolderID).List(j.NamePattern)
+			if err != nil {
+				return nil, j, err
+			}
+			files, err = applyFileFilters(files)
+			return files, j, err
+		}
+	}
+	return nil, nil, fmt.Errorf("no folder found for kab %s", r.Kab)
+}
+
+// processFormRequests handles the emergency re-uploads submitted through the
+// Google Form before the regular queue, marking each response row with its outcome.
+// It does nothing unless FORM_RESPONSES_SPREADSHEET_ID is set.
+func (p *Pipeline) processFormRequests(srv *drive.Service, sheetsSrv *sheets.Service) {
+	spreadsheetID := os.Getenv("FORM_RESPONSES_SPREADSHEET_ID")
+	if spreadsheetID == "" {
+		return
+	}
+	sheet := env.Or("FORM_RESPONSES_SHEET", defaultFormSheet)
+	handledCol := env.Or("FORM_HANDLED_COLUMN", defaultFormHandledColumn)
+	reqs, err := readFormRequests(sheetsSrv, spreadsheetID, sheet,
+		env.Or("FORM_FILE_COLUMN", defaultFormFileColumn), env.Or("FORM_KAB_COLUMN", defaultFormKabColumn), handledCol)
+	if err != nil {
+		log.Printf("Warning: %v", err)
+		return
+	}
+	log.Printf("Found %d unhandled form request(s)", len(reqs))
+	for _, r := range reqs {
+		log.Printf("Handling form request in row %d (file=%q, kab=%q)", r.Row, r.FileID, r.Kab)
+		result := "done"
+		if err := p.handleWorkRequest(srv, sheetsSrv, r.workRequest); err != nil {
+			result = "failed: " + err.Error()
+		}
+		result = fmt.Sprintf("%s %s", time.Now().Format("1/2/2006 15:04:05"), result)
+		if mErr := markFormRequestHandled(sheetsSrv, spreadsheetID, sheet, handledCol, r.Row, result); mErr != nil {
+			log.Printf("Warning: %v", mErr)
+		}
+	}
+}
+
+// handleWorkRequest processes every file a request refers to and returns the
+// last error encountered.
+func (p *Pipeline) handleWorkRequest(srv *drive.Service, sheetsSrv *sheets.Service, r workRequest) error {
+	files, j, err := p.resolveWorkRequest(srv, r)
+	if err != nil {
+		return err
+	}
+	if len(files) == 0 {
+		return fmt.Errorf("no backup files found")
+	}
+	source.SetQuotaUser(j.quotaUser())
+	setNotifyJob(j)
+	p.enqueueFiles(files)
+	for _, f := range files {
+		if _, perr := p.handleFile(srv, sheetsSrv, f, j); perr != nil {
+			err = perr
+		}
+	}
+	return err
+}
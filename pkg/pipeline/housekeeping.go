@@ -0,0 +1,217 @@
+package pipeline
+
+import (
+	"io/fs"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"backup-otomatis/internal/env"
+)
+
+// Housekeeping runs at startup and, in listen mode, once per housekeepingInterval.
+const (
+	housekeepingInterval = 24 * time.Hour
+	// Temporary directories not used by a checkpoint are orphaned after this long.
+	defaultTempMaxAge = 24 * time.Hour
+	// Checkpoints of interrupted files are abandoned after this long.
+	checkpointRetention = 7 * 24 * time.Hour
+	defaultLogMaxAge    = 30 * 24 * time.Hour
+	defaultCacheMaxAge  = 7 * 24 * time.Hour
+)
+
+// housekeepingResult counts what one housekeeping pass removed.
+type housekeepingResult struct {
+	Files int
+	Bytes int64
+}
+
+func (r *housekeepingResult) add(files int, bytes int64) {
+	r.Files += files
+	r.Bytes += bytes
+}
+
+// maybeHousekeep runs housekeeping when the previous pass is older than
+// housekeepingInterval.
+func (p *Pipeline) maybeHousekeep() {
+	if time.Since(p.state.lastHousekeeping()) < housekeepingInterval {
+		return
+	}
+	p.housekeep()
+}
+
+// housekeep frees disk space and trims the state file. It removes, each
+// failure being logged and skipped:
+//   - rotated logs in HOUSEKEEPING_LOG_DIR older than HOUSEKEEPING_LOG_MAX_AGE,
+//   - temporary directories left behind by crashed runs,
+//   - download cache entries unused for HOUSEKEEPING_CACHE_MAX_AGE,
+//   - local REPLICATE_DESTINATION copies older than REPLICATE_RETENTION,
+//   - expired state records and abandoned checkpoints.
+//
+// The reclaimed space is logged and added to the housekeeping_* metrics.
+func (p *Pipeline) housekeep() {
+	now := time.Now()
+	var res housekeepingResult
+	if dir := os.Getenv("HOUSEKEEPING_LOG_DIR"); dir != "" {
+		res.add(removeOldFiles(dir, now.Add(-env.Duration("HOUSEKEEPING_LOG_MAX_AGE", defaultLogMaxAge)), isLogFile))
+	}
+	res.add(p.removeOrphanedTempDirs(now.Add(-env.Duration("HOUSEKEEPING_TEMP_MAX_AGE", defaultTempMaxAge))))
+	if cache := configuredDownloadCache(); cache != nil {
+		res.add(removeOldFiles(cache.dir, now.Add(-env.Duration("HOUSEKEEPING_CACHE_MAX_AGE", defaultCacheMaxAge)), nil))
+	}
+	if dir := localReplicaDir(); dir != "" {
+		if keep := env.Duration("REPLICATE_RETENTION", 0); keep > 0 {
+			res.add(removeOldFiles(dir, now.Add(-keep), func(name string) bool { return strings.HasSuffix(name, ".bak") }))
+		}
+	}
+	records := p.state.prune(now)
+
+	metricHousekeepingRuns.Add(1)
+	metricHousekeepingFiles.Add(int64(res.Files))
+	metricHousekeepingBytes.Add(res.Bytes)
+	log.Printf("Housekeeping removed %d file(s) and directories, reclaiming %s, and %d expired state record(s)",
+		res.Files, formatBytes(res.Bytes), records)
+	if err := p.state.setLastHousekeeping(now); err != nil {
+		log.Printf("Warning: failed to save state: %v", err)
+	}
+}
+
+// isLogFile matches current and rotated log files, e.g. run.log or run.log.3.
+func isLogFile(name string) bool {
+	return strings.HasSuffix(name, ".log") || strings.Contains(name, ".log.")
+}
+
+// removeOldFiles deletes the regular files under dir last modified before
+// cutoff and, when match is non-nil, whose name it accepts.
+func removeOldFiles(dir string, cutoff time.Time, match func(string) bool) (int, int64) {
+	var files int
+	var bytes int64
+	filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("Warning: housekeeping cannot read %s: %v", p, err)
+			}
+			return nil
+		}
+		if d.IsDir() || (match != nil && !match(d.Name())) {
+			return nil
+		}
+		fi, err := d.Info()
+		if err != nil || !fi.Mode().IsRegular() || !fi.ModTime().Before(cutoff) {
+			return nil
+		}
+		if err := os.Remove(p); err != nil {
+			log.Printf("Warning: housekeeping failed to remove %s: %v", p, err)
+			return nil
+		}
+		files++
+		bytes += fi.Size()
+		return nil
+	})
+	return files, bytes
+}
+
+// removeOrphanedTempDirs deletes the working directories created by
+// createTempDir before cutoff that no live checkpoint refers to.
+func (p *Pipeline) removeOrphanedTempDirs(cutoff time.Time) (int, int64) {
+	inUse := p.state.checkpointDirs()
+	matches, _ := filepath.Glob(filepath.Join(os.TempDir(), "backup-*"))
+	var dirs int
+	var bytes int64
+	for _, dir := range matches {
+		fi, err := os.Stat(dir)
+		if err != nil || !fi.IsDir() || !fi.ModTime().Before(cutoff) || inUse[filepath.Clean(dir)] {
+			continue
+		}
+		size := dirSize(dir)
+		if err := os.RemoveAll(dir); err != nil {
+			log.Printf("Warning: housekeeping failed to remove %s: %v", dir, err)
+			continue
+		}
+		log.Printf("Removed orphaned temporary directory %s (%s)", dir, formatBytes(size))
+		dirs++
+		bytes += size
+	}
+	return dirs, bytes
+}
+
+// dirSize returns the total size of the regular files under dir.
+func dirSize(dir string) int64 {
+	var n int64
+	filepath.WalkDir(dir, func(_ string, d fs.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			if fi, err := d.Info(); err == nil {
+				n += fi.Size()
+			}
+		}
+		return nil
+	})
+	return n
+}
+
+// localReplicaDir returns REPLICATE_DESTINATION when it is a local or UNC
+// directory; bucket copies expire through the bucket's lifecycle rules.
+func localReplicaDir() string {
+	dest := os.Getenv("REPLICATE_DESTINATION")
+	if u, err := url.Parse(dest); err == nil && (u.Scheme == "gs" || u.Scheme == "s3") {
+		return ""
+	}
+	return dest
+}
+
+// checkpointDirs returns the working directories of the current checkpoints.
+func (s *stateStore) checkpointDirs() map[string]bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dirs := make(map[string]bool, len(s.data.Checkpoints))
+	for _, c := range s.data.Checkpoints {
+		dirs[filepath.Clean(c.Dir)] = true
+	}
+	return dirs
+}
+
+// prune drops expired records that are otherwise only trimmed when new ones
+// are written, plus checkpoints older than checkpointRetention together with
+// their directories. It returns the number of records removed.
+func (s *stateStore) prune(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	kept := s.data.Phases[:0]
+	for _, r := range s.data.Phases {
+		if now.Sub(r.At) <= phaseHistoryRetention {
+			kept = append(kept, r)
+		}
+	}
+	n += len(s.data.Phases) - len(kept)
+	s.data.Phases = kept
+	for id, o := range s.data.SeenSizes {
+		if now.Sub(o.At) > seenSizeRetention {
+			delete(s.data.SeenSizes, id)
+			n++
+		}
+	}
+	for k, at := range s.data.Validated {
+		if now.Sub(at) > validatedRetention {
+			delete(s.data.Validated, k)
+			n++
+		}
+	}
+	for id, c := range s.data.Checkpoints {
+		if now.Sub(c.At) > checkpointRetention {
+			os.RemoveAll(c.Dir)
+			delete(s.data.Checkpoints, id)
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	if err := s.save(); err != nil {
+		log.Printf("Warning: failed to save state: %v", err)
+	}
+	return n
+}
@@ -0,0 +1,181 @@
+package pipeline
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// Dashboard roles. Viewers see status and history; operators may also change
+// what gets processed.
+const (
+	roleViewer   = "viewer"
+	roleOperator = "operator"
+)
+
+// httpAuth protects the embedded HTTP server. Requests must come from an
+// allowed address and, when a token or basic auth credentials are configured,
+// present one of them. Client certificates are enforced by the TLS layer.
+type httpAuth struct {
+	allowed     []*net.IPNet
+	token       string
+	viewerToken string
+	basicUser   string
+	basicPass   string
+}
+
+// httpIdentity is who made a request and with which role.
+type httpIdentity struct {
+	User string
+	Role string
+}
+
+type identityKey struct{}
+
+// requestIdentity returns the identity attached to the request by httpAuth.
+func requestIdentity(r *http.Request) httpIdentity {
+	if id, ok := r.Context().Value(identityKey{}).(httpIdentity); ok {
+		return id
+	}
+	return httpIdentity{User: "anonymous", Role: roleViewer}
+}
+
+// loadHTTPAuth reads HTTP_ALLOW_IPS (comma-separated IPs or CIDRs),
+// HTTP_AUTH_TOKEN, HTTP_VIEWER_TOKEN, HTTP_BASIC_USER and HTTP_BASIC_PASSWORD.
+func loadHTTPAuth() (*httpAuth, error) {
+	a := &httpAuth{
+		token:       os.Getenv("HTTP_AUTH_TOKEN"),
+		viewerToken: os.Getenv("HTTP_VIEWER_TOKEN"),
+		basicUser:   os.Getenv("HTTP_BASIC_USER"),
+		basicPass:   os.Getenv("HTTP_BASIC_PASSWORD"),
+	}
+	for _, s := range strings.Split(os.Getenv("HTTP_ALLOW_IPS"), ",") {
+		if s = strings.TrimSpace(s); s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+				s += "/32"
+			} else {
+				s += "/128"
+			}
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid HTTP_ALLOW_IPS entry %q: %v", s, err)
+		}
+		a.allowed = append(a.allowed, n)
+	}
+	return a, nil
+}
+
+// allowedAddr reports whether the remote address is in the allowlist. An
+// empty allowlist allows every address.
+func (a *httpAuth) allowedAddr(remoteAddr string) bool {
+	if len(a.allowed) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, n := range a.allowed {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// authenticate returns the identity of the request's credentials. The
+// operator token and basic auth grant the operator role, HTTP_VIEWER_TOKEN the
+// viewer role. Without any configured credentials every request is an
+// anonymous viewer, so operator actions stay disabled.
+func (a *httpAuth) authenticate(r *http.Request) (httpIdentity, bool) {
+	if a.token == "" && a.viewerToken == "" && a.basicUser == "" {
+		return httpIdentity{User: "anonymous", Role: roleViewer}, true
+	}
+	if t, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		if a.token != "" && secureEqual(t, a.token) {
+			return httpIdentity{User: "token", Role: roleOperator}, true
+		}
+		if a.viewerToken != "" && secureEqual(t, a.viewerToken) {
+			return httpIdentity{User: "viewer-token", Role: roleViewer}, true
+		}
+	}
+	if a.basicUser != "" {
+		if u, p, ok := r.BasicAuth(); ok && secureEqual(u, a.basicUser) && secureEqual(p, a.basicPass) {
+			return httpIdentity{User: u, Role: roleOperator}, true
+		}
+	}
+	return httpIdentity{}, false
+}
+
+// secureEqual compares secrets in constant time.
+func secureEqual(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+// wrap returns handler guarded by the allowlist and credentials.
+func (a *httpAuth) wrap(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.allowedAddr(r.RemoteAddr) {
+			log.Printf("HTTP request from %s rejected by allowlist", r.RemoteAddr)
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		id, ok := a.authenticate(r)
+		if !ok {
+			if a.basicUser != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="backup-otomatis"`)
+			}
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), identityKey{}, id)))
+	})
+}
+
+// operatorOnly rejects requests that are not POSTs from an operator.
+func operatorOnly(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if requestIdentity(r).Role != roleOperator {
+			http.Error(w, "operator role required", http.StatusForbidden)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// serverTLSConfig returns the TLS settings requiring client certificates signed
+// by HTTP_CLIENT_CA, or nil when mTLS is not configured.
+func serverTLSConfig() (*tls.Config, error) {
+	caFile := os.Getenv("HTTP_CLIENT_CA")
+	if caFile == "" {
+		return nil, nil
+	}
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read HTTP_CLIENT_CA: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return &tls.Config{ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert, MinVersion: tls.VersionTLS12}, nil
+}
@@ -0,0 +1,88 @@
+package pipeline
+
+import (
+	"log"
+	"os"
+	"strings"
+
+	"backup-otomatis/pkg/source"
+	"google.golang.org/api/sheets/v4"
+)
+
+// ignoreList holds file IDs and kab names that are never processed, e.g. test
+// uploads or a kab handled manually. Entries are compared case-insensitively.
+type ignoreList map[string]bool
+
+// loadIgnoreList combines IGNORE_LIST (comma-separated file IDs, Drive links or
+// kab names) with the first column of IGNORE_SHEET_RANGE on the tracking sheet,
+// e.g. "'Ignore'!A:A", so supervisors can maintain the list without access to
+// the server. A sheet that cannot be read is logged and skipped.
+func loadIgnoreList(srv *sheets.Service, spreadsheetID string) ignoreList {
+	l := ignoreList{}
+	for _, e := range strings.Split(os.Getenv("IGNORE_LIST"), ",") {
+		l.add(e)
+	}
+	if rng := os.Getenv("IGNORE_SHEET_RANGE"); rng != "" {
+		resp, err := srv.Spreadsheets.Values.Get(spreadsheetID, rng).Do()
+		if err != nil {
+			log.Printf("Warning: failed to read ignore list %s: %v", rng, err)
+		} else {
+			for _, row := range resp.Values {
+				if len(row) > 0 {
+					if s, ok := row[0].(string); ok {
+						l.add(s)
+					}
+				}
+			}
+		}
+	}
+	return l
+}
+
+// add records an entry; Drive links are reduced to their file ID.
+func (l ignoreList) add(entry string) {
+	entry = strings.TrimSpace(entry)
+	if entry == "" {
+		return
+	}
+	if id := driveFileIDFromText(entry); id != "" && strings.Contains(entry, "/") {
+		entry = id
+	}
+	l[strings.ToLower(entry)] = true
+}
+
+// has reports whether the file ID or kab name is ignored.
+func (l ignoreList) has(s string) bool {
+	return s != "" && l[strings.ToLower(strings.TrimSpace(s))]
+}
+
+// skipIgnored removes the files whose ID or kab (parent folder name) is on the
+// ignore list. Kab names are only looked up when the list is not empty.
+func skipIgnored(files []*source.File, l ignoreList) []*source.File {
+	if len(l) == 0 {
+		return files
+	}
+	parentNames := map[string]string{}
+	var kept []*source.File
+	for _, f := range files {
+		if l.has(f.ID) {
+			log.Printf("Skipping %s (ID: %s): file is on the ignore list", f.Name, f.ID)
+			continue
+		}
+		var kab string
+		if len(f.Parents) > 0 {
+			name, ok := parentNames[f.Parents[0]]
+			if !ok {
+				name, _ = f.Kab()
+				parentNames[f.Parents[0]] = name
+			}
+			kab = name
+		}
+		if l.has(kab) {
+			log.Printf("Skipping %s (ID: %s): kab %s is on the ignore list", f.Name, f.ID, kab)
+			continue
+		}
+		kept = append(kept, f)
+	}
+	return kept
+}
@@ -0,0 +1,109 @@
+package pipeline
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"backup-otomatis/pkg/archive"
+	"backup-otomatis/pkg/source"
+)
+
+// Columns of RESTORE HEADERONLY and RESTORE FILELISTONLY shown by inspect.
+var (
+	inspectHeaderColumns = []string{"DatabaseName", "ServerName", "BackupStartDate", "BackupFinishDate",
+		"SoftwareVersionMajor", "SoftwareVersionMinor", "SoftwareVersionBuild", "Collation",
+		"RecoveryModel", "Compressed", "BackupSize", "CompressedBackupSize"}
+	inspectFileColumns = []string{"LogicalName", "Type", "FileGroupName", "Size", "PhysicalName"}
+)
+
+// inspectCommand implements `backup-otomatis inspect --id=<fileID>`: it
+// downloads and extracts one upload and prints the archive listing and the
+// backup header without restoring anything.
+func (p *Pipeline) inspectCommand(args []string) error {
+	fs := flag.NewFlagSet("inspect", flag.ContinueOnError)
+	id := fs.String("id", "", "Drive file ID or link to inspect")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	fileID := driveFileIDFromText(*id)
+	if fileID == "" {
+		return fmt.Errorf("--id is required")
+	}
+	srv, _, err := p.commandServices()
+	if err != nil {
+		return err
+	}
+	f, err := srv.Files.Get(fileID).Fields(source.FileFields).Do()
+	if err != nil {
+		return fmt.Errorf("failed to get file %s: %v", fileID, err)
+	}
+	file := p.driveSource(srv, "").File(f)
+	tempDir, err := createTempDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+	return p.inspectFile(file, tempDir, os.Stdout)
+}
+
+// inspectFile writes the inspection report of file to w.
+func (p *Pipeline) inspectFile(file *source.File, tempDir string, w io.Writer) error {
+	fmt.Fprintf(w, "File:     %s (%s)\n", file.Name, file.ID)
+	fmt.Fprintf(w, "Size:     %s\n", formatBytes(file.Size))
+	fmt.Fprintf(w, "Created:  %s\n", file.CreatedTime)
+
+	downloaded := filepath.Join(tempDir, file.Name)
+	cache := configuredDownloadCache()
+	if cache == nil || !cache.fetch(file, downloaded) {
+		if err := file.Download(downloaded); err != nil {
+			return fmt.Errorf("failed to download file: %v", err)
+		}
+	}
+	if err := configureExtractors(); err != nil {
+		return err
+	}
+	plain, err := decryptArchive(downloaded)
+	if err != nil {
+		return err
+	}
+	ex := archive.For(plain)
+	listing, err := ex.List(plain, p.SevenZPassword)
+	if err != nil {
+		return fmt.Errorf("failed to list archive: %v", err)
+	}
+	fmt.Fprintf(w, "\nArchive contents:\n%s\n", listing)
+
+	extractDir := filepath.Join(tempDir, "extracted")
+	if err := ex.Extract(plain, extractDir, p.SevenZPassword); err != nil {
+		return fmt.Errorf("failed to extract archive: %v", err)
+	}
+	bakFile, err := findBakFile(extractDir)
+	if err != nil {
+		return fmt.Errorf("failed to find .bak file: %v", err)
+	}
+	defer grantPermissions(bakFile, p.DBHost)()
+	for _, section := range []struct {
+		kind string
+		cols []string
+	}{{"HEADERONLY", inspectHeaderColumns}, {"FILELISTONLY", inspectFileColumns}} {
+		rows, err := backupInfo(p.DBHost, p.DBUser, p.DBPass, section.kind, bakFile)
+		if err != nil {
+			log.Printf("Warning: %v", err)
+			continue
+		}
+		fmt.Fprintf(w, "\n%s of %s:\n", section.kind, filepath.Base(bakFile))
+		for i, row := range rows {
+			fmt.Fprintf(w, "[%d]\n", i+1)
+			for _, c := range section.cols {
+				if v, ok := row[c]; ok {
+					fmt.Fprintf(w, "  %-22s %s\n", c+":", v)
+				}
+			}
+		}
+	}
+	return nil
+}
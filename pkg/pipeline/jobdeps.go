@@ -0,0 +1,116 @@
+package pipeline
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// Dependency conditions: the job waited for ran today without any failure, or
+// ran today whatever its outcome.
+const (
+	dependsSucceeded = "succeeded"
+	dependsCompleted = "completed"
+)
+
+// jobDependency makes a job wait until another job has finished for the day,
+// e.g. a provincial consolidation restore that needs every kab restored first.
+type jobDependency struct {
+	// Job names the job waited for; a pattern such as "kab-*" waits for every
+	// job of the run it matches.
+	Job string `json:"job"`
+	// Condition is "succeeded" (default) or "completed".
+	Condition string `json:"condition"`
+}
+
+func (d jobDependency) condition() string {
+	if strings.EqualFold(d.Condition, dependsCompleted) {
+		return dependsCompleted
+	}
+	return dependsSucceeded
+}
+
+// orderJobsByDependencies resolves the dependency patterns against the jobs
+// of the run and moves every job after the jobs it depends on, keeping the
+// order otherwise. A name matching no job of the run is kept as is, for jobs
+// run by another process. Cycles are an error.
+func orderJobsByDependencies(jobs []*job) ([]*job, error) {
+	byName := make(map[string]*job, len(jobs))
+	for _, j := range jobs {
+		byName[j.Name] = j
+	}
+	for _, j := range jobs {
+		j.waitFor = nil
+		for _, d := range j.DependsOn {
+			matched := false
+			for _, other := range jobs {
+				if other != j {
+					if ok, _ := path.Match(d.Job, other.Name); ok {
+						j.waitFor = append(j.waitFor, jobDependency{Job: other.Name, Condition: d.condition()})
+						matched = true
+					}
+				}
+			}
+			if !matched {
+				j.waitFor = append(j.waitFor, jobDependency{Job: d.Job, Condition: d.condition()})
+			}
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+	mark := make(map[*job]int, len(jobs))
+	ordered := make([]*job, 0, len(jobs))
+	var visit func(j *job, chain []string) error
+	visit = func(j *job, chain []string) error {
+		switch mark[j] {
+		case done:
+			return nil
+		case visiting:
+			return fmt.Errorf("job dependencies form a cycle: %s", strings.Join(append(chain, j.Name), " -> "))
+		}
+		mark[j] = visiting
+		for _, d := range j.waitFor {
+			if dep, ok := byName[d.Job]; ok {
+				if err := visit(dep, append(chain, j.Name)); err != nil {
+					return err
+				}
+			}
+		}
+		mark[j] = done
+		ordered = append(ordered, j)
+		return nil
+	}
+	for _, j := range jobs {
+		if err := visit(j, nil); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// dependenciesMet reports whether every job j waits for has finished today
+// according to runs, in the job's timezone, as its condition requires, and
+// otherwise what it is waiting for.
+func (j *job) dependenciesMet(runs map[string]jobRun, now time.Time) (bool, string) {
+	loc := j.location()
+	today := now.In(loc).Format("2006-01-02")
+	var waiting []string
+	for _, d := range j.waitFor {
+		r, ok := runs[d.Job]
+		switch {
+		case !ok || r.At.In(loc).Format("2006-01-02") != today:
+			waiting = append(waiting, d.Job+" (not run today)")
+		case d.condition() == dependsSucceeded && !r.Succeeded:
+			waiting = append(waiting, d.Job+" (failed today)")
+		}
+	}
+	if len(waiting) > 0 {
+		return false, "waiting for " + strings.Join(waiting, ", ")
+	}
+	return true, ""
+}
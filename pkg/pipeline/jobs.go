@@ -0,0 +1,454 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"backup-otomatis/internal/env"
+	"backup-otomatis/pkg/source"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/sheets/v4"
+)
+
+// job is one logical unit of work: the backup files of one Drive location that
+// are restored and tracked together.
+type job struct {
+	// Name identifies the job in logs; for discovered jobs it is the kab folder name.
+	Name string `json:"name"`
+	// FolderID restricts listing to one Drive folder. Empty searches all of Drive.
+	FolderID string `json:"folderId"`
+	// NamePattern is the substring backup file names must contain.
+	NamePattern string `json:"namePattern"`
+	// DBName is the database the update query runs against.
+	DBName string `json:"dbName"`
+	// SpreadsheetID is the tracking sheet; empty uses SPREADSHEET_ID.
+	SpreadsheetID string `json:"spreadsheetId"`
+	// DeletePolicy and GracePeriod override DELETE_GRACE_POLICY and
+	// DELETE_GRACE_PERIOD for this job's source.
+	DeletePolicy string `json:"deletePolicy"`
+	GracePeriod  string `json:"gracePeriod"`
+	// DownloadBudget and RestoreBudget override PHASE_BUDGET_DOWNLOAD and
+	// PHASE_BUDGET_RESTORE for this job, e.g. "45m" for a kab on a slow link.
+	DownloadBudget string `json:"downloadBudget"`
+	RestoreBudget  string `json:"restoreBudget"`
+	// ProcessedAction overrides PROCESSED_ACTION: delete, mark or move.
+	ProcessedAction string `json:"processedAction"`
+	// Timezone overrides SPREADSHEET_TIMEZONE for the job's timestamps.
+	Timezone string `json:"timezone"`
+	// QuotaUser tags the job's Google API requests; empty uses the job name.
+	QuotaUser string `json:"quotaUser"`
+	// DiscordWebhook and TeamsWebhook override DISCORD_WEBHOOK_URL and
+	// TEAMS_WEBHOOK_URL for notifications raised while the job runs.
+	DiscordWebhook string `json:"discordWebhook"`
+	TeamsWebhook   string `json:"teamsWebhook"`
+	// Route lists file properties (appProperties or properties) a file must
+	// carry to belong to this job; empty uses ROUTE_PROPERTIES.
+	Route map[string]string `json:"route"`
+	// Targets are further SQL Server instances the job's backups are restored
+	// onto in parallel, e.g. a reporting and a DR server.
+	Targets []restoreTarget `json:"targets"`
+	// Stages lists the pipeline stages the job runs (restore, update, archive,
+	// replicate); empty runs the stages implied by the configuration.
+	Stages []string `json:"stages"`
+	// Mirrors are fallback locations of the job's files (gs://, s3://, http(s)
+	// URLs or paths, with {kab}, {name} and {id} placeholders) tried when the
+	// Drive download fails or is corrupt; empty uses MIRROR_SOURCES.
+	Mirrors []string `json:"mirrors"`
+	// Schedule limits the job to certain days and hours; nil runs it always.
+	Schedule *jobSchedule `json:"schedule"`
+	// Type is empty for regular restore jobs or "validate" for validate-only jobs.
+	Type string `json:"type"`
+	// ValidationQueries are run against validate-only restores; empty uses
+	// VALIDATION_QUERIES_FILE.
+	ValidationQueries []string `json:"validationQueries"`
+	// DatabaseFlags are set on Temp after every restore (TRUSTWORTHY,
+	// DB_CHAINING, OWNER=<login>); empty uses POST_RESTORE_FLAGS.
+	DatabaseFlags []string `json:"databaseFlags"`
+	// AgentJob names a SQL Agent job started after every restore; empty uses
+	// AGENT_JOB_NAME.
+	AgentJob string `json:"agentJob"`
+	// Azure reads the job's backups from an Azure Blob container instead of
+	// Drive; FolderID is then ignored.
+	Azure *source.Azure `json:"azure"`
+	// GCS reads the job's backups from a Cloud Storage bucket instead of Drive.
+	GCS *source.GCS `json:"gcs"`
+	// URLList reads the job's backups from a manifest of download links.
+	URLList *source.URLList `json:"urlList"`
+	// IMAP reads the job's backups from mail attachments.
+	IMAP *source.IMAP `json:"imap"`
+	// DependsOn lists the jobs that must have finished for the day before this
+	// one runs.
+	DependsOn []jobDependency `json:"dependsOn"`
+
+	// waitFor is DependsOn resolved against the jobs of the run.
+	waitFor []jobDependency
+}
+
+// deletePolicy returns the deletion grace policy for the job's files.
+func (j *job) deletePolicy() string {
+	p := strings.ToLower(j.DeletePolicy)
+	if p == "" {
+		p = strings.ToLower(env.Or("DELETE_GRACE_POLICY", gracePolicyAge))
+	}
+	switch p {
+	case gracePolicyAge, gracePolicyModified, gracePolicyComplete:
+		return p
+	}
+	log.Printf("warning: unknown delete grace policy %q, using %s", p, gracePolicyAge)
+	return gracePolicyAge
+}
+
+// gracePeriod returns how long a file must be left alone before it may be deleted.
+func (j *job) gracePeriod() time.Duration {
+	def := env.Duration("DELETE_GRACE_PERIOD", maxAgeForDeletion)
+	if j.GracePeriod == "" {
+		return def
+	}
+	d, err := time.ParseDuration(j.GracePeriod)
+	if err != nil {
+		log.Printf("warning: invalid grace period %q for job %s, using %s", j.GracePeriod, j.Name, def)
+		return def
+	}
+	return d
+}
+
+// processedAction returns what happens to the job's files after processing.
+func (j *job) processedAction() string {
+	a := strings.ToLower(j.ProcessedAction)
+	if a == "" {
+		a = strings.ToLower(env.Or("PROCESSED_ACTION", processedActionDelete))
+	}
+	switch a {
+	case processedActionDelete, processedActionMark, processedActionMove:
+		return a
+	}
+	log.Printf("warning: unknown processed action %q, using %s", a, processedActionDelete)
+	return processedActionDelete
+}
+
+// location returns the timezone of the job's spreadsheet timestamps.
+func (j *job) location() *time.Location {
+	if j.Timezone != "" {
+		return env.LoadLocation(j.Timezone)
+	}
+	return spreadsheetLocation()
+}
+
+// spreadsheetID returns the tracking sheet of the job.
+func (j *job) spreadsheetID(cfg *Config) string {
+	if j.SpreadsheetID != "" {
+		return j.SpreadsheetID
+	}
+	return cfg.SpreadsheetID
+}
+
+// jobResult is the outcome of one job in a run.
+type jobResult struct {
+	Name      string
+	Processed int
+	Failed    int
+	// Empty counts backups without data in REQUIRED_DATA_TABLES.
+	Empty int
+	// Held counts files waiting for the canary of a new update version.
+	Held int
+	// RowsAffected is the total row count reported by the update queries.
+	RowsAffected int64
+	Err          error // set when the job could not run at all
+	// Skipped is set when the job did not run because of its schedule or
+	// dependencies.
+	Skipped bool
+	Files   []fileResult
+}
+
+// fileResult is the outcome of one file, as reported by --output=json.
+type fileResult struct {
+	FileID       string             `json:"fileId"`
+	Name         string             `json:"name"`
+	Status       string             `json:"status"` // "processed", "empty", "failed" or "held"
+	Seconds      float64            `json:"seconds"`
+	Phases       map[string]float64 `json:"phases,omitempty"`
+	RowsAffected int64              `json:"rowsAffected"`
+	Error        string             `json:"error,omitempty"`
+	Ref          string             `json:"ref"`
+	SafetyBackup string             `json:"safetyBackup,omitempty"`
+}
+
+// configuredJobs returns the jobs of this run: those listed in JOBS_FILE, one per
+// discovered kab folder when AUTO_DISCOVER_KABS is true, or the single default job.
+func (p *Pipeline) configuredJobs(srv *drive.Service) ([]*job, error) {
+	if path := os.Getenv("JOBS_FILE"); path != "" {
+		return loadJobsFile(path, p.DBName)
+	}
+	if strings.EqualFold(os.Getenv("AUTO_DISCOVER_KABS"), "true") {
+		jobs, err := discoverJobs(srv, os.Getenv("KAB_PARENT_FOLDER_ID"), p.DBName, os.Getenv("DB_NAME_TEMPLATE"))
+		if err != nil {
+			return nil, fmt.Errorf("unable to discover kab folders: %v", err)
+		}
+		log.Printf("Discovered %d kab folder(s)", len(jobs))
+		return jobs, nil
+	}
+	return []*job{defaultJob(p.DBName)}, nil
+}
+
+// loadJobsFile reads a JSON array of jobs. Missing name patterns and database
+// names default to dbName.
+func loadJobsFile(path, dbName string) ([]*job, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read jobs file: %v", err)
+	}
+	var jobs []*job
+	if err := json.Unmarshal(b, &jobs); err != nil {
+		return nil, fmt.Errorf("failed to parse jobs file %s: %v", path, err)
+	}
+	for i, j := range jobs {
+		if j.Name == "" {
+			j.Name = fmt.Sprintf("job%d", i+1)
+		}
+		if j.NamePattern == "" {
+			j.NamePattern = dbName
+		}
+		if j.DBName == "" {
+			j.DBName = dbName
+		}
+		j.checkStages()
+	}
+	log.Printf("Loaded %d job(s) from %s", len(jobs), path)
+	return jobs, nil
+}
+
+// runJob lists and processes the files of one job. Any failure, including a
+// panic, is contained in the returned result so the remaining jobs still run.
+func (p *Pipeline) runJob(srv *drive.Service, sheetsSrv *sheets.Service, j *job, urgent map[string]bool) (res jobResult) {
+	res.Name = j.Name
+	source.SetQuotaUser(j.quotaUser())
+	setNotifyJob(j)
+	if ok, window := digestWindow(); ok && window == 0 {
+		// Run mode: the job's digest goes to its own channels.
+		defer flushDigest(true)
+	}
+	defer func() {
+		if res.Skipped {
+			return
+		}
+		if err := p.state.recordJobRun(j.Name, time.Now(), res.Err == nil && res.Failed == 0); err != nil {
+			log.Printf("Warning: failed to save state: %v", err)
+		}
+	}()
+	defer func() {
+		if r := recover(); r != nil {
+			res.Err = fmt.Errorf("panic: %v", r)
+			log.Printf("Job %s aborted: %v", j.Name, res.Err)
+		}
+	}()
+
+	if ok, reason := j.scheduled(time.Now()); !ok {
+		log.Printf("Skipping job %s: %s", j.Name, reason)
+		res.Skipped = true
+		return res
+	}
+	if ok, reason := j.dependenciesMet(p.state.jobRuns(), time.Now()); !ok {
+		log.Printf("Skipping job %s: %s", j.Name, reason)
+		res.Skipped = true
+		return res
+	}
+
+	if err := p.ensureJobSpreadsheet(srv, sheetsSrv, j); err != nil {
+		res.Err = err
+		log.Printf("Skipping job %s: %v", j.Name, res.Err)
+		return res
+	}
+
+	// Fail the job early when its tracking sheet is unreachable instead of
+	// deleting files whose processing could not be recorded.
+	if _, err := sheetsSrv.Spreadsheets.Get(j.spreadsheetID(p.Config)).Fields("spreadsheetId").Do(); err != nil {
+		res.Err = fmt.Errorf("spreadsheet %s unreachable: %v", j.spreadsheetID(p.Config), err)
+		log.Printf("Skipping job %s: %v", j.Name, res.Err)
+		return res
+	}
+
+	ignored := loadIgnoreList(sheetsSrv, j.spreadsheetID(p.Config))
+	if j.FolderID != "" && ignored.has(j.Name) {
+		log.Printf("Skipping job %s: kab is on the ignore list", j.Name)
+		return res
+	}
+
+	// Get files from folder
+	files, err := p.listJobFiles(srv, j)
+	if err != nil {
+		res.Err = fmt.Errorf("unable to get files: %v", err)
+		log.Printf("Skipping job %s: %v", j.Name, res.Err)
+		return res
+	}
+	log.Printf("Found %d files to process", len(files))
+	p.prefetchFileMetadata(srv, files)
+	files = p.readyUploads(srv, files)
+	files = skipIgnored(files, ignored)
+	files = routeFiles(files, j)
+	if j.validateOnly() {
+		files = p.skipValidated(files)
+	}
+
+	// Files of a discovered job all belong to the same kab, so only the
+	// all-Drive job needs per-file prioritization.
+	if j.FolderID == "" {
+		files = prioritizeFiles(files, urgent)
+	}
+
+	files = p.canaryFirst(files)
+
+	p.enqueueFiles(files)
+
+	// Process each file
+	for i, file := range files {
+		if shutdownRequested() {
+			log.Printf("Shutting down, %d file(s) of job %s left for the next run", len(files)-i, j.Name)
+			for _, f := range files[i:] {
+				if err := p.state.dequeue(f.ID); err != nil {
+					log.Printf("Warning: failed to save state: %v", err)
+				}
+			}
+			break
+		}
+		log.Printf("Processing file %d/%d: %s (ID: %s)", i+1, len(files), file.Name, file.ID)
+		if held, reason := p.heldForCanary(file); held {
+			log.Printf("Holding %s: %s", file.Name, reason)
+			if err := p.state.dequeue(file.ID); err != nil {
+				log.Printf("Warning: failed to save state: %v", err)
+			}
+			res.Held++
+			res.Files = append(res.Files, fileResult{FileID: file.ID, Name: file.Name, Status: "held"})
+			continue
+		}
+		start := time.Now()
+		out, err := p.handleFile(srv, sheetsSrv, file, j)
+		fr := fileResult{FileID: file.ID, Name: file.Name, Status: "processed", Seconds: time.Since(start).Seconds(), Ref: out.CorrelationID, SafetyBackup: out.SafetyBackup}
+		switch {
+		case err != nil:
+			res.Failed++
+			fr.Status, fr.Error = "failed", err.Error()
+		case out.Empty:
+			res.Empty++
+			fr.Status = "empty"
+		default:
+			res.Processed++
+		}
+		for _, n := range out.RowsAffected {
+			res.RowsAffected += n
+			fr.RowsAffected += n
+		}
+		if len(out.Phases) > 0 {
+			fr.Phases = make(map[string]float64, len(out.Phases))
+			for phase, d := range out.Phases {
+				fr.Phases[phase] = d.Seconds()
+			}
+		}
+		res.Files = append(res.Files, fr)
+	}
+	return res
+}
+
+// formatRunSummary renders the results of a run for summary notifications in
+// the configured locale.
+func formatRunSummary(results []jobResult) string {
+	var processed, failed int
+	rows := make([]msgData, 0, len(results))
+	for _, r := range results {
+		processed += r.Processed
+		failed += r.Failed
+		row := msgData{"Name": r.Name, "Processed": r.Processed, "Failed": r.Failed, "Empty": r.Empty, "Held": r.Held, "Rows": r.RowsAffected, "Err": ""}
+		if r.Err != nil {
+			row["Err"] = r.Err.Error()
+		}
+		var backups []string
+		for _, f := range r.Files {
+			if f.SafetyBackup != "" {
+				backups = append(backups, f.SafetyBackup)
+			}
+		}
+		row["SafetyBackups"] = backups
+		rows = append(rows, row)
+	}
+	return localize("run-summary", msgData{"Processed": processed, "Failed": failed, "Jobs": rows, "Canary": canarySummary()})
+}
+
+// exitCodeLevel returns the notification level matching a run's exit code.
+func exitCodeLevel(code int) string {
+	switch code {
+	case 0:
+		return levelInfo
+	case 1:
+		return levelWarning
+	}
+	return levelError
+}
+
+// summarizeJobs logs one line per job and returns the process exit code:
+// 0 when everything succeeded, 1 when some files failed and 2 when at least
+// one job could not run.
+func summarizeJobs(results []jobResult) int {
+	code := 0
+	for _, r := range results {
+		switch {
+		case r.Skipped:
+			log.Printf("Job %s: skipped", r.Name)
+		case r.Err != nil:
+			log.Printf("Job %s: FAILED (%v), %d processed, %d failed", r.Name, r.Err, r.Processed, r.Failed)
+			code = 2
+		case r.Failed > 0:
+			log.Printf("Job %s: %d processed, %d failed, %d empty, %d row(s) updated", r.Name, r.Processed, r.Failed, r.Empty, r.RowsAffected)
+			if code == 0 {
+				code = 1
+			}
+		default:
+			log.Printf("Job %s: %d processed, %d empty, %d row(s) updated", r.Name, r.Processed, r.Empty, r.RowsAffected)
+		}
+	}
+	return code
+}
+
+// defaultJob is the single job used when auto-discovery is disabled: files named
+// after dbName anywhere in Drive, updated into dbName.
+func defaultJob(dbName string) *job {
+	return &job{Name: dbName, NamePattern: dbName, DBName: dbName}
+}
+
+// discoverJobs creates one job per sub-folder (kab) of parentID. Target database
+// names are derived from template, where {kab} is replaced by the folder name and
+// {dbname} by dbName; an empty template keeps dbName for every job.
+func discoverJobs(srv *drive.Service, parentID, dbName, template string) ([]*job, error) {
+	if parentID == "" {
+		return nil, fmt.Errorf("KAB_PARENT_FOLDER_ID is not set")
+	}
+	folders, err := listKabFolders(srv, parentID)
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]*job, 0, len(folders))
+	for _, f := range folders {
+		jobs = append(jobs, kabJob(f.Name, f.Id, dbName, template))
+	}
+	return jobs, nil
+}
+
+// kabJob builds the job for one kab folder, deriving its database name from template.
+func kabJob(kab, folderID, dbName, template string) *job {
+	if template == "" {
+		template = "{dbname}"
+	}
+	target := strings.NewReplacer("{kab}", kab, "{dbname}", dbName).Replace(template)
+	return &job{Name: kab, FolderID: folderID, NamePattern: dbName, DBName: target}
+}
+
+// prioritizeJobs moves jobs whose name is flagged urgent to the front, keeping
+// the original order within each group.
+func prioritizeJobs(jobs []*job, urgent map[string]bool) {
+	sort.SliceStable(jobs, func(a, b int) bool {
+		return urgent[jobs[a].Name] && !urgent[jobs[b].Name]
+	})
+}
@@ -0,0 +1,102 @@
+package pipeline
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"backup-otomatis/pkg/track"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/sheets/v4"
+)
+
+// listKabFolders returns the sub-folders (one per kab) of the given Drive folder.
+func listKabFolders(srv *drive.Service, parentID string) ([]*drive.File, error) {
+	q := fmt.Sprintf("trashed = false and '%s' in parents and mimeType = 'application/vnd.google-apps.folder'", parentID)
+	var folders []*drive.File
+	pageToken := ""
+	for {
+		req := srv.Files.List().Q(q).PageSize(1000).Fields("nextPageToken, files(id, name)").OrderBy("name")
+		if pageToken != "" {
+			req = req.PageToken(pageToken)
+		}
+		resp, err := req.Do()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list kab folders: %v", err)
+		}
+		folders = append(folders, resp.Files...)
+		if resp.NextPageToken == "" {
+			break
+		}
+		pageToken = resp.NextPageToken
+	}
+	return folders, nil
+}
+
+// expectedKabs returns the kab names that should appear in the tracking sheet.
+//
+// EXPECTED_KABS (comma-separated) takes precedence. Otherwise the names of the
+// sub-folders of KAB_PARENT_FOLDER_ID are used.
+func expectedKabs(srv *drive.Service) ([]string, error) {
+	if v := os.Getenv("EXPECTED_KABS"); v != "" {
+		var kabs []string
+		for _, k := range strings.Split(v, ",") {
+			if k = strings.TrimSpace(k); k != "" {
+				kabs = append(kabs, k)
+			}
+		}
+		return kabs, nil
+	}
+	parentID := os.Getenv("KAB_PARENT_FOLDER_ID")
+	if parentID == "" {
+		return nil, fmt.Errorf("neither EXPECTED_KABS nor KAB_PARENT_FOLDER_ID is set")
+	}
+	folders, err := listKabFolders(srv, parentID)
+	if err != nil {
+		return nil, err
+	}
+	kabs := make([]string, 0, len(folders))
+	for _, f := range folders {
+		kabs = append(kabs, f.Name)
+	}
+	return kabs, nil
+}
+
+// ensureSpreadsheetRows appends, in sorted order, a row for every kab that is not
+// yet present in the kab column, so later upserts only ever update existing rows.
+// It returns the number of rows added.
+func ensureSpreadsheetRows(srv *sheets.Service, spreadsheetID string, kabs []string) (int, error) {
+	t, err := track.ReadTable(srv, spreadsheetID)
+	if err != nil {
+		return 0, err
+	}
+	present := map[string]bool{}
+	for k := range t.KabRows() {
+		present[k] = true
+	}
+	var missing []string
+	for _, k := range kabs {
+		k = strings.TrimSpace(k)
+		if !present[k] {
+			missing = append(missing, k)
+			present[k] = true
+		}
+	}
+	if len(missing) == 0 {
+		return 0, nil
+	}
+	sort.Strings(missing)
+	values := make([][]interface{}, 0, len(missing))
+	for _, k := range missing {
+		values = append(values, t.NewRow(map[int]interface{}{t.KabCol: k}))
+	}
+	vr := &sheets.ValueRange{Values: values}
+	_, err = srv.Spreadsheets.Values.Append(spreadsheetID, t.Range, vr).ValueInputOption("USER_ENTERED").InsertDataOption("INSERT_ROWS").Do()
+	if err != nil {
+		return 0, fmt.Errorf("failed to append rows to spreadsheet: %v", err)
+	}
+	log.Printf("Added %d kab row(s) to the spreadsheet: %s", len(missing), strings.Join(missing, ", "))
+	return len(missing), nil
+}
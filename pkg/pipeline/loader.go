@@ -0,0 +1,144 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// loaderMapping maps delimited files found in archives to the table they are
+// loaded into.
+type loaderMapping struct {
+	// Pattern is a glob matched against the file's base name, ignoring case,
+	// e.g. "ruta*.csv".
+	Pattern string `json:"pattern"`
+	// Table is the schema-qualified target table, which must exist.
+	Table string `json:"table"`
+	// Database defaults to the job's database.
+	Database string `json:"database"`
+	// Delimiter separates fields: "," (default), ";", "|" or "tab".
+	Delimiter string `json:"delimiter"`
+	// CodePage is passed to BULK INSERT: "65001" (UTF-8, default), "ACP", "OEM",
+	// "RAW" or a code page number such as "1252".
+	CodePage string `json:"codePage"`
+	// FirstRow is the first data row (default 2, skipping the header).
+	FirstRow int `json:"firstRow"`
+	// Truncate empties the table before the archive's first file is loaded.
+	Truncate bool `json:"truncate"`
+}
+
+// loadLoaderMappings reads LOADER_CONFIG_FILE, a JSON array of mappings.
+func loadLoaderMappings() ([]loaderMapping, error) {
+	path := os.Getenv("LOADER_CONFIG_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read loader config: %v", err)
+	}
+	var mappings []loaderMapping
+	if err := json.Unmarshal(b, &mappings); err != nil {
+		return nil, fmt.Errorf("failed to parse loader config %s: %v", path, err)
+	}
+	for _, m := range mappings {
+		if m.Pattern == "" || m.Table == "" {
+			return nil, fmt.Errorf("loader mapping needs a pattern and a table")
+		}
+		if _, err := filepath.Match(m.Pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid loader pattern %q: %v", m.Pattern, err)
+		}
+	}
+	return mappings, nil
+}
+
+// mappingFor returns the first mapping whose pattern matches name.
+func mappingFor(mappings []loaderMapping, name string) (loaderMapping, bool) {
+	base := strings.ToLower(filepath.Base(name))
+	for _, m := range mappings {
+		if ok, _ := filepath.Match(strings.ToLower(m.Pattern), base); ok {
+			return m, true
+		}
+	}
+	return loaderMapping{}, false
+}
+
+// spec returns the bulk load of the mapping; truncate is false for every file
+// after the first one loaded into the same table.
+func (m loaderMapping) spec(truncate bool) bulkLoadSpec {
+	delim := m.Delimiter
+	if strings.EqualFold(delim, "tab") {
+		delim = "\t"
+	}
+	return bulkLoadSpec{Table: m.Table, Delimiter: delim, CodePage: m.CodePage, FirstRow: m.FirstRow, Truncate: truncate}
+}
+
+// loaderFiles returns the files under dir matched by a mapping, in name order.
+func loaderFiles(dir string, mappings []loaderMapping) []string {
+	var files []string
+	filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			if _, ok := mappingFor(mappings, p); ok {
+				files = append(files, p)
+			}
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files
+}
+
+// hasLoaderFiles reports whether dir holds files for the loader.
+func hasLoaderFiles(dir string) bool {
+	mappings, err := loadLoaderMappings()
+	if err != nil {
+		log.Printf("Warning: %v", err)
+		return false
+	}
+	return len(loaderFiles(dir, mappings)) > 0
+}
+
+// runLoader loads the delimited files under extractDir into their mapped
+// tables and returns the row count of every table loaded.
+func (p *Pipeline) runLoader(j *job, extractDir string) (map[string]int64, error) {
+	mappings, err := loadLoaderMappings()
+	if err != nil || len(mappings) == 0 {
+		return nil, err
+	}
+	loaded := map[string]int64{}
+	for _, path := range loaderFiles(extractDir, mappings) {
+		m, _ := mappingFor(mappings, path)
+		db := m.Database
+		if db == "" {
+			db = j.DBName
+		}
+		_, seen := loaded[m.Table]
+		revoke := grantPermissions(path, p.DBHost)
+		n, err := bulkLoad(p.DBHost, p.DBUser, p.DBPass, db, m.spec(m.Truncate && !seen), path)
+		revoke()
+		if err != nil {
+			return loaded, fmt.Errorf("loading %s: %v", filepath.Base(path), err)
+		}
+		log.Printf("Loaded %s into %s (%d row(s) in table)", filepath.Base(path), m.Table, n)
+		loaded[m.Table] = n
+	}
+	return loaded, nil
+}
+
+// formatLoaded renders the loaded tables for the tracking sheet.
+func formatLoaded(loaded map[string]int64) string {
+	tables := make([]string, 0, len(loaded))
+	for t := range loaded {
+		tables = append(tables, t)
+	}
+	sort.Strings(tables)
+	parts := make([]string, len(tables))
+	for i, t := range tables {
+		parts[i] = fmt.Sprintf("%s=%d", t, loaded[t])
+	}
+	return "load: " + strings.Join(parts, ", ")
+}
@@ -0,0 +1,61 @@
+package pipeline
+
+import (
+	"fmt"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+
+	"backup-otomatis/internal/env"
+)
+
+// mailConfigured reports whether SMTP_HOST is set, i.e. email can be sent.
+func mailConfigured() bool {
+	return os.Getenv("SMTP_HOST") != ""
+}
+
+// splitAddresses splits a comma-separated list of email addresses.
+func splitAddresses(list string) []string {
+	var out []string
+	for _, a := range strings.Split(list, ",") {
+		if a = strings.TrimSpace(a); a != "" {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+// sendMail sends a message through SMTP_HOST:SMTP_PORT, authenticating with
+// SMTP_USER and SMTP_PASSWORD when set. contentType is "text/plain" or
+// "text/html".
+func sendMail(to []string, subject, contentType, body string) error {
+	host := os.Getenv("SMTP_HOST")
+	if host == "" {
+		return fmt.Errorf("SMTP_HOST is not set")
+	}
+	if len(to) == 0 {
+		return fmt.Errorf("no recipients")
+	}
+	from := env.Or("SMTP_FROM", os.Getenv("SMTP_USER"))
+	if from == "" {
+		return fmt.Errorf("neither SMTP_FROM nor SMTP_USER is set")
+	}
+	var auth smtp.Auth
+	if user := os.Getenv("SMTP_USER"); user != "" {
+		auth = smtp.PlainAuth("", user, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: %s; charset=UTF-8\r\n\r\n", contentType)
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	addr := host + ":" + env.Or("SMTP_PORT", "587")
+	if err := smtp.SendMail(addr, auth, from, to, []byte(msg.String())); err != nil {
+		return fmt.Errorf("failed to send email: %v", err)
+	}
+	return nil
+}
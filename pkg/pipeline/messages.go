@@ -0,0 +1,177 @@
+package pipeline
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// defaultLocale is used when NOTIFY_LOCALE is unset or names an unknown locale.
+const defaultLocale = "en"
+
+// msgData holds the values a message template refers to.
+type msgData map[string]interface{}
+
+// messageCatalog holds the built-in notification and report templates per
+// locale. Templates use text/template syntax; a template file named
+// <locale>/<key>.tmpl in a template directory replaces the built-in one.
+var messageCatalog = map[string]map[string]string{
+	"en": {
+		"dashboard-request-failed":  `Dashboard request by {{.User}} (file={{printf "%q" .FileID}}, kab={{printf "%q" .Kab}}) failed: {{.Err}}`,
+		"queue-request-failed":      `Queued request (file={{printf "%q" .FileID}}, kab={{printf "%q" .Kab}}) failed: {{.Err}}`,
+		"drive-trashed":             `Could not delete {{.File}} (not owned by us), moved it to trash instead: {{.Err}}`,
+		"drive-marked":              `Could not delete, trash or leave {{.File}}; it stays in Drive marked as processed: {{.Err}}`,
+		"drive-retire-failed":       `Could not delete, trash, leave or mark {{.File}}; it will be processed again: {{.Err}}`,
+		"drive-access-removed":      `Could not delete {{.File}} (not owned by us), removed our access to it instead: {{.Err}}`,
+		"backup-skipped":            `Skipping {{.File}}: {{.Err}}`,
+		"file-failed":               `Processing {{.File}} ({{.Kab}}) failed: {{.Err}}`,
+		"failure-escalated":         `{{with .Mention}}{{.}} {{end}}{{.Kab}} failed {{.Count}} times in a row, latest {{.File}}: {{.Err}}`,
+		"pipeline-down":             `No backup has been processed successfully since {{.Since}} ({{.Down}})`,
+		"pipeline-recovered":        `Backups are being processed successfully again`,
+		"archive-failed":            `Archiving {{.File}} failed, keeping it in Drive: {{.Err}}`,
+		"spreadsheet-created":       `Created tracking spreadsheet {{.ID}} for job {{.Job}}; add it as the job's spreadsheetId to keep it when the state file is lost`,
+		"memory-ceiling":            `Memory use {{.Memory}} exceeds the ceiling of {{.Ceiling}} ({{.Goroutines}} goroutines), action: {{.Action}}`,
+		"restore-log-prune-failed":  `Pruning the restore log failed, nothing was deleted: {{.Err}}`,
+		"empty-upload":              `{{.File}} ({{.Kab}}) is an empty upload, the update was skipped: {{.Counts}}`,
+		"loader-failed":             `Loading the data files of {{.File}} failed: {{.Err}}`,
+		"replicate-failed":          `Copying the backup of {{.File}} to secondary storage failed, keeping it in Drive: {{.Err}}`,
+		"phase-over-budget":         `{{.Phase}} of {{.File}} exceeded its {{.Budget}} budget (running {{.Elapsed}}, size {{.Size}}, rate {{.Rate}})`,
+		"validation-failed":         `Validation of {{.File}} failed: {{.Err}}`,
+		"validation-not-restorable": `Validation of {{.File}} failed: backup does not restore: {{.Err}}`,
+		"validation-queries-failed": `Validation of {{.File}}: {{.Failed}} of {{.Total}} queries failed{{.Report}}`,
+		"validation-passed":         `Validation of {{.File}} passed ({{.Total}} queries){{.Report}}`,
+		"run-summary": `Run finished: {{.Processed}} file(s) processed, {{.Failed}} failed` +
+			`{{range .Jobs}}` + "\n" + `- {{.Name}}: {{if .Err}}FAILED ({{.Err}}){{else}}{{.Processed}} processed, {{.Failed}} failed{{if .Empty}}, {{.Empty}} empty{{end}}{{if .Held}}, {{.Held}} held{{end}}, {{.Rows}} row(s) updated{{end}}` +
+			`{{range .SafetyBackups}}` + "\n" + `  safety backup: {{.}}{{end}}{{end}}` +
+			`{{with .Canary}}` + "\n" + `Canary of update version {{.Version}} on kab {{.Kab}}: {{.Status}}{{if .Held}}, {{.Held}} file(s) held{{end}}{{end}}`,
+		"perf-report": `{{if not .Regs}}Performance report: no kab restore time grew more than 50% over its 4-week median{{else}}` +
+			`Performance report: {{len .Regs}} kab(s) with restore time >50% above their 4-week median` +
+			`{{range .Regs}}` + "\n" + `- {{.Kab}}: {{.Current}} (baseline {{.Baseline}}, +{{.Growth}}%){{end}}{{end}}`,
+		"notification-digest": `{{len .Items}} notification(s) since {{.Since}}` +
+			`{{range .Items}}` + "\n" + `- {{.At}} [{{.Level}}] {{.Message}}{{end}}`,
+		"target-restore-failed": `Restore of {{.File}} on target {{.Target}} failed: {{.Err}}`,
+		"stale-kabs": `{{len .Kabs}} kab(s) have not uploaded a backup in time` +
+			`{{range .Kabs}}` + "\n" + `- {{.Kab}}: last upload {{.Since}} ({{.Days}} day(s) ago){{end}}`,
+		"credential-failed": `{{.Credential}} is not working: {{.Err}}`,
+		"canary-passed":     `Update version {{.Version}} passed the canary on kab {{.Kab}} ({{.Metrics}} metric(s) checked) and is applied to the other kabs`,
+		"canary-failed": `Update version {{.Version}} failed the canary on kab {{.Kab}}; the other kabs keep waiting` +
+			`{{range .Problems}}` + "\n" + `- {{.}}{{end}}`,
+		"credential-expiring": `{{.Credential}} expires on {{.Expires}} ({{.Days}} day(s) left): {{.Action}}`,
+		"credential-expired":  `{{.Credential}} expired on {{.Expires}}: {{.Action}}`,
+	},
+	"id": {
+		"dashboard-request-failed":  `Permintaan dasbor oleh {{.User}} (file={{printf "%q" .FileID}}, kab={{printf "%q" .Kab}}) gagal: {{.Err}}`,
+		"queue-request-failed":      `Permintaan antrean (file={{printf "%q" .FileID}}, kab={{printf "%q" .Kab}}) gagal: {{.Err}}`,
+		"drive-trashed":             `{{.File}} tidak dapat dihapus (bukan milik kita), dipindahkan ke sampah: {{.Err}}`,
+		"drive-marked":              `{{.File}} tidak dapat dihapus, dibuang atau dilepas; tetap di Drive dengan tanda sudah diproses: {{.Err}}`,
+		"drive-retire-failed":       `{{.File}} tidak dapat dihapus, dibuang, dilepas atau ditandai; file akan diproses lagi: {{.Err}}`,
+		"drive-access-removed":      `{{.File}} tidak dapat dihapus (bukan milik kita), akses kita ke file dicabut: {{.Err}}`,
+		"backup-skipped":            `{{.File}} dilewati: {{.Err}}`,
+		"file-failed":               `Pemrosesan {{.File}} ({{.Kab}}) gagal: {{.Err}}`,
+		"failure-escalated":         `{{with .Mention}}{{.}} {{end}}{{.Kab}} gagal {{.Count}} kali berturut-turut, terakhir {{.File}}: {{.Err}}`,
+		"pipeline-down":             `Tidak ada backup yang berhasil diproses sejak {{.Since}} ({{.Down}})`,
+		"pipeline-recovered":        `Backup kembali berhasil diproses`,
+		"archive-failed":            `Pengarsipan {{.File}} gagal, file tetap di Drive: {{.Err}}`,
+		"spreadsheet-created":       `Spreadsheet pelacakan {{.ID}} dibuat untuk job {{.Job}}; tambahkan sebagai spreadsheetId job agar tetap dipakai bila file state hilang`,
+		"memory-ceiling":            `Pemakaian memori {{.Memory}} melebihi batas {{.Ceiling}} ({{.Goroutines}} goroutine), tindakan: {{.Action}}`,
+		"restore-log-prune-failed":  `Pemangkasan log restore gagal, tidak ada yang dihapus: {{.Err}}`,
+		"empty-upload":              `{{.File}} ({{.Kab}}) adalah unggahan kosong, update dilewati: {{.Counts}}`,
+		"loader-failed":             `Pemuatan file data {{.File}} gagal: {{.Err}}`,
+		"replicate-failed":          `Penyalinan backup {{.File}} ke penyimpanan sekunder gagal, file tetap di Drive: {{.Err}}`,
+		"phase-over-budget":         `Tahap {{.Phase}} untuk {{.File}} melebihi batas {{.Budget}} (berjalan {{.Elapsed}}, ukuran {{.Size}}, kecepatan {{.Rate}})`,
+		"validation-failed":         `Validasi {{.File}} gagal: {{.Err}}`,
+		"validation-not-restorable": `Validasi {{.File}} gagal: backup tidak dapat di-restore: {{.Err}}`,
+		"validation-queries-failed": `Validasi {{.File}}: {{.Failed}} dari {{.Total}} kueri gagal{{.Report}}`,
+		"validation-passed":         `Validasi {{.File}} berhasil ({{.Total}} kueri){{.Report}}`,
+		"run-summary": `Proses selesai: {{.Processed}} file berhasil, {{.Failed}} gagal` +
+			`{{range .Jobs}}` + "\n" + `- {{.Name}}: {{if .Err}}GAGAL ({{.Err}}){{else}}{{.Processed}} berhasil, {{.Failed}} gagal{{if .Empty}}, {{.Empty}} kosong{{end}}{{if .Held}}, {{.Held}} ditahan{{end}}, {{.Rows}} baris diperbarui{{end}}` +
+			`{{range .SafetyBackups}}` + "\n" + `  backup pengaman: {{.}}{{end}}{{end}}` +
+			`{{with .Canary}}` + "\n" + `Canary versi update {{.Version}} di kab {{.Kab}}: {{.Status}}{{if .Held}}, {{.Held}} file ditahan{{end}}{{end}}`,
+		"perf-report": `{{if not .Regs}}Laporan kinerja: tidak ada kab dengan waktu restore naik lebih dari 50% dari median 4 minggu{{else}}` +
+			`Laporan kinerja: {{len .Regs}} kab dengan waktu restore >50% di atas median 4 minggu` +
+			`{{range .Regs}}` + "\n" + `- {{.Kab}}: {{.Current}} (acuan {{.Baseline}}, +{{.Growth}}%){{end}}{{end}}`,
+		"notification-digest": `{{len .Items}} notifikasi sejak {{.Since}}` +
+			`{{range .Items}}` + "\n" + `- {{.At}} [{{.Level}}] {{.Message}}{{end}}`,
+		"target-restore-failed": `Restore {{.File}} di target {{.Target}} gagal: {{.Err}}`,
+		"stale-kabs": `{{len .Kabs}} kab belum mengunggah backup tepat waktu` +
+			`{{range .Kabs}}` + "\n" + `- {{.Kab}}: unggahan terakhir {{.Since}} ({{.Days}} hari lalu){{end}}`,
+		"credential-failed": `{{.Credential}} tidak berfungsi: {{.Err}}`,
+		"canary-passed":     `Versi update {{.Version}} lolos canary di kab {{.Kab}} ({{.Metrics}} metrik diperiksa) dan diterapkan ke kab lain`,
+		"canary-failed": `Versi update {{.Version}} gagal canary di kab {{.Kab}}; kab lain tetap menunggu` +
+			`{{range .Problems}}` + "\n" + `- {{.}}{{end}}`,
+		"credential-expiring": `{{.Credential}} kedaluwarsa pada {{.Expires}} ({{.Days}} hari lagi): {{.Action}}`,
+		"credential-expired":  `{{.Credential}} kedaluwarsa sejak {{.Expires}}: {{.Action}}`,
+	},
+}
+
+// messageLocale returns the configured locale (NOTIFY_LOCALE, "id" or "en").
+func messageLocale() string {
+	l := strings.ToLower(strings.TrimSpace(os.Getenv("NOTIFY_LOCALE")))
+	if _, ok := messageCatalog[l]; ok {
+		return l
+	}
+	return defaultLocale
+}
+
+// templateDirs returns the directories searched for template overrides:
+// TEMPLATE_DIR, then "templates" next to the user and machine config files.
+func templateDirs() []string {
+	var dirs []string
+	if d := os.Getenv("TEMPLATE_DIR"); d != "" {
+		dirs = append(dirs, d)
+	}
+	if p := userConfigPath(); p != "" {
+		dirs = append(dirs, filepath.Join(filepath.Dir(p), "templates"))
+	}
+	return append(dirs, filepath.Join(filepath.Dir(machineConfigPath()), "templates"))
+}
+
+// messageTemplate returns the template text for key in locale, preferring an
+// override file and falling back to the built-in English text.
+func messageTemplate(locale, key string) string {
+	for _, dir := range templateDirs() {
+		if b, err := os.ReadFile(filepath.Join(dir, locale, key+".tmpl")); err == nil {
+			return strings.TrimRight(string(b), "\r\n")
+		}
+	}
+	if t, ok := messageCatalog[locale][key]; ok {
+		return t
+	}
+	return messageCatalog[defaultLocale][key]
+}
+
+// localize renders the message key with data in the configured locale. A
+// broken override is logged and the built-in template used instead.
+func localize(key string, data msgData) string {
+	locale := messageLocale()
+	text := messageTemplate(locale, key)
+	out, err := renderMessage(key, text, data)
+	if err != nil {
+		log.Printf("Warning: message template %s/%s: %v", locale, key, err)
+		if out, err = renderMessage(key, messageCatalog[defaultLocale][key], data); err != nil {
+			return fmt.Sprintf("%s %v", key, data)
+		}
+	}
+	return out
+}
+
+func renderMessage(key, text string, data msgData) (string, error) {
+	t, err := template.New(key).Parse(text)
+	if err != nil {
+		return "", err
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
+
+// notifyMsg sends the localized message key as a notification.
+func notifyMsg(level, key string, data msgData) {
+	notify(level, "%s", localize(key, data))
+}
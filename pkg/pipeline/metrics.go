@@ -0,0 +1,12 @@
+package pipeline
+
+import (
+	"expvar"
+)
+
+// Process metrics, published through the standard expvar registry.
+var (
+	metricHousekeepingRuns  = expvar.NewInt("housekeeping_runs")
+	metricHousekeepingFiles = expvar.NewInt("housekeeping_removed_files")
+	metricHousekeepingBytes = expvar.NewInt("housekeeping_reclaimed_bytes")
+)
@@ -0,0 +1,132 @@
+package pipeline
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+
+	"backup-otomatis/pkg/source"
+)
+
+// mirrorAppProperty is the Drive appProperty in which the uploader can record
+// where it pushed its own copy of the file; it is tried before the job's mirrors.
+const mirrorAppProperty = "mirror"
+
+// mirrors returns the fallback sources of the job, or MIRROR_SOURCES
+// (comma-separated) when the job declares none.
+func (j *job) mirrors() []string {
+	if len(j.Mirrors) > 0 {
+		return j.Mirrors
+	}
+	var out []string
+	for _, m := range strings.Split(os.Getenv("MIRROR_SOURCES"), ",") {
+		if m = strings.TrimSpace(m); m != "" {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+// mirrorLocations returns the mirror locations of file, with {kab}, {name}
+// and {id} in the job's templates replaced.
+func mirrorLocations(file *source.File, j *job) []string {
+	var locs []string
+	if m := file.Properties[mirrorAppProperty]; m != "" {
+		locs = append(locs, m)
+	}
+	templates := j.mirrors()
+	if len(templates) == 0 {
+		return locs
+	}
+	kab, err := file.Kab()
+	if err != nil {
+		log.Printf("Warning: failed to resolve kab for mirror lookup: %v", err)
+	}
+	r := strings.NewReplacer("{kab}", kab, "{name}", file.Name, "{id}", file.ID)
+	for _, t := range templates {
+		locs = append(locs, r.Replace(t))
+	}
+	return locs
+}
+
+// downloadWithFallback downloads file from Drive to destPath and checks it
+// against the size and md5 checksum Drive reports. When the download fails or
+// the copy is corrupt, the mirrors of the file are tried in order and their
+// copies checked the same way.
+func (p *Pipeline) downloadWithFallback(file *source.File, j *job, destPath string) error {
+	err := file.Download(destPath)
+	if err == nil {
+		err = verifyDownload(file, destPath)
+	}
+	if err == nil {
+		return nil
+	}
+	locs := mirrorLocations(file, j)
+	if len(locs) == 0 {
+		return err
+	}
+	errs := []string{"drive: " + err.Error()}
+	for _, loc := range locs {
+		log.Printf("Warning: download of %s from Drive failed (%v), trying mirror %s", file.Name, err, loc)
+		os.Remove(destPath)
+		if err = p.fetchMirror(loc, destPath); err == nil {
+			err = verifyDownload(file, destPath)
+		}
+		if err == nil {
+			log.Printf("Downloaded %s from mirror %s", file.Name, loc)
+			return nil
+		}
+		errs = append(errs, loc+": "+err.Error())
+	}
+	return fmt.Errorf("all sources failed: %s", strings.Join(errs, "; "))
+}
+
+// verifyDownload checks the downloaded copy of file at p against the size and,
+// when Drive reports one, the md5 checksum of the Drive file.
+func verifyDownload(file *source.File, p string) error {
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := md5.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return err
+	}
+	if file.Size > 0 && n != file.Size {
+		return fmt.Errorf("downloaded %d bytes, expected %d", n, file.Size)
+	}
+	if file.MD5 != "" && !strings.EqualFold(hex.EncodeToString(h.Sum(nil)), file.MD5) {
+		return fmt.Errorf("md5 checksum mismatch, the download is corrupt")
+	}
+	return nil
+}
+
+// fetchMirror copies loc, a gs:// or s3:// object, an http(s) URL or a local
+// or UNC path, to destPath.
+func (p *Pipeline) fetchMirror(loc, destPath string) error {
+	u, err := url.Parse(loc)
+	if err != nil || len(u.Scheme) <= 1 {
+		// Not a URL, or a Windows drive letter.
+		return copyLocalFile(loc, destPath)
+	}
+	switch u.Scheme {
+	case "gs":
+		return source.DownloadGCS(p.ServiceAccountFile, u.Host, strings.TrimPrefix(u.Path, "/"), destPath)
+	case "s3":
+		if b, err := exec.Command("aws", "s3", "cp", "--only-show-errors", loc, destPath).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to download %s: %v: %s", loc, err, strings.TrimSpace(string(b)))
+		}
+		return nil
+	case "http", "https":
+		return source.DownloadURL(loc, destPath)
+	}
+	return fmt.Errorf("unsupported mirror scheme %q", u.Scheme)
+}
@@ -0,0 +1,107 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Notification levels, in increasing order of severity.
+const (
+	levelInfo    = "info"
+	levelWarning = "warning"
+	levelError   = "error"
+)
+
+// notifier delivers an operator-facing message to an external channel.
+type notifier interface {
+	Notify(level, message string) error
+}
+
+// summaryNotifier is a notifier that also wants the summary sent at the end of
+// every run, not just individual events.
+type summaryNotifier interface {
+	notifier
+	NotifySummary(level, message string) error
+}
+
+// webhookNotifier posts notifications as JSON to a generic HTTP endpoint.
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (w *webhookNotifier) Notify(level, message string) error {
+	body, err := json.Marshal(map[string]string{"level": level, "text": message})
+	if err != nil {
+		return err
+	}
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned status %s", resp.Status)
+	}
+	return nil
+}
+
+// configuredNotifiers returns the notifiers enabled through environment variables.
+func configuredNotifiers() []notifier {
+	var ns []notifier
+	if u := os.Getenv("NOTIFY_WEBHOOK_URL"); u != "" {
+		ns = append(ns, &webhookNotifier{url: u, client: &http.Client{Timeout: 10 * time.Second}})
+	}
+	ns = append(ns, chatNotifiers()...)
+	if os.Getenv("WHATSAPP_API_URL") != "" {
+		if w, err := newWhatsAppNotifier(); err != nil {
+			log.Printf("Warning: WhatsApp notifications disabled: %v", err)
+		} else {
+			ns = append(ns, w)
+		}
+	}
+	if desktopNotifyEnabled() {
+		ns = append(ns, toastNotifier{})
+	}
+	return ns
+}
+
+// notify logs the message and forwards it to every configured notifier, or
+// holds it for the digest when NOTIFY_DIGEST is set and it is not an error.
+// Delivery failures are logged and never interrupt processing.
+func notify(level, format string, args ...interface{}) {
+	message := fmt.Sprintf(format, args...)
+	log.Printf("[%s] %s", level, message)
+	if ref := currentCorrelationID(); ref != "" {
+		message += " (ref " + ref + ")"
+	}
+	if queueDigest(level, message) {
+		return
+	}
+	deliver(level, message)
+}
+
+// deliver sends a message to every configured notifier.
+func deliver(level, message string) {
+	for _, n := range configuredNotifiers() {
+		if err := n.Notify(level, message); err != nil {
+			log.Printf("Warning: failed to send notification: %v", err)
+		}
+	}
+}
+
+// notifySummary sends the run summary to the notifiers that want summaries.
+func notifySummary(level, message string) {
+	for _, n := range configuredNotifiers() {
+		if sn, ok := n.(summaryNotifier); ok {
+			if err := sn.NotifySummary(level, message); err != nil {
+				log.Printf("Warning: failed to send run summary: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package pipeline
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"backup-otomatis/internal/env"
+)
+
+// Default duration budgets per processing phase. They can be overridden with
+// PHASE_BUDGET_DOWNLOAD and PHASE_BUDGET_RESTORE (Go duration syntax, e.g. "45m")
+// and per job with downloadBudget and restoreBudget.
+const (
+	defaultDownloadBudget = 20 * time.Minute
+	defaultRestoreBudget  = 30 * time.Minute
+)
+
+// Performance baselining: a kab is reported when the median restore time of the
+// last week exceeds the median of the preceding four weeks by more than 50%.
+const (
+	perfReportInterval   = 7 * 24 * time.Hour
+	perfBaselineWeeks    = 4
+	perfRegressionFactor = 1.5
+)
+
+// phaseBudget returns the budget of the named phase for the job: the job's own
+// budget, or else the configured one.
+func phaseBudget(j *job, phase string) time.Duration {
+	var def time.Duration
+	var override string
+	switch phase {
+	case "download":
+		def, override = env.Duration("PHASE_BUDGET_DOWNLOAD", defaultDownloadBudget), j.DownloadBudget
+	case "restore":
+		def, override = env.Duration("PHASE_BUDGET_RESTORE", defaultRestoreBudget), j.RestoreBudget
+	default:
+		return 0
+	}
+	if override == "" {
+		return def
+	}
+	d, err := time.ParseDuration(override)
+	if err != nil {
+		log.Printf("warning: invalid %s budget %q for job %s, using %s", phase, override, j.Name, def)
+		return def
+	}
+	return d
+}
+
+// watchPhase starts timing a phase for the given file of job j and sends a
+// warning notification once the phase runs past the job's budget. The phase itself keeps
+// running; the warning only carries context (file size and observed rate) so
+// degrading disks or throttled networks are noticed early.
+//
+// progress, when non-nil, reports the number of bytes handled so far and is
+// used to compute the rate. The returned function must be called when the
+// phase finishes and reports the elapsed time.
+func watchPhase(j *job, phase string, fileName string, size int64, progress func() int64) func() time.Duration {
+	start := time.Now()
+	budget := phaseBudget(j, phase)
+	var timer *time.Timer
+	if budget > 0 {
+		timer = time.AfterFunc(budget, func() {
+			elapsed := time.Since(start)
+			done := size
+			if progress != nil {
+				done = progress()
+			}
+			notifyMsg(levelWarning, "phase-over-budget", msgData{"Phase": phase, "File": fileName, "Budget": budget,
+				"Elapsed": elapsed.Round(time.Second), "Size": formatBytes(size), "Rate": formatRate(done, elapsed)})
+		})
+	}
+	return func() time.Duration {
+		elapsed := time.Since(start)
+		if timer != nil && !timer.Stop() {
+			log.Printf("%s of %s finished after %s (budget %s)", phase, fileName, elapsed.Round(time.Second), budget)
+		}
+		return elapsed
+	}
+}
+
+// fileSizeOnDisk returns a progress function reporting the current size of path.
+func fileSizeOnDisk(path string) func() int64 {
+	return func() int64 {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return 0
+		}
+		return fi.Size()
+	}
+}
+
+// formatBytes renders a byte count in MB with one decimal.
+func formatBytes(n int64) string {
+	return fmt.Sprintf("%.1f MB", float64(n)/(1024*1024))
+}
+
+// formatRate renders a throughput in MB/s.
+func formatRate(n int64, elapsed time.Duration) string {
+	if elapsed <= 0 {
+		return "n/a"
+	}
+	return fmt.Sprintf("%.2f MB/s", float64(n)/(1024*1024)/elapsed.Seconds())
+}
+
+// perfRegression describes a kab whose restore time grew beyond its baseline.
+type perfRegression struct {
+	Kab      string
+	Baseline time.Duration
+	Current  time.Duration
+}
+
+// findPerfRegressions compares, per kab, the median restore duration of the week
+// before now against the median of the perfBaselineWeeks weeks preceding it.
+// Kabs without data in both windows are ignored.
+func findPerfRegressions(records []phaseRecord, now time.Time) []perfRegression {
+	weekStart := now.Add(-perfReportInterval)
+	baseStart := weekStart.Add(-perfBaselineWeeks * perfReportInterval)
+	current := map[string][]float64{}
+	baseline := map[string][]float64{}
+	for _, r := range records {
+		if r.Phase != "restore" || r.Kab == "" {
+			continue
+		}
+		switch {
+		case r.At.After(weekStart) && !r.At.After(now):
+			current[r.Kab] = append(current[r.Kab], r.Seconds)
+		case r.At.After(baseStart) && !r.At.After(weekStart):
+			baseline[r.Kab] = append(baseline[r.Kab], r.Seconds)
+		}
+	}
+	var out []perfRegression
+	for kab, cur := range current {
+		base, ok := baseline[kab]
+		if !ok {
+			continue
+		}
+		c, b := median(cur), median(base)
+		if b > 0 && c > b*perfRegressionFactor {
+			out = append(out, perfRegression{
+				Kab:      kab,
+				Baseline: time.Duration(b * float64(time.Second)),
+				Current:  time.Duration(c * float64(time.Second)),
+			})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Kab < out[j].Kab })
+	return out
+}
+
+// median returns the median of vals, which must not be empty. vals is sorted in place.
+func median(vals []float64) float64 {
+	sort.Float64s(vals)
+	n := len(vals)
+	if n%2 == 1 {
+		return vals[n/2]
+	}
+	return (vals[n/2-1] + vals[n/2]) / 2
+}
+
+// formatPerfReport renders the regressions as a human-readable report in the
+// configured locale.
+func formatPerfReport(regs []perfRegression) string {
+	rows := make([]msgData, 0, len(regs))
+	for _, r := range regs {
+		rows = append(rows, msgData{
+			"Kab":      r.Kab,
+			"Current":  r.Current.Round(time.Second),
+			"Baseline": r.Baseline.Round(time.Second),
+			"Growth":   fmt.Sprintf("%.0f", (float64(r.Current)/float64(r.Baseline)-1)*100),
+		})
+	}
+	return localize("perf-report", msgData{"Regs": rows})
+}
+
+// maybeSendPerfReport produces the weekly performance report when the previous
+// one is older than perfReportInterval. Regressions are sent as a warning
+// notification; a clean report is only logged.
+func (p *Pipeline) maybeSendPerfReport() {
+	now := time.Now()
+	if now.Sub(p.state.lastPerfReport()) < perfReportInterval {
+		return
+	}
+	regs := findPerfRegressions(p.state.phaseHistory(), now)
+	if len(regs) > 0 {
+		notify(levelWarning, "%s", formatPerfReport(regs))
+	} else {
+		log.Println(formatPerfReport(regs))
+	}
+	if err := p.state.setLastPerfReport(now); err != nil {
+		log.Printf("Warning: failed to save state: %v", err)
+	}
+}
@@ -0,0 +1,958 @@
+// Package pipeline runs the backup restoration jobs: it lists the uploaded
+// backups of each job, downloads and extracts them, restores them to SQL
+// Server, runs the update step, records the result in the tracking sheet and
+// retires the upload, along with the reports, notifications and maintenance
+// commands around a run.
+package pipeline
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"backup-otomatis/internal/env"
+	"backup-otomatis/pkg/restore"
+	"backup-otomatis/pkg/source"
+	"backup-otomatis/pkg/track"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/sheets/v4"
+)
+
+// defaultSpreadsheetTimeFormat is the Go time layout of the human-readable
+// timestamp column unless SPREADSHEET_TIME_FORMAT overrides it.
+const defaultSpreadsheetTimeFormat = "1/2/2006 15:04:05"
+
+const (
+	minFileSize       = 10 * 1024
+	maxAgeForDeletion = 10 * time.Minute
+)
+
+// Pipeline is one instance of the backup processing: its settings, the state
+// it keeps between runs and where it publishes results.
+type Pipeline struct {
+	*Config
+	state *stateStore
+	// publisher is the configured result publisher, or nil when publishing
+	// is disabled.
+	publisher   resultPublisher
+	parentNames *parentNameCache
+}
+
+// New returns the pipeline processing with cfg, opening its state file.
+func New(cfg *Config) (*Pipeline, error) {
+	st, err := openState(cfg.StateFile)
+	if err != nil {
+		return nil, err
+	}
+	return &Pipeline{Config: cfg, state: st, parentNames: newParentNameCache(st)}, nil
+}
+
+// Run processes the backups once or, in daemon mode, until the process is
+// stopped, and returns the exit code of the run. An error means processing
+// could not start.
+func (p *Pipeline) Run(started time.Time) (int, error) {
+	startRun()
+	p.housekeep()
+
+	log.Printf("DB_HOST: %s", p.DBHost)
+	log.Printf("DB_USER: %s", p.DBUser)
+	log.Printf("DB_PASS: %s", strings.Repeat("*", len(p.DBPass))) // Hide password
+	log.Printf("DB_NAME: %s", p.DBName)
+	log.Printf("SEVENZ_PASSWORD: %s", strings.Repeat("*", len(p.SevenZPassword)))
+
+	log.Printf("SERVICE_ACCOUNT_FILE: %s", p.ServiceAccountFile)
+	log.Printf("SPREADSHEET_ID: %s", p.SpreadsheetID)
+	if p.ImpersonateSubject != "" {
+		log.Printf("GOOGLE_IMPERSONATE_SUBJECT: %s", p.ImpersonateSubject)
+	}
+
+	if err := p.validateConfig(); err != nil {
+		return 0, err
+	}
+	log.Println("All required environment variables are set")
+
+	// Authenticate with Google Drive and Sheets
+	log.Println("Authenticating with Google Drive and Sheets...")
+	ctx := context.Background()
+	srv, sheetsSrv, err := source.NewServices(ctx, p.ServiceAccountFile, p.ImpersonateSubject)
+	if err != nil {
+		return 0, err
+	}
+	log.Println("Google Drive and Sheets authentication successful")
+
+	p.publisher, err = p.newResultPublisher(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("Unable to set up result publishing: %v", err)
+	}
+
+	if daemonMode() {
+		return p.runDaemon(srv, sheetsSrv), nil
+	}
+	return p.runCycle(srv, sheetsSrv, started), nil
+}
+
+// runCycle processes everything pending once: the out-of-band requests, then
+// each job, followed by the summary, reports and checks of a run. It returns
+// the exit code of the run.
+func (p *Pipeline) runCycle(srv *drive.Service, sheetsSrv *sheets.Service, started time.Time) int {
+	if processingPaused() {
+		log.Println("Skipping this run because processing is paused")
+		return 0
+	}
+
+	// Out-of-band requests from the dashboard and the Google Form go before
+	// the regular queue.
+	track.Replay(sheetsSrv, p.state)
+	p.processControlRequests(srv, sheetsSrv)
+	p.processFormRequests(srv, sheetsSrv)
+
+	jobs, err := p.configuredJobs(srv)
+	if err != nil {
+		log.Printf("Unable to load jobs: %v", err)
+		return 1
+	}
+
+	// Restore kabs flagged as urgent by supervisors first.
+	var urgent map[string]bool
+	if urgentCol := os.Getenv("SPREADSHEET_URGENT_COLUMN"); urgentCol != "" {
+		urgent, err = track.ReadUrgentKabs(sheetsSrv, p.SpreadsheetID, urgentCol)
+		if err != nil {
+			log.Printf("Warning: failed to read urgent flags: %v", err)
+		}
+		prioritizeJobs(jobs, urgent)
+	}
+	// Dependencies outrank urgency.
+	if jobs, err = orderJobsByDependencies(jobs); err != nil {
+		log.Printf("Unable to load jobs: %v", err)
+		return 1
+	}
+
+	// Entries left by an interrupted run would never be dequeued.
+	if err := p.state.clearQueue(); err != nil {
+		log.Printf("Warning: failed to save state: %v", err)
+	}
+	var results []jobResult
+	for _, j := range jobs {
+		if shutdownRequested() {
+			log.Printf("Shutting down, job %s left for the next run", j.Name)
+			continue
+		}
+		results = append(results, p.runJob(srv, sheetsSrv, j, urgent))
+	}
+	// Write the tracking updates still collected by SHEET_WRITE_BATCH.
+	track.Replay(sheetsSrv, p.state)
+
+	log.Println("Backup-otomatis application completed")
+	exitCode := summarizeJobs(results)
+	// The run summary covers every job, so it goes to the global channels.
+	setNotifyJob(nil)
+	flushDigest(true)
+	notifySummary(exitCodeLevel(exitCode), formatRunSummary(results))
+	if outputFormat() == "json" {
+		if err := writeRunSummary(os.Stdout, results, started, exitCode); err != nil {
+			log.Printf("Warning: failed to write run summary: %v", err)
+		}
+	}
+
+	p.maybeSendPerfReport()
+	p.maybeSendDailyReport(sheetsSrv, p.SpreadsheetID)
+	p.checkStaleKabs(srv)
+	p.checkCredentialHealth()
+	p.maybePruneRestoreLog()
+
+	// Optionally empty the quarantine folder based on environment settings.
+	emptyQuarantineStr := os.Getenv("EMPTY_QUARANTINE")
+	if strings.EqualFold(emptyQuarantineStr, "true") {
+		// parse options
+		deleteAll := strings.EqualFold(os.Getenv("QUARANTINE_DELETE_ALL"), "true")
+		maxAgeHours := 24 * 7 // default: 7 days
+		if v := os.Getenv("QUARANTINE_MAX_AGE_HOURS"); v != "" {
+			if pv, err := strconv.Atoi(v); err == nil && pv >= 0 {
+				maxAgeHours = pv
+			}
+		}
+		if err := p.emptyQuarantine(srv, sheetsSrv, p.QuarantineFolderID, deleteAll, maxAgeHours); err != nil {
+			log.Printf("Warning: failed to empty quarantine folder %s: %v", p.QuarantineFolderID, err)
+		}
+	}
+
+	return exitCode
+}
+
+// fileOutcome carries what processing one file produced besides success or failure.
+type fileOutcome struct {
+	// RowsAffected holds the rows affected by each statement of the update query.
+	RowsAffected []int64
+	// Phases holds the duration of each processing phase that ran.
+	Phases map[string]time.Duration
+	// Empty is set when the restored backup had no rows in REQUIRED_DATA_TABLES;
+	// the update was skipped.
+	Empty bool
+	// CorrelationID identifies the file's processing in logs and reports.
+	CorrelationID string
+	// SafetyBackup is the path, on the SQL Server host, of the backup of the
+	// job's database taken before the update, if any.
+	SafetyBackup string
+}
+
+// handleFile processes one file and, on success, drops the restored database to
+// free space. It returns the processing error, which has already been logged.
+func (p *Pipeline) handleFile(srv *drive.Service, sheetsSrv *sheets.Service, file *source.File, j *job) (fileOutcome, error) {
+	var out fileOutcome
+	defer beginFile(file)()
+	out.CorrelationID = currentCorrelationID()
+	releaseLease, lErr := source.Lease(file)
+	if lErr != nil {
+		log.Printf("Skipping %s: %v", file.Name, lErr)
+		return out, lErr
+	}
+	defer releaseLease()
+	defer p.trackQueuedFile(file)()
+	if dataImportEnabled() && isDataFile(file.Name) {
+		err := p.importDataFile(srv, sheetsSrv, file, j)
+		p.publishResult(file, j, err)
+		p.recordFileOutcome(file, err)
+		if err != nil {
+			log.Printf("Error importing file %s: %v", file.Name, err)
+		}
+		return out, err
+	}
+	if j.validateOnly() {
+		err := p.validateFile(srv, file, j)
+		p.publishResult(file, j, err)
+		p.recordFileOutcome(file, err)
+		if err != nil {
+			log.Printf("Error validating file %s: %v", file.Name, err)
+		}
+		return out, err
+	}
+
+	err := explainSQLError(p.processFile(srv, sheetsSrv, file, j, &out))
+	p.publishResult(file, j, err)
+	p.recordFileOutcome(file, err)
+	p.logRestore(file, out, err)
+	p.appendSheetLog(sheetsSrv, j, file, out, err)
+	if err != nil {
+		log.Printf("Error processing file %s: %v", file.Name, err)
+		return out, err
+	}
+	log.Printf("Successfully processed file %s", file.Name)
+	if !j.runsStage(stageRestore) {
+		return out, nil
+	}
+
+	// After successful processing, drop the restored database to free space.
+	if derr := restore.Drop(p.DBHost, p.DBUser, p.DBPass); derr != nil {
+		log.Printf("Warning: failed to drop database %s after processing %s: %v", j.DBName, file.Name, derr)
+	} else {
+		log.Printf("Dropped database %s after processing %s", j.DBName, file.Name)
+	}
+	return out, nil
+}
+
+func (p *Pipeline) processFile(srv *drive.Service, sheetsSrv *sheets.Service, file *source.File, j *job, out *fileOutcome) error {
+	log.Printf("Starting processing for file: %s", file.Name)
+
+	if file.Size < minFileSize {
+		return deleteSmallFile(srv, file)
+	}
+
+	tempDir, cleanup, err := p.resumableWorkDir(file)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
+
+	phases := map[string]time.Duration{}
+	out.Phases = phases
+	bakFile, err := p.downloadAndExtract(srv, file, j, tempDir, phases)
+	// deleteSmallFile deletes a file from Google Drive if it is smaller than the minimum size.
+	//
+	// Parameters:
+	//   - srv: Google Drive service client.
+	//   - file: the file to delete.
+	//
+	// Returns:
+	//   - error: any error encountered during deletion.
+	if err != nil {
+		// If a quarantine folder is set, move the Drive file there for later inspection.
+		if p.QuarantineFolderID != "" {
+			if mErr := source.Move(file, p.QuarantineFolderID); mErr != nil {
+				log.Printf("Warning: failed to move file %s to quarantine: %v", file.Name, mErr)
+			} else {
+				log.Printf("Moved file %s to quarantine folder %s", file.Name, p.QuarantineFolderID)
+			}
+		} else {
+			if ok, reason := shouldDelete(file, j.deletePolicy(), j.gracePeriod()); ok {
+				if dErr := p.deleteFileAndUpdateSpreadsheet(srv, sheetsSrv, j.spreadsheetID(p.Config), file, j.processedAction(), j.location(), nil); dErr != nil {
+					log.Printf("Warning: failed to delete small file %s: %v", file.Name, dErr)
+				}
+			} else {
+				log.Printf("File %s %s, skipping deletion", file.Name, reason)
+			}
+		}
+		return err
+	}
+
+	bakFile, err = runStepPlugins(stagePostExtract, file, j, pluginInput{ExtractDir: filepath.Join(tempDir, "extracted"), BakFile: bakFile})
+	if err != nil {
+		return err
+	}
+
+	kab, err := file.Kab()
+	if err != nil {
+		log.Printf("Warning: failed to resolve kab for script variables: %v", err)
+	}
+
+	var restoredAt time.Time
+	var targets []targetResult
+	if j.runsStage(stageRestore) && bakFile != "" {
+		restoredAt, targets, err = p.restoreAndUpdate(sheetsSrv, file, j, kab, bakFile, phases, out)
+		if err != nil {
+			return err
+		}
+	} else if bakFile != "" {
+		log.Printf("Job %s skips the restore stage", j.Name)
+	}
+
+	loaded, err := p.runLoader(j, filepath.Join(tempDir, "extracted"))
+	if err != nil {
+		notifyMsg(levelError, "loader-failed", msgData{"File": file.Name, "Err": err})
+		return err
+	}
+
+	if j.runsStage(stageArchive) {
+		archiveStart := time.Now()
+		if err := p.archiveBackup(file, filepath.Join(tempDir, file.Name)); err != nil {
+			// Keep the file in Drive so the retention copy is not lost.
+			notifyMsg(levelError, "archive-failed", msgData{"File": file.Name, "Err": err})
+			return err
+		}
+		phases["archive"] = time.Since(archiveStart)
+	}
+
+	if j.runsStage(stageReplicate) && bakFile != "" {
+		replicateStart := time.Now()
+		if err := p.replicateBackup(file, bakFile); err != nil {
+			// Keep the file in Drive until an off-Drive copy exists.
+			notifyMsg(levelError, "replicate-failed", msgData{"File": file.Name, "Err": err})
+			return err
+		}
+		phases["replicate"] = time.Since(replicateStart)
+	}
+
+	// formatCreatedTime formats the file creation time according to the configured timezone.
+	//
+	// If SPREADSHEET_TIMEZONE is set, it uses that timezone; otherwise, uses local time.
+	// Falls back to the original string if parsing fails.
+	//
+	// Parameters:
+	//   - createdTimeStr: RFC3339 formatted creation time string.
+	//
+	// Returns:
+	//   - string: formatted time string in "1/2/2006 15:04:05" format.
+	p.logProcessing(j.DBName, kab, file.Name)
+
+	extras := map[string]interface{}{}
+	if col := os.Getenv("SPREADSHEET_NOTES_COLUMN"); col != "" {
+		var notes []string
+		if out.Empty {
+			notes = append(notes, "empty upload")
+		} else if !restoredAt.IsZero() && j.runsStage(stageUpdate) {
+			notes = append(notes, "update: "+restore.FormatRowsAffected(out.RowsAffected))
+		}
+		if len(loaded) > 0 {
+			notes = append(notes, formatLoaded(loaded))
+		}
+		notes = append(notes, "ref "+out.CorrelationID)
+		extras[col] = strings.Join(notes, "; ")
+	}
+	if col := os.Getenv("SPREADSHEET_PROCESSED_BY_COLUMN"); col != "" {
+		extras[col] = processedBy()
+	}
+	if col := os.Getenv("SPREADSHEET_RESTORED_AT_COLUMN"); col != "" && !restoredAt.IsZero() {
+		extras[col] = restoredAt.In(j.location()).Format(env.Or("SPREADSHEET_TIME_FORMAT", defaultSpreadsheetTimeFormat))
+	}
+	if col := os.Getenv("SPREADSHEET_RESTORE_DURATION_COLUMN"); col != "" && !restoredAt.IsZero() {
+		extras[col] = phases["restore"].Round(time.Second).String()
+	}
+	if err := applyTargetResults(targets, file.Name, j.location(), extras); err != nil {
+		return err
+	}
+	err = p.deleteFileAndUpdateSpreadsheet(srv, sheetsSrv, j.spreadsheetID(p.Config), file, j.processedAction(), j.location(), extras)
+	if err != nil {
+		return err
+	}
+	if cache := configuredDownloadCache(); cache != nil {
+		cache.remove(file)
+	}
+
+	if kab == "" {
+		log.Printf("Warning: kab unknown, not recording phase history")
+	} else {
+		if sErr := p.state.recordPhases(kab, file.ID, out.CorrelationID, file.Size, phases); sErr != nil {
+			log.Printf("Warning: failed to save phase durations: %v", sErr)
+		}
+		if !restoredAt.IsZero() && !out.Empty {
+			if sErr := p.state.recordRestore(kab, restoredAt); sErr != nil {
+				log.Printf("Warning: failed to save restore time: %v", sErr)
+			}
+		}
+	}
+
+	log.Printf("Processing completed for file: %s", file.Name)
+	return nil
+}
+
+// restoreAndUpdate restores bakFile into Temp on DB_HOST, prepares it and,
+// unless the job skips the update stage, runs the update query or script. Extra
+// restore targets run in parallel with the update. It returns when the restore
+// completed and the outcome of the extra targets.
+func (p *Pipeline) restoreAndUpdate(sheetsSrv *sheets.Service, file *source.File, j *job, kab, bakFile string, phases map[string]time.Duration, out *fileOutcome) (time.Time, []targetResult, error) {
+	revoke := grantPermissions(bakFile, p.DBHost)
+	defer revoke()
+
+	if err := checkBackupCompatibility(p.DBHost, p.DBUser, p.DBPass, bakFile); err != nil {
+		notifyMsg(levelError, "backup-skipped", msgData{"File": file.Name, "Err": err})
+		return time.Time{}, nil, err
+	}
+
+	restoreDone := watchPhase(j, "restore", file.Name, file.Size, nil)
+	progress := p.trackRestoreProgress(file.ID)
+	defer metricRestorePercent.Set(0)
+	err := restore.BackupWithProgress(p.DBHost, p.DBUser, p.DBPass, bakFile, progress)
+	if err = classifyRestoreError(err); isIncompatibleBackup(err) {
+		restoreDone()
+		notifyMsg(levelError, "backup-skipped", msgData{"File": file.Name, "Err": err})
+		return time.Time{}, nil, err
+	}
+	if err != nil {
+		// If restore failed because the database was in use (exclusive access could not be obtained),
+		// attempt to force-drop the database and retry once.
+		lower := strings.ToLower(err.Error())
+		if strings.Contains(lower, "exclusive access could not be obtained") || strings.Contains(lower, "msg 3101") || strings.Contains(lower, "database is in use") {
+			log.Printf("Restore failed due to database in use: %v. Attempting force drop and retry...", err)
+			if derr := restore.Drop(p.DBHost, p.DBUser, p.DBPass); derr != nil {
+				log.Printf("Warning: failed to drop database: %v", derr)
+			} else {
+				// small pause before retrying
+				time.Sleep(3 * time.Second)
+				rerr := restore.BackupWithProgress(p.DBHost, p.DBUser, p.DBPass, bakFile, progress)
+				if rerr == nil {
+					log.Printf("Restore succeeded after dropping database %s", j.DBName)
+				} else {
+					log.Printf("Retry restore failed: %v", rerr)
+					err = rerr
+				}
+			}
+		}
+
+		if err != nil {
+			restoreDone()
+			if p.QuarantineFolderID != "" {
+				// rename the file to include parent folder name instead of the name pattern
+				parentName, pErr := file.Kab()
+				if pErr == nil && parentName != "" {
+					newName := strings.Replace(file.Name, j.NamePattern, parentName, -1)
+					if rErr := source.Rename(file, newName); rErr != nil {
+						log.Printf("Warning: failed to rename file %s before quarantine: %v", file.Name, rErr)
+					} else {
+						log.Printf("Renamed file %s -> %s before moving to quarantine", file.Name, newName)
+						file.Name = newName
+					}
+				}
+				if mErr := source.Move(file, p.QuarantineFolderID); mErr != nil {
+					log.Printf("Warning: failed to move file %s to quarantine: %v", file.Name, mErr)
+				} else {
+					log.Printf("Moved file %s to quarantine folder %s", file.Name, p.QuarantineFolderID)
+				}
+			}
+			return time.Time{}, nil, err
+		}
+	}
+
+	phases["restore"] = restoreDone()
+	metricRestorePercent.Set(0)
+	restoredAt := time.Now()
+	revoke()
+
+	// A backup of a fresh install restores fine but must not overwrite real data.
+	empty, counts, err := emptyRestore(p.DBHost, p.DBUser, p.DBPass)
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+	if empty {
+		notifyMsg(levelWarning, "empty-upload", msgData{"File": file.Name, "Kab": kab, "Counts": counts})
+		out.Empty = true
+		return restoredAt, nil, nil
+	}
+
+	if err := anonymizeRestore(p.DBHost, p.DBUser, p.DBPass); err != nil {
+		return time.Time{}, nil, err
+	}
+	if err := applyDatabaseFlags(p.DBHost, p.DBUser, p.DBPass, j, file.Name); err != nil {
+		return time.Time{}, nil, err
+	}
+
+	createPreIndexes(p.DBHost, p.DBUser, p.DBPass)
+
+	vars := fileSQLVars(file, kab, j)
+
+	// QC indicators describe the upload as received, so they run before the update.
+	p.recordQCIndicators(sheetsSrv, j.spreadsheetID(p.Config), kab, vars, j.location())
+
+	if _, err := runStepPlugins(stagePostRestore, file, j, pluginInput{DBHost: p.DBHost, Database: "Temp", Vars: vars}); err != nil {
+		return time.Time{}, nil, err
+	}
+	agentStart := time.Now()
+	if err := runAgentJob(p.DBHost, p.DBUser, p.DBPass, j, file.Name); err != nil {
+		return time.Time{}, nil, err
+	}
+	if j.agentJobName() != "" {
+		phases["agent-job"] = time.Since(agentStart)
+	}
+
+	// Extra restore targets run alongside the update on DB_HOST.
+	waitTargets := p.startFanOut(j, file.Name, bakFile, vars)
+	if !j.runsStage(stageUpdate) {
+		log.Printf("Job %s skips the update stage", j.Name)
+		return restoredAt, waitTargets(), nil
+	}
+
+	if safetyBackupEnabled() {
+		snapshotStart := time.Now()
+		path, err := p.takeSafetyBackup(j.DBName, kab)
+		if err != nil {
+			waitTargets()
+			return time.Time{}, nil, err
+		}
+		phases["snapshot"] = time.Since(snapshotStart)
+		out.SafetyBackup = path
+	}
+
+	updateStart := time.Now()
+	stopMonitor := monitorUpdate(p.DBHost, p.DBUser, p.DBPass, j.DBName)
+	out.RowsAffected, err = p.update().Run(p.DBHost, p.DBUser, p.DBPass, j.DBName, vars)
+	stopMonitor()
+	targets := waitTargets()
+	if err != nil {
+		// grantPermissions grants SQL Server service permissions on the backup file and its directory.
+		//
+		// It determines the appropriate service account based on the database host and uses icacls
+		// to grant full control permissions.
+		//
+		// Parameters:
+		//   - bakFile: path to the .bak file.
+		//   - dbHost: SQL Server host, used to determine the service account.
+		return time.Time{}, nil, err
+	}
+	phases["update"] = time.Since(updateStart)
+	log.Printf("Update query affected %s", restore.FormatRowsAffected(out.RowsAffected))
+	if err := p.checkCanary(j, kab); err != nil {
+		return time.Time{}, nil, err
+	}
+	return restoredAt, targets, nil
+}
+
+func deleteSmallFile(srv *drive.Service, file *source.File) error {
+	log.Printf("File %s is smaller than 10KB (%d bytes), deleting from Drive", file.Name, file.Size)
+	err := deleteDriveFile(srv, file)
+	// deleteFileAndUpdateSpreadsheet deletes a file from Google Drive and updates the tracking spreadsheet.
+	//
+	// It retrieves the parent folder name, formats the creation time, and either updates an existing
+	// row in the spreadsheet or appends a new one.
+	//
+	// Parameters:
+	//   - srv: Google Drive service client.
+	//   - sheetsSrv: Google Sheets service client.
+	//   - spreadsheetID: ID of the Google Sheet.
+	//   - file: the file being processed.
+	//
+	// Returns:
+	//   - error: any error encountered during deletion or spreadsheet update.
+	if err != nil {
+		return fmt.Errorf("failed to delete small file: %v", err)
+	}
+	log.Println("Small file deleted from Google Drive")
+	return nil
+}
+
+func createTempDir() (string, error) {
+	tempDir, err := os.MkdirTemp("", "backup-*")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp dir: %v", err)
+	}
+	log.Printf("Temporary directory created: %s", tempDir)
+	return tempDir, nil
+}
+
+func (p *Pipeline) downloadAndExtract(srv *drive.Service, file *source.File, j *job, tempDir string, phases map[string]time.Duration) (string, error) {
+	downloadedFile := filepath.Join(tempDir, file.Name)
+	resumed, resumedBak := p.resumePoint(file, tempDir)
+	if resumed == checkpointExtracted {
+		log.Printf("Using .bak file extracted by the interrupted run: %s", resumedBak)
+		return resumedBak, nil
+	}
+	log.Printf("Downloading file to: %s", downloadedFile)
+	cache := configuredDownloadCache()
+	var err error
+	if resumed == checkpointDownloaded {
+		log.Printf("Using download of the interrupted run: %s", downloadedFile)
+	} else if cache != nil && cache.fetch(file, downloadedFile) {
+		log.Printf("Using cached download of %s", file.Name)
+	} else {
+		done := watchPhase(j, "download", file.Name, file.Size, fileSizeOnDisk(downloadedFile))
+		err = p.downloadWithFallback(file, j, downloadedFile)
+		phases["download"] = done()
+		if err == nil && cache != nil {
+			if cErr := cache.store(file, downloadedFile); cErr != nil {
+				log.Printf("Warning: %v", cErr)
+			}
+		}
+	}
+	// downloadFile downloads a file from Google Drive to the specified destination path.
+	//
+	// Parameters:
+	//   - srv: Google Drive service client.
+	//   - fileID: ID of the file to download.
+	//   - destPath: local path where the file will be saved.
+	//
+	// Returns:
+	//   - error: any error encountered during download.
+	if err != nil {
+		return "", fmt.Errorf("failed to download file: %v", err)
+	}
+	log.Println("File downloaded successfully")
+	p.markCheckpoint(file, tempDir, checkpointDownloaded, "")
+
+	extractDir := filepath.Join(tempDir, "extracted")
+	log.Printf("Extracting archive to: %s", extractDir)
+	// Drop partial output of an interrupted extraction; 7z would stop to ask
+	// before overwriting it.
+	os.RemoveAll(extractDir)
+	extractStart := time.Now()
+	err = extractArchive(downloadedFile, extractDir, p.SevenZPassword)
+	phases["extract"] = time.Since(extractStart)
+	// findBakFile searches for a .bak file within the specified directory.
+	//
+	// It recursively walks the directory and returns the path of the first .bak file found.
+	//
+	// Parameters:
+	//   - dir: directory to search in.
+	//
+	// Returns:
+	//   - string: path to the .bak file.
+	//   - error: error if no .bak file is found or if walking fails.
+	//   - password: password for the archive.
+	//
+	// Returns:
+	//   - error: any error encountered during extraction.
+	if err != nil {
+		return "", fmt.Errorf("failed to extract archive: %v", err)
+	}
+	log.Println("Archive extraction completed")
+
+	log.Println("Searching for .bak file...")
+	// restoreDB restores a SQL Server database from a .bak file.
+	//
+	// It performs a full restore with move operations, setting the database to single-user mode
+	// during the process and back to multi-user afterward. It detects logical file names and
+	// uses the instance's default data path.
+	//
+	// Parameters:
+	//   - host: SQL Server host.
+	//   - user: database username (empty for Windows auth).
+	//   - pass: database password (empty for Windows auth).
+	//   - dbName: name of the database to restore.
+	//   - bakPath: path to the .bak file.
+	//
+	// Returns:
+	//   - error: any error encountered during the restore process.
+	bakFile, err := findBakFile(extractDir)
+	if err != nil {
+		if hasLoaderFiles(extractDir) {
+			// A data-only archive: its files go to the loader, nothing is restored.
+			log.Printf("Archive has no .bak file but data files for the loader")
+			p.markCheckpoint(file, tempDir, checkpointExtracted, "")
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to find .bak file: %v", err)
+	}
+	log.Printf("Found .bak file: %s", bakFile)
+	p.markCheckpoint(file, tempDir, checkpointExtracted, bakFile)
+	return bakFile, nil
+}
+
+// grantPermissions lets the SQL Server service of dbHost read bakFile. By default
+// it gets full control of the file and, recursively, its folder. With
+// RESTORE_PERMISSIONS=least-privilege it only gets read access to the file
+// itself, which the returned function removes again; call it once SQL Server is
+// done with the file. It may be called more than once.
+func grantPermissions(bakFile, dbHost string) func() {
+	serviceAcct := "NT SERVICE\\MSSQLSERVER"
+	if strings.Contains(dbHost, "\\") {
+		parts := strings.SplitN(dbHost, "\\", 2)
+		instance := parts[1]
+		serviceAcct = "NT SERVICE\\MSSQL$" + instance
+	}
+	if leastPrivilegePermissions() {
+		return grantReadOnly(bakFile, serviceAcct)
+	}
+	log.Println("Granting permissions to SQL Server service on bak file and folder...")
+	cmd := exec.Command("icacls", bakFile, "/grant", serviceAcct+":F")
+	err := cmd.Run()
+	if err != nil {
+		log.Printf("Failed to grant permissions on bak file: %v", err)
+	}
+	extractFolder := filepath.Dir(bakFile)
+	cmd = exec.Command("icacls", extractFolder, "/grant", serviceAcct+":F", "/T")
+	err = cmd.Run()
+	if err != nil {
+		log.Printf("Failed to grant permissions on extract folder: %v", err)
+	}
+	return func() {}
+}
+
+// leastPrivilegePermissions reports whether RESTORE_PERMISSIONS selects
+// least-privilege grants.
+func leastPrivilegePermissions() bool {
+	switch strings.ToLower(os.Getenv("RESTORE_PERMISSIONS")) {
+	case "", "full":
+		return false
+	case "least-privilege":
+		return true
+	}
+	log.Printf("Warning: invalid RESTORE_PERMISSIONS %q, use full or least-privilege", os.Getenv("RESTORE_PERMISSIONS"))
+	return false
+}
+
+// grantReadOnly grants serviceAcct read access to path alone and returns the
+// function removing the grant. Folders are left alone: the service account
+// only needs to traverse them, which Windows allows by default.
+func grantReadOnly(path, serviceAcct string) func() {
+	log.Printf("Granting %s read access to %s", serviceAcct, filepath.Base(path))
+	if output, err := exec.Command("icacls", path, "/grant", serviceAcct+":(R)").CombinedOutput(); err != nil {
+		log.Printf("Failed to grant read permission on %s: %v: %s", path, err, strings.TrimSpace(string(output)))
+		return func() {}
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			if output, err := exec.Command("icacls", path, "/remove:g", serviceAcct).CombinedOutput(); err != nil {
+				log.Printf("Warning: failed to remove read permission of %s on %s: %v: %s", serviceAcct, path, err, strings.TrimSpace(string(output)))
+			}
+		})
+	}
+}
+
+// Deletion grace policies, selected with DELETE_GRACE_POLICY or per job.
+const (
+	// gracePolicyAge waits until the file was created at least the grace period ago.
+	gracePolicyAge = "age"
+	// gracePolicyModified waits until the file was last modified at least the grace period ago.
+	gracePolicyModified = "modified"
+	// gracePolicyComplete additionally requires Drive to report an md5 checksum,
+	// which is only present once the upload has completed.
+	gracePolicyComplete = "complete"
+)
+
+// shouldDelete determines if a file that failed processing may be deleted, so that
+// a file still being uploaded is never removed from under the uploader.
+//
+// It returns false and the reason when the file is still inside its grace period
+// or its upload does not look complete under policy.
+func shouldDelete(file *source.File, policy string, grace time.Duration) (bool, string) {
+	ts := file.CreatedTime
+	if policy == gracePolicyModified || policy == gracePolicyComplete {
+		ts = file.ModifiedTime
+	}
+	if policy == gracePolicyComplete && file.MD5 == "" {
+		return false, "has no checksum yet (upload incomplete)"
+	}
+	t, err := time.Parse(time.RFC3339, ts)
+	if err != nil {
+		log.Printf("Error parsing time for %s: %v, proceeding without deletion", file.Name, err)
+		return false, "has an unreadable timestamp"
+	}
+	if age := time.Since(t); age < grace {
+		return false, fmt.Sprintf("is within its %s grace period (%s policy, age %s)", grace, policy, age.Round(time.Second))
+	}
+	return true, ""
+}
+
+func formatCreatedTime(createdTimeStr string, loc *time.Location) string {
+	t, err := time.Parse(time.RFC3339, createdTimeStr)
+	if err != nil {
+		return createdTimeStr
+	}
+	return t.In(loc).Format(env.Or("SPREADSHEET_TIME_FORMAT", defaultSpreadsheetTimeFormat))
+}
+
+// isoCreatedTime renders the file creation time as ISO-8601 with offset, for
+// the machine-readable spreadsheet column.
+func isoCreatedTime(createdTimeStr string, loc *time.Location) string {
+	t, err := time.Parse(time.RFC3339, createdTimeStr)
+	if err != nil {
+		return createdTimeStr
+	}
+	return t.In(loc).Format(time.RFC3339)
+}
+
+// spreadsheetLocation returns the timezone of SPREADSHEET_TIMEZONE, or Local.
+func spreadsheetLocation() *time.Location {
+	return env.LoadLocation(os.Getenv("SPREADSHEET_TIMEZONE"))
+}
+
+func (p *Pipeline) deleteFileAndUpdateSpreadsheet(srv *drive.Service, sheetsSrv *sheets.Service, spreadsheetID string, file *source.File, action string, loc *time.Location, extras map[string]interface{}) error {
+	log.Printf("Removing file from Google Drive (%s): %s", action, file.ID)
+	err := retireDriveFile(srv, file, action)
+	if err != nil {
+		return fmt.Errorf("failed to %s Drive file: %v", action, err)
+	}
+	log.Println("File removed from Google Drive")
+
+	parentName, pErr := file.Kab()
+	log.Printf("Parent folder name: %s", parentName)
+	if pErr != nil {
+		log.Printf("Warning: failed to get parent folder name: %v", pErr)
+	} else {
+		createdStr := formatCreatedTime(file.CreatedTime, loc)
+		if col := os.Getenv("SPREADSHEET_ISO_COLUMN"); col != "" {
+			withISO := map[string]interface{}{col: isoCreatedTime(file.CreatedTime, loc)}
+			for k, v := range extras {
+				withISO[k] = v
+			}
+			extras = withISO
+		}
+		if uErr := track.WriteRow(sheetsSrv, p.state, spreadsheetID, parentName, createdStr, extras); uErr != nil {
+			log.Printf("Warning: failed to update spreadsheet: %v", uErr)
+		} else {
+			log.Printf("Spreadsheet updated for Kab=%s with Susenas=%s", parentName, createdStr)
+		}
+	}
+	return nil
+}
+
+// emptyQuarantine lists files in the specified quarantine folder and deletes them
+// according to the options. If deleteAll is true, all files are removed. Otherwise
+// files older than maxAgeHours are deleted. For each deletion, the spreadsheet is
+// updated via deleteFileAndUpdateSpreadsheet.
+func (p *Pipeline) emptyQuarantine(srv *drive.Service, sheetsSrv *sheets.Service, quarantineFolderID string, deleteAll bool, maxAgeHours int) error {
+	if quarantineFolderID == "" {
+		return fmt.Errorf("no quarantine folder configured")
+	}
+	// list files in folder
+	q := fmt.Sprintf("trashed = false and '%s' in parents and mimeType != 'application/vnd.google-apps.folder'", quarantineFolderID)
+	pageToken := ""
+	for {
+		req := srv.Files.List().Q(q).Fields("nextPageToken, files(" + source.FileFields + ")")
+		if pageToken != "" {
+			req = req.PageToken(pageToken)
+		}
+		resp, err := req.Do()
+		if err != nil {
+			return fmt.Errorf("failed to list quarantine files: %v", err)
+		}
+		for _, f := range p.driveSource(srv, quarantineFolderID).Files(resp.Files) {
+			deleteIt := deleteAll
+			if !deleteAll {
+				ct, err := time.Parse(time.RFC3339, f.CreatedTime)
+				if err != nil {
+					// unable to parse time; skip deletion of this file
+					log.Printf("Warning: unable to parse createdTime for %s: %v", f.Name, err)
+					continue
+				}
+				if time.Since(ct) >= time.Duration(maxAgeHours)*time.Hour {
+					deleteIt = true
+				}
+			}
+			if deleteIt {
+				// call deleteFileAndUpdateSpreadsheet to delete and update sheet
+				if err := p.deleteFileAndUpdateSpreadsheet(srv, sheetsSrv, os.Getenv("SPREADSHEET_ID"), f, processedActionDelete, spreadsheetLocation(), nil); err != nil {
+					log.Printf("Warning: failed to delete quarantine file %s: %v", f.Name, err)
+				} else {
+					log.Printf("Deleted quarantine file: %s", f.Name)
+				}
+			}
+		}
+		if resp.NextPageToken == "" {
+			break
+		}
+		pageToken = resp.NextPageToken
+	}
+	return nil
+}
+
+func findBakFile(dir string) (string, error) {
+	// runUpdateQuery executes a SQL query on the specified database.
+	//
+	// Parameters:
+	//   - host: SQL Server host.
+	//   - user: database username (empty for Windows auth).
+	//   - pass: database password (empty for Windows auth).
+	//   - dbName: target database name.
+	//   - query: SQL query to execute.
+	//
+	// Returns:
+	//   - error: any error encountered during query execution.
+	var candidates []bakCandidate
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == "__MACOSX" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.EqualFold(filepath.Ext(info.Name()), ".bak") || strings.HasPrefix(info.Name(), "._") {
+			return nil
+		}
+		if info.Size() == 0 {
+			log.Printf("Ignoring empty backup %s", path)
+			return nil
+		}
+		candidates = append(candidates, bakCandidate{path: path, size: info.Size(), modTime: info.ModTime()})
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(candidates) == 0 {
+		return "", fmt.Errorf("no .bak file found")
+	}
+	return chooseBakFile(dir, candidates), nil
+}
+
+// prioritizeFiles moves files whose parent folder (kab) is flagged urgent to the
+// front of the queue, keeping the original order within each group.
+func prioritizeFiles(files []*source.File, urgent map[string]bool) []*source.File {
+	if len(urgent) == 0 {
+		return files
+	}
+	isUrgent := make(map[string]bool, len(files))
+	for _, f := range files {
+		kab, err := f.Kab()
+		if err != nil {
+			log.Printf("Warning: failed to resolve kab for %s: %v", f.Name, err)
+			continue
+		}
+		if urgent[strings.TrimSpace(kab)] {
+			isUrgent[f.ID] = true
+			log.Printf("File %s belongs to urgent kab %s", f.Name, kab)
+		}
+	}
+	sort.SliceStable(files, func(i, j int) bool {
+		return isUrgent[files[i].ID] && !isUrgent[files[j].ID]
+	})
+	return files
+}
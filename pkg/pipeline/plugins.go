@@ -0,0 +1,173 @@
+package pipeline
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"backup-otomatis/pkg/source"
+)
+
+// Plugin stages. post-extract plugins run on the extracted .bak before it is
+// restored; post-restore plugins run against the restored database before the
+// update query.
+const (
+	stagePostExtract = "post-extract"
+	stagePostRestore = "post-restore"
+)
+
+// defaultPluginTimeout bounds a plugin without its own timeout.
+const defaultPluginTimeout = 30 * time.Minute
+
+// stepPlugin is an external command inserted into the processing of each file.
+// It receives a pluginInput as JSON on stdin and may answer with a pluginOutput
+// on stdout; a non-zero exit status fails the file.
+type stepPlugin struct {
+	Name    string   `json:"name"`
+	Stage   string   `json:"stage"`
+	Command []string `json:"command"`
+	Timeout string   `json:"timeout"`
+	// Jobs limits the plugin to the named jobs; empty means every job.
+	Jobs []string `json:"jobs"`
+	// Artifact is the file holding the plugin's code, checked before each run;
+	// it must be the executable or one of the command's arguments, e.g. the
+	// script run by an interpreter. Empty means the command's executable.
+	Artifact string `json:"artifact"`
+	// SHA256 pins the artifact to one version by its hex digest.
+	SHA256 string `json:"sha256"`
+	// InterpreterSHA256 pins the executable that runs an artifact given as
+	// an argument, e.g. python.exe, by its hex digest.
+	InterpreterSHA256 string `json:"interpreterSha256"`
+}
+
+// pluginInput describes the file being processed.
+type pluginInput struct {
+	Stage      string            `json:"stage"`
+	Job        string            `json:"job"`
+	FileID     string            `json:"fileId"`
+	FileName   string            `json:"fileName"`
+	ExtractDir string            `json:"extractDir,omitempty"`
+	BakFile    string            `json:"bakFile,omitempty"`
+	DBHost     string            `json:"dbHost,omitempty"`
+	Database   string            `json:"database,omitempty"`
+	Vars       map[string]string `json:"vars,omitempty"`
+}
+
+// pluginOutput is a plugin's optional answer.
+type pluginOutput struct {
+	// BakFile replaces the backup to restore (post-extract only).
+	BakFile string `json:"bakFile"`
+	// Skip stops processing of the file, leaving it in Drive.
+	Skip   bool   `json:"skip"`
+	Reason string `json:"reason"`
+}
+
+// loadStepPlugins reads the JSON array of plugins in STEP_PLUGINS_FILE.
+func loadStepPlugins() ([]stepPlugin, error) {
+	path := os.Getenv("STEP_PLUGINS_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read step plugins: %v", err)
+	}
+	var plugins []stepPlugin
+	if err := json.Unmarshal(b, &plugins); err != nil {
+		return nil, fmt.Errorf("failed to parse step plugins %s: %v", path, err)
+	}
+	for _, p := range plugins {
+		if len(p.Command) == 0 {
+			return nil, fmt.Errorf("step plugin %q has no command", p.Name)
+		}
+		if p.Stage != stagePostExtract && p.Stage != stagePostRestore {
+			return nil, fmt.Errorf("step plugin %q has unknown stage %q", p.Name, p.Stage)
+		}
+	}
+	return plugins, nil
+}
+
+// appliesTo reports whether the plugin runs for the job.
+func (p stepPlugin) appliesTo(j *job) bool {
+	if len(p.Jobs) == 0 {
+		return true
+	}
+	for _, name := range p.Jobs {
+		if strings.EqualFold(name, j.Name) {
+			return true
+		}
+	}
+	return false
+}
+
+// run executes the plugin with in on stdin and decodes its answer. Plugin
+// stderr is passed through to the log.
+func (p stepPlugin) run(in pluginInput) (pluginOutput, error) {
+	var out pluginOutput
+	timeout := defaultPluginTimeout
+	if p.Timeout != "" {
+		d, err := time.ParseDuration(p.Timeout)
+		if err != nil {
+			return out, fmt.Errorf("invalid timeout for step plugin %q: %v", p.Name, err)
+		}
+		timeout = d
+	}
+	command, cleanup, err := p.verifiedCommand()
+	if err != nil {
+		return out, err
+	}
+	defer cleanup()
+	body, err := json.Marshal(in)
+	if err != nil {
+		return out, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.Output()
+	if err != nil {
+		return out, fmt.Errorf("step plugin %q failed: %v", p.Name, err)
+	}
+	if s := bytes.TrimSpace(stdout); len(s) > 0 {
+		if err := json.Unmarshal(s, &out); err != nil {
+			return out, fmt.Errorf("step plugin %q returned invalid JSON: %v", p.Name, err)
+		}
+	}
+	return out, nil
+}
+
+// runStepPlugins runs the plugins configured for stage in order. It returns
+// the .bak file to restore, which post-extract plugins may replace.
+func runStepPlugins(stage string, file *source.File, j *job, in pluginInput) (string, error) {
+	plugins, err := loadStepPlugins()
+	if err != nil {
+		return in.BakFile, err
+	}
+	in.Stage, in.Job, in.FileID, in.FileName = stage, j.Name, file.ID, file.Name
+	for _, p := range plugins {
+		if p.Stage != stage || !p.appliesTo(j) {
+			continue
+		}
+		log.Printf("Running %s plugin %s for %s", stage, p.Name, file.Name)
+		out, err := p.run(in)
+		if err != nil {
+			return in.BakFile, err
+		}
+		if out.Skip {
+			return in.BakFile, fmt.Errorf("skipped by step plugin %q: %s", p.Name, out.Reason)
+		}
+		if out.BakFile != "" && stage == stagePostExtract {
+			log.Printf("Step plugin %s replaced the backup with %s", p.Name, out.BakFile)
+			in.BakFile = out.BakFile
+		}
+	}
+	return in.BakFile, nil
+}
@@ -0,0 +1,203 @@
+package pipeline
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"backup-otomatis/internal/env"
+	"backup-otomatis/pkg/source"
+	"google.golang.org/api/drive/v3"
+)
+
+// defaultPrefetchWorkers is how many Drive requests the prefetch phase runs
+// at once unless PREFETCH_WORKERS says otherwise. Folder names are trusted for
+// defaultParentNameTTL unless PARENT_NAME_TTL says otherwise, so a renamed
+// kab folder shows its new name within a day.
+const (
+	defaultPrefetchWorkers = 8
+	defaultParentNameTTL   = 24 * time.Hour
+)
+
+// parentNameCache caches Drive folder names by folder ID, filled by
+// resolveParentNames and the kab lookups of Drive files and persisted in the
+// state file so later runs start warm. It is the folder name cache of the
+// Drive source.
+type parentNameCache struct {
+	mu    sync.Mutex
+	once  sync.Once
+	state *stateStore
+	m     map[string]string
+}
+
+func newParentNameCache(st *stateStore) *parentNameCache {
+	return &parentNameCache{state: st, m: map[string]string{}}
+}
+
+func parentNameTTL() time.Duration {
+	return env.Duration("PARENT_NAME_TTL", defaultParentNameTTL)
+}
+
+// CachedName returns the cached name of a folder. The first call loads the
+// names from the state file that are younger than PARENT_NAME_TTL.
+func (c *parentNameCache) CachedName(folderID string) (string, bool) {
+	c.once.Do(func() {
+		names := c.state.parentNames(parentNameTTL(), time.Now())
+		c.mu.Lock()
+		for id, name := range names {
+			if _, ok := c.m[id]; !ok {
+				c.m[id] = name
+			}
+		}
+		c.mu.Unlock()
+	})
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	name, ok := c.m[folderID]
+	return name, ok
+}
+
+// CacheName remembers the name of one folder.
+func (c *parentNameCache) CacheName(folderID, name string) {
+	c.cacheNames(map[string]string{folderID: name})
+}
+
+// cacheNames remembers folder names, by folder ID, in memory and in the state
+// file.
+func (c *parentNameCache) cacheNames(names map[string]string) {
+	if len(names) == 0 {
+		return
+	}
+	c.mu.Lock()
+	for id, name := range names {
+		c.m[id] = name
+	}
+	c.mu.Unlock()
+	if err := c.state.cacheParentNames(names, time.Now(), parentNameTTL()); err != nil {
+		log.Printf("Warning: failed to save state: %v", err)
+	}
+}
+
+// resolveParentNames looks up the names of the folders that are not cached.
+// When KAB_PARENT_FOLDER_ID is set and several folders are missing, the kab
+// folders are listed in one request, which usually answers all of them; the
+// rest are looked up one by one on PREFETCH_WORKERS goroutines. It returns how
+// many folders were looked up and how many lookups failed.
+func (p *Pipeline) resolveParentNames(srv *drive.Service, folderIDs []string) (looked, failed int) {
+	var missing []string
+	for _, id := range folderIDs {
+		if _, ok := p.parentNames.CachedName(id); !ok {
+			missing = append(missing, id)
+		}
+	}
+	if parent := os.Getenv("KAB_PARENT_FOLDER_ID"); parent != "" && len(missing) > 1 {
+		if folders, err := listKabFolders(srv, parent); err == nil {
+			names := make(map[string]string, len(folders))
+			for _, f := range folders {
+				names[f.Id] = f.Name
+			}
+			p.parentNames.cacheNames(names)
+			var rest []string
+			for _, id := range missing {
+				if _, ok := names[id]; !ok {
+					rest = append(rest, id)
+				}
+			}
+			missing = rest
+		}
+	}
+	found := map[string]string{}
+	var mu sync.Mutex
+	runPrefetch(len(missing), func(i int) {
+		p, err := srv.Files.Get(missing[i]).Fields("id, name").Do()
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			failed++
+			return
+		}
+		found[missing[i]] = p.Name
+	})
+	p.parentNames.cacheNames(found)
+	return len(missing), failed
+}
+
+// prefetchFileMetadata resolves, in one parallel pass before the files are
+// processed, what the main loop would otherwise look up file by file: the
+// names of the parent folders, and the checksum, size and parents of files
+// listed without them. Each distinct folder is resolved once, and not at all
+// when its name is cached. Failures are left to the per-file lookups, which
+// report them. PREFETCH=false turns the phase off.
+func (p *Pipeline) prefetchFileMetadata(srv *drive.Service, files []*source.File) {
+	if strings.EqualFold(os.Getenv("PREFETCH"), "false") || len(files) == 0 {
+		return
+	}
+	start := time.Now()
+
+	// Files first, since they may reveal more parents.
+	var incomplete []*source.File
+	for _, f := range files {
+		if _, ok := f.Object.(*source.DriveObject); !ok {
+			continue
+		}
+		if f.MD5 == "" || f.Size == 0 || len(f.Parents) == 0 {
+			incomplete = append(incomplete, f)
+		}
+	}
+	runPrefetch(len(incomplete), func(i int) {
+		f := incomplete[i]
+		got, err := srv.Files.Get(f.ID).Fields("md5Checksum, size, parents").Do()
+		if err != nil {
+			return
+		}
+		// Each worker owns its file, so no lock is needed.
+		if f.MD5 == "" {
+			f.MD5 = got.Md5Checksum
+		}
+		if f.Size == 0 {
+			f.Size = got.Size
+		}
+		if len(f.Parents) == 0 {
+			f.Parents = got.Parents
+		}
+	})
+
+	seen := map[string]bool{}
+	var folders []string
+	for _, f := range files {
+		if len(f.Parents) > 0 && !seen[f.Parents[0]] {
+			seen[f.Parents[0]] = true
+			folders = append(folders, f.Parents[0])
+		}
+	}
+	looked, failed := p.resolveParentNames(srv, folders)
+	log.Printf("Prefetched %d file(s) and %d of %d folder name(s) in %s (%d failed)",
+		len(incomplete), looked, len(folders), time.Since(start).Round(time.Millisecond), failed)
+}
+
+// runPrefetch calls fn for 0..n-1 on PREFETCH_WORKERS goroutines.
+func runPrefetch(n int, fn func(i int)) {
+	workers := defaultPrefetchWorkers
+	if v, err := strconv.Atoi(os.Getenv("PREFETCH_WORKERS")); err == nil && v > 0 {
+		workers = v
+	}
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+}
@@ -0,0 +1,188 @@
+package pipeline
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"backup-otomatis/internal/env"
+	"backup-otomatis/pkg/source"
+	"google.golang.org/api/pubsub/v1"
+)
+
+// resultPublisher announces finished restores to downstream services.
+type resultPublisher interface {
+	Publish(ctx context.Context, data []byte) error
+}
+
+// restoreResult is the message published for every processed file.
+type restoreResult struct {
+	FileID      string `json:"fileId"`
+	FileName    string `json:"fileName"`
+	Size        int64  `json:"size"`
+	CreatedTime string `json:"createdTime"`
+	Kab         string `json:"kab,omitempty"`
+	Job         string `json:"job"`
+	Database    string `json:"database"`
+	Status      string `json:"status"` // "success" or "failed"
+	Error       string `json:"error,omitempty"`
+	CompletedAt string `json:"completedAt"`
+	RunID       string `json:"runId"`
+	Ref         string `json:"ref"`
+}
+
+// pubsubPublisher publishes to a Google Pub/Sub topic.
+type pubsubPublisher struct {
+	srv   *pubsub.Service
+	topic string // projects/<project>/topics/<name>
+}
+
+func (p *pubsubPublisher) Publish(ctx context.Context, data []byte) error {
+	req := &pubsub.PublishRequest{Messages: []*pubsub.PubsubMessage{{Data: base64.StdEncoding.EncodeToString(data)}}}
+	if _, err := p.srv.Projects.Topics.Publish(p.topic, req).Context(ctx).Do(); err != nil {
+		return fmt.Errorf("failed to publish to %s: %v", p.topic, err)
+	}
+	return nil
+}
+
+// redisStreamPublisher appends messages to a Redis stream with XADD.
+type redisStreamPublisher struct {
+	addr     string
+	password string
+	stream   string
+}
+
+func (p *redisStreamPublisher) Publish(ctx context.Context, data []byte) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to redis %s: %v", p.addr, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(conn)
+	if p.password != "" {
+		if _, err := redisCommand(conn, r, "AUTH", p.password); err != nil {
+			return err
+		}
+	}
+	_, err = redisCommand(conn, r, "XADD", p.stream, "*", "result", string(data))
+	return err
+}
+
+// natsPublisher publishes to a NATS subject using the plain text protocol.
+type natsPublisher struct {
+	addr    string
+	subject string
+}
+
+func (p *natsPublisher) Publish(ctx context.Context, data []byte) error {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", p.addr)
+	if err != nil {
+		return fmt.Errorf("failed to connect to nats %s: %v", p.addr, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	r := bufio.NewReader(conn)
+	// The server greets with INFO; PING after PUB makes it confirm (or reject) the publish.
+	if _, err := r.ReadString('\n'); err != nil {
+		return fmt.Errorf("nats handshake failed: %v", err)
+	}
+	msg := fmt.Sprintf("CONNECT {\"verbose\":false}\r\nPUB %s %d\r\n%s\r\nPING\r\n", p.subject, len(data), data)
+	if _, err := conn.Write([]byte(msg)); err != nil {
+		return fmt.Errorf("nats write failed: %v", err)
+	}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("nats read failed: %v", err)
+		}
+		switch {
+		case strings.HasPrefix(line, "PONG"):
+			return nil
+		case strings.HasPrefix(line, "-ERR"):
+			return fmt.Errorf("nats error: %s", strings.TrimSpace(line))
+		}
+	}
+}
+
+// newResultPublisher creates the publisher selected by RESULT_PUBLISH_TYPE
+// ("pubsub", "redis" or "nats"). It returns nil when publishing is disabled.
+func (p *Pipeline) newResultPublisher(ctx context.Context) (resultPublisher, error) {
+	switch strings.ToLower(os.Getenv("RESULT_PUBLISH_TYPE")) {
+	case "":
+		return nil, nil
+	case "pubsub":
+		topic := os.Getenv("RESULT_PUBSUB_TOPIC")
+		if topic == "" {
+			return nil, fmt.Errorf("RESULT_PUBSUB_TOPIC is not set")
+		}
+		opts, err := source.ClientOptions(ctx, p.ServiceAccountFile, p.ImpersonateSubject, pubsub.PubsubScope)
+		if err != nil {
+			return nil, err
+		}
+		srv, err := pubsub.NewService(ctx, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to retrieve Pub/Sub client: %v", err)
+		}
+		return &pubsubPublisher{srv: srv, topic: topic}, nil
+	case "redis":
+		addr := os.Getenv("REDIS_ADDR")
+		if addr == "" {
+			return nil, fmt.Errorf("REDIS_ADDR is not set")
+		}
+		return &redisStreamPublisher{addr: addr, password: os.Getenv("REDIS_PASSWORD"), stream: env.Or("RESULT_REDIS_STREAM", "backup-otomatis:results")}, nil
+	case "nats":
+		addr := os.Getenv("NATS_ADDR")
+		if addr == "" {
+			return nil, fmt.Errorf("NATS_ADDR is not set")
+		}
+		return &natsPublisher{addr: addr, subject: env.Or("RESULT_NATS_SUBJECT", "backup-otomatis.results")}, nil
+	}
+	return nil, fmt.Errorf("unsupported RESULT_PUBLISH_TYPE %q (use pubsub, redis or nats)", os.Getenv("RESULT_PUBLISH_TYPE"))
+}
+
+// publishResult announces the outcome of processing file. Publishing failures
+// are logged and never affect processing.
+func (p *Pipeline) publishResult(file *source.File, j *job, procErr error) {
+	if p.publisher == nil {
+		return
+	}
+	res := restoreResult{
+		FileID:      file.ID,
+		FileName:    file.Name,
+		Size:        file.Size,
+		CreatedTime: file.CreatedTime,
+		Job:         j.Name,
+		Database:    j.DBName,
+		Status:      "success",
+		CompletedAt: time.Now().Format(time.RFC3339),
+		RunID:       currentRunID(),
+		Ref:         currentCorrelationID(),
+	}
+	if kab, err := file.Kab(); err == nil {
+		res.Kab = kab
+	}
+	if procErr != nil {
+		res.Status = "failed"
+		res.Error = procErr.Error()
+	}
+	data, err := json.Marshal(res)
+	if err != nil {
+		log.Printf("Warning: failed to encode result for %s: %v", file.Name, err)
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := p.publisher.Publish(ctx, data); err != nil {
+		log.Printf("Warning: failed to publish result for %s: %v", file.Name, err)
+	}
+}
@@ -0,0 +1,136 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"time"
+
+	"backup-otomatis/internal/env"
+	"backup-otomatis/pkg/restore"
+	"backup-otomatis/pkg/track"
+	"google.golang.org/api/sheets/v4"
+)
+
+// qcIndicator is one quality-control figure computed on each fresh restore,
+// e.g. the number of incomplete questionnaires.
+type qcIndicator struct {
+	Name string `json:"name"`
+	// Query must return a single value. It runs in the restored database and may
+	// use the update script variables such as $(KAB).
+	Query string `json:"query"`
+}
+
+// loadQCIndicators reads the JSON array of indicators in QC_INDICATORS_FILE.
+func loadQCIndicators() ([]qcIndicator, error) {
+	path := os.Getenv("QC_INDICATORS_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read QC indicators: %v", err)
+	}
+	var indicators []qcIndicator
+	if err := json.Unmarshal(b, &indicators); err != nil {
+		return nil, fmt.Errorf("failed to parse QC indicators %s: %v", path, err)
+	}
+	return indicators, nil
+}
+
+// recordQCIndicators computes the configured indicators on the restored database
+// and writes them as one row per kab per day to the QC_SHEET_NAME tab (default
+// "QC") of the job's spreadsheet. Failures are logged and never fail the file.
+func (p *Pipeline) recordQCIndicators(sheetsSrv *sheets.Service, spreadsheetID string, kab string, vars map[string]string, loc *time.Location) {
+	indicators, err := loadQCIndicators()
+	if err != nil {
+		log.Printf("Warning: %v", err)
+		return
+	}
+	if len(indicators) == 0 {
+		return
+	}
+	if kab == "" {
+		log.Printf("Warning: kab unknown, skipping QC indicators")
+		return
+	}
+	header := []interface{}{"Date", "Kab"}
+	row := []interface{}{time.Now().In(loc).Format("2006-01-02"), kab}
+	for _, ind := range indicators {
+		header = append(header, ind.Name)
+		query, err := restore.ExpandVars(ind.Query, vars)
+		var v string
+		if err == nil {
+			v, err = restore.Scalar(p.DBHost, p.DBUser, p.DBPass, "Temp", query)
+		}
+		if err != nil {
+			log.Printf("Warning: QC indicator %q failed: %v", ind.Name, err)
+			v = "ERROR"
+		}
+		// Numbers are stored as numbers so the sheet can chart them.
+		if n, err := strconv.ParseFloat(v, 64); err == nil {
+			row = append(row, n)
+		} else {
+			row = append(row, v)
+		}
+	}
+	log.Printf("QC indicators for %s: %v", kab, row[2:])
+	sheet := env.Or("QC_SHEET_NAME", "QC")
+	if err := upsertQCRow(sheetsSrv, spreadsheetID, sheet, header, row); err != nil {
+		log.Printf("Warning: failed to write QC indicators: %v", err)
+	}
+}
+
+// upsertQCRow writes row to sheet, replacing an existing row with the same date
+// and kab. The sheet tab and its header row are created when missing. Values are
+// written as-is so the date column reads back exactly as written.
+func upsertQCRow(srv *sheets.Service, spreadsheetID, sheet string, header, row []interface{}) error {
+	if _, err := ensureSheetTab(srv, spreadsheetID, sheet); err != nil {
+		return err
+	}
+	resp, err := srv.Spreadsheets.Values.Get(spreadsheetID, track.SheetRange(sheet, "A:B")).Do()
+	if err != nil {
+		return fmt.Errorf("failed to read QC sheet: %v", err)
+	}
+	if len(resp.Values) == 0 {
+		vr := &sheets.ValueRange{Values: [][]interface{}{header}}
+		if _, err := srv.Spreadsheets.Values.Update(spreadsheetID, track.SheetRange(sheet, "A1"), vr).ValueInputOption("RAW").Do(); err != nil {
+			return fmt.Errorf("failed to write QC header: %v", err)
+		}
+	}
+	for i, r := range resp.Values {
+		if len(r) >= 2 && fmt.Sprint(r[0]) == row[0] && fmt.Sprint(r[1]) == row[1] {
+			a1 := track.SheetRange(sheet, fmt.Sprintf("A%d", i+1))
+			vr := &sheets.ValueRange{Values: [][]interface{}{row}}
+			_, err := srv.Spreadsheets.Values.Update(spreadsheetID, a1, vr).ValueInputOption("RAW").Do()
+			return err
+		}
+	}
+	vr := &sheets.ValueRange{Values: [][]interface{}{row}}
+	_, err = srv.Spreadsheets.Values.Append(spreadsheetID, track.SheetRange(sheet, "A:B"), vr).ValueInputOption("RAW").InsertDataOption("INSERT_ROWS").Do()
+	return err
+}
+
+// ensureSheetTab adds a tab named title to the spreadsheet unless it exists,
+// and reports whether it was added.
+func ensureSheetTab(srv *sheets.Service, spreadsheetID, title string) (bool, error) {
+	ss, err := srv.Spreadsheets.Get(spreadsheetID).Fields("sheets(properties(title))").Do()
+	if err != nil {
+		return false, fmt.Errorf("failed to read spreadsheet: %v", err)
+	}
+	for _, s := range ss.Sheets {
+		if s.Properties != nil && s.Properties.Title == title {
+			return false, nil
+		}
+	}
+	req := &sheets.BatchUpdateSpreadsheetRequest{Requests: []*sheets.Request{{
+		AddSheet: &sheets.AddSheetRequest{Properties: &sheets.SheetProperties{Title: title}},
+	}}}
+	if _, err := srv.Spreadsheets.BatchUpdate(spreadsheetID, req).Do(); err != nil {
+		return false, fmt.Errorf("failed to create sheet %s: %v", title, err)
+	}
+	log.Printf("Created sheet %s", title)
+	return true, nil
+}
@@ -0,0 +1,303 @@
+package pipeline
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"backup-otomatis/internal/env"
+	"backup-otomatis/pkg/source"
+	"backup-otomatis/pkg/track"
+	"google.golang.org/api/pubsub/v1"
+)
+
+// Defaults for the queue trigger.
+const (
+	defaultRedisQueueKey = "backup-otomatis:requests"
+	redisBlockTimeout    = 30 * time.Second
+	queueErrorBackoff    = 10 * time.Second
+)
+
+// workQueue delivers work requests pushed by an upstream uploader service.
+type workQueue interface {
+	// Receive waits for new messages and returns the requests they carry.
+	// Messages are acknowledged on receipt, so a restore that outlives the
+	// broker's redelivery deadline is not started twice; failures are reported
+	// through notifications instead of redelivery.
+	Receive(ctx context.Context) ([]workRequest, error)
+}
+
+// parseWorkRequest decodes a message body: either a JSON object with fileId
+// and/or kab, or a bare Drive file ID or link.
+func parseWorkRequest(data []byte) (workRequest, error) {
+	text := strings.TrimSpace(string(data))
+	var r workRequest
+	if strings.HasPrefix(text, "{") {
+		if err := json.Unmarshal([]byte(text), &r); err != nil {
+			return r, fmt.Errorf("invalid request message: %v", err)
+		}
+		r.FileID = driveFileIDFromText(r.FileID)
+	} else {
+		r.FileID = driveFileIDFromText(text)
+	}
+	if r.FileID == "" && r.Kab == "" {
+		return r, fmt.Errorf("request message has neither a file ID nor a kab: %q", text)
+	}
+	return r, nil
+}
+
+// pubsubQueue pulls requests from a Google Pub/Sub subscription.
+type pubsubQueue struct {
+	srv          *pubsub.Service
+	subscription string // projects/<project>/subscriptions/<name>
+}
+
+func (q *pubsubQueue) Receive(ctx context.Context) ([]workRequest, error) {
+	resp, err := q.srv.Projects.Subscriptions.Pull(q.subscription, &pubsub.PullRequest{MaxMessages: 10}).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to pull from %s: %v", q.subscription, err)
+	}
+	if len(resp.ReceivedMessages) == 0 {
+		return nil, nil
+	}
+	var reqs []workRequest
+	ackIDs := make([]string, 0, len(resp.ReceivedMessages))
+	for _, m := range resp.ReceivedMessages {
+		ackIDs = append(ackIDs, m.AckId)
+		if m.Message == nil {
+			continue
+		}
+		data, err := base64.StdEncoding.DecodeString(m.Message.Data)
+		if err != nil {
+			log.Printf("Warning: dropping undecodable message %s: %v", m.Message.MessageId, err)
+			continue
+		}
+		r, err := parseWorkRequest(data)
+		if err != nil {
+			log.Printf("Warning: dropping message %s: %v", m.Message.MessageId, err)
+			continue
+		}
+		reqs = append(reqs, r)
+	}
+	_, err = q.srv.Projects.Subscriptions.Acknowledge(q.subscription, &pubsub.AcknowledgeRequest{AckIds: ackIDs}).Context(ctx).Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to acknowledge messages: %v", err)
+	}
+	return reqs, nil
+}
+
+// redisQueue pops requests from a Redis list with BLPOP.
+type redisQueue struct {
+	addr     string
+	password string
+	key      string
+}
+
+func (q *redisQueue) Receive(ctx context.Context) ([]workRequest, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", q.addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to redis %s: %v", q.addr, err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	} else {
+		conn.SetDeadline(time.Now().Add(redisBlockTimeout + 10*time.Second))
+	}
+	r := bufio.NewReader(conn)
+	if q.password != "" {
+		if _, err := redisCommand(conn, r, "AUTH", q.password); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := redisCommand(conn, r, "BLPOP", q.key, strconv.Itoa(int(redisBlockTimeout.Seconds())))
+	if err != nil {
+		return nil, err
+	}
+	// BLPOP returns nil on timeout or [key, value] when an element was popped.
+	pair, ok := reply.([]interface{})
+	if !ok || len(pair) != 2 {
+		return nil, nil
+	}
+	value, _ := pair[1].(string)
+	req, err := parseWorkRequest([]byte(value))
+	if err != nil {
+		log.Printf("Warning: dropping message from %s: %v", q.key, err)
+		return nil, nil
+	}
+	return []workRequest{req}, nil
+}
+
+// redisCommand sends one command using the RESP protocol and reads its reply.
+func redisCommand(conn net.Conn, r *bufio.Reader, args ...string) (interface{}, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(a), a)
+	}
+	if _, err := conn.Write([]byte(b.String())); err != nil {
+		return nil, fmt.Errorf("redis write failed: %v", err)
+	}
+	return readRedisReply(r)
+}
+
+// readRedisReply parses one RESP reply. Bulk strings and simple strings become
+// string, integers int64, arrays []interface{} and null replies nil.
+func readRedisReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("redis read failed: %v", err)
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return nil, fmt.Errorf("empty redis reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, fmt.Errorf("redis error: %s", line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, fmt.Errorf("redis read failed: %v", err)
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, n)
+		for i := range items {
+			if items[i], err = readRedisReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("unexpected redis reply %q", line)
+}
+
+// newWorkQueue creates the queue selected by QUEUE_TYPE ("pubsub" or "redis").
+func (p *Pipeline) newWorkQueue(ctx context.Context) (workQueue, error) {
+	switch strings.ToLower(os.Getenv("QUEUE_TYPE")) {
+	case "pubsub":
+		sub := os.Getenv("PUBSUB_SUBSCRIPTION")
+		if sub == "" {
+			return nil, fmt.Errorf("PUBSUB_SUBSCRIPTION is not set")
+		}
+		opts, err := source.ClientOptions(ctx, p.ServiceAccountFile, p.ImpersonateSubject, pubsub.PubsubScope)
+		if err != nil {
+			return nil, err
+		}
+		srv, err := pubsub.NewService(ctx, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to retrieve Pub/Sub client: %v", err)
+		}
+		return &pubsubQueue{srv: srv, subscription: sub}, nil
+	case "redis":
+		addr := os.Getenv("REDIS_ADDR")
+		if addr == "" {
+			return nil, fmt.Errorf("REDIS_ADDR is not set")
+		}
+		return &redisQueue{addr: addr, password: os.Getenv("REDIS_PASSWORD"), key: env.Or("REDIS_QUEUE_KEY", defaultRedisQueueKey)}, nil
+	case "":
+		return nil, fmt.Errorf("QUEUE_TYPE is not set")
+	}
+	return nil, fmt.Errorf("unsupported QUEUE_TYPE %q (use pubsub or redis)", os.Getenv("QUEUE_TYPE"))
+}
+
+// listen consumes the configured queue until SIGINT or SIGTERM, processing each
+// requested file as it arrives.
+func (p *Pipeline) listen() error {
+	// Pub/Sub requests are acked on receipt, so a listener that cannot
+	// process them must not take any.
+	if err := p.validateConfig(); err != nil {
+		return err
+	}
+	srv, sheetsSrv, err := p.commandServices()
+	if err != nil {
+		return err
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	q, err := p.newWorkQueue(ctx)
+	if err != nil {
+		return err
+	}
+	if p.publisher, err = p.newResultPublisher(ctx); err != nil {
+		return err
+	}
+	log.Printf("Listening for work requests on %s queue", os.Getenv("QUEUE_TYPE"))
+	listenMode = true
+	startRun()
+	startMetricsServer()
+	p.housekeep()
+	restart := false
+	for ctx.Err() == nil {
+		maybeLogResources()
+		if memoryOverCeiling() {
+			restart = true
+			break
+		}
+		p.maybeHousekeep()
+		p.checkPipelineDown()
+		flushDigest(false)
+		p.maybeSendDailyReport(sheetsSrv, p.SpreadsheetID)
+		p.checkStaleKabs(srv)
+		p.checkCredentialHealth()
+		p.maybePruneRestoreLog()
+		if processingPaused() {
+			select {
+			case <-ctx.Done():
+			case <-time.After(queueErrorBackoff):
+			}
+			continue
+		}
+		track.Replay(sheetsSrv, p.state)
+		p.processControlRequests(srv, sheetsSrv)
+		reqs, err := q.Receive(ctx)
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			log.Printf("Warning: %v", err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(queueErrorBackoff):
+			}
+			continue
+		}
+		for _, r := range reqs {
+			log.Printf("Received work request (file=%q, kab=%q)", r.FileID, r.Kab)
+			if err := p.handleWorkRequest(srv, sheetsSrv, r); err != nil {
+				notifyMsg(levelError, "queue-request-failed", msgData{"FileID": r.FileID, "Kab": r.Kab, "Err": err})
+			}
+		}
+	}
+	flushDigest(true)
+	log.Println("Listener stopped")
+	if restart {
+		return restartAfterCeiling()
+	}
+	return nil
+}
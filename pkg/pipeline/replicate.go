@@ -0,0 +1,68 @@
+package pipeline
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"backup-otomatis/internal/env"
+	"backup-otomatis/pkg/source"
+)
+
+// replicateBackup copies the restored .bak to REPLICATE_DESTINATION, a local or
+// UNC directory (e.g. a NAS share) or a gs://bucket/prefix or s3://bucket/prefix
+// location, so every backup that was actually restored has a copy outside
+// Drive. It does nothing when REPLICATE_DESTINATION is not set.
+//
+// Copies are stored as <destination>/<kab>/<yyyy>/<mm>/<drive-file-base>.bak.
+func (p *Pipeline) replicateBackup(file *source.File, bakFile string) error {
+	dest := os.Getenv("REPLICATE_DESTINATION")
+	if dest == "" {
+		return nil
+	}
+	kab, err := file.Kab()
+	if err != nil {
+		return fmt.Errorf("failed to resolve kab for replication: %v", err)
+	}
+	// The .bak inside an archive usually has the same name every time, so the
+	// copy is named after the Drive file instead.
+	base := file.Name
+	if i := strings.Index(base, "."); i > 0 {
+		base = base[:i]
+	}
+	rel := path.Join(kab, time.Now().Format("2006/01"), base+".bak")
+
+	u, err := url.Parse(dest)
+	if err == nil && (u.Scheme == "gs" || u.Scheme == "s3") {
+		if u.Host == "" {
+			return fmt.Errorf("invalid REPLICATE_DESTINATION %q", dest)
+		}
+		name := path.Join(strings.Trim(u.Path, "/"), rel)
+		tags := map[string]string{"kab": kab, "driveFileId": file.ID}
+		log.Printf("Replicating %s to %s://%s/%s", filepath.Base(bakFile), u.Scheme, u.Host, name)
+		if u.Scheme == "gs" {
+			return uploadToGCS(p.ServiceAccountFile, u.Host, name, bakFile, env.Or("REPLICATE_STORAGE_CLASS", "STANDARD"), tags)
+		}
+		return uploadToS3(u.Host, name, bakFile, env.Or("REPLICATE_STORAGE_CLASS", "STANDARD"), tags)
+	}
+
+	target := filepath.Join(dest, filepath.FromSlash(rel))
+	log.Printf("Replicating %s to %s", filepath.Base(bakFile), target)
+	// Copy under a temporary name so a partial copy is never mistaken for a
+	// complete one.
+	tmp := target + ".partial"
+	if err := copyLocalFile(bakFile, tmp); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to copy backup to %s: %v", target, err)
+	}
+	if err := os.Rename(tmp, target); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to copy backup to %s: %v", target, err)
+	}
+	return nil
+}
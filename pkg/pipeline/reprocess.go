@@ -0,0 +1,218 @@
+package pipeline
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"backup-otomatis/pkg/archive"
+	"backup-otomatis/pkg/restore"
+	"backup-otomatis/pkg/source"
+	"google.golang.org/api/storage/v1"
+)
+
+// archivedBackup is one object in the ARCHIVE_DESTINATION store.
+type archivedBackup struct {
+	Name    string
+	Created time.Time
+	Size    int64
+}
+
+// reprocessCommand implements `backup-otomatis reprocess --kab=3501
+// --date=2025-06-10`: it finds the copy of the kab's backup archived on that
+// date, restores it into Temp and runs the update against --db (default
+// DB_NAME) and the validation queries, as a normal run would have.
+func (p *Pipeline) reprocessCommand(args []string, w io.Writer) error {
+	fs := flag.NewFlagSet("reprocess", flag.ContinueOnError)
+	kab := fs.String("kab", "", "kab whose archived backup is reprocessed")
+	date := fs.String("date", "", "date the backup was archived, YYYY-MM-DD")
+	name := fs.String("name", "", "substring of the archived file name, when the date has several")
+	db := fs.String("db", "", "database the update runs against (default DB_NAME)")
+	skipUpdate := fs.Bool("skip-update", false, "restore and validate without running the update")
+	keep := fs.Bool("keep", false, "keep the Temp database afterwards")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *kab == "" || *date == "" {
+		return fmt.Errorf("usage: reprocess --kab=<kab> --date=YYYY-MM-DD [--name=<substring>] [--db=<database>] [--skip-update] [--keep]")
+	}
+	day, err := time.ParseInLocation("2006-01-02", *date, spreadsheetLocation())
+	if err != nil {
+		return fmt.Errorf("invalid --date %q: %v", *date, err)
+	}
+	if *db == "" {
+		*db = p.DBName
+	}
+	dest := os.Getenv("ARCHIVE_DESTINATION")
+	u, err := url.Parse(dest)
+	if dest == "" || err != nil || u.Host == "" {
+		return fmt.Errorf("ARCHIVE_DESTINATION is not set or invalid")
+	}
+
+	prefix := path.Join(strings.Trim(u.Path, "/"), *kab, day.Format("2006/01")) + "/"
+	backups, err := p.listArchivedBackups(u.Scheme, u.Host, prefix)
+	if err != nil {
+		return err
+	}
+	var matches []archivedBackup
+	for _, b := range backups {
+		if b.Created.In(day.Location()).Format("2006-01-02") == *date && strings.Contains(path.Base(b.Name), *name) {
+			matches = append(matches, b)
+		}
+	}
+	if len(matches) == 0 {
+		return fmt.Errorf("no backup of %s archived on %s under %s://%s/%s", *kab, *date, u.Scheme, u.Host, prefix)
+	}
+	sort.Slice(matches, func(i, k int) bool { return matches[i].Created.After(matches[k].Created) })
+	if len(matches) > 1 {
+		fmt.Fprintf(w, "%d backups archived that day, using the latest (narrow with --name):\n", len(matches))
+		for _, m := range matches {
+			fmt.Fprintf(w, "  %s  %s  %s\n", m.Created.In(day.Location()).Format("15:04:05"), formatBytes(m.Size), path.Base(m.Name))
+		}
+	}
+	chosen := matches[0]
+	fmt.Fprintf(w, "Reprocessing %s://%s/%s into %s\n", u.Scheme, u.Host, chosen.Name, *db)
+
+	tempDir, err := createTempDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+	downloaded := filepath.Join(tempDir, path.Base(chosen.Name))
+	if err := p.fetchMirror(fmt.Sprintf("%s://%s/%s", u.Scheme, u.Host, chosen.Name), downloaded); err != nil {
+		return err
+	}
+	if err := configureExtractors(); err != nil {
+		return err
+	}
+	plain, err := decryptArchive(downloaded)
+	if err != nil {
+		return err
+	}
+	extractDir := filepath.Join(tempDir, "extracted")
+	if err := archive.For(plain).Extract(plain, extractDir, p.SevenZPassword); err != nil {
+		return fmt.Errorf("failed to extract archive: %v", err)
+	}
+	bakFile, err := findBakFile(extractDir)
+	if err != nil {
+		return fmt.Errorf("failed to find .bak file: %v", err)
+	}
+
+	revoke := grantPermissions(bakFile, p.DBHost)
+	err = restore.Backup(p.DBHost, p.DBUser, p.DBPass, bakFile)
+	revoke()
+	if err != nil {
+		return explainSQLError(err)
+	}
+	if !*keep {
+		defer func() {
+			if err := restore.Drop(p.DBHost, p.DBUser, p.DBPass); err != nil {
+				log.Printf("Warning: failed to drop Temp: %v", err)
+			}
+		}()
+	}
+	fmt.Fprintln(w, "Restored into Temp")
+
+	j := defaultJob(*db)
+	file := &source.File{ID: "archive:" + chosen.Name, Name: path.Base(chosen.Name), Size: chosen.Size, CreatedTime: chosen.Created.Format(time.RFC3339)}
+	if err := anonymizeRestore(p.DBHost, p.DBUser, p.DBPass); err != nil {
+		return err
+	}
+	if err := applyDatabaseFlags(p.DBHost, p.DBUser, p.DBPass, j, file.Name); err != nil {
+		return err
+	}
+
+	queries, err := j.validationQueries()
+	if err != nil {
+		return err
+	}
+	failed := 0
+	for _, q := range queries {
+		out, qErr := restore.Query(p.DBHost, p.DBUser, p.DBPass, "Temp", q)
+		if qErr != nil {
+			failed++
+			fmt.Fprintf(w, "- %s: ERROR %v\n", q, qErr)
+			continue
+		}
+		fmt.Fprintf(w, "- %s: %s\n", q, strings.Join(strings.Fields(string(out)), " "))
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d validation queries failed, update not run", failed, len(queries))
+	}
+
+	detail := fmt.Sprintf("kab=%s date=%s file=%s db=%s", *kab, *date, chosen.Name, *db)
+	if !*skipUpdate {
+		rows, err := p.update().Run(p.DBHost, p.DBUser, p.DBPass, *db, fileSQLVars(file, *kab, j))
+		if err != nil {
+			return explainSQLError(err)
+		}
+		fmt.Fprintf(w, "Update affected %s\n", restore.FormatRowsAffected(rows))
+		detail += " updated"
+	}
+	if err := appendAudit(auditEntry{At: time.Now(), User: processedBy(), Role: "system", Action: "reprocess", Detail: detail}); err != nil {
+		log.Printf("Warning: failed to write audit log: %v", err)
+	}
+	return nil
+}
+
+// listArchivedBackups lists the archive objects under prefix in a gs:// or
+// s3:// bucket.
+func (p *Pipeline) listArchivedBackups(scheme, bucket, prefix string) ([]archivedBackup, error) {
+	var out []archivedBackup
+	switch scheme {
+	case "gs":
+		ctx := context.Background()
+		opts, err := source.ClientOptions(ctx, p.ServiceAccountFile, "", storage.DevstorageReadOnlyScope)
+		if err != nil {
+			return nil, err
+		}
+		srv, err := storage.NewService(ctx, opts...)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create Cloud Storage client: %v", err)
+		}
+		err = srv.Objects.List(bucket).Prefix(prefix).Pages(ctx, func(l *storage.Objects) error {
+			for _, o := range l.Items {
+				t, _ := time.Parse(time.RFC3339, o.TimeCreated)
+				out = append(out, archivedBackup{Name: o.Name, Created: t, Size: int64(o.Size)})
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list gs://%s/%s: %v", bucket, prefix, err)
+		}
+	case "s3":
+		b, err := exec.Command("aws", "s3api", "list-objects-v2", "--bucket", bucket, "--prefix", prefix, "--output", "json").Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to list s3://%s/%s: %v", bucket, prefix, err)
+		}
+		var resp struct {
+			Contents []struct {
+				Key          string
+				LastModified time.Time
+				Size         int64
+			}
+		}
+		if len(b) > 0 {
+			if err := json.Unmarshal(b, &resp); err != nil {
+				return nil, fmt.Errorf("failed to parse S3 listing: %v", err)
+			}
+		}
+		for _, o := range resp.Contents {
+			out = append(out, archivedBackup{Name: o.Key, Created: o.LastModified, Size: o.Size})
+		}
+	default:
+		return nil, fmt.Errorf("unsupported ARCHIVE_DESTINATION scheme %q (use gs:// or s3://)", scheme)
+	}
+	return out, nil
+}
@@ -0,0 +1,179 @@
+package pipeline
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"backup-otomatis/internal/env"
+	"backup-otomatis/pkg/restore"
+	"backup-otomatis/pkg/source"
+)
+
+// Restore history kept in dbo.BackupRestoreLog of RESTORE_LOG_DATABASE. Rows older
+// than RESTORE_LOG_RETENTION are pruned at most once per restoreLogPruneInterval,
+// in batches so the table stays usable while a large backlog is removed.
+const (
+	restoreLogTable         = "dbo.BackupRestoreLog"
+	defaultRestoreRetention = 2 * 365 * 24 * time.Hour
+	restoreLogPruneInterval = 30 * 24 * time.Hour
+	restoreLogPruneBatch    = 10000
+)
+
+// restoreLogSchema creates the log table on first use and adds the columns
+// introduced since to tables created by older versions.
+const restoreLogSchema = `IF OBJECT_ID(N'dbo.BackupRestoreLog') IS NULL
+BEGIN
+	CREATE TABLE dbo.BackupRestoreLog (
+		Id bigint IDENTITY PRIMARY KEY,
+		LoggedAt datetime2 NOT NULL DEFAULT SYSUTCDATETIME(),
+		Kab nvarchar(200) NOT NULL,
+		FileName nvarchar(400) NOT NULL,
+		FileId nvarchar(100) NOT NULL,
+		SizeBytes bigint NOT NULL,
+		RestoreSeconds float NULL,
+		Status nvarchar(20) NOT NULL,
+		Error nvarchar(max) NULL,
+		ProcessedBy nvarchar(200) NULL,
+		CorrelationId nvarchar(64) NULL
+	);
+	CREATE INDEX IX_BackupRestoreLog_LoggedAt ON dbo.BackupRestoreLog (LoggedAt);
+END;
+IF COL_LENGTH(N'dbo.BackupRestoreLog', N'CorrelationId') IS NULL
+	ALTER TABLE dbo.BackupRestoreLog ADD CorrelationId nvarchar(64) NULL;
+`
+
+// restoreLogReady records that restoreLogSchema ran in this process. It runs
+// as a batch of its own, since a batch referring to a column it adds fails to compile.
+var restoreLogReady struct {
+	sync.Mutex
+	done bool
+}
+
+// ensureRestoreLog creates or upgrades the log table once per process.
+func (p *Pipeline) ensureRestoreLog(db string) error {
+	restoreLogReady.Lock()
+	defer restoreLogReady.Unlock()
+	if restoreLogReady.done {
+		return nil
+	}
+	if _, err := restore.RunQuery(p.DBHost, p.DBUser, p.DBPass, db, restoreLogSchema); err != nil {
+		return fmt.Errorf("failed to prepare %s: %v", restoreLogTable, err)
+	}
+	restoreLogReady.done = true
+	return nil
+}
+
+// restoreLogDatabase returns RESTORE_LOG_DATABASE; an empty value disables the log.
+func restoreLogDatabase() string {
+	return os.Getenv("RESTORE_LOG_DATABASE")
+}
+
+// logRestore appends the outcome of one processed file to the restore log.
+// Failures are logged and never fail the file.
+func (p *Pipeline) logRestore(file *source.File, out fileOutcome, procErr error) {
+	db := restoreLogDatabase()
+	if db == "" {
+		return
+	}
+	kab, err := file.Kab()
+	if err != nil || kab == "" {
+		kab = file.Name
+	}
+	status, errText, seconds := "processed", "NULL", "NULL"
+	switch {
+	case procErr != nil:
+		status, errText = "failed", "N'"+sqlString(procErr.Error())+"'"
+	case out.Empty:
+		status = "empty"
+	}
+	if d, ok := out.Phases["restore"]; ok {
+		seconds = fmt.Sprintf("%.1f", d.Seconds())
+	}
+	if err := p.ensureRestoreLog(db); err != nil {
+		log.Printf("Warning: failed to write restore log: %v", err)
+		return
+	}
+	query := fmt.Sprintf(
+		"INSERT INTO %s (Kab, FileName, FileId, SizeBytes, RestoreSeconds, Status, Error, ProcessedBy, CorrelationId) VALUES (N'%s', N'%s', N'%s', %d, %s, N'%s', %s, N'%s', N'%s');",
+		restoreLogTable, sqlString(kab), sqlString(file.Name), sqlString(file.ID), file.Size, seconds, status, errText, sqlString(processedBy()), sqlString(out.CorrelationID))
+	if _, err := restore.RunQuery(p.DBHost, p.DBUser, p.DBPass, db, query); err != nil {
+		log.Printf("Warning: failed to write restore log: %v", err)
+	}
+}
+
+// maybePruneRestoreLog removes restore log rows older than RESTORE_LOG_RETENTION
+// when the previous prune is older than restoreLogPruneInterval. With
+// RESTORE_LOG_EXPORT_DIR set, the rows are first written to a tab-separated file
+// there and nothing is deleted if the export fails.
+func (p *Pipeline) maybePruneRestoreLog() {
+	db := restoreLogDatabase()
+	if db == "" {
+		return
+	}
+	now := time.Now()
+	if now.Sub(p.state.lastRestoreLogPrune()) < restoreLogPruneInterval {
+		return
+	}
+	if err := p.ensureRestoreLog(db); err != nil {
+		notifyMsg(levelWarning, "restore-log-prune-failed", msgData{"Err": err})
+		return
+	}
+	cutoff := now.Add(-env.Duration("RESTORE_LOG_RETENTION", defaultRestoreRetention)).UTC()
+	where := fmt.Sprintf("LoggedAt < '%s'", cutoff.Format("2006-01-02T15:04:05"))
+	if dir := os.Getenv("RESTORE_LOG_EXPORT_DIR"); dir != "" {
+		path := filepath.Join(dir, "restore-log-before-"+cutoff.Format("20060102")+".tsv")
+		if err := p.exportRestoreLog(db, where, path); err != nil {
+			notifyMsg(levelWarning, "restore-log-prune-failed", msgData{"Err": err})
+			return
+		}
+		log.Printf("Exported restore log rows before %s to %s", cutoff.Format("2006-01-02"), path)
+	}
+	query := fmt.Sprintf(
+		"WHILE 1 = 1 BEGIN DELETE TOP (%d) FROM %s WHERE %s; IF @@ROWCOUNT < %d BREAK; END;",
+		restoreLogPruneBatch, restoreLogTable, where, restoreLogPruneBatch)
+	counts, err := restore.RunQuery(p.DBHost, p.DBUser, p.DBPass, db, query)
+	if err != nil {
+		notifyMsg(levelWarning, "restore-log-prune-failed", msgData{"Err": err})
+		return
+	}
+	var pruned int64
+	for _, n := range counts {
+		pruned += n
+	}
+	log.Printf("Pruned %d restore log row(s) older than %s", pruned, cutoff.Format("2006-01-02"))
+	if err := p.state.setLastRestoreLogPrune(now); err != nil {
+		log.Printf("Warning: failed to save state: %v", err)
+	}
+}
+
+// exportRestoreLog writes the restore log rows matching where to path, with a
+// header line and tabs as separator. Tabs and line breaks in errors are flattened.
+func (p *Pipeline) exportRestoreLog(db, where, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create export directory: %v", err)
+	}
+	columns := []string{"Id", "LoggedAt", "Kab", "FileName", "FileId", "SizeBytes", "RestoreSeconds", "Status", "Error", "ProcessedBy", "CorrelationId"}
+	query := "SET NOCOUNT ON; SELECT Id, CONVERT(varchar(19), LoggedAt, 126), Kab, FileName, FileId, SizeBytes, RestoreSeconds, Status, " +
+		"CAST(REPLACE(REPLACE(REPLACE(Error, CHAR(9), ' '), CHAR(13), ' '), CHAR(10), ' ') AS nvarchar(4000)), ProcessedBy, CorrelationId FROM " + restoreLogTable +
+		" WHERE " + where + " ORDER BY Id;"
+	args := restore.ConnArgs(p.DBHost, p.DBUser, p.DBPass, db)
+	args = append(args, "-h", "-1", "-W", "-s", "\t", "-Q", query)
+	output, err := exec.Command("sqlcmd", args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("failed to export restore log: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	if has, txt := restore.OutputHasError(output); has {
+		return fmt.Errorf("restore log export reported error: %s", txt)
+	}
+	data := append([]byte(strings.Join(columns, "\t")+"\n"), output...)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write restore log export: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+package pipeline
+
+import (
+	"expvar"
+	"log"
+
+	"backup-otomatis/pkg/restore"
+)
+
+// metricRestorePercent is the progress of the restore on DB_HOST, 0 when none runs.
+var metricRestorePercent = expvar.NewInt("restore_progress_percent")
+
+// trackRestoreProgress returns the progress function of the restore of a
+// queued file: it publishes the percentage in the queue served by /api/queue
+// and in the restore_progress_percent metric.
+func (p *Pipeline) trackRestoreProgress(fileID string) func(restore.Progress) {
+	return func(pr restore.Progress) {
+		metricRestorePercent.Set(int64(pr.Percent))
+		if err := p.state.setQueuedProgress(fileID, pr.Percent); err != nil {
+			log.Printf("Warning: failed to save state: %v", err)
+		}
+	}
+}
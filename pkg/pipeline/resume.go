@@ -0,0 +1,121 @@
+package pipeline
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"backup-otomatis/pkg/source"
+)
+
+// Checkpoint phases of a file, in order.
+const (
+	checkpointDownloaded = "downloaded"
+	checkpointExtracted  = "extracted"
+)
+
+// fileCheckpoint records how far the processing of one Drive file version got,
+// so a run killed after the download resumes instead of starting over.
+type fileCheckpoint struct {
+	Key     string    `json:"key"` // file ID and MD5, see validationKey
+	Dir     string    `json:"dir"`
+	Phase   string    `json:"phase,omitempty"`
+	BakFile string    `json:"bakFile,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+// checkpoint returns the checkpoint of the file, if any.
+func (s *stateStore) checkpoint(fileID string) (fileCheckpoint, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c, ok := s.data.Checkpoints[fileID]
+	return c, ok
+}
+
+// setCheckpoint stores the checkpoint of the file.
+func (s *stateStore) setCheckpoint(fileID string, c fileCheckpoint) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data.Checkpoints == nil {
+		s.data.Checkpoints = map[string]fileCheckpoint{}
+	}
+	c.At = time.Now()
+	s.data.Checkpoints[fileID] = c
+	return s.save()
+}
+
+// clearCheckpoint forgets the checkpoint of the file.
+func (s *stateStore) clearCheckpoint(fileID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.data.Checkpoints[fileID]; !ok {
+		return nil
+	}
+	delete(s.data.Checkpoints, fileID)
+	return s.save()
+}
+
+// resumableWorkDir returns the working directory for the file. When an earlier
+// run was interrupted while processing the same file version and left its
+// directory behind, that directory is reused; otherwise a fresh one is created
+// and recorded. The returned cleanup removes the directory and the checkpoint
+// and runs on every normal return, so only a crash leaves them behind.
+func (p *Pipeline) resumableWorkDir(file *source.File) (string, func(), error) {
+	key := validationKey(file)
+	if c, ok := p.state.checkpoint(file.ID); ok {
+		if fi, err := os.Stat(c.Dir); err == nil && fi.IsDir() && c.Key == key {
+			log.Printf("Resuming %s from checkpoint %q in %s", file.Name, c.Phase, c.Dir)
+			return c.Dir, p.cleanupWorkDir(file.ID, c.Dir), nil
+		}
+		// The file changed or its artifacts are gone; start over.
+		os.RemoveAll(c.Dir)
+	}
+	dir, err := createTempDir()
+	if err != nil {
+		return "", nil, err
+	}
+	if err := p.state.setCheckpoint(file.ID, fileCheckpoint{Key: key, Dir: dir}); err != nil {
+		log.Printf("Warning: failed to save checkpoint: %v", err)
+	}
+	return dir, p.cleanupWorkDir(file.ID, dir), nil
+}
+
+func (p *Pipeline) cleanupWorkDir(fileID, dir string) func() {
+	return func() {
+		os.RemoveAll(dir)
+		if err := p.state.clearCheckpoint(fileID); err != nil {
+			log.Printf("Warning: failed to save state: %v", err)
+		}
+	}
+}
+
+// markCheckpoint records that the file reached phase in dir.
+func (p *Pipeline) markCheckpoint(file *source.File, dir, phase, bakFile string) {
+	c := fileCheckpoint{Key: validationKey(file), Dir: dir, Phase: phase, BakFile: bakFile}
+	if err := p.state.setCheckpoint(file.ID, c); err != nil {
+		log.Printf("Warning: failed to save checkpoint: %v", err)
+	}
+}
+
+// resumePoint returns the phase the file already completed in dir, verifying
+// that its artifacts are still valid: the download must have the size Drive
+// reports and the extracted .bak must exist.
+func (p *Pipeline) resumePoint(file *source.File, dir string) (phase, bakFile string) {
+	c, ok := p.state.checkpoint(file.ID)
+	if !ok || c.Dir != dir || c.Key != validationKey(file) {
+		return "", ""
+	}
+	switch c.Phase {
+	case checkpointExtracted:
+		if _, err := os.Stat(c.BakFile); err == nil {
+			return checkpointExtracted, c.BakFile
+		}
+		fallthrough
+	case checkpointDownloaded:
+		if fi, err := os.Stat(filepath.Join(dir, file.Name)); err == nil && fi.Size() == file.Size {
+			return checkpointDownloaded, ""
+		}
+	}
+	return "", ""
+}
@@ -0,0 +1,62 @@
+package pipeline
+
+import (
+	"log"
+	"os"
+	"strings"
+
+	"backup-otomatis/pkg/source"
+)
+
+// routeRules returns the file properties a file must carry to be processed by
+// the job: the job's Route, or ROUTE_PROPERTIES ("key=value,...") for jobs
+// without one.
+func (j *job) routeRules() map[string]string {
+	if len(j.Route) > 0 {
+		return j.Route
+	}
+	rules := map[string]string{}
+	for _, pair := range strings.Split(os.Getenv("ROUTE_PROPERTIES"), ",") {
+		k, v, ok := strings.Cut(pair, "=")
+		if k = strings.TrimSpace(k); ok && k != "" {
+			rules[k] = strings.TrimSpace(v)
+		}
+	}
+	return rules
+}
+
+// routeFiles keeps the files whose properties match the job's route, so one
+// folder can feed several environments (e.g. target=training and
+// target=production). Files without the routed properties are only kept when
+// ROUTE_ALLOW_UNTAGGED is true.
+func routeFiles(files []*source.File, j *job) []*source.File {
+	rules := j.routeRules()
+	if len(rules) == 0 {
+		return files
+	}
+	allowUntagged := strings.EqualFold(os.Getenv("ROUTE_ALLOW_UNTAGGED"), "true")
+	var kept []*source.File
+	for _, f := range files {
+		match, tagged := true, false
+		for k, want := range rules {
+			v, ok := f.Properties[k]
+			if !ok {
+				match = false
+				continue
+			}
+			tagged = true
+			if !strings.EqualFold(v, want) {
+				match = false
+			}
+		}
+		switch {
+		case match, !tagged && allowUntagged:
+			kept = append(kept, f)
+		case !tagged:
+			log.Printf("Skipping %s (ID: %s): missing routing properties for job %s", f.Name, f.ID, j.Name)
+		default:
+			log.Printf("Skipping %s (ID: %s): routed to another environment", f.Name, f.ID)
+		}
+	}
+	return kept
+}
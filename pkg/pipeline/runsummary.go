@@ -0,0 +1,58 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// outputFormat returns the run summary format set with --output or
+// OUTPUT_FORMAT: "json", or "" for the log summary only.
+func outputFormat() string {
+	return strings.ToLower(strings.TrimSpace(os.Getenv("OUTPUT_FORMAT")))
+}
+
+// runSummary is the machine-readable summary printed by --output=json.
+type runSummary struct {
+	Version  string       `json:"version"`
+	Host     string       `json:"host"`
+	RunID    string       `json:"runId"`
+	Started  time.Time    `json:"started"`
+	Finished time.Time    `json:"finished"`
+	ExitCode int          `json:"exitCode"`
+	Jobs     []jobSummary `json:"jobs"`
+}
+
+// jobSummary is the outcome of one job in the run summary.
+type jobSummary struct {
+	Name         string       `json:"name"`
+	Processed    int          `json:"processed"`
+	Failed       int          `json:"failed"`
+	Empty        int          `json:"empty"`
+	Held         int          `json:"held,omitempty"`
+	RowsAffected int64        `json:"rowsAffected"`
+	Error        string       `json:"error,omitempty"`
+	Files        []fileResult `json:"files"`
+}
+
+// writeRunSummary writes the results of the run as one JSON document to w.
+// Logs keep going to stderr, so wrappers can parse stdout directly.
+func writeRunSummary(w io.Writer, results []jobResult, started time.Time, exitCode int) error {
+	host, _ := os.Hostname()
+	s := runSummary{Version: Version(), Host: host, RunID: currentRunID(), Started: started, Finished: time.Now(), ExitCode: exitCode, Jobs: []jobSummary{}}
+	for _, r := range results {
+		js := jobSummary{Name: r.Name, Processed: r.Processed, Failed: r.Failed, Empty: r.Empty, Held: r.Held, RowsAffected: r.RowsAffected, Files: r.Files}
+		if r.Err != nil {
+			js.Error = r.Err.Error()
+		}
+		if js.Files == nil {
+			js.Files = []fileResult{}
+		}
+		s.Jobs = append(s.Jobs, js)
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(s)
+}
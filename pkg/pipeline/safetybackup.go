@@ -0,0 +1,95 @@
+package pipeline
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"backup-otomatis/pkg/restore"
+)
+
+// safetyBackupEnabled reports whether SAFETY_BACKUP takes a copy-only backup of
+// the job's database before the update changes it, for manual rollback.
+func safetyBackupEnabled() bool {
+	return strings.EqualFold(os.Getenv("SAFETY_BACKUP"), "true")
+}
+
+// takeSafetyBackup backs up dbName to SAFETY_BACKUP_DIR, or the instance's
+// default backup folder, and returns the path of the backup on the SQL Server
+// host. COMPRESSION and CHECKSUM are used unless SAFETY_BACKUP_COMPRESSION or
+// SAFETY_BACKUP_CHECKSUM is false; Express editions cannot compress backups.
+// The backup is not started when the destination drive has less free space
+// than the data in use, so it cannot fill the disk the restores need.
+func (p *Pipeline) takeSafetyBackup(dbName, kab string) (string, error) {
+	dir := os.Getenv("SAFETY_BACKUP_DIR")
+	if dir == "" {
+		v, err := restore.Scalar(p.DBHost, p.DBUser, p.DBPass, "master", "SELECT CAST(SERVERPROPERTY('InstanceDefaultBackupPath') AS nvarchar(4000))")
+		if err != nil || v == "" || strings.EqualFold(v, "NULL") {
+			return "", fmt.Errorf("SAFETY_BACKUP_DIR is not set and the instance has no default backup path")
+		}
+		dir = v
+	}
+	name := fmt.Sprintf("%s_%s_%s.bak", dbName, sanitizeFileName(kab), time.Now().Format("20060102-150405"))
+	// The path is interpreted by SQL Server, which runs on Windows.
+	path := strings.TrimRight(dir, `\/`) + `\` + name
+
+	if err := p.checkSafetyBackupSpace(dbName, dir); err != nil {
+		return "", err
+	}
+
+	options := []string{"COPY_ONLY", "INIT"}
+	if !strings.EqualFold(os.Getenv("SAFETY_BACKUP_COMPRESSION"), "false") {
+		options = append(options, "COMPRESSION")
+	}
+	if !strings.EqualFold(os.Getenv("SAFETY_BACKUP_CHECKSUM"), "false") {
+		options = append(options, "CHECKSUM")
+	}
+	log.Printf("Taking safety backup of %s to %s (%s)", dbName, path, strings.Join(options, ", "))
+	query := fmt.Sprintf("BACKUP DATABASE [%s] TO DISK = N'%s' WITH %s;", dbName, sqlString(path), strings.Join(options, ", "))
+	if _, err := restore.RunQuery(p.DBHost, p.DBUser, p.DBPass, "master", query); err != nil {
+		return "", fmt.Errorf("safety backup of %s failed: %v", dbName, err)
+	}
+	return path, nil
+}
+
+// checkSafetyBackupSpace compares the data in use in dbName with the free space
+// of the destination drive as reported by SQL Server. Destinations without a
+// drive letter, such as UNC shares, are not checked.
+func (p *Pipeline) checkSafetyBackupSpace(dbName, dir string) error {
+	if len(dir) < 2 || dir[1] != ':' {
+		log.Printf("Not checking free space of safety backup destination %s", dir)
+		return nil
+	}
+	drive := strings.ToUpper(dir[:1])
+	v, err := restore.Scalar(p.DBHost, p.DBUser, p.DBPass, dbName,
+		"SELECT SUM(CAST(FILEPROPERTY(name, 'SpaceUsed') AS bigint)) * 8192 FROM sys.database_files WHERE type = 0")
+	if err != nil {
+		return fmt.Errorf("failed to measure %s: %v", dbName, err)
+	}
+	needed, _ := strconv.ParseInt(v, 10, 64)
+	v, err = restore.Scalar(p.DBHost, p.DBUser, p.DBPass, "master",
+		"CREATE TABLE #drives (drive char(1), mb bigint); INSERT #drives EXEC master.sys.xp_fixeddrives; "+
+			"SELECT mb FROM #drives WHERE drive = '"+drive+"'")
+	if err != nil || v == "" {
+		log.Printf("Warning: could not read free space of drive %s: %v", drive, err)
+		return nil
+	}
+	freeMB, _ := strconv.ParseInt(v, 10, 64)
+	if free := freeMB * 1024 * 1024; free < needed {
+		return fmt.Errorf("safety backup of %s needs up to %s but drive %s: has %s free", dbName, formatBytes(needed), drive, formatBytes(free))
+	}
+	return nil
+}
+
+// sanitizeFileName replaces the characters Windows does not allow in file names.
+func sanitizeFileName(s string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`<>:"/\|?* `, r) {
+			return '_'
+		}
+		return r
+	}, s)
+}
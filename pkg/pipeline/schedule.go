@@ -0,0 +1,118 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// jobSchedule restricts when a job runs. Empty fields do not restrict.
+type jobSchedule struct {
+	// Days are the weekdays the job runs on, e.g. ["mon", "tue", "wed", "thu", "fri"].
+	Days []string `json:"days"`
+	// Hours is the daily window in the job's timezone, e.g. "07:00-17:00". A
+	// window ending before it starts spans midnight.
+	Hours string `json:"hours"`
+	// SkipHolidays pauses the job on the dates of HOLIDAYS_FILE.
+	SkipHolidays bool `json:"skipHolidays"`
+}
+
+// holiday is one entry of HOLIDAYS_FILE.
+type holiday struct {
+	Date string `json:"date"` // YYYY-MM-DD
+	Name string `json:"name"`
+}
+
+// loadHolidays reads the holiday calendar from HOLIDAYS_FILE, a JSON array of
+// {"date": "2026-08-17", "name": "..."} objects, keyed by date.
+func loadHolidays() (map[string]string, error) {
+	path := os.Getenv("HOLIDAYS_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read holidays: %v", err)
+	}
+	var hs []holiday
+	if err := json.Unmarshal(b, &hs); err != nil {
+		return nil, fmt.Errorf("failed to parse holidays %s: %v", path, err)
+	}
+	out := make(map[string]string, len(hs))
+	for _, h := range hs {
+		if _, err := time.Parse("2006-01-02", h.Date); err != nil {
+			return nil, fmt.Errorf("invalid holiday date %q in %s", h.Date, path)
+		}
+		out[h.Date] = h.Name
+	}
+	return out, nil
+}
+
+// parseHours parses a "HH:MM-HH:MM" window into minutes since midnight.
+func parseHours(s string) (from, to int, err error) {
+	a, b, ok := strings.Cut(s, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid hours %q, want HH:MM-HH:MM", s)
+	}
+	ta, errA := time.Parse("15:04", strings.TrimSpace(a))
+	tb, errB := time.Parse("15:04", strings.TrimSpace(b))
+	if errA != nil || errB != nil {
+		return 0, 0, fmt.Errorf("invalid hours %q, want HH:MM-HH:MM", s)
+	}
+	return ta.Hour()*60 + ta.Minute(), tb.Hour()*60 + tb.Minute(), nil
+}
+
+// allows reports whether the schedule permits running at now, which must be
+// in the job's timezone, and otherwise why not.
+func (s *jobSchedule) allows(now time.Time, holidays map[string]string) (bool, string) {
+	if len(s.Days) > 0 {
+		today := strings.ToLower(now.Weekday().String()[:3])
+		found := false
+		for _, d := range s.Days {
+			if d = strings.ToLower(strings.TrimSpace(d)); len(d) >= 3 && d[:3] == today {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false, fmt.Sprintf("does not run on %s", now.Weekday())
+		}
+	}
+	if s.SkipHolidays {
+		if name, ok := holidays[now.Format("2006-01-02")]; ok {
+			return false, fmt.Sprintf("paused for holiday %s", name)
+		}
+	}
+	if s.Hours != "" {
+		from, to, err := parseHours(s.Hours)
+		if err != nil {
+			log.Printf("Warning: %v, ignoring run window", err)
+			return true, ""
+		}
+		m := now.Hour()*60 + now.Minute()
+		in := m >= from && m < to
+		if to <= from {
+			in = m >= from || m < to
+		}
+		if !in {
+			return false, fmt.Sprintf("outside its run window %s", s.Hours)
+		}
+	}
+	return true, ""
+}
+
+// scheduled reports whether the job may run now and, if not, why. Jobs
+// without a schedule always run.
+func (j *job) scheduled(now time.Time) (bool, string) {
+	if j.Schedule == nil {
+		return true, ""
+	}
+	holidays, err := loadHolidays()
+	if err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	return j.Schedule.allows(now.In(j.location()), holidays)
+}
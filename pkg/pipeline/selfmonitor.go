@@ -0,0 +1,168 @@
+package pipeline
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"runtime"
+	"runtime/metrics"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"backup-otomatis/internal/env"
+)
+
+// defaultResourceLogInterval is how often listen logs its resource usage when
+// RESOURCE_LOG_INTERVAL is not set.
+const defaultResourceLogInterval = 15 * time.Minute
+
+// processStarted is used for the uptime reported in resource summaries.
+var processStarted = time.Now()
+
+// lastResourceLog is when listen last logged its resource usage.
+var lastResourceLog time.Time
+
+func init() {
+	expvar.Publish("process", expvar.Func(func() interface{} { return currentResources() }))
+}
+
+// resourceUsage is a snapshot of the process's own resource consumption.
+type resourceUsage struct {
+	// MemoryBytes is the memory the Go runtime holds from the operating system,
+	// which for this process is close to its resident set size.
+	MemoryBytes uint64  `json:"memoryBytes"`
+	HeapBytes   uint64  `json:"heapBytes"`
+	Goroutines  int     `json:"goroutines"`
+	Uptime      float64 `json:"uptimeSeconds"`
+}
+
+// currentResources samples the runtime metrics of the process.
+func currentResources() resourceUsage {
+	samples := []metrics.Sample{
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+		{Name: "/memory/classes/heap/objects:bytes"},
+	}
+	metrics.Read(samples)
+	value := func(i int) uint64 {
+		if samples[i].Value.Kind() != metrics.KindUint64 {
+			return 0
+		}
+		return samples[i].Value.Uint64()
+	}
+	return resourceUsage{
+		MemoryBytes: value(0) - value(1),
+		HeapBytes:   value(2),
+		Goroutines:  runtime.NumGoroutine(),
+		Uptime:      time.Since(processStarted).Seconds(),
+	}
+}
+
+// maybeLogResources logs a resource summary once per RESOURCE_LOG_INTERVAL.
+func maybeLogResources() {
+	if time.Since(lastResourceLog) < env.Duration("RESOURCE_LOG_INTERVAL", defaultResourceLogInterval) {
+		return
+	}
+	lastResourceLog = time.Now()
+	r := currentResources()
+	log.Printf("Resources: memory %s, heap %s, %d goroutine(s), up %s",
+		formatBytes(int64(r.MemoryBytes)), formatBytes(int64(r.HeapBytes)), r.Goroutines,
+		time.Duration(r.Uptime*float64(time.Second)).Round(time.Minute))
+}
+
+// memoryCeiling returns MEMORY_CEILING_MB in bytes, or 0 when unset.
+func memoryCeiling() uint64 {
+	v := os.Getenv("MEMORY_CEILING_MB")
+	if v == "" {
+		return 0
+	}
+	mb, err := strconv.ParseUint(v, 10, 64)
+	if err != nil || mb == 0 {
+		log.Printf("Warning: invalid MEMORY_CEILING_MB %q, ignoring it", v)
+		return 0
+	}
+	return mb << 20
+}
+
+// memoryOverCeiling reports whether the process uses more memory than
+// MEMORY_CEILING_MB, after a garbage collection to rule out uncollected garbage.
+func memoryOverCeiling() bool {
+	ceiling := memoryCeiling()
+	if ceiling == 0 || currentResources().MemoryBytes <= ceiling {
+		return false
+	}
+	runtime.GC()
+	r := currentResources()
+	if r.MemoryBytes <= ceiling {
+		return false
+	}
+	notifyMsg(levelWarning, "memory-ceiling", msgData{"Memory": formatBytes(int64(r.MemoryBytes)),
+		"Ceiling": formatBytes(int64(ceiling)), "Goroutines": r.Goroutines, "Action": env.Or("MEMORY_CEILING_ACTION", "restart")})
+	return true
+}
+
+// restartAfterCeiling ends listen once memory exceeded the ceiling. With
+// MEMORY_CEILING_ACTION=exit the process exits with an error so a service
+// manager restarts it; otherwise a fresh process with the same arguments is
+// started before this one returns.
+func restartAfterCeiling() error {
+	if strings.EqualFold(os.Getenv("MEMORY_CEILING_ACTION"), "exit") {
+		return fmt.Errorf("memory ceiling exceeded, exiting for restart")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("memory ceiling exceeded and the executable cannot be found: %v", err)
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("memory ceiling exceeded and restarting failed: %v", err)
+	}
+	log.Printf("Memory ceiling exceeded, continuing in new process %d", cmd.Process.Pid)
+	return nil
+}
+
+// handleMetrics serves the process resources and every integer expvar counter
+// in the Prometheus text format.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	res := currentResources()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintf(w, "backup_otomatis_memory_bytes %d\n", res.MemoryBytes)
+	fmt.Fprintf(w, "backup_otomatis_heap_bytes %d\n", res.HeapBytes)
+	fmt.Fprintf(w, "backup_otomatis_goroutines %d\n", res.Goroutines)
+	fmt.Fprintf(w, "backup_otomatis_uptime_seconds %.0f\n", res.Uptime)
+	var lines []string
+	expvar.Do(func(kv expvar.KeyValue) {
+		if v, ok := kv.Value.(*expvar.Int); ok {
+			lines = append(lines, fmt.Sprintf("backup_otomatis_%s %d", kv.Key, v.Value()))
+		}
+	})
+	sort.Strings(lines)
+	for _, l := range lines {
+		fmt.Fprintln(w, l)
+	}
+}
+
+// startMetricsServer serves /metrics and /debug/vars on METRICS_LISTEN_ADDR
+// for processes that do not run the full HTTP server, such as listen.
+func startMetricsServer() {
+	addr := os.Getenv("METRICS_LISTEN_ADDR")
+	if addr == "" {
+		return
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.Handle("/debug/vars", expvar.Handler())
+	srv := &http.Server{Addr: addr, Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		log.Printf("Metrics listening on %s", addr)
+		if err := srv.ListenAndServe(); err != nil {
+			log.Printf("Warning: metrics server stopped: %v", err)
+		}
+	}()
+}
@@ -0,0 +1,231 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"backup-otomatis/internal/env"
+)
+
+// defaultStaleAfter is how long a kab may go without a restore before it is
+// reported as stale, unless STALE_AFTER overrides it.
+const defaultStaleAfter = 48 * time.Hour
+
+// kabFreshness is the restore freshness of one kab as served by /api/freshness.
+type kabFreshness struct {
+	Kab            string     `json:"kab"`
+	LastRestore    *time.Time `json:"lastRestore"`
+	StalenessHours *float64   `json:"stalenessHours"`
+	Stale          bool       `json:"stale"`
+}
+
+// freshness returns one entry per kab that was ever restored or is listed in
+// EXPECTED_KABS, sorted by kab. Kabs without any restore are stale.
+func freshness(last map[string]time.Time, now time.Time, staleAfter time.Duration, thresholds map[string]time.Duration) []kabFreshness {
+	kabs := map[string]bool{}
+	for k := range last {
+		kabs[k] = true
+	}
+	for _, k := range strings.Split(os.Getenv("EXPECTED_KABS"), ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			kabs[k] = true
+		}
+	}
+	out := make([]kabFreshness, 0, len(kabs))
+	for k := range kabs {
+		f := kabFreshness{Kab: k, Stale: true}
+		if at, ok := last[k]; ok {
+			at := at
+			hours := now.Sub(at).Hours()
+			f.LastRestore = &at
+			f.StalenessHours = &hours
+			limit := staleAfter
+			if d, ok := thresholds[k]; ok {
+				limit = d
+			}
+			f.Stale = now.Sub(at) > limit
+		}
+		out = append(out, f)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Kab < out[j].Kab })
+	return out
+}
+
+// handleFreshness serves GET /api/freshness. The state file is re-read on every
+// request because scheduled runs update it from another process.
+func handleFreshness(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	st, err := openState(stateFilePath())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, freshness(st.lastRestores(), time.Now(), env.Duration("STALE_AFTER", defaultStaleAfter), staleThresholds()))
+}
+
+// writeJSON writes body as the JSON response.
+func writeJSON(w http.ResponseWriter, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(body); err != nil {
+		log.Printf("Warning: failed to write response: %v", err)
+	}
+}
+
+// handleStatus serves GET /api/status: whether processing is paused and which
+// dashboard requests are waiting for the next run.
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	c, err := readControl()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, c)
+}
+
+// handleAudit serves GET /api/audit with the latest operator actions.
+func handleAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	entries, err := readAudit(200)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, entries)
+}
+
+// audited records the operator action in the audit log before responding.
+// A failure to write the audit entry fails the action.
+func audited(w http.ResponseWriter, r *http.Request, action, detail string) bool {
+	id := requestIdentity(r)
+	err := appendAudit(auditEntry{At: time.Now(), User: id.User, Role: id.Role, Action: action, Detail: detail, RemoteAddr: r.RemoteAddr})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	log.Printf("%s by %s from %s %s", action, id.User, r.RemoteAddr, detail)
+	return true
+}
+
+// handlePause serves POST /api/pause. Scheduled runs and the listener stop
+// picking up work until processing is resumed.
+func handlePause(w http.ResponseWriter, r *http.Request) {
+	if !audited(w, r, "pause", "") {
+		return
+	}
+	user := requestIdentity(r).User
+	now := time.Now()
+	err := updateControl(func(c *controlData) {
+		c.Paused, c.PausedBy, c.PausedAt = true, user, &now
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleResume serves POST /api/resume.
+func handleResume(w http.ResponseWriter, r *http.Request) {
+	if !audited(w, r, "resume", "") {
+		return
+	}
+	err := updateControl(func(c *controlData) {
+		c.Paused, c.PausedBy, c.PausedAt = false, "", nil
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleRequest serves POST /api/requests. The body uses the queue message
+// format ({"fileId": ...} to retry one file, {"kab": ...} to re-restore a
+// kab); the request is handled at the start of the next run.
+func handleRequest(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, 1<<16))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req, err := parseWorkRequest(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !audited(w, r, "request", fmt.Sprintf("file=%q kab=%q", req.FileID, req.Kab)) {
+		return
+	}
+	user := requestIdentity(r).User
+	err = updateControl(func(c *controlData) {
+		c.Requests = append(c.Requests, controlRequest{workRequest: req, RequestedBy: user, At: time.Now()})
+	})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// newServerMux returns the routes of the embedded HTTP server.
+func newServerMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/freshness", handleFreshness)
+	mux.HandleFunc("/api/status", handleStatus)
+	mux.HandleFunc("/api/queue", handleQueue)
+	mux.HandleFunc("/api/audit", handleAudit)
+	mux.HandleFunc("/api/pause", operatorOnly(handlePause))
+	mux.HandleFunc("/api/resume", operatorOnly(handleResume))
+	mux.HandleFunc("/api/requests", operatorOnly(handleRequest))
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
+
+// serve runs the embedded HTTP server on HTTP_LISTEN_ADDR (default ":8080"),
+// over TLS when HTTP_TLS_CERT and HTTP_TLS_KEY are set.
+func serve() error {
+	auth, err := loadHTTPAuth()
+	if err != nil {
+		return err
+	}
+	tlsConfig, err := serverTLSConfig()
+	if err != nil {
+		return err
+	}
+	certFile, keyFile := os.Getenv("HTTP_TLS_CERT"), os.Getenv("HTTP_TLS_KEY")
+	if tlsConfig != nil && (certFile == "" || keyFile == "") {
+		return fmt.Errorf("HTTP_CLIENT_CA requires HTTP_TLS_CERT and HTTP_TLS_KEY")
+	}
+	addr := env.Or("HTTP_LISTEN_ADDR", ":8080")
+	srv := &http.Server{
+		Addr:              addr,
+		Handler:           auth.wrap(newServerMux()),
+		TLSConfig:         tlsConfig,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if certFile != "" {
+		log.Printf("HTTPS server listening on %s", addr)
+		return srv.ListenAndServeTLS(certFile, keyFile)
+	}
+	log.Printf("HTTP server listening on %s", addr)
+	return srv.ListenAndServe()
+}
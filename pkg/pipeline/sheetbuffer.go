@@ -0,0 +1,44 @@
+package pipeline
+
+import (
+	"backup-otomatis/pkg/track"
+)
+
+// BufferSheetWrite stores a failed update, replacing an older pending update
+// of the same row since the newer one supersedes it.
+func (s *stateStore) BufferSheetWrite(w track.Write) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.data.PendingSheetWrites[:0]
+	for _, p := range s.data.PendingSheetWrites {
+		if !p.SameRow(w.SpreadsheetID, w.Kab) {
+			kept = append(kept, p)
+		}
+	}
+	s.data.PendingSheetWrites = append(kept, w)
+	return s.save()
+}
+
+// DropSheetWrites forgets pending updates of a row that was just written.
+func (s *stateStore) DropSheetWrites(spreadsheetID, kab string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.data.PendingSheetWrites[:0]
+	for _, p := range s.data.PendingSheetWrites {
+		if !p.SameRow(spreadsheetID, kab) {
+			kept = append(kept, p)
+		}
+	}
+	if len(kept) == len(s.data.PendingSheetWrites) {
+		return nil
+	}
+	s.data.PendingSheetWrites = kept
+	return s.save()
+}
+
+// PendingSheetWrites returns a copy of the buffered updates, oldest first.
+func (s *stateStore) PendingSheetWrites() []track.Write {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]track.Write(nil), s.data.PendingSheetWrites...)
+}
@@ -0,0 +1,156 @@
+package pipeline
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"backup-otomatis/internal/env"
+	"backup-otomatis/pkg/track"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/sheets/v4"
+)
+
+// autoCreateSpreadsheets reports whether jobs without a spreadsheetId get a
+// tracking sheet of their own instead of SPREADSHEET_ID.
+func autoCreateSpreadsheets() bool {
+	return strings.EqualFold(os.Getenv("AUTO_CREATE_SPREADSHEETS"), "true")
+}
+
+// ensureJobSpreadsheet gives a job without a spreadsheetId the sheet created
+// for it earlier, or creates one, when AUTO_CREATE_SPREADSHEETS is true. The
+// ID is kept in the state file by job name so later runs reuse the sheet.
+func (p *Pipeline) ensureJobSpreadsheet(srv *drive.Service, sheetsSrv *sheets.Service, j *job) error {
+	if j.SpreadsheetID != "" || !autoCreateSpreadsheets() {
+		return nil
+	}
+	if id := p.state.jobSpreadsheet(j.Name); id != "" {
+		j.SpreadsheetID = id
+		return nil
+	}
+	id, err := createTrackingSpreadsheet(srv, sheetsSrv, env.Or("SPREADSHEET_NAME_PREFIX", "Backup tracking")+" - "+j.Name)
+	if err != nil {
+		return fmt.Errorf("failed to create spreadsheet for job %s: %v", j.Name, err)
+	}
+	if err := p.state.setJobSpreadsheet(j.Name, id); err != nil {
+		log.Printf("Warning: failed to save state: %v", err)
+	}
+	j.SpreadsheetID = id
+	notifyMsg(levelInfo, "spreadsheet-created", msgData{"Job": j.Name, "ID": id})
+	return nil
+}
+
+// createTrackingSpreadsheet creates a tracking sheet in SPREADSHEET_FOLDER_ID
+// and shares it with SPREADSHEET_SHARE_WITH. With SPREADSHEET_TEMPLATE_ID the
+// template is copied, keeping its headers and formatting; otherwise a sheet
+// with a frozen header row and a highlight for stale uploads is set up.
+func createTrackingSpreadsheet(srv *drive.Service, sheetsSrv *sheets.Service, name string) (string, error) {
+	var parents []string
+	if folder := os.Getenv("SPREADSHEET_FOLDER_ID"); folder != "" {
+		parents = []string{folder}
+	}
+	var id string
+	if tmpl := os.Getenv("SPREADSHEET_TEMPLATE_ID"); tmpl != "" {
+		f, err := srv.Files.Copy(tmpl, &drive.File{Name: name, Parents: parents}).Fields("id").Do()
+		if err != nil {
+			return "", fmt.Errorf("failed to copy template %s: %v", tmpl, err)
+		}
+		id = f.Id
+	} else {
+		f, err := srv.Files.Create(&drive.File{Name: name, Parents: parents, MimeType: "application/vnd.google-apps.spreadsheet"}).Fields("id").Do()
+		if err != nil {
+			return "", err
+		}
+		id = f.Id
+		if err := formatTrackingSpreadsheet(sheetsSrv, id); err != nil {
+			return "", err
+		}
+	}
+	log.Printf("Created tracking spreadsheet %q (%s)", name, id)
+	// The sheet exists now; a sharing failure must not make the next run
+	// create another one.
+	if err := shareSpreadsheet(srv, id); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+	return id, nil
+}
+
+// formatTrackingSpreadsheet writes the header row of a new tracking sheet,
+// freezes it, and colours upload times older than STALE_AFTER.
+func formatTrackingSpreadsheet(sheetsSrv *sheets.Service, id string) error {
+	headers := []interface{}{env.Or("SPREADSHEET_KAB_HEADER", track.DefaultKabHeader), env.Or("SPREADSHEET_UPLOAD_HEADER", track.DefaultUploadHeader)}
+	for _, h := range strings.Split(os.Getenv("SPREADSHEET_EXTRA_HEADERS"), ",") {
+		if h = strings.TrimSpace(h); h != "" {
+			headers = append(headers, h)
+		}
+	}
+	vr := &sheets.ValueRange{Values: [][]interface{}{headers}}
+	if _, err := sheetsSrv.Spreadsheets.Values.Update(id, "A1", vr).ValueInputOption("RAW").Do(); err != nil {
+		return fmt.Errorf("failed to write spreadsheet headers: %v", err)
+	}
+	staleDays := env.Duration("STALE_AFTER", defaultStaleAfter).Hours() / 24
+	req := &sheets.BatchUpdateSpreadsheetRequest{Requests: []*sheets.Request{
+		{UpdateSheetProperties: &sheets.UpdateSheetPropertiesRequest{
+			Properties: &sheets.SheetProperties{SheetId: 0, GridProperties: &sheets.GridProperties{FrozenRowCount: 1}},
+			Fields:     "gridProperties.frozenRowCount",
+		}},
+		{RepeatCell: &sheets.RepeatCellRequest{
+			Range:  &sheets.GridRange{SheetId: 0, StartRowIndex: 0, EndRowIndex: 1},
+			Cell:   &sheets.CellData{UserEnteredFormat: &sheets.CellFormat{TextFormat: &sheets.TextFormat{Bold: true}}},
+			Fields: "userEnteredFormat.textFormat.bold",
+		}},
+		{AddConditionalFormatRule: &sheets.AddConditionalFormatRuleRequest{Rule: &sheets.ConditionalFormatRule{
+			Ranges: []*sheets.GridRange{{SheetId: 0, StartRowIndex: 1, StartColumnIndex: 1, EndColumnIndex: 2}},
+			BooleanRule: &sheets.BooleanRule{
+				Condition: &sheets.BooleanCondition{Type: "CUSTOM_FORMULA", Values: []*sheets.ConditionValue{
+					{UserEnteredValue: fmt.Sprintf("=AND(ISNUMBER($B2), NOW()-$B2>%g)", staleDays)},
+				}},
+				Format: &sheets.CellFormat{BackgroundColor: &sheets.Color{Red: 0.96, Green: 0.8, Blue: 0.8}},
+			},
+		}}},
+	}}
+	if _, err := sheetsSrv.Spreadsheets.BatchUpdate(id, req).Do(); err != nil {
+		return fmt.Errorf("failed to format spreadsheet: %v", err)
+	}
+	return nil
+}
+
+// shareSpreadsheet grants SPREADSHEET_SHARE_ROLE (default writer) on the sheet
+// to each address of SPREADSHEET_SHARE_WITH, without notification emails.
+func shareSpreadsheet(srv *drive.Service, id string) error {
+	role := env.Or("SPREADSHEET_SHARE_ROLE", "writer")
+	for _, addr := range splitAddresses(os.Getenv("SPREADSHEET_SHARE_WITH")) {
+		// Whether an address is a group is not known, so it is tried as a
+		// group first and then as a user.
+		p := &drive.Permission{Type: "group", Role: role, EmailAddress: addr}
+		_, err := srv.Permissions.Create(id, p).SendNotificationEmail(false).Do()
+		if err != nil {
+			p.Type = "user"
+			_, err = srv.Permissions.Create(id, p).SendNotificationEmail(false).Do()
+		}
+		if err != nil {
+			return fmt.Errorf("failed to share spreadsheet with %s: %v", addr, err)
+		}
+		log.Printf("Shared spreadsheet %s with %s as %s", id, addr, role)
+	}
+	return nil
+}
+
+// jobSpreadsheet returns the spreadsheet created for the job, if any.
+func (s *stateStore) jobSpreadsheet(name string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data.JobSpreadsheets[name]
+}
+
+// setJobSpreadsheet records the spreadsheet created for the job.
+func (s *stateStore) setJobSpreadsheet(name, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data.JobSpreadsheets == nil {
+		s.data.JobSpreadsheets = map[string]string{}
+	}
+	s.data.JobSpreadsheets[name] = id
+	return s.save()
+}
@@ -0,0 +1,104 @@
+package pipeline
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"backup-otomatis/pkg/restore"
+	"backup-otomatis/pkg/source"
+	"backup-otomatis/pkg/track"
+	"google.golang.org/api/sheets/v4"
+)
+
+// sheetLogHeader is the header row of every log tab.
+var sheetLogHeader = []interface{}{"Time", "Job", "Kab", "File", "Size (MB)", "Status", "Restore", "Notes", "Ref"}
+
+// sheetLogTabs remembers the log tabs known to exist, by spreadsheet ID and
+// title, so the spreadsheet is only inspected once per tab and process.
+var sheetLogTabs = struct {
+	sync.Mutex
+	known map[string]bool
+}{known: map[string]bool{}}
+
+// sheetLogTabLayout returns the Go time layout of the log tab names for
+// SHEET_LOG_TABS ("day" or "month"), or "" when the processing log is disabled.
+func sheetLogTabLayout() string {
+	switch strings.ToLower(os.Getenv("SHEET_LOG_TABS")) {
+	case "":
+		return ""
+	case "day":
+		return "2006-01-02"
+	case "month":
+		return "2006-01"
+	}
+	log.Printf("Warning: invalid SHEET_LOG_TABS %q, use day or month", os.Getenv("SHEET_LOG_TABS"))
+	return ""
+}
+
+// appendSheetLog appends one row for the processed file to the tracking
+// spreadsheet's log tab of the current day or month, e.g. "2025-06" (prefixed
+// with SHEET_LOG_TAB_PREFIX), creating the tab with its header when missing.
+// The tracking tab keeps one row per kab; the log tabs keep every file without
+// any single tab growing without bound. Failures are logged and never fail the file.
+func (p *Pipeline) appendSheetLog(sheetsSrv *sheets.Service, j *job, file *source.File, out fileOutcome, procErr error) {
+	layout := sheetLogTabLayout()
+	if layout == "" {
+		return
+	}
+	now := time.Now().In(j.location())
+	spreadsheetID := j.spreadsheetID(p.Config)
+	tab := os.Getenv("SHEET_LOG_TAB_PREFIX") + now.Format(layout)
+	if err := ensureSheetLogTab(sheetsSrv, spreadsheetID, tab); err != nil {
+		log.Printf("Warning: failed to prepare log tab %s: %v", tab, err)
+		return
+	}
+	kab, err := file.Kab()
+	if err != nil {
+		kab = ""
+	}
+	status, notes := "processed", restore.FormatRowsAffected(out.RowsAffected)
+	switch {
+	case procErr != nil:
+		status, notes = "failed", procErr.Error()
+	case out.Empty:
+		status, notes = "empty", ""
+	}
+	restore := ""
+	if d, ok := out.Phases["restore"]; ok {
+		restore = d.Round(time.Second).String()
+	}
+	row := []interface{}{now.Format("2006-01-02 15:04:05"), j.Name, kab, file.Name,
+		fmt.Sprintf("%.1f", float64(file.Size)/(1024*1024)), status, restore, notes, out.CorrelationID}
+	vr := &sheets.ValueRange{Values: [][]interface{}{row}}
+	_, err = sheetsSrv.Spreadsheets.Values.Append(spreadsheetID, track.SheetRange(tab, "A:A"), vr).ValueInputOption("RAW").InsertDataOption("INSERT_ROWS").Do()
+	if err != nil {
+		log.Printf("Warning: failed to append to log tab %s: %v", tab, err)
+	}
+}
+
+// ensureSheetLogTab creates the log tab with its header row unless it is
+// already known to exist.
+func ensureSheetLogTab(srv *sheets.Service, spreadsheetID, tab string) error {
+	key := spreadsheetID + "/" + tab
+	sheetLogTabs.Lock()
+	defer sheetLogTabs.Unlock()
+	if sheetLogTabs.known[key] {
+		return nil
+	}
+	created, err := ensureSheetTab(srv, spreadsheetID, tab)
+	if err != nil {
+		return err
+	}
+	if created {
+		vr := &sheets.ValueRange{Values: [][]interface{}{sheetLogHeader}}
+		if _, err := srv.Spreadsheets.Values.Update(spreadsheetID, track.SheetRange(tab, "A1"), vr).ValueInputOption("RAW").Do(); err != nil {
+			return fmt.Errorf("failed to write log header: %v", err)
+		}
+	}
+	sheetLogTabs.known[key] = true
+	return nil
+}
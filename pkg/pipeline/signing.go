@@ -0,0 +1,174 @@
+package pipeline
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// trustedKeys are the base64 Ed25519 public keys whose signatures are accepted
+// for code run by the tool, comma-separated, set at build time with
+// go build -ldflags "-X backup-otomatis/pkg/pipeline.trustedKeys=<key1>,<key2>".
+// They are deliberately not configurable at run time, so whoever can edit .env
+// cannot add a key.
+var trustedKeys = ""
+
+// signedPluginsRequired reports whether step plugins must carry a signature
+// by one of trustedKeys: always in a build with trusted keys, so the
+// environment cannot turn verification off. REQUIRE_SIGNED_PLUGINS=true can
+// only add the requirement, which a build without keys then fails.
+func signedPluginsRequired() bool {
+	return trustedKeys != "" || strings.EqualFold(os.Getenv("REQUIRE_SIGNED_PLUGINS"), "true")
+}
+
+// verifySignature checks the detached signature sigPath, the base64 Ed25519
+// signature of data, against trustedKeys.
+func verifySignature(name string, data []byte, sigPath string) error {
+	raw, err := os.ReadFile(sigPath)
+	if err != nil {
+		return fmt.Errorf("no signature for %s: %v", name, err)
+	}
+	sig, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(raw)))
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return fmt.Errorf("invalid signature file %s", sigPath)
+	}
+	keys := 0
+	for _, k := range strings.Split(trustedKeys, ",") {
+		pub, err := base64.StdEncoding.DecodeString(strings.TrimSpace(k))
+		if err != nil || len(pub) != ed25519.PublicKeySize {
+			continue
+		}
+		keys++
+		if ed25519.Verify(ed25519.PublicKey(pub), data, sig) {
+			return nil
+		}
+	}
+	if keys == 0 {
+		return fmt.Errorf("cannot verify %s: this build has no trusted keys", name)
+	}
+	return fmt.Errorf("signature of %s does not match any trusted key", name)
+}
+
+// verifyPinned checks that the SHA-256 digest of data is the pinned hex digest.
+func verifyPinned(name string, data []byte, pinned string) error {
+	sum := sha256.Sum256(data)
+	if got := hex.EncodeToString(sum[:]); !strings.EqualFold(got, strings.TrimSpace(pinned)) {
+		return fmt.Errorf("%s has SHA-256 %s, pinned is %s", name, got, pinned)
+	}
+	return nil
+}
+
+// artifactIndex returns which element of the plugin's command is its code:
+// the executable, resolved to exe, when artifact is not set, otherwise the
+// element naming the same file as artifact. An artifact the command does not
+// run is an error, since checking it would vouch for nothing.
+func (p stepPlugin) artifactIndex(exe string) (int, error) {
+	if p.Artifact == "" {
+		return 0, nil
+	}
+	want, err := os.Stat(p.Artifact)
+	if err != nil {
+		return 0, fmt.Errorf("artifact: %v", err)
+	}
+	for i, arg := range p.Command {
+		if i == 0 {
+			arg = exe
+		}
+		if fi, err := os.Stat(arg); err == nil && os.SameFile(fi, want) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("artifact %s is not part of the command", p.Artifact)
+}
+
+// verifyInterpreter checks exe, the executable running a plugin whose
+// artifact is one of its arguments, against interpreterSha256 when it is set
+// and against trustedKeys when signatures are required. An interpreter that
+// nothing vouches for fails the plugin, since any binary could otherwise be
+// paired with a verified script.
+func (p stepPlugin) verifyInterpreter(exe string) error {
+	if p.InterpreterSHA256 == "" && !signedPluginsRequired() {
+		return fmt.Errorf("interpreter %s is not verified: set interpreterSha256", exe)
+	}
+	data, err := os.ReadFile(exe)
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %v", exe, err)
+	}
+	if p.InterpreterSHA256 != "" {
+		if err := verifyPinned(exe, data, p.InterpreterSHA256); err != nil {
+			return err
+		}
+	}
+	if signedPluginsRequired() {
+		if err := verifySignature(exe, data, exe+".sig"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifiedCommand checks the plugin's code before it runs, against its pinned
+// digest when sha256 is set and against trustedKeys when signatures are
+// required, and returns the command line to run. The code is read once and
+// the verified copy, in a private temporary directory, takes its place in the
+// command, so the file cannot be swapped between the check and the run. When
+// the code is an argument, the executable running it is verified as well and
+// run from the path that was checked. The returned function removes the copy.
+func (p stepPlugin) verifiedCommand() ([]string, func(), error) {
+	if p.SHA256 == "" && !signedPluginsRequired() {
+		return p.Command, func() {}, nil
+	}
+	exe, err := exec.LookPath(p.Command[0])
+	if err != nil {
+		return nil, nil, fmt.Errorf("step plugin %q: %v", p.Name, err)
+	}
+	idx, err := p.artifactIndex(exe)
+	if err != nil {
+		return nil, nil, fmt.Errorf("step plugin %q: %v", p.Name, err)
+	}
+	path := p.Command[idx]
+	if idx == 0 {
+		path = exe
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("step plugin %q: failed to read %s: %v", p.Name, path, err)
+	}
+	if p.SHA256 != "" {
+		if err := verifyPinned(path, data, p.SHA256); err != nil {
+			return nil, nil, fmt.Errorf("step plugin %q: %v", p.Name, err)
+		}
+	}
+	if signedPluginsRequired() {
+		if err := verifySignature(path, data, path+".sig"); err != nil {
+			return nil, nil, fmt.Errorf("step plugin %q: %v", p.Name, err)
+		}
+	}
+	if idx != 0 {
+		if err := p.verifyInterpreter(exe); err != nil {
+			return nil, nil, fmt.Errorf("step plugin %q: %v", p.Name, err)
+		}
+	}
+
+	dir, err := os.MkdirTemp("", "plugin-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+	// The copy keeps the file name, which interpreters and Windows go by.
+	verified := filepath.Join(dir, filepath.Base(path))
+	if err := os.WriteFile(verified, data, 0o700); err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("step plugin %q: %v", p.Name, err)
+	}
+	command := append([]string(nil), p.Command...)
+	command[0] = exe
+	command[idx] = verified
+	return command, cleanup, nil
+}
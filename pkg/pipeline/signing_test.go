@@ -0,0 +1,47 @@
+package pipeline
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerifiedCommandChecksInterpreter(t *testing.T) {
+	t.Setenv("REQUIRE_SIGNED_PLUGINS", "")
+	dir := t.TempDir()
+	interp := filepath.Join(dir, "interp")
+	script := filepath.Join(dir, "scrub.py")
+	if err := os.WriteFile(interp, []byte("interpreter"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(script, []byte("script"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	digest := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+
+	p := stepPlugin{Name: "scrub", Command: []string{interp, script}, Artifact: script, SHA256: digest("script")}
+	if _, _, err := p.verifiedCommand(); err == nil || !strings.Contains(err.Error(), "interpreter") {
+		t.Fatalf("unverified interpreter: err = %v, want an interpreter error", err)
+	}
+
+	p.InterpreterSHA256 = digest("other")
+	if _, _, err := p.verifiedCommand(); err == nil {
+		t.Fatal("interpreter with a different digest was accepted")
+	}
+
+	p.InterpreterSHA256 = digest("interpreter")
+	command, cleanup, err := p.verifiedCommand()
+	if err != nil {
+		t.Fatalf("pinned interpreter: %v", err)
+	}
+	defer cleanup()
+	if command[0] != interp || command[1] == script {
+		t.Errorf("command = %v, want %s and the verified copy of the script", command, interp)
+	}
+}
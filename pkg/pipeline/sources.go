@@ -0,0 +1,45 @@
+package pipeline
+
+import (
+	"log"
+
+	"backup-otomatis/pkg/source"
+	"google.golang.org/api/drive/v3"
+)
+
+// driveSource returns the Drive folder folderID as a source whose kab lookups
+// go through parentNames.
+func (p *Pipeline) driveSource(srv *drive.Service, folderID string) *source.Drive {
+	return &source.Drive{Srv: srv, FolderID: folderID, Names: p.parentNames}
+}
+
+// jobSource returns the source of the job's backups, Drive unless the job
+// names another one.
+func (p *Pipeline) jobSource(srv *drive.Service, j *job) source.Lister {
+	switch {
+	case j.Azure != nil:
+		log.Printf("Retrieving files from Azure Blob container %s for job %s...", j.Azure.ContainerURL, j.Name)
+		return j.Azure
+	case j.GCS != nil:
+		log.Printf("Retrieving files from gs://%s/%s for job %s...", j.GCS.Bucket, j.GCS.Prefix, j.Name)
+		return j.GCS.Lister(p.ServiceAccountFile)
+	case j.URLList != nil:
+		log.Printf("Retrieving manifest %s for job %s...", j.URLList.ManifestURL, j.Name)
+		return j.URLList
+	case j.IMAP != nil:
+		log.Printf("Retrieving mail from %s %s for job %s...", j.IMAP.Addr, j.IMAP.Mailbox(), j.Name)
+		return j.IMAP
+	}
+	log.Printf("Retrieving files from Google Drive for job %s...", j.Name)
+	return p.driveSource(srv, j.FolderID)
+}
+
+// listJobFiles lists the job's backups from its source and applies the file
+// filters to the listing.
+func (p *Pipeline) listJobFiles(srv *drive.Service, j *job) ([]*source.File, error) {
+	files, err := p.jobSource(srv, j).List(j.NamePattern)
+	if err != nil {
+		return nil, err
+	}
+	return applyFileFilters(files)
+}
@@ -0,0 +1,103 @@
+package pipeline
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// sqlErrorHelp explains a SQL Server error number to the operator.
+type sqlErrorHelp struct {
+	Category    string
+	Explanation string
+	Fix         string
+}
+
+// sqlErrorHelps are the SQL Server errors commonly hit while restoring and
+// updating, by error number.
+var sqlErrorHelps = map[int]sqlErrorHelp{
+	3201: {
+		Category:    "backup file not readable",
+		Explanation: "SQL Server cannot open the extracted .bak file",
+		Fix:         "check that the SQL Server service account can read the temp folder (see RESTORE_PERMISSIONS) and that DB_HOST runs on this machine or the path is shared with it",
+	},
+	3154: {
+		Category:    "different database in backup",
+		Explanation: "the backup holds another database than the one being overwritten",
+		Fix:         "drop the Temp database by hand; the restore uses WITH REPLACE, so this points to a database restored outside the tool",
+	},
+	5118: {
+		Category:    "compressed data folder",
+		Explanation: "the database files would be placed in an NTFS-compressed or encrypted folder",
+		Fix:         "turn off NTFS compression and encryption on the SQL Server data folder",
+	},
+	1834: {
+		Category:    "database file in use",
+		Explanation: "another database already uses the data or log file the restore wants to create",
+		Fix:         "drop or move the database holding Temp.mdf/Temp_log.ldf in the instance's data folder",
+	},
+	262: {
+		Category:    "permission denied",
+		Explanation: "the SQL login lacks a permission the statement needs, e.g. CREATE DATABASE",
+		Fix:         "grant the DB_USER login the dbcreator role for restores, or the needed rights on the job database for updates",
+	},
+	18456: {
+		Category:    "login failed",
+		Explanation: "SQL Server rejected DB_USER/DB_PASS",
+		Fix:         "check the credentials, that the login is enabled and that mixed-mode authentication is on",
+	},
+	4060: {
+		Category:    "database not available",
+		Explanation: "the database named in the connection cannot be opened",
+		Fix:         "check DB_NAME or the job's database and the login's access to it",
+	},
+	3159: {
+		Category:    "tail of log not backed up",
+		Explanation: "the database being replaced is in full recovery with an unsaved log tail",
+		Fix:         "drop the Temp database by hand or set it to simple recovery",
+	},
+}
+
+// sqlMsgRE matches the header of a SQL Server message in sqlcmd output, e.g.
+// "Msg 3201, Level 16, State 2, Server SRV, Line 1".
+var sqlMsgRE = regexp.MustCompile(`Msg (\d+), Level (\d+), State \d+[^\n]*\n?([^\n]*)`)
+
+// sqlError is a SQL Server failure with an explanation for the operator.
+type sqlError struct {
+	Number  int
+	Message string
+	Help    sqlErrorHelp
+	Err     error
+}
+
+func (e *sqlError) Error() string {
+	return fmt.Sprintf("%s (SQL Server error %d): %s; fix: %s [%s]", e.Help.Category, e.Number, e.Help.Explanation, e.Help.Fix, strings.TrimSpace(e.Message))
+}
+
+func (e *sqlError) Unwrap() error { return e.Err }
+
+// explainSQLError replaces a failure caused by one of the SQL Server errors in
+// sqlErrorHelps with a sqlError explaining it, so notifications and the sheet
+// log say what went wrong and what to do instead of showing the raw sqlcmd
+// output. Messages are taken in order and the first known one wins: the
+// generic 3013 "terminating abnormally" that follows most restore errors is
+// not listed. Other errors are returned unchanged.
+func explainSQLError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var ie *incompatibleBackupError
+	var se *sqlError
+	if errors.As(err, &ie) || errors.As(err, &se) {
+		return err
+	}
+	for _, m := range sqlMsgRE.FindAllStringSubmatch(err.Error(), -1) {
+		n, _ := strconv.Atoi(m[1])
+		if help, ok := sqlErrorHelps[n]; ok {
+			return &sqlError{Number: n, Message: m[3], Help: help, Err: err}
+		}
+	}
+	return err
+}
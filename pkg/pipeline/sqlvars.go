@@ -0,0 +1,32 @@
+package pipeline
+
+import (
+	"regexp"
+	"time"
+
+	"backup-otomatis/pkg/source"
+)
+
+// leadingDigits matches the numeric kab code at the start of a folder name like "3201 Bogor".
+var leadingDigits = regexp.MustCompile(`^\d+`)
+
+// fileSQLVars returns the per-file variables available to update scripts. KAB
+// and KAB_CODE are left undefined when the kab is unknown, so a script using
+// them fails instead of running with an empty value.
+func fileSQLVars(file *source.File, kab string, j *job) map[string]string {
+	vars := map[string]string{
+		"DB_NAME":      j.DBName,
+		"RESTORED_DB":  "Temp",
+		"RESTORE_DATE": time.Now().Format("2006-01-02"),
+		"FILE_NAME":    file.Name,
+		"FILE_CREATED": file.CreatedTime,
+	}
+	if kab != "" {
+		vars["KAB"] = kab
+		vars["KAB_CODE"] = kab
+		if code := leadingDigits.FindString(kab); code != "" {
+			vars["KAB_CODE"] = code
+		}
+	}
+	return vars
+}
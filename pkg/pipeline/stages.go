@@ -0,0 +1,66 @@
+package pipeline
+
+import (
+	"log"
+	"os"
+	"strings"
+)
+
+// Pipeline stages a job can enable with its stages list. Download and
+// extraction always run.
+const (
+	stageRestore   = "restore"
+	stageUpdate    = "update"
+	stageArchive   = "archive"
+	stageReplicate = "replicate"
+)
+
+// knownStages lists the stages accepted in a job's stages list, including the
+// ones that cannot be turned off.
+var knownStages = map[string]bool{
+	"download": true, "extract": true,
+	stageRestore: true, stageUpdate: true, stageArchive: true, stageReplicate: true,
+}
+
+// runsStage reports whether the job runs the named stage. Without a stages
+// list, restore and update always run and archive and replicate run when
+// ARCHIVE_DESTINATION and REPLICATE_DESTINATION are set.
+func (j *job) runsStage(stage string) bool {
+	if len(j.Stages) == 0 {
+		switch stage {
+		case stageArchive:
+			return os.Getenv("ARCHIVE_DESTINATION") != ""
+		case stageReplicate:
+			return os.Getenv("REPLICATE_DESTINATION") != ""
+		}
+		return true
+	}
+	for _, s := range j.Stages {
+		if strings.EqualFold(strings.TrimSpace(s), stage) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkStages warns about unknown stage names and stages that cannot run as
+// configured.
+func (j *job) checkStages() {
+	for _, s := range j.Stages {
+		if !knownStages[strings.ToLower(strings.TrimSpace(s))] {
+			log.Printf("Warning: job %s lists unknown stage %q", j.Name, s)
+		}
+	}
+	if len(j.Stages) == 0 {
+		return
+	}
+	if j.runsStage(stageUpdate) && !j.runsStage(stageRestore) {
+		log.Printf("Warning: job %s runs the update stage without the restore stage; the update is skipped", j.Name)
+	}
+	if j.runsStage(stageArchive) && os.Getenv("ARCHIVE_DESTINATION") == "" {
+		log.Printf("Warning: job %s runs the archive stage but ARCHIVE_DESTINATION is not set", j.Name)
+	}
+	if j.runsStage(stageReplicate) && os.Getenv("REPLICATE_DESTINATION") == "" {
+		log.Printf("Warning: job %s runs the replicate stage but REPLICATE_DESTINATION is not set", j.Name)
+	}
+}
@@ -0,0 +1,124 @@
+package pipeline
+
+import (
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"backup-otomatis/internal/env"
+	"backup-otomatis/pkg/source"
+	"google.golang.org/api/drive/v3"
+)
+
+// A stale kab is reminded about once a day until it uploads again; listen
+// checks for stale kabs once an hour.
+const (
+	defaultStaleRemind = 24 * time.Hour
+	staleCheckInterval = time.Hour
+)
+
+// lastStaleCheck limits staleness checks, which list the kab folders, to one
+// per staleCheckInterval in listen mode.
+var lastStaleCheck time.Time
+
+// staleThresholds returns the per-kab thresholds from STALE_THRESHOLDS, a
+// comma-separated list of kab=duration pairs such as "Kab A=72h,Kab B=24h".
+func staleThresholds() map[string]time.Duration {
+	out := map[string]time.Duration{}
+	for _, pair := range strings.Split(os.Getenv("STALE_THRESHOLDS"), ",") {
+		kab, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(v))
+		if err != nil || d <= 0 {
+			log.Printf("Warning: invalid staleness threshold %q for %s", v, kab)
+			continue
+		}
+		out[strings.TrimSpace(kab)] = d
+	}
+	return out
+}
+
+// staleKab is a kab that has not uploaded within its threshold.
+type staleKab struct {
+	Kab   string
+	Since time.Time
+	Days  int
+}
+
+// findStaleKabs returns the kabs whose last upload is older than their
+// threshold and whose previous reminder is older than remind. Kabs without a
+// recorded upload are watched from now on.
+func findStaleKabs(kabs []string, uploads, alerted map[string]time.Time, thresholds map[string]time.Duration, def, remind time.Duration, now time.Time) (stale []staleKab, unseen []string) {
+	for _, kab := range kabs {
+		last, ok := uploads[kab]
+		if !ok {
+			unseen = append(unseen, kab)
+			continue
+		}
+		limit := def
+		if d, ok := thresholds[kab]; ok {
+			limit = d
+		}
+		if now.Sub(last) < limit {
+			continue
+		}
+		if at, ok := alerted[kab]; ok && now.Sub(at) < remind {
+			continue
+		}
+		stale = append(stale, staleKab{Kab: kab, Since: last, Days: int(now.Sub(last).Hours() / 24)})
+	}
+	sort.Slice(stale, func(i, j int) bool { return stale[i].Since.Before(stale[j].Since) })
+	return stale, unseen
+}
+
+// checkStaleKabs sends, when STALE_ALERTS is true, one warning listing the kabs
+// that have not uploaded for longer than their threshold (STALE_AFTER,
+// overridden per kab by STALE_THRESHOLDS), repeated every STALE_REMIND_EVERY
+// until they upload again.
+func (p *Pipeline) checkStaleKabs(srv *drive.Service) {
+	if !strings.EqualFold(os.Getenv("STALE_ALERTS"), "true") {
+		return
+	}
+	now := time.Now()
+	if now.Sub(lastStaleCheck) < staleCheckInterval {
+		return
+	}
+	lastStaleCheck = now
+	kabs, err := expectedKabs(srv)
+	if err != nil {
+		log.Printf("Warning: staleness check skipped: %v", err)
+		return
+	}
+	stale, unseen := findStaleKabs(kabs, p.state.lastUploads(), p.state.staleAlerts(), staleThresholds(),
+		env.Duration("STALE_AFTER", defaultStaleAfter), env.Duration("STALE_REMIND_EVERY", defaultStaleRemind), now)
+	if len(unseen) > 0 {
+		if err := p.state.watchUploads(unseen, now); err != nil {
+			log.Printf("Warning: failed to save state: %v", err)
+		}
+	}
+	if len(stale) == 0 {
+		return
+	}
+	rows := make([]msgData, 0, len(stale))
+	names := make([]string, 0, len(stale))
+	for _, s := range stale {
+		rows = append(rows, msgData{"Kab": s.Kab, "Since": s.Since.Format("2006-01-02 15:04"), "Days": s.Days})
+		names = append(names, s.Kab)
+	}
+	notifyMsg(levelWarning, "stale-kabs", msgData{"Kabs": rows})
+	if err := p.state.markStaleAlerts(names, now); err != nil {
+		log.Printf("Warning: failed to save state: %v", err)
+	}
+}
+
+// uploadTime returns when file was uploaded, or now when Drive did not say.
+func uploadTime(file *source.File) time.Time {
+	if t, err := time.Parse(time.RFC3339, file.CreatedTime); err == nil {
+		return t
+	}
+	return time.Now()
+}
@@ -0,0 +1,610 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"backup-otomatis/pkg/track"
+)
+
+// defaultStateFile is where run history is kept when STATE_FILE is not set.
+const defaultStateFile = "backup-otomatis-state.json"
+
+// phaseHistoryRetention bounds how long per-phase durations are kept.
+const phaseHistoryRetention = 90 * 24 * time.Hour
+
+// seenSizeRetention bounds how long observed file sizes are kept.
+const seenSizeRetention = 7 * 24 * time.Hour
+
+// validatedRetention bounds how long validated file versions are remembered.
+const validatedRetention = 30 * 24 * time.Hour
+
+// stateStore persists run history between invocations as a single JSON file.
+// All methods are safe for concurrent use.
+type stateStore struct {
+	path string
+	mu   sync.Mutex
+	data stateData
+}
+
+// stateData is the on-disk layout of the state file.
+type stateData struct {
+	Phases         []phaseRecord           `json:"phases,omitempty"`
+	LastPerfReport time.Time               `json:"lastPerfReport,omitempty"`
+	SeenSizes      map[string]observedSize `json:"seenSizes,omitempty"`
+	Validated      map[string]time.Time    `json:"validated,omitempty"`
+	LastRestore    map[string]time.Time    `json:"lastRestore,omitempty"`
+	// PendingSheetWrites are tracking sheet updates waiting to be replayed.
+	PendingSheetWrites []track.Write `json:"pendingSheetWrites,omitempty"`
+	// Checkpoints track files whose processing is under way, by file ID.
+	Checkpoints map[string]fileCheckpoint `json:"checkpoints,omitempty"`
+	// FailureStreaks counts the consecutive failures per kab.
+	FailureStreaks map[string]int `json:"failureStreaks,omitempty"`
+	// DownSince is the first failure since the last successful file; Paged
+	// records that the outage has been paged.
+	DownSince time.Time `json:"downSince,omitempty"`
+	Paged     bool      `json:"paged,omitempty"`
+	// LastDailyReport is when the daily report was last emailed.
+	LastDailyReport time.Time `json:"lastDailyReport,omitempty"`
+	// LastUpload is the creation time of the latest file seen per kab, and
+	// StaleAlerts when each kab was last reminded it is overdue.
+	LastUpload  map[string]time.Time `json:"lastUpload,omitempty"`
+	StaleAlerts map[string]time.Time `json:"staleAlerts,omitempty"`
+	// Queue holds the files listed by the current run that are not finished.
+	Queue []queuedFile `json:"queue,omitempty"`
+	// LastRestoreLogPrune is when dbo.BackupRestoreLog was last pruned.
+	LastRestoreLogPrune time.Time `json:"lastRestoreLogPrune,omitempty"`
+	// JobSpreadsheets are the tracking sheets created for jobs, by job name.
+	JobSpreadsheets map[string]string `json:"jobSpreadsheets,omitempty"`
+	// LastHousekeeping is when housekeeping last ran.
+	LastHousekeeping time.Time `json:"lastHousekeeping,omitempty"`
+	// JobRuns is the latest run of each job, by job name.
+	JobRuns map[string]jobRun `json:"jobRuns,omitempty"`
+	// UpdateVersion is the update query or script version approved by the
+	// canary, and CanaryBaseline the canary kab's validation metrics under it.
+	UpdateVersion  string             `json:"updateVersion,omitempty"`
+	CanaryBaseline map[string]float64 `json:"canaryBaseline,omitempty"`
+	// ParentNames caches Drive folder names by folder ID.
+	ParentNames map[string]cachedName `json:"parentNames,omitempty"`
+	// CredentialAlerts is when each failing or expiring credential was last
+	// reminded about, by credential name.
+	CredentialAlerts map[string]time.Time `json:"credentialAlerts,omitempty"`
+}
+
+// jobRun is when a job last ran and whether all its files succeeded.
+type jobRun struct {
+	At        time.Time `json:"at"`
+	Succeeded bool      `json:"succeeded"`
+}
+
+// cachedName is a folder name and when it was looked up.
+type cachedName struct {
+	Name string    `json:"name"`
+	At   time.Time `json:"at"`
+}
+
+// observedSize is the size of a Drive file when it was last listed.
+type observedSize struct {
+	Size int64     `json:"size"`
+	At   time.Time `json:"at"`
+}
+
+// phaseRecord is the duration of one processing phase for one file.
+type phaseRecord struct {
+	Kab     string    `json:"kab"`
+	FileID  string    `json:"fileId"`
+	Ref     string    `json:"ref,omitempty"`
+	Phase   string    `json:"phase"`
+	Seconds float64   `json:"seconds"`
+	Size    int64     `json:"size"`
+	At      time.Time `json:"at"`
+}
+
+// stateFilePath returns the configured state file location.
+func stateFilePath() string {
+	if p := os.Getenv("STATE_FILE"); p != "" {
+		return p
+	}
+	return defaultStateFile
+}
+
+// openState loads the state file at path. A missing file yields an empty store.
+func openState(path string) (*stateStore, error) {
+	s := &stateStore{path: path}
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state file: %v", err)
+	}
+	if err := json.Unmarshal(b, &s.data); err != nil {
+		return nil, fmt.Errorf("failed to parse state file %s: %v", path, err)
+	}
+	return s, nil
+}
+
+// save writes the state atomically by replacing the file. Callers must hold s.mu.
+func (s *stateStore) save() error {
+	b, err := json.MarshalIndent(&s.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(s.path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return fmt.Errorf("failed to create state directory: %v", err)
+		}
+	}
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o644); err != nil {
+		return fmt.Errorf("failed to write state file: %v", err)
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// recordPhases stores the phase durations measured for one file and drops
+// records older than phaseHistoryRetention.
+func (s *stateStore) recordPhases(kab string, fileID, correlationID string, size int64, phases map[string]time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for phase, d := range phases {
+		s.data.Phases = append(s.data.Phases, phaseRecord{
+			Kab:     kab,
+			FileID:  fileID,
+			Ref:     correlationID,
+			Phase:   phase,
+			Seconds: d.Seconds(),
+			Size:    size,
+			At:      now,
+		})
+	}
+	cutoff := now.Add(-phaseHistoryRetention)
+	kept := s.data.Phases[:0]
+	for _, r := range s.data.Phases {
+		if r.At.After(cutoff) {
+			kept = append(kept, r)
+		}
+	}
+	s.data.Phases = kept
+	return s.save()
+}
+
+// phaseHistory returns a copy of the stored phase records.
+func (s *stateStore) phaseHistory() []phaseRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]phaseRecord(nil), s.data.Phases...)
+}
+
+// lastPerfReport returns when the performance report was last produced.
+func (s *stateStore) lastPerfReport() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data.LastPerfReport
+}
+
+// setLastPerfReport records that the performance report was produced at t.
+func (s *stateStore) setLastPerfReport(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.LastPerfReport = t
+	return s.save()
+}
+
+// observeSize records the current size of a Drive file and returns the size
+// seen on the previous observation, if any.
+func (s *stateStore) observeSize(fileID string, size int64) (int64, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data.SeenSizes == nil {
+		s.data.SeenSizes = map[string]observedSize{}
+	}
+	prev, ok := s.data.SeenSizes[fileID]
+	now := time.Now()
+	s.data.SeenSizes[fileID] = observedSize{Size: size, At: now}
+	for id, o := range s.data.SeenSizes {
+		if now.Sub(o.At) > seenSizeRetention {
+			delete(s.data.SeenSizes, id)
+		}
+	}
+	if err := s.save(); err != nil {
+		log.Printf("Warning: failed to save state: %v", err)
+	}
+	return prev.Size, ok
+}
+
+// validated reports whether the file version identified by key passed validation.
+func (s *stateStore) validated(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.data.Validated[key]
+	return ok
+}
+
+// markValidated records that the file version identified by key passed
+// validation and forgets versions older than validatedRetention.
+func (s *stateStore) markValidated(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data.Validated == nil {
+		s.data.Validated = map[string]time.Time{}
+	}
+	now := time.Now()
+	s.data.Validated[key] = now
+	for k, at := range s.data.Validated {
+		if now.Sub(at) > validatedRetention {
+			delete(s.data.Validated, k)
+		}
+	}
+	return s.save()
+}
+
+// recordRestore records when the latest restore of kab completed.
+func (s *stateStore) recordRestore(kab string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data.LastRestore == nil {
+		s.data.LastRestore = map[string]time.Time{}
+	}
+	s.data.LastRestore[kab] = at
+	return s.save()
+}
+
+// lastRestores returns a copy of the latest restore time per kab.
+func (s *stateStore) lastRestores() map[string]time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]time.Time, len(s.data.LastRestore))
+	for k, v := range s.data.LastRestore {
+		out[k] = v
+	}
+	return out
+}
+
+// recordOutcome updates the failure streak of kab and the pipeline outage
+// window. It returns the kab's streak after the update and, on success, whether
+// an outage had been paged (which the success resolves).
+func (s *stateStore) recordOutcome(kab string, ok bool, at time.Time) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	paged := false
+	if ok {
+		delete(s.data.FailureStreaks, kab)
+		paged = s.data.Paged
+		s.data.DownSince, s.data.Paged = time.Time{}, false
+	} else {
+		if s.data.FailureStreaks == nil {
+			s.data.FailureStreaks = map[string]int{}
+		}
+		s.data.FailureStreaks[kab]++
+		if s.data.DownSince.IsZero() {
+			s.data.DownSince = at
+		}
+	}
+	if err := s.save(); err != nil {
+		log.Printf("Warning: failed to save state: %v", err)
+	}
+	return s.data.FailureStreaks[kab], paged
+}
+
+// pipelineDown returns when the current outage started (zero when the last
+// file succeeded) and whether it has been paged.
+func (s *stateStore) pipelineDown() (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data.DownSince, s.data.Paged
+}
+
+// setPaged records whether the current outage has been paged.
+func (s *stateStore) setPaged(paged bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Paged = paged
+	return s.save()
+}
+
+// failureStreaks returns a copy of the consecutive failure count per kab.
+func (s *stateStore) failureStreaks() map[string]int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]int, len(s.data.FailureStreaks))
+	for k, v := range s.data.FailureStreaks {
+		out[k] = v
+	}
+	return out
+}
+
+// lastDailyReport returns when the daily report was last sent.
+func (s *stateStore) lastDailyReport() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data.LastDailyReport
+}
+
+// setLastDailyReport records that the daily report was sent at t.
+func (s *stateStore) setLastDailyReport(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.LastDailyReport = t
+	return s.save()
+}
+
+// lastRestoreLogPrune returns when the restore log was last pruned.
+func (s *stateStore) lastRestoreLogPrune() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data.LastRestoreLogPrune
+}
+
+// setLastRestoreLogPrune records that the restore log was pruned at t.
+func (s *stateStore) setLastRestoreLogPrune(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.LastRestoreLogPrune = t
+	return s.save()
+}
+
+// lastHousekeeping returns when housekeeping last ran.
+func (s *stateStore) lastHousekeeping() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data.LastHousekeeping
+}
+
+// setLastHousekeeping records that housekeeping ran at t.
+func (s *stateStore) setLastHousekeeping(t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.LastHousekeeping = t
+	return s.save()
+}
+
+// recordUpload records a file of kab uploaded at t and ends any staleness
+// reminders for it.
+func (s *stateStore) recordUpload(kab string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data.LastUpload == nil {
+		s.data.LastUpload = map[string]time.Time{}
+	}
+	if t.After(s.data.LastUpload[kab]) {
+		s.data.LastUpload[kab] = t
+	}
+	delete(s.data.StaleAlerts, kab)
+	return s.save()
+}
+
+// watchUploads starts the staleness clock at t for kabs without a recorded upload.
+func (s *stateStore) watchUploads(kabs []string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data.LastUpload == nil {
+		s.data.LastUpload = map[string]time.Time{}
+	}
+	for _, k := range kabs {
+		if _, ok := s.data.LastUpload[k]; !ok {
+			s.data.LastUpload[k] = t
+		}
+	}
+	return s.save()
+}
+
+// lastUploads returns a copy of the latest upload time per kab.
+func (s *stateStore) lastUploads() map[string]time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]time.Time, len(s.data.LastUpload))
+	for k, v := range s.data.LastUpload {
+		out[k] = v
+	}
+	return out
+}
+
+// staleAlerts returns a copy of when each overdue kab was last reminded.
+func (s *stateStore) staleAlerts() map[string]time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]time.Time, len(s.data.StaleAlerts))
+	for k, v := range s.data.StaleAlerts {
+		out[k] = v
+	}
+	return out
+}
+
+// markStaleAlerts records that kabs were reminded at t.
+func (s *stateStore) markStaleAlerts(kabs []string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data.StaleAlerts == nil {
+		s.data.StaleAlerts = map[string]time.Time{}
+	}
+	for _, k := range kabs {
+		s.data.StaleAlerts[k] = t
+	}
+	return s.save()
+}
+
+// recordJobRun records that the job ran at t.
+func (s *stateStore) recordJobRun(name string, t time.Time, succeeded bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data.JobRuns == nil {
+		s.data.JobRuns = map[string]jobRun{}
+	}
+	s.data.JobRuns[name] = jobRun{At: t, Succeeded: succeeded}
+	return s.save()
+}
+
+// jobRuns returns a copy of the latest run of each job.
+func (s *stateStore) jobRuns() map[string]jobRun {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]jobRun, len(s.data.JobRuns))
+	for k, v := range s.data.JobRuns {
+		out[k] = v
+	}
+	return out
+}
+
+// approvedUpdateVersion returns the update version approved by the canary.
+func (s *stateStore) approvedUpdateVersion() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.data.UpdateVersion
+}
+
+// approveUpdateVersion records version as approved with the canary metrics
+// measured under it; nil metrics keep the baseline.
+func (s *stateStore) approveUpdateVersion(version string, metrics map[string]float64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.UpdateVersion = version
+	if metrics != nil {
+		s.data.CanaryBaseline = metrics
+	}
+	return s.save()
+}
+
+// canaryBaseline returns a copy of the canary metrics of the approved version.
+func (s *stateStore) canaryBaseline() map[string]float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]float64, len(s.data.CanaryBaseline))
+	for k, v := range s.data.CanaryBaseline {
+		out[k] = v
+	}
+	return out
+}
+
+// parentNames returns the cached folder names younger than maxAge at now.
+func (s *stateStore) parentNames(maxAge time.Duration, now time.Time) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := map[string]string{}
+	for id, c := range s.data.ParentNames {
+		if now.Sub(c.At) < maxAge {
+			out[id] = c.Name
+		}
+	}
+	return out
+}
+
+// cacheParentNames records folder names looked up at t and drops those older
+// than maxAge.
+func (s *stateStore) cacheParentNames(names map[string]string, t time.Time, maxAge time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data.ParentNames == nil {
+		s.data.ParentNames = map[string]cachedName{}
+	}
+	for id, c := range s.data.ParentNames {
+		if t.Sub(c.At) >= maxAge {
+			delete(s.data.ParentNames, id)
+		}
+	}
+	for id, name := range names {
+		s.data.ParentNames[id] = cachedName{Name: name, At: t}
+	}
+	return s.save()
+}
+
+// credentialAlerts returns a copy of when each credential was last reminded.
+func (s *stateStore) credentialAlerts() map[string]time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]time.Time, len(s.data.CredentialAlerts))
+	for k, v := range s.data.CredentialAlerts {
+		out[k] = v
+	}
+	return out
+}
+
+// markCredentialAlerts records that credentials were reminded at t.
+func (s *stateStore) markCredentialAlerts(names []string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data.CredentialAlerts == nil {
+		s.data.CredentialAlerts = map[string]time.Time{}
+	}
+	for _, n := range names {
+		s.data.CredentialAlerts[n] = t
+	}
+	return s.save()
+}
+
+// enqueue appends files to the published queue, replacing entries for the
+// same file.
+func (s *stateStore) enqueue(files []queuedFile) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, f := range files {
+		s.removeQueued(f.FileID)
+		s.data.Queue = append(s.data.Queue, f)
+	}
+	return s.save()
+}
+
+// startQueued marks a queued file as being processed since t.
+func (s *stateStore) startQueued(fileID, ref string, t time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.data.Queue {
+		if s.data.Queue[i].FileID == fileID {
+			s.data.Queue[i].Started = &t
+			s.data.Queue[i].Ref = ref
+		}
+	}
+	return s.save()
+}
+
+// setQueuedProgress records the restore progress of a queued file.
+func (s *stateStore) setQueuedProgress(fileID string, percent int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.data.Queue {
+		if s.data.Queue[i].FileID == fileID {
+			s.data.Queue[i].RestorePercent = percent
+		}
+	}
+	return s.save()
+}
+
+// dequeue removes a finished file from the queue.
+func (s *stateStore) dequeue(fileID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeQueued(fileID)
+	return s.save()
+}
+
+// clearQueue empties the queue, e.g. what a crashed run left behind.
+func (s *stateStore) clearQueue() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data.Queue = nil
+	return s.save()
+}
+
+// removeQueued drops fileID from the queue. Callers must hold s.mu.
+func (s *stateStore) removeQueued(fileID string) {
+	kept := s.data.Queue[:0]
+	for _, f := range s.data.Queue {
+		if f.FileID != fileID {
+			kept = append(kept, f)
+		}
+	}
+	s.data.Queue = kept
+}
+
+// queue returns a copy of the published queue.
+func (s *stateStore) queue() []queuedFile {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]queuedFile(nil), s.data.Queue...)
+}
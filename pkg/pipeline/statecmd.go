@@ -0,0 +1,104 @@
+package pipeline
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// stateExportVersion is the layout version of state export files.
+const stateExportVersion = 1
+
+// stateExport is the file written by "state export" and read by "state import".
+type stateExport struct {
+	Version    int       `json:"version"`
+	ExportedAt time.Time `json:"exportedAt"`
+	Host       string    `json:"host"`
+	State      stateData `json:"state"`
+}
+
+// stateCommand implements "state export" and "state import", which move the
+// run history to another server so processed files are not reprocessed there.
+func (p *Pipeline) stateCommand(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: state export [-o file] | state import -i file [-force]")
+	}
+	switch args[0] {
+	case "export":
+		fs := flag.NewFlagSet("state export", flag.ContinueOnError)
+		out := fs.String("o", "", "file to write the export to (default stdout)")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if *out == "" {
+			return p.state.export(os.Stdout)
+		}
+		f, err := os.Create(*out)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %v", *out, err)
+		}
+		if err := p.state.export(f); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	case "import":
+		fs := flag.NewFlagSet("state import", flag.ContinueOnError)
+		in := fs.String("i", "", "export file to import")
+		force := fs.Bool("force", false, "replace a state file that already has history")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if *in == "" {
+			return fmt.Errorf("-i is required")
+		}
+		f, err := os.Open(*in)
+		if err != nil {
+			return fmt.Errorf("failed to open %s: %v", *in, err)
+		}
+		defer f.Close()
+		exp, err := p.state.importFrom(f, *force)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Imported state exported from %s at %s into %s\n", exp.Host, exp.ExportedAt.Format(time.RFC3339), p.state.path)
+		return nil
+	}
+	return fmt.Errorf("unknown state command %q", args[0])
+}
+
+// export writes the state as a stateExport. Checkpoints and the queue refer to
+// this machine's temporary files and current run, so they are left out.
+func (s *stateStore) export(w io.Writer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data := s.data
+	data.Checkpoints = nil
+	data.Queue = nil
+	host, _ := os.Hostname()
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(stateExport{Version: stateExportVersion, ExportedAt: time.Now().UTC(), Host: host, State: data})
+}
+
+// importFrom replaces the state with an export read from r. A state that
+// already holds history is only replaced when force is set.
+func (s *stateStore) importFrom(r io.Reader, force bool) (stateExport, error) {
+	var exp stateExport
+	if err := json.NewDecoder(r).Decode(&exp); err != nil {
+		return exp, fmt.Errorf("failed to parse state export: %v", err)
+	}
+	if exp.Version != stateExportVersion {
+		return exp, fmt.Errorf("unsupported state export version %d", exp.Version)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !force && (len(s.data.Phases) > 0 || len(s.data.Validated) > 0 || len(s.data.LastRestore) > 0) {
+		return exp, fmt.Errorf("%s already has history, use -force to replace it", s.path)
+	}
+	s.data = exp.State
+	return exp, s.save()
+}
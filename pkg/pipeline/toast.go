@@ -0,0 +1,55 @@
+package pipeline
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// toastAppID is the AppUserModelID toasts are shown under. PowerShell's own ID
+// is registered on every Windows machine, so no shortcut has to be installed.
+const toastAppID = `{1AC14E77-02E7-4E5D-B744-2EB1AE5198B7}\WindowsPowerShell\v1.0\powershell.exe`
+
+// toastScript shows a two-line toast with the title and body passed in the
+// environment, which avoids quoting the message into the script.
+const toastScript = `[Windows.UI.Notifications.ToastNotificationManager, Windows.UI.Notifications, ContentType = WindowsRuntime] > $null
+$t = [Windows.UI.Notifications.ToastNotificationManager]::GetTemplateContent([Windows.UI.Notifications.ToastTemplateType]::ToastText02)
+$x = $t.GetElementsByTagName('text')
+$x.Item(0).AppendChild($t.CreateTextNode($env:BACKUP_OTOMATIS_TOAST_TITLE)) > $null
+$x.Item(1).AppendChild($t.CreateTextNode($env:BACKUP_OTOMATIS_TOAST_BODY)) > $null
+[Windows.UI.Notifications.ToastNotificationManager]::CreateToastNotifier($env:BACKUP_OTOMATIS_TOAST_APP).Show([Windows.UI.Notifications.ToastNotification]::new($t))`
+
+// toastNotifier shows Windows desktop notifications for operators running the
+// tool interactively on the DB server. Only run summaries are shown; individual
+// warnings would bury the desktop during a long run.
+type toastNotifier struct{}
+
+func (toastNotifier) Notify(level, message string) error { return nil }
+
+func (toastNotifier) NotifySummary(level, message string) error {
+	title := "backup-otomatis"
+	if level != levelInfo {
+		title += " (" + level + ")"
+	}
+	// Toasts show a few lines only; the full summary is in the log.
+	if lines := strings.SplitN(message, "\n", 4); len(lines) > 3 {
+		message = strings.Join(lines[:3], "\n") + "\n..."
+	}
+	cmd := exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", toastScript)
+	cmd.Env = append(os.Environ(),
+		"BACKUP_OTOMATIS_TOAST_TITLE="+title,
+		"BACKUP_OTOMATIS_TOAST_BODY="+message,
+		"BACKUP_OTOMATIS_TOAST_APP="+toastAppID)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("toast failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// desktopNotifyEnabled reports whether DESKTOP_NOTIFY asks for toasts. They are
+// only available on Windows.
+func desktopNotifyEnabled() bool {
+	return runtime.GOOS == "windows" && strings.EqualFold(os.Getenv("DESKTOP_NOTIFY"), "true")
+}
@@ -0,0 +1,74 @@
+package pipeline
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"backup-otomatis/internal/env"
+	"backup-otomatis/pkg/restore"
+)
+
+// defaultUpdateProgressInterval is how often a running update query is reported.
+const defaultUpdateProgressInterval = time.Minute
+
+// createPreIndexes runs the statements of UPDATE_PRE_INDEXES_FILE, one per line,
+// in the freshly restored database so the update query does not scan unindexed
+// tables. Failing statements are logged and skipped.
+func createPreIndexes(host, user, pass string) {
+	path := os.Getenv("UPDATE_PRE_INDEXES_FILE")
+	if path == "" {
+		return
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("Warning: failed to read UPDATE_PRE_INDEXES_FILE: %v", err)
+		return
+	}
+	for _, stmt := range strings.Split(string(b), "\n") {
+		if stmt = strings.TrimSpace(stmt); stmt == "" || strings.HasPrefix(stmt, "--") {
+			continue
+		}
+		start := time.Now()
+		if _, err := restore.Query(host, user, pass, "Temp", stmt); err != nil {
+			log.Printf("Warning: pre-index statement failed: %s: %v", stmt, err)
+			continue
+		}
+		log.Printf("Pre-index statement done in %s: %s", time.Since(start).Round(time.Second), stmt)
+	}
+}
+
+// monitorUpdate logs, every UPDATE_PROGRESS_INTERVAL, what the requests running
+// in dbName are doing according to sys.dm_exec_requests. The returned function
+// stops the monitor.
+func monitorUpdate(host, user, pass, dbName string) func() {
+	interval := env.Duration("UPDATE_PROGRESS_INTERVAL", defaultUpdateProgressInterval)
+	if interval <= 0 {
+		return func() {}
+	}
+	query := fmt.Sprintf(`SELECT r.session_id, r.status, r.command, r.wait_type,
+r.total_elapsed_time / 1000 AS elapsed_s, r.percent_complete, r.logical_reads, r.row_count
+FROM sys.dm_exec_requests r
+WHERE r.database_id = DB_ID('%s') AND r.session_id <> @@SPID`, strings.ReplaceAll(dbName, "'", "''"))
+	stop := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				out, err := restore.Query(host, user, pass, "master", query)
+				if err != nil {
+					log.Printf("Warning: failed to read update progress: %v", err)
+					continue
+				}
+				log.Printf("Update query still running on %s: %s", dbName, strings.Join(strings.Fields(string(out)), " "))
+			}
+		}
+	}()
+	return func() { close(stop) }
+}
@@ -0,0 +1,62 @@
+package pipeline
+
+import (
+	"log"
+	"strconv"
+	"strings"
+
+	"backup-otomatis/pkg/source"
+	"google.golang.org/api/drive/v3"
+)
+
+// appProperties convention shared with the uploader tool:
+//
+//   - uploading=true is set when an upload starts and removed (or set to false)
+//     once the last byte has been written.
+//   - expectedSize=<bytes> may be set to the final size of the file; a file whose
+//     current size differs is treated as incomplete.
+const (
+	appPropUploading    = "uploading"
+	appPropExpectedSize = "expectedSize"
+)
+
+// uploadInProgress reports whether file is still being uploaded, and why.
+// Besides the appProperties convention, a file whose size changed since the
+// previous run is considered to be still growing.
+func (p *Pipeline) uploadInProgress(file *source.File) (bool, string) {
+	if strings.EqualFold(file.Properties[appPropUploading], "true") {
+		return true, "uploader marked it as uploading"
+	}
+	if v, ok := file.Properties[appPropExpectedSize]; ok {
+		want, err := strconv.ParseInt(v, 10, 64)
+		if err == nil && want != file.Size {
+			return true, "size " + strconv.FormatInt(file.Size, 10) + " does not match expectedSize " + v
+		}
+	}
+	if prev, ok := p.state.observeSize(file.ID, file.Size); ok && prev != file.Size {
+		return true, "size grew from " + strconv.FormatInt(prev, 10) + " to " + strconv.FormatInt(file.Size, 10) + " since the last run"
+	}
+	return false, ""
+}
+
+// skipIncompleteUploads removes files that are still being uploaded; they are
+// picked up by a later run once the upload has finished.
+func (p *Pipeline) skipIncompleteUploads(files []*source.File) []*source.File {
+	var kept []*source.File
+	for _, f := range files {
+		if busy, why := p.uploadInProgress(f); busy {
+			log.Printf("Skipping %s (ID: %s): upload in progress, %s", f.Name, f.ID, why)
+			continue
+		}
+		kept = append(kept, f)
+	}
+	return kept
+}
+
+// readyUploads drops the uploads still in progress and then the older copies
+// of re-uploaded files. In that order, a complete copy is never retired as the
+// duplicate of a newer one that may still be aborted.
+func (p *Pipeline) readyUploads(srv *drive.Service, files []*source.File) []*source.File {
+	files = p.skipIncompleteUploads(files)
+	return dedupeFiles(srv, files, dedupeWindow(), p.QuarantineFolderID)
+}
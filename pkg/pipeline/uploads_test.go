@@ -0,0 +1,31 @@
+package pipeline
+
+import (
+	"path/filepath"
+	"testing"
+
+	"backup-otomatis/pkg/source"
+)
+
+func TestReadyUploadsKeepsCompleteCopyOfInProgressUpload(t *testing.T) {
+	t.Setenv("DEDUP_WINDOW_HOURS", "24")
+	t.Setenv("DEDUP_ACTION", "delete")
+	p, err := New(&Config{StateFile: filepath.Join(t.TempDir(), "state.json")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	older := &source.File{ID: "old", Name: "backup.7z", Parents: []string{"kab"}, CreatedTime: "2025-03-01T08:00:00Z", Size: 1000}
+	newer := &source.File{ID: "new", Name: "backup.7z", Parents: []string{"kab"}, CreatedTime: "2025-03-01T09:00:00Z", Size: 400,
+		Properties: map[string]string{appPropUploading: "true"}}
+
+	// The files have no source, so deleting the older copy fails the test.
+	got := p.readyUploads(nil, []*source.File{older, newer})
+	if len(got) != 1 || got[0].ID != "old" {
+		var ids []string
+		for _, f := range got {
+			ids = append(ids, f.ID)
+		}
+		t.Fatalf("readyUploads kept %v, want [old]", ids)
+	}
+}
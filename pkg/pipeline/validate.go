@@ -0,0 +1,223 @@
+package pipeline
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"backup-otomatis/pkg/restore"
+	"backup-otomatis/pkg/source"
+	"google.golang.org/api/drive/v3"
+)
+
+// jobTypeValidate marks a job that only checks that backups restore cleanly.
+// Its files are restored into a throwaway SQL instance, checked with the
+// validation queries and left in Drive; no update query is run and the
+// production server is never touched.
+const jobTypeValidate = "validate"
+
+// sandboxStartTimeout bounds how long a validation container may take to accept connections.
+const sandboxStartTimeout = 2 * time.Minute
+
+// validateOnly reports whether the job is a validate-only job.
+func (j *job) validateOnly() bool {
+	return strings.EqualFold(j.Type, jobTypeValidate)
+}
+
+// validationQueries returns the job's validation queries, falling back to the
+// non-empty lines of VALIDATION_QUERIES_FILE.
+func (j *job) validationQueries() ([]string, error) {
+	if len(j.ValidationQueries) > 0 {
+		return j.ValidationQueries, nil
+	}
+	path := os.Getenv("VALIDATION_QUERIES_FILE")
+	if path == "" {
+		return nil, nil
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read validation queries: %v", err)
+	}
+	var queries []string
+	for _, l := range strings.Split(string(b), "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			queries = append(queries, l)
+		}
+	}
+	return queries, nil
+}
+
+// validationKey identifies one version of a Drive file in the state store.
+func validationKey(file *source.File) string {
+	return file.ID + ":" + file.MD5
+}
+
+// skipValidated drops files whose current version was already validated.
+func (p *Pipeline) skipValidated(files []*source.File) []*source.File {
+	var out []*source.File
+	for _, f := range files {
+		if p.state.validated(validationKey(f)) {
+			continue
+		}
+		out = append(out, f)
+	}
+	return out
+}
+
+// sqlSandbox is a throwaway SQL Server instance used for validation: either an
+// existing local instance (typically LocalDB) given by VALIDATE_SQL_HOST, or a
+// docker container started from VALIDATE_DOCKER_IMAGE for a single file.
+type sqlSandbox struct {
+	host, user, pass string
+	container        string
+	// mountDir is the host directory mounted at /backup inside the container.
+	mountDir string
+}
+
+// startSQLSandbox provides the sandbox instance. bakDir must contain the backup
+// file; it is mounted into the container so the server can read it.
+func startSQLSandbox(bakDir string) (*sqlSandbox, error) {
+	if host := os.Getenv("VALIDATE_SQL_HOST"); host != "" {
+		return &sqlSandbox{host: host, user: os.Getenv("VALIDATE_SQL_USER"), pass: os.Getenv("VALIDATE_SQL_PASSWORD")}, nil
+	}
+	image := os.Getenv("VALIDATE_DOCKER_IMAGE")
+	if image == "" {
+		return nil, fmt.Errorf("neither VALIDATE_SQL_HOST nor VALIDATE_DOCKER_IMAGE is set")
+	}
+	port, err := freeLocalPort()
+	if err != nil {
+		return nil, err
+	}
+	secret := make([]byte, 12)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	// The suffix satisfies the SQL Server password complexity policy.
+	pass := hex.EncodeToString(secret) + "Aa1!"
+	out, err := exec.Command("docker", "run", "-d", "--rm",
+		"-e", "ACCEPT_EULA=Y",
+		"-e", "MSSQL_SA_PASSWORD="+pass,
+		"-p", fmt.Sprintf("127.0.0.1:%d:1433", port),
+		"-v", bakDir+":/backup",
+		image).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to start validation container: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+	s := &sqlSandbox{
+		host:      fmt.Sprintf("127.0.0.1,%d", port),
+		user:      "sa",
+		pass:      pass,
+		container: strings.TrimSpace(string(out)),
+		mountDir:  bakDir,
+	}
+	log.Printf("Started validation container %.12s on port %d", s.container, port)
+	deadline := time.Now().Add(sandboxStartTimeout)
+	for {
+		if _, err := restore.Query(s.host, s.user, s.pass, "master", "SELECT 1"); err == nil {
+			return s, nil
+		} else if time.Now().After(deadline) {
+			s.close()
+			return nil, fmt.Errorf("validation container did not accept connections within %s: %v", sandboxStartTimeout, err)
+		}
+		time.Sleep(3 * time.Second)
+	}
+}
+
+// serverPath translates a host path below the mounted directory to the path
+// the sandbox server sees.
+func (s *sqlSandbox) serverPath(p string) string {
+	if s.container == "" {
+		return p
+	}
+	rel, err := filepath.Rel(s.mountDir, p)
+	if err != nil {
+		return p
+	}
+	return "/backup/" + filepath.ToSlash(rel)
+}
+
+// close drops the restored database and removes the container, if any.
+func (s *sqlSandbox) close() {
+	if s.container != "" {
+		if out, err := exec.Command("docker", "rm", "-f", s.container).CombinedOutput(); err != nil {
+			log.Printf("Warning: failed to remove validation container %.12s: %v: %s", s.container, err, strings.TrimSpace(string(out)))
+		}
+		return
+	}
+	if err := restore.Drop(s.host, s.user, s.pass); err != nil {
+		log.Printf("Warning: failed to drop validation database: %v", err)
+	}
+}
+
+// freeLocalPort returns a TCP port that is currently free on the loopback interface.
+func freeLocalPort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, fmt.Errorf("failed to find a free port: %v", err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// validateFile restores file into a sandbox instance, runs the job's validation
+// queries and reports the outcome. The Drive file is left in place and its
+// current version is remembered so it is not validated again.
+func (p *Pipeline) validateFile(srv *drive.Service, file *source.File, j *job) error {
+	log.Printf("Validating file: %s", file.Name)
+	queries, err := j.validationQueries()
+	if err != nil {
+		return err
+	}
+
+	tempDir, err := createTempDir()
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+
+	phases := map[string]time.Duration{}
+	bakFile, err := p.downloadAndExtract(srv, file, j, tempDir, phases)
+	if err != nil {
+		notifyMsg(levelError, "validation-failed", msgData{"File": file.Name, "Err": err})
+		return err
+	}
+
+	sandbox, err := startSQLSandbox(filepath.Dir(bakFile))
+	if err != nil {
+		return err
+	}
+	defer sandbox.close()
+
+	if err := restore.Backup(sandbox.host, sandbox.user, sandbox.pass, sandbox.serverPath(bakFile)); err != nil {
+		notifyMsg(levelError, "validation-not-restorable", msgData{"File": file.Name, "Err": err})
+		return err
+	}
+
+	var report strings.Builder
+	failed := 0
+	for _, q := range queries {
+		out, qErr := restore.Query(sandbox.host, sandbox.user, sandbox.pass, "Temp", q)
+		if qErr != nil {
+			failed++
+			fmt.Fprintf(&report, "\n- %s: ERROR %v", q, qErr)
+			continue
+		}
+		fmt.Fprintf(&report, "\n- %s: %s", q, strings.Join(strings.Fields(string(out)), " "))
+	}
+	if failed > 0 {
+		notifyMsg(levelError, "validation-queries-failed", msgData{"File": file.Name, "Failed": failed, "Total": len(queries), "Report": report.String()})
+		return fmt.Errorf("%d validation queries failed", failed)
+	}
+	notifyMsg(levelInfo, "validation-passed", msgData{"File": file.Name, "Total": len(queries), "Report": report.String()})
+	if err := p.state.markValidated(validationKey(file)); err != nil {
+		log.Printf("Warning: failed to save state: %v", err)
+	}
+	return nil
+}
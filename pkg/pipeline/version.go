@@ -0,0 +1,65 @@
+package pipeline
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"backup-otomatis/pkg/restore"
+	"backup-otomatis/pkg/source"
+)
+
+// version is the release of this build, set with
+// go build -ldflags "-X backup-otomatis/pkg/pipeline.version=v1.2.3".
+// Development builds fall back to the VCS revision recorded by the Go
+// toolchain.
+var version = ""
+
+// Version returns the version of the running binary.
+func Version() string {
+	if version != "" {
+		return version
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" && len(s.Value) >= 7 {
+				return "dev-" + s.Value[:7]
+			}
+		}
+	}
+	return "dev"
+}
+
+func init() {
+	source.UserAgent = "backup-otomatis/" + Version()
+}
+
+// processedBy identifies this server and build, e.g. "BPS-SRV01 (backup-otomatis v1.2.3)",
+// so supervisors can tell which of several servers restored a file.
+func processedBy() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return fmt.Sprintf("%s (backup-otomatis %s)", host, Version())
+}
+
+// logProcessing inserts a row describing the processed file into SQL_LOG_TABLE
+// in the job database. The table needs the columns Kab, FileName, ProcessedAt,
+// ProcessedBy and Version. Failures are only logged.
+func (p *Pipeline) logProcessing(dbName, kab, fileName string) {
+	table := os.Getenv("SQL_LOG_TABLE")
+	if table == "" {
+		return
+	}
+	host, _ := os.Hostname()
+	q := func(s string) string { return "N'" + strings.ReplaceAll(s, "'", "''") + "'" }
+	query := fmt.Sprintf("INSERT INTO %s (Kab, FileName, ProcessedAt, ProcessedBy, Version) VALUES (%s, %s, %s, %s, %s)",
+		table, q(kab), q(fileName), q(time.Now().Format("2006-01-02T15:04:05")), q(host), q(Version()))
+	if _, err := restore.Query(p.DBHost, p.DBUser, p.DBPass, dbName, query); err != nil {
+		log.Printf("Warning: failed to write to SQL log table %s: %v", table, err)
+	}
+}
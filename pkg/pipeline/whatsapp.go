@@ -0,0 +1,98 @@
+package pipeline
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+
+	"backup-otomatis/internal/env"
+)
+
+// defaultWhatsAppBody is the request body of the WhatsApp Cloud API. Other
+// providers are supported by overriding it with WHATSAPP_BODY_TEMPLATE.
+const defaultWhatsAppBody = `{"messaging_product": "whatsapp", "to": {{json .To}}, "type": "text", "text": {"body": {{json .Message}}}}`
+
+// whatsAppNotifier sends run summaries and errors to WhatsApp through a
+// WhatsApp Business API provider. Warnings and info events are not sent to
+// keep the coordination group quiet.
+type whatsAppNotifier struct {
+	url        string
+	token      string
+	recipients []string
+	body       *template.Template
+	client     *http.Client
+}
+
+// newWhatsAppNotifier configures the notifier from WHATSAPP_API_URL,
+// WHATSAPP_API_TOKEN, WHATSAPP_TO and WHATSAPP_BODY_TEMPLATE.
+func newWhatsAppNotifier() (*whatsAppNotifier, error) {
+	var to []string
+	for _, r := range strings.Split(os.Getenv("WHATSAPP_TO"), ",") {
+		if r = strings.TrimSpace(r); r != "" {
+			to = append(to, r)
+		}
+	}
+	if len(to) == 0 {
+		return nil, fmt.Errorf("WHATSAPP_TO is not set")
+	}
+	funcs := template.FuncMap{"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	}}
+	body, err := template.New("whatsapp").Funcs(funcs).Parse(env.Or("WHATSAPP_BODY_TEMPLATE", defaultWhatsAppBody))
+	if err != nil {
+		return nil, fmt.Errorf("invalid WHATSAPP_BODY_TEMPLATE: %v", err)
+	}
+	return &whatsAppNotifier{
+		url:        os.Getenv("WHATSAPP_API_URL"),
+		token:      os.Getenv("WHATSAPP_API_TOKEN"),
+		recipients: to,
+		body:       body,
+		client:     &http.Client{Timeout: 15 * time.Second},
+	}, nil
+}
+
+func (w *whatsAppNotifier) Notify(level, message string) error {
+	if level != levelError {
+		return nil
+	}
+	return w.send(level, message)
+}
+
+func (w *whatsAppNotifier) NotifySummary(level, message string) error {
+	return w.send(level, message)
+}
+
+// send posts the message to every recipient and returns the last error.
+func (w *whatsAppNotifier) send(level, message string) error {
+	var lastErr error
+	for _, to := range w.recipients {
+		var b bytes.Buffer
+		if err := w.body.Execute(&b, map[string]string{"To": to, "Level": level, "Message": message}); err != nil {
+			return err
+		}
+		req, err := http.NewRequest(http.MethodPost, w.url, &b)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if w.token != "" {
+			req.Header.Set("Authorization", "Bearer "+w.token)
+		}
+		resp, err := w.client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			lastErr = fmt.Errorf("WhatsApp provider returned status %s for %s", resp.Status, to)
+		}
+	}
+	return lastErr
+}
@@ -0,0 +1,221 @@
+package pipeline
+
+import (
+	"archive/zip"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+
+	"backup-otomatis/pkg/track"
+)
+
+// xlsxCell is a cell of a worksheet as stored in the sheet XML.
+type xlsxCell struct {
+	Ref    string `xml:"r,attr"`
+	Type   string `xml:"t,attr"`
+	Value  string `xml:"v"`
+	Inline struct {
+		Text string `xml:"t"`
+		Runs []struct {
+			Text string `xml:"t"`
+		} `xml:"r"`
+	} `xml:"is"`
+}
+
+// xlsxToCSV writes the first worksheet of an .xlsx workbook to csvPath. Cells
+// are written as Excel stores them: numbers and dates as their raw values.
+func xlsxToCSV(xlsxPath, csvPath string) error {
+	zr, err := zip.OpenReader(xlsxPath)
+	if err != nil {
+		return fmt.Errorf("failed to open workbook: %v", err)
+	}
+	defer zr.Close()
+	files := map[string]*zip.File{}
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+	shared, err := xlsxSharedStrings(files["xl/sharedStrings.xml"])
+	if err != nil {
+		return err
+	}
+	sheet, err := xlsxFirstSheet(files)
+	if err != nil {
+		return err
+	}
+	rc, err := sheet.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	out, err := os.Create(csvPath)
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(out)
+	dec := xml.NewDecoder(rc)
+	// Rows are padded to the width of the header row, since empty trailing
+	// cells are not stored.
+	var row []string
+	width := -1
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			out.Close()
+			return fmt.Errorf("failed to read worksheet: %v", err)
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if t.Name.Local == "row" {
+				row = row[:0]
+			}
+			if t.Name.Local == "c" {
+				var c xlsxCell
+				if err := dec.DecodeElement(&c, &t); err != nil {
+					out.Close()
+					return fmt.Errorf("failed to read worksheet: %v", err)
+				}
+				col := track.ColumnIndex(strings.TrimRight(c.Ref, "0123456789"))
+				if col < 0 {
+					col = len(row)
+				}
+				for len(row) <= col {
+					row = append(row, "")
+				}
+				row[col] = xlsxCellText(c, shared)
+			}
+		case xml.EndElement:
+			if t.Name.Local == "row" {
+				if width < 0 {
+					width = len(row)
+				}
+				for len(row) < width {
+					row = append(row, "")
+				}
+				if err := w.Write(row); err != nil {
+					out.Close()
+					return err
+				}
+			}
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// xlsxCellText returns the text of a cell, resolving shared strings.
+func xlsxCellText(c xlsxCell, shared []string) string {
+	switch c.Type {
+	case "s":
+		if i, err := strconv.Atoi(c.Value); err == nil && i >= 0 && i < len(shared) {
+			return shared[i]
+		}
+		return ""
+	case "inlineStr":
+		if c.Inline.Text != "" {
+			return c.Inline.Text
+		}
+		var b strings.Builder
+		for _, r := range c.Inline.Runs {
+			b.WriteString(r.Text)
+		}
+		return b.String()
+	}
+	return c.Value
+}
+
+// xlsxSharedStrings reads the shared string table; f may be nil.
+func xlsxSharedStrings(f *zip.File) ([]string, error) {
+	if f == nil {
+		return nil, nil
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	var sst struct {
+		Items []struct {
+			Text string `xml:"t"`
+			Runs []struct {
+				Text string `xml:"t"`
+			} `xml:"r"`
+		} `xml:"si"`
+	}
+	if err := xml.NewDecoder(rc).Decode(&sst); err != nil {
+		return nil, fmt.Errorf("failed to read shared strings: %v", err)
+	}
+	out := make([]string, len(sst.Items))
+	for i, it := range sst.Items {
+		if it.Text != "" || len(it.Runs) == 0 {
+			out[i] = it.Text
+			continue
+		}
+		var b strings.Builder
+		for _, r := range it.Runs {
+			b.WriteString(r.Text)
+		}
+		out[i] = b.String()
+	}
+	return out, nil
+}
+
+// xlsxFirstSheet returns the part of the first sheet in workbook order.
+func xlsxFirstSheet(files map[string]*zip.File) (*zip.File, error) {
+	var wb struct {
+		Sheets []struct {
+			ID string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+		} `xml:"sheets>sheet"`
+	}
+	var rels struct {
+		Rels []struct {
+			ID     string `xml:"Id,attr"`
+			Target string `xml:"Target,attr"`
+		} `xml:"Relationship"`
+	}
+	if err := xlsxDecode(files["xl/workbook.xml"], &wb); err == nil && len(wb.Sheets) > 0 {
+		if err := xlsxDecode(files["xl/_rels/workbook.xml.rels"], &rels); err == nil {
+			for _, r := range rels.Rels {
+				if r.ID != wb.Sheets[0].ID {
+					continue
+				}
+				target := strings.TrimPrefix(r.Target, "/")
+				if !strings.HasPrefix(target, "xl/") {
+					target = path.Join("xl", target)
+				}
+				if f, ok := files[target]; ok {
+					return f, nil
+				}
+			}
+		}
+	}
+	if f, ok := files["xl/worksheets/sheet1.xml"]; ok {
+		return f, nil
+	}
+	return nil, fmt.Errorf("workbook has no worksheet")
+}
+
+// xlsxDecode decodes the XML part f into v.
+func xlsxDecode(f *zip.File, v interface{}) error {
+	if f == nil {
+		return fmt.Errorf("missing part")
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	return xml.NewDecoder(rc).Decode(v)
+}
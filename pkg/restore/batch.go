@@ -0,0 +1,183 @@
+package restore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"backup-otomatis/internal/env"
+	_ "github.com/denisenkom/go-mssqldb"
+)
+
+// batch is one batch of a T-SQL script, as delimited by GO separators.
+type batch struct {
+	SQL  string
+	Line int // line of the script where the batch starts
+}
+
+// goSeparator matches a GO batch separator line, optionally with a repeat count
+// and a trailing comment.
+var goSeparator = regexp.MustCompile(`(?i)^\s*go(?:\s+(\d+))?\s*(?:--.*)?$`)
+
+// splitBatches splits a T-SQL script on GO separator lines the way sqlcmd
+// does. GO inside string literals, quoted identifiers and block comments is not
+// a separator. "GO n" repeats the preceding batch n times; empty batches are dropped.
+func splitBatches(script string) []batch {
+	var batches []batch
+	var cur strings.Builder
+	start := 1
+	flush := func(count int) {
+		if strings.TrimSpace(cur.String()) != "" {
+			for i := 0; i < count; i++ {
+				batches = append(batches, batch{SQL: cur.String(), Line: start})
+			}
+		}
+		cur.Reset()
+	}
+
+	var quote byte // closing character of the open string or identifier, 0 if none
+	blockDepth := 0
+	for i, line := range strings.SplitAfter(script, "\n") {
+		if quote == 0 && blockDepth == 0 {
+			if m := goSeparator.FindStringSubmatch(strings.TrimRight(line, "\r\n")); m != nil {
+				count := 1
+				if m[1] != "" {
+					count, _ = strconv.Atoi(m[1])
+				}
+				flush(count)
+				start = i + 2
+				continue
+			}
+		}
+		for k := 0; k < len(line); k++ {
+			c := line[k]
+			var next byte
+			if k+1 < len(line) {
+				next = line[k+1]
+			}
+			switch {
+			case quote != 0:
+				if c == quote {
+					if next == quote {
+						k++ // doubled quote is an escaped quote
+					} else {
+						quote = 0
+					}
+				}
+			case blockDepth > 0:
+				if c == '*' && next == '/' {
+					blockDepth--
+					k++
+				} else if c == '/' && next == '*' {
+					blockDepth++
+					k++
+				}
+			case c == '-' && next == '-':
+				k = len(line)
+			case c == '/' && next == '*':
+				blockDepth++
+				k++
+			case c == '\'' || c == '"':
+				quote = c
+			case c == '[':
+				quote = ']'
+			}
+		}
+		cur.WriteString(line)
+	}
+	flush(1)
+	return batches
+}
+
+// ServerURL builds a go-mssqldb connection URL from an sqlcmd-style host
+// ("host", "host,port" or "host\instance"). Empty credentials select Windows
+// authentication, as with sqlcmd -E.
+func ServerURL(host, user, pass, dbName string) string {
+	h, instance, _ := strings.Cut(host, `\`)
+	if hp, port, ok := strings.Cut(h, ","); ok {
+		h = hp + ":" + port
+	}
+	if h == "." || strings.EqualFold(h, "(local)") {
+		h = "localhost"
+	}
+	u := &url.URL{Scheme: "sqlserver", Host: h, Path: instance}
+	if user != "" || pass != "" {
+		u.User = url.UserPassword(user, pass)
+	}
+	q := url.Values{}
+	q.Set("database", dbName)
+	setSQLTLSParams(q)
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// RunScript runs the T-SQL script at path against dbName through the
+// native driver, one batch at a time on a single connection so session state
+// carries over between batches. A batch failing with a transient error is
+// retried on its own; any other error stops the script and names the batch.
+// Script variables are resolved from vars first. It returns the rows affected
+// by each batch.
+func RunScript(host, user, pass, dbName, path string, vars map[string]string) ([]int64, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read update script: %v", err)
+	}
+	script, err := ExpandVars(string(b), vars)
+	if err != nil {
+		return nil, err
+	}
+	batches := splitBatches(script)
+	log.Printf("Running update script %s (%d batches)", path, len(batches))
+
+	ctx := context.Background()
+	if timeout := env.Duration("UPDATE_QUERY_TIMEOUT", 0); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	db, err := sql.Open("sqlserver", ServerURL(host, user, pass, dbName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %v", err)
+	}
+	defer db.Close()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", host, err)
+	}
+	defer conn.Close()
+	return execBatches(ctx, conn, batches)
+}
+
+// execBatches runs batches one by one on conn, retrying a batch that fails
+// with a transient error. It returns the rows affected by each batch run.
+func execBatches(ctx context.Context, conn *sql.Conn, batches []batch) ([]int64, error) {
+	var err error
+	attempts, backoff := retrySettings()
+	var counts []int64
+	for i, batch := range batches {
+		var res sql.Result
+		for attempt := 1; ; attempt++ {
+			res, err = conn.ExecContext(ctx, batch.SQL)
+			if err == nil || attempt >= attempts || !isTransient(err.Error()) {
+				break
+			}
+			wait := time.Duration(attempt) * backoff
+			log.Printf("Batch %d/%d hit a transient error (attempt %d/%d), retrying in %s: %v", i+1, len(batches), attempt, attempts, wait, err)
+			time.Sleep(wait)
+		}
+		if err != nil {
+			return counts, fmt.Errorf("batch %d/%d (line %d) failed: %v", i+1, len(batches), batch.Line, err)
+		}
+		n, _ := res.RowsAffected()
+		counts = append(counts, n)
+		log.Printf("Batch %d/%d (line %d): %d row(s) affected", i+1, len(batches), batch.Line, n)
+	}
+	return counts, nil
+}
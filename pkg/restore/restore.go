@@ -0,0 +1,144 @@
+// Package restore restores the backups into SQL Server and runs the update
+// step against them, through sqlcmd and the go-mssqldb driver. The Temp
+// database the backups are restored into is dropped again with Drop.
+package restore
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Backup restores the .bak file at bakPath into the Temp database on host,
+// replacing it. The data and log files go to the instance's default data path,
+// or next to the backup when the instance has none. Empty user and pass select
+// Windows authentication.
+func Backup(host, user, pass, bakPath string) error {
+	return BackupWithProgress(host, user, pass, bakPath, nil)
+}
+
+// BackupWithProgress is Backup passing the restore's progress events to
+// progress, which may be nil.
+func BackupWithProgress(host, user, pass, bakPath string, progress func(Progress)) error {
+	dbName := "Temp"
+	args := ConnArgs(host, user, pass, "master")
+
+	// First, get logical file names from the backup using RESTORE FILELISTONLY
+	argsList := append(args, "-h", "-1", "-W", "-s", "|", "-Q", fmt.Sprintf("SET NOCOUNT ON; RESTORE FILELISTONLY FROM DISK='%s'", bakPath))
+	cmd := exec.Command("sqlcmd", argsList...)
+	out, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("failed to run RESTORE FILELISTONLY: %v", err)
+	}
+	// If sqlcmd returned output that looks like an error message (for example
+	// messages starting with "Msg" or containing "error"/"failed"), treat
+	// it as a failure even if the process exit code is 0.
+	if has, txt := OutputHasError(out); has {
+		return fmt.Errorf("RESTORE FILELISTONLY reported error: %s", txt)
+	}
+	listOut := strings.TrimSpace(string(out))
+	var dataLogical, logLogical string
+	if listOut != "" {
+		lines := strings.Split(listOut, "\n")
+		for _, l := range lines {
+			l = strings.TrimSpace(l)
+			if l == "" {
+				continue
+			}
+			cols := strings.Split(l, "|")
+			for i := range cols {
+				cols[i] = strings.TrimSpace(cols[i])
+			}
+			if len(cols) < 3 {
+				continue
+			}
+			typ := strings.ToUpper(cols[2])
+			if strings.HasPrefix(typ, "L") {
+				logLogical = cols[0]
+			} else {
+				// treat as data
+				dataLogical = cols[0]
+			}
+		}
+	}
+
+	// Next, query the instance default data path. Use SET NOCOUNT ON and suppress headers/rowcounts.
+	argsPath := append(args, "-h", "-1", "-W", "-Q", "SET NOCOUNT ON; SELECT SERVERPROPERTY('InstanceDefaultDataPath')")
+	cmd = exec.Command("sqlcmd", argsPath...)
+	out, err = cmd.Output()
+	if err != nil {
+		// If we can't get the instance path, fall back to the backup's directory
+		log.Printf("warning: failed to get instance data path: %v", err)
+	} else {
+		// check output for error-like content
+		if has, txt := OutputHasError(out); has {
+			log.Printf("warning: RESTORE PATH query reported messages: %s", txt)
+			// continue; don't abort here because we can still fall back to bak dir
+		}
+	}
+	dataPath := strings.TrimSpace(string(out))
+	// sqlcmd may return the literal "NULL" when the property is not set.
+	if dataPath == "" || strings.EqualFold(dataPath, "NULL") {
+		// fallback to directory of the .bak file
+		dataPath = filepath.Dir(bakPath)
+		log.Printf("Data path empty or NULL, falling back to bak directory: %s", dataPath)
+	} else {
+		log.Printf("Data path: %s", dataPath)
+	}
+
+	// Use detected logical names or sensible defaults
+	if dataLogical == "" {
+		dataLogical = dbName
+	}
+	if logLogical == "" {
+		logLogical = dbName + "_log"
+	}
+
+	// Set database to single user mode to close all other connections
+	// Database set to single user mode is handled by caller if needed
+
+	// Build RESTORE ... WITH MOVE statement
+	mdfTarget := filepath.Join(dataPath, dbName+".mdf")
+	ldfTarget := filepath.Join(dataPath, dbName+"_log.ldf")
+	query := fmt.Sprintf("RESTORE DATABASE %s FROM DISK='%s' WITH REPLACE, STATS = %d, MOVE '%s' TO '%s', MOVE '%s' TO '%s'", dbName, bakPath, statsPercent, dataLogical, mdfTarget, logLogical, ldfTarget)
+	argsRestore := append(args, "-Q", query)
+	output, err := runWithStats(argsRestore, progress)
+	if err != nil {
+		log.Printf("sqlcmd output: %s", string(output))
+		return fmt.Errorf("restore failed: %v: %s", err, strings.TrimSpace(string(output)))
+	}
+	if has, txt := OutputHasError(output); has {
+		log.Printf("sqlcmd output: %s", string(output))
+		return fmt.Errorf("restore reported errors: %s", txt)
+	}
+	log.Println("Database restore completed")
+
+	// // Set database back to multi user mode
+	// Set database back to multi user mode is handled by caller if needed
+
+	return nil
+}
+
+// Drop drops the Temp database on host using sqlcmd. It will attempt to set
+// the database to single user with rollback immediate before dropping to ensure
+// no active connections block the drop.
+func Drop(host, user, pass string) error {
+	dbName := "Temp"
+	args := ConnArgs(host, user, pass, "master")
+
+	// Set single user with rollback immediate, then drop database
+	cmdText := fmt.Sprintf("ALTER DATABASE %s SET SINGLE_USER WITH ROLLBACK IMMEDIATE; DROP DATABASE %s;", dbName, dbName)
+	args = append(args, "-Q", cmdText)
+	cmd := exec.Command("sqlcmd", args...)
+	output, err := cmd.CombinedOutput()
+	log.Printf("sqlcmd output (dropDatabase): %s", string(output))
+	if err != nil {
+		return fmt.Errorf("sqlcmd error while dropping database: %v", err)
+	}
+	if has, txt := OutputHasError(output); has {
+		return fmt.Errorf("drop database reported errors: %s", txt)
+	}
+	return nil
+}
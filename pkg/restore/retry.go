@@ -0,0 +1,114 @@
+package restore
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"backup-otomatis/internal/env"
+)
+
+// Default retry settings for transient SQL errors in the update step.
+const (
+	defaultSQLRetryAttempts = 3
+	defaultSQLRetryBackoff  = 5 * time.Second
+)
+
+// transientSQLErrors are SQL Server error numbers worth retrying: deadlock
+// victim (1205), broken connection (233) and a database that cannot be opened
+// yet, e.g. while the web app reconnects (4060).
+var transientSQLErrors = map[int]string{
+	1205: "deadlock victim",
+	233:  "no process is on the other end of the pipe",
+	4060: "cannot open database",
+}
+
+// sqlMessagePattern matches the "Msg <number>," prefix sqlcmd prints per error.
+var sqlMessagePattern = regexp.MustCompile(`Msg (\d+),`)
+
+// isTransient reports whether the error text of a failed statement
+// contains one of transientSQLErrors, by number or, for connection errors that
+// sqlcmd prints without a number, by message.
+func isTransient(text string) bool {
+	for _, m := range sqlMessagePattern.FindAllStringSubmatch(text, -1) {
+		if n, err := strconv.Atoi(m[1]); err == nil {
+			if _, ok := transientSQLErrors[n]; ok {
+				return true
+			}
+		}
+	}
+	lower := strings.ToLower(text)
+	for _, msg := range transientSQLErrors {
+		if strings.Contains(lower, msg) {
+			return true
+		}
+	}
+	return false
+}
+
+// retrySettings returns the attempts and initial backoff for transient SQL
+// errors, from SQL_RETRY_ATTEMPTS and SQL_RETRY_BACKOFF.
+func retrySettings() (int, time.Duration) {
+	attempts := defaultSQLRetryAttempts
+	if v := os.Getenv("SQL_RETRY_ATTEMPTS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			attempts = n
+		} else {
+			log.Printf("Warning: invalid SQL_RETRY_ATTEMPTS %q, using %d", v, attempts)
+		}
+	}
+	return attempts, env.Duration("SQL_RETRY_BACKOFF", defaultSQLRetryBackoff)
+}
+
+// runQueryWithRetry runs the update query and retries it with linear
+// backoff while it fails with a transient error. Permanent errors such as
+// syntax errors are returned immediately.
+func runQueryWithRetry(host, user, pass, dbName, query string) ([]int64, error) {
+	attempts, backoff := retrySettings()
+	var err error
+	for attempt := 1; attempt <= attempts; attempt++ {
+		var rows []int64
+		rows, err = RunQuery(host, user, pass, dbName, query)
+		if err == nil || !isTransient(err.Error()) {
+			return rows, err
+		}
+		if attempt < attempts {
+			wait := time.Duration(attempt) * backoff
+			log.Printf("Update query hit a transient error (attempt %d/%d), retrying in %s: %v", attempt, attempts, wait, err)
+			time.Sleep(wait)
+		}
+	}
+	return nil, err
+}
+
+// rowsAffectedPattern matches the per-statement count sqlcmd prints unless NOCOUNT is on.
+var rowsAffectedPattern = regexp.MustCompile(`\((\d+) rows? affected\)`)
+
+// parseRowsAffected returns the rows affected by each statement in sqlcmd output.
+func parseRowsAffected(output string) []int64 {
+	var counts []int64
+	for _, m := range rowsAffectedPattern.FindAllStringSubmatch(output, -1) {
+		if n, err := strconv.ParseInt(m[1], 10, 64); err == nil {
+			counts = append(counts, n)
+		}
+	}
+	return counts
+}
+
+// FormatRowsAffected renders per-statement counts, e.g. "17 rows (12, 0, 5)".
+func FormatRowsAffected(counts []int64) string {
+	if len(counts) == 0 {
+		return "no row counts reported"
+	}
+	var total int64
+	parts := make([]string, len(counts))
+	for i, n := range counts {
+		total += n
+		parts[i] = strconv.FormatInt(n, 10)
+	}
+	return fmt.Sprintf("%d rows (%s)", total, strings.Join(parts, ", "))
+}
@@ -0,0 +1,211 @@
+package restore
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"backup-otomatis/internal/env"
+)
+
+// defaultScriptsTable records which scripts of UPDATE_SCRIPTS_DIR were
+// applied to a restore unless UPDATE_SCRIPTS_TABLE names another table.
+const defaultScriptsTable = "dbo.update_script_history"
+
+// updateScriptFile matches versioned script names such as V1__create_views.sql
+// or V2.1__fix_kab_codes.sql.
+var updateScriptFile = regexp.MustCompile(`(?i)^V(\d+(?:\.\d+)*)__(.+)\.sql$`)
+
+// schemaQualified matches a schema.table name.
+var schemaQualified = regexp.MustCompile(`^\[?\w+\]?\.\[?\w+\]?$`)
+
+// Script is one versioned script of UPDATE_SCRIPTS_DIR.
+type Script struct {
+	Version  string
+	Name     string
+	Path     string
+	Checksum string
+	parts    []int
+}
+
+// before orders scripts by their numeric version, so V10 runs after V9.
+func (s Script) before(o Script) bool {
+	for i := 0; i < len(s.parts) && i < len(o.parts); i++ {
+		if s.parts[i] != o.parts[i] {
+			return s.parts[i] < o.parts[i]
+		}
+	}
+	return len(s.parts) < len(o.parts)
+}
+
+// LoadScripts reads the versioned scripts of dir in version order.
+// Other files are ignored with a warning; two scripts with the same version
+// are an error.
+func LoadScripts(dir string) ([]Script, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read UPDATE_SCRIPTS_DIR: %v", err)
+	}
+	var scripts []Script
+	seen := map[string]string{}
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+		m := updateScriptFile.FindStringSubmatch(e.Name())
+		if m == nil {
+			log.Printf("Warning: ignoring %s in UPDATE_SCRIPTS_DIR, expected V<version>__<name>.sql", e.Name())
+			continue
+		}
+		s := Script{Name: e.Name(), Path: filepath.Join(dir, e.Name())}
+		// Versions compare numerically, so V1.02 and V1.2 are the same version.
+		var norm []string
+		for _, p := range strings.Split(m[1], ".") {
+			n, _ := strconv.Atoi(p)
+			s.parts = append(s.parts, n)
+			norm = append(norm, strconv.Itoa(n))
+		}
+		s.Version = strings.Join(norm, ".")
+		if other, ok := seen[s.Version]; ok {
+			return nil, fmt.Errorf("update scripts %s and %s have the same version %s", other, s.Name, s.Version)
+		}
+		seen[s.Version] = s.Name
+		b, err := os.ReadFile(s.Path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read update script: %v", err)
+		}
+		sum := sha256.Sum256(b)
+		s.Checksum = hex.EncodeToString(sum[:])
+		scripts = append(scripts, s)
+	}
+	sort.Slice(scripts, func(i, k int) bool { return scripts[i].before(scripts[k]) })
+	return scripts, nil
+}
+
+// scriptsTable returns UPDATE_SCRIPTS_TABLE, which must be schema
+// qualified so the scripts' own default schema cannot move it.
+func scriptsTable() (string, error) {
+	t := env.Or("UPDATE_SCRIPTS_TABLE", defaultScriptsTable)
+	if !schemaQualified.MatchString(t) {
+		return "", fmt.Errorf("UPDATE_SCRIPTS_TABLE %q must be schema-qualified, e.g. %s", t, defaultScriptsTable)
+	}
+	return t, nil
+}
+
+// RunScripts applies the versioned scripts of dir to dbName in version
+// order, migration style. Which scripts were applied is tracked in
+// UPDATE_SCRIPTS_TABLE inside the restored database, so the table starts empty
+// with every restore and a retried update only runs the scripts that have not
+// succeeded yet. Each script runs batch by batch like UPDATE_SCRIPT_FILE and
+// its outcome, duration and error are recorded; the first failing script stops
+// the update and the later ones are reported as not run. A script that changed
+// after it was applied to the same restore is an error. It returns the rows
+// affected by each batch run.
+func RunScripts(host, user, pass, dbName, dir string, vars map[string]string) ([]int64, error) {
+	scripts, err := LoadScripts(dir)
+	if err != nil {
+		return nil, err
+	}
+	table, err := scriptsTable()
+	if err != nil {
+		return nil, err
+	}
+	if restored := vars["RESTORED_DB"]; restored != "" {
+		table = restored + "." + table
+	}
+	table = QuoteName(table)
+	log.Printf("Running %d update script(s) from %s", len(scripts), dir)
+
+	ctx := context.Background()
+	if timeout := env.Duration("UPDATE_QUERY_TIMEOUT", 0); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	db, err := sql.Open("sqlserver", ServerURL(host, user, pass, dbName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %v", err)
+	}
+	defer db.Close()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", host, err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, fmt.Sprintf(`IF OBJECT_ID(N'%[1]s', N'U') IS NULL
+CREATE TABLE %[1]s (
+	version nvarchar(50) NOT NULL PRIMARY KEY,
+	script nvarchar(260) NOT NULL,
+	checksum char(64) NOT NULL,
+	applied_at datetime2 NOT NULL,
+	duration_ms int NOT NULL,
+	success bit NOT NULL,
+	error nvarchar(max) NULL
+)`, table)); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", table, err)
+	}
+	applied := map[string]string{}
+	rows, err := conn.QueryContext(ctx, fmt.Sprintf("SELECT version, checksum FROM %s WHERE success = 1", table))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %v", table, err)
+	}
+	for rows.Next() {
+		var version, checksum string
+		if err := rows.Scan(&version, &checksum); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to read %s: %v", table, err)
+		}
+		applied[version] = checksum
+	}
+	rows.Close()
+
+	var counts []int64
+	for i, s := range scripts {
+		if checksum, ok := applied[s.Version]; ok {
+			if checksum != s.Checksum {
+				return counts, fmt.Errorf("update script %s changed after it was applied", s.Name)
+			}
+			log.Printf("Update script %s already applied", s.Name)
+			continue
+		}
+		b, err := os.ReadFile(s.Path)
+		if err != nil {
+			return counts, fmt.Errorf("failed to read update script: %v", err)
+		}
+		script, err := ExpandVars(string(b), vars)
+		if err != nil {
+			return counts, fmt.Errorf("update script %s: %v", s.Name, err)
+		}
+		start := time.Now()
+		n, runErr := execBatches(ctx, conn, splitBatches(script))
+		counts = append(counts, n...)
+		var errText interface{}
+		if runErr != nil {
+			errText = runErr.Error()
+		}
+		if _, err := conn.ExecContext(ctx, fmt.Sprintf(`DELETE FROM %[1]s WHERE version = @p1;
+INSERT INTO %[1]s (version, script, checksum, applied_at, duration_ms, success, error) VALUES (@p1, @p2, @p3, SYSDATETIME(), @p4, @p5, @p6)`, table),
+			s.Version, s.Name, s.Checksum, time.Since(start).Milliseconds(), runErr == nil, errText); err != nil {
+			log.Printf("Warning: failed to record update script %s in %s: %v", s.Name, table, err)
+		}
+		if runErr != nil {
+			for _, rest := range scripts[i+1:] {
+				log.Printf("Update script %s not run", rest.Name)
+			}
+			return counts, fmt.Errorf("update script %s failed: %v", s.Name, runErr)
+		}
+		log.Printf("Update script %s applied in %s", s.Name, time.Since(start).Round(time.Millisecond))
+	}
+	return counts, nil
+}
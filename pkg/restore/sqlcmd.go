@@ -0,0 +1,105 @@
+package restore
+
+import (
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+
+	"backup-otomatis/internal/env"
+)
+
+// QuoteName brackets each part of a possibly schema-qualified name.
+func QuoteName(name string) string {
+	parts := strings.Split(name, ".")
+	for i, p := range parts {
+		parts[i] = "[" + strings.ReplaceAll(strings.Trim(p, "[]"), "]", "]]") + "]"
+	}
+	return strings.Join(parts, ".")
+}
+
+// RunQuery runs query against dbName with sqlcmd, cancelled after
+// UPDATE_QUERY_TIMEOUT, and returns the rows affected by each statement.
+func RunQuery(host, user, pass, dbName, query string) ([]int64, error) {
+	args := ConnArgs(host, user, pass, dbName)
+	args = append(args, QueryTimeoutArgs()...)
+	args = append(args, "-Q", query)
+	// log.Printf("Running sqlcmd with args: %v", args)
+	cmd := exec.Command("sqlcmd", args...)
+	output, err := cmd.CombinedOutput()
+	log.Printf("sqlcmd output: %s", string(output))
+	if err != nil {
+		return nil, fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	if has, txt := OutputHasError(output); has {
+		return nil, fmt.Errorf("sql update reported error: %s", txt)
+	}
+	return parseRowsAffected(string(output)), nil
+}
+
+// OutputHasError inspects sqlcmd output for common SQL Server error patterns.
+// It returns true and a shortened text snippet when it detects likely errors.
+func OutputHasError(output []byte) (bool, string) {
+	s := string(output)
+	if s == "" {
+		return false, ""
+	}
+	lower := strings.ToLower(s)
+	// Look for SQL Server message prefix (e.g., "Msg 12345") or common error words.
+	if strings.Contains(s, "Msg ") || strings.Contains(lower, "error") || strings.Contains(lower, "failed") || strings.Contains(lower, "cannot") {
+		// return a trimmed snippet (first 1024 chars) to avoid huge error messages
+		snippet := s
+		if len(snippet) > 1024 {
+			snippet = snippet[:1024] + "..."
+		}
+		return true, snippet
+	}
+	return false, ""
+}
+
+// Scalar runs query against dbName and returns the first value it prints.
+func Scalar(host, user, pass, dbName, query string) (string, error) {
+	args := ConnArgs(host, user, pass, dbName)
+	args = append(args, "-h", "-1", "-W", "-Q", "SET NOCOUNT ON; "+query)
+	output, err := exec.Command("sqlcmd", args...).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	if has, txt := OutputHasError(output); has {
+		return "", fmt.Errorf("query reported error: %s", txt)
+	}
+	for _, l := range strings.Split(string(output), "\n") {
+		if l = strings.TrimSpace(l); l != "" {
+			return l, nil
+		}
+	}
+	return "", nil
+}
+
+// QueryTimeoutArgs returns the sqlcmd arguments enforcing
+// UPDATE_QUERY_TIMEOUT, after which sqlcmd cancels the statement.
+func QueryTimeoutArgs() []string {
+	timeout := env.Duration("UPDATE_QUERY_TIMEOUT", 0)
+	if timeout <= 0 {
+		return nil
+	}
+	secs := int(timeout.Seconds())
+	if secs < 1 {
+		secs = 1
+	}
+	return []string{"-t", fmt.Sprint(secs)}
+}
+
+// Query runs query against dbName and returns its output.
+func Query(host, user, pass, dbName, query string) ([]byte, error) {
+	args := ConnArgs(host, user, pass, dbName)
+	args = append(args, "-W", "-Q", "SET NOCOUNT ON; "+query)
+	output, err := exec.Command("sqlcmd", args...).CombinedOutput()
+	if err != nil {
+		return output, fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	if has, txt := OutputHasError(output); has {
+		return output, fmt.Errorf("query reported error: %s", txt)
+	}
+	return output, nil
+}
@@ -0,0 +1,77 @@
+package restore
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"log"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statsPercent is the STATS interval of restores: SQL Server reports
+// progress every this many percent.
+const statsPercent = 5
+
+// Progress is one "n percent processed." message of a running restore.
+type Progress struct {
+	Percent int
+	Elapsed time.Duration
+}
+
+// remaining estimates the time left from the progress so far.
+func (p Progress) remaining() time.Duration {
+	if p.Percent <= 0 {
+		return 0
+	}
+	return time.Duration(float64(p.Elapsed) * float64(100-p.Percent) / float64(p.Percent))
+}
+
+var (
+	restorePercentRE = regexp.MustCompile(`^(\d+) percent processed`)
+	restoreDoneRE    = regexp.MustCompile(`processed (\d+) pages in ([\d.]+) seconds \(([\d.]+) MB/sec\)`)
+)
+
+// runWithStats runs sqlcmd with args, a RESTORE ... WITH STATS
+// statement, and turns its progress messages into events as they arrive: each
+// is logged with an estimate of the time left and passed to progress, which
+// may be nil. It returns the complete output for error detection.
+func runWithStats(args []string, progress func(Progress)) ([]byte, error) {
+	cmd := exec.Command("sqlcmd", args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stderr = cmd.Stdout
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	var output bytes.Buffer
+	sc := bufio.NewScanner(stdout)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := sc.Text()
+		output.WriteString(line + "\n")
+		text := strings.TrimSpace(line)
+		if m := restorePercentRE.FindStringSubmatch(text); m != nil {
+			pct, _ := strconv.Atoi(m[1])
+			p := Progress{Percent: pct, Elapsed: time.Since(start)}
+			log.Printf("Restore %d%% done after %s, about %s left", pct, p.Elapsed.Round(time.Second), p.remaining().Round(time.Second))
+			if progress != nil {
+				progress(p)
+			}
+		} else if m := restoreDoneRE.FindStringSubmatch(text); m != nil {
+			log.Printf("Restore processed %s pages in %s s (%s MB/s)", m[1], m[2], m[3])
+		}
+	}
+	if sc.Err() != nil {
+		// Keep draining, or sqlcmd blocks on a full pipe and never exits.
+		io.Copy(&output, stdout)
+	}
+	err = cmd.Wait()
+	return output.Bytes(), err
+}
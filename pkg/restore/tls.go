@@ -0,0 +1,55 @@
+package restore
+
+import (
+	"net/url"
+	"os"
+	"strings"
+)
+
+// sqlEncrypt reports whether connections must be encrypted (DB_ENCRYPT).
+func sqlEncrypt() bool {
+	return strings.EqualFold(os.Getenv("DB_ENCRYPT"), "true")
+}
+
+// sqlTrustServerCertificate reports whether the server certificate is accepted
+// without validation (DB_TRUST_SERVER_CERTIFICATE). Security requires false.
+func sqlTrustServerCertificate() bool {
+	return strings.EqualFold(os.Getenv("DB_TRUST_SERVER_CERTIFICATE"), "true")
+}
+
+// ConnArgs returns the sqlcmd arguments connecting to dbName on host:
+// Windows authentication when user and pass are empty, -N to encrypt and -C
+// to trust the server certificate as configured.
+func ConnArgs(host, user, pass, dbName string) []string {
+	args := []string{"-S", host, "-d", dbName}
+	if user == "" && pass == "" {
+		args = append(args, "-E")
+	} else {
+		args = append(args, "-U", user, "-P", pass)
+	}
+	if sqlEncrypt() {
+		args = append(args, "-N")
+	}
+	if sqlTrustServerCertificate() {
+		args = append(args, "-C")
+	}
+	return args
+}
+
+// setSQLTLSParams adds the go-mssqldb encryption parameters to q. DB_CA_CERT_FILE
+// and DB_HOST_NAME_IN_CERTIFICATE validate servers whose certificate is signed
+// by an internal CA or issued for another name.
+func setSQLTLSParams(q url.Values) {
+	if sqlEncrypt() {
+		q.Set("encrypt", "true")
+	}
+	if sqlTrustServerCertificate() {
+		q.Set("TrustServerCertificate", "true")
+	}
+	if v := os.Getenv("DB_CA_CERT_FILE"); v != "" {
+		q.Set("certificate", v)
+	}
+	if v := os.Getenv("DB_HOST_NAME_IN_CERTIFICATE"); v != "" {
+		q.Set("hostNameInCertificate", v)
+	}
+}
@@ -0,0 +1,25 @@
+package restore
+
+// Update is the update run against a restored database: the versioned
+// scripts of ScriptsDir, else the script ScriptFile, else the statement Query.
+type Update struct {
+	ScriptsDir string
+	ScriptFile string
+	Query      string
+}
+
+// Run runs the update against dbName on host with the file's script
+// variables. It returns the rows affected by each statement or batch.
+func (u Update) Run(host, user, pass, dbName string, vars map[string]string) ([]int64, error) {
+	if u.ScriptsDir != "" {
+		return RunScripts(host, user, pass, dbName, u.ScriptsDir, vars)
+	}
+	if u.ScriptFile != "" {
+		return RunScript(host, user, pass, dbName, u.ScriptFile, vars)
+	}
+	query, err := ExpandVars(u.Query, vars)
+	if err != nil {
+		return nil, err
+	}
+	return runQueryWithRetry(host, user, pass, dbName, query)
+}
@@ -0,0 +1,44 @@
+package restore
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// setvarLine matches an sqlcmd ":setvar NAME value" line; the value may be quoted.
+var setvarLine = regexp.MustCompile(`(?im)^[ \t]*:setvar[ \t]+(\w+)[ \t]+("[^"]*"|\S+)[ \t]*\r?$\n?`)
+
+// sqlVarRef matches an sqlcmd-style $(NAME) variable reference.
+var sqlVarRef = regexp.MustCompile(`\$\((\w+)\)`)
+
+// ExpandVars resolves sqlcmd-style variables in an update script. ":setvar"
+// lines define defaults and are removed; the per-file variables in vars take
+// precedence over them so one shared script works for every kab. Variable names
+// are case-insensitive, and referencing an undefined variable is an error, as
+// in sqlcmd.
+func ExpandVars(script string, vars map[string]string) (string, error) {
+	values := map[string]string{}
+	for _, m := range setvarLine.FindAllStringSubmatch(script, -1) {
+		values[strings.ToUpper(m[1])] = strings.Trim(m[2], `"`)
+	}
+	for k, v := range vars {
+		values[strings.ToUpper(k)] = v
+	}
+	script = setvarLine.ReplaceAllString(script, "")
+
+	var missing []string
+	out := sqlVarRef.ReplaceAllStringFunc(script, func(ref string) string {
+		name := strings.ToUpper(sqlVarRef.FindStringSubmatch(ref)[1])
+		v, ok := values[name]
+		if !ok {
+			missing = append(missing, name)
+			return ref
+		}
+		return v
+	})
+	if len(missing) > 0 {
+		return "", fmt.Errorf("undefined script variable(s): %s", strings.Join(missing, ", "))
+	}
+	return out, nil
+}
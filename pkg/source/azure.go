@@ -0,0 +1,346 @@
+package source
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Azure Blob requests use this REST API version and retry throttling and
+// server errors this many times.
+const (
+	azureAPIVersion     = "2021-08-06"
+	azureAttempts       = 4
+	azureLeaseSeconds   = 60
+	azureLeaseRenewal   = 40 * time.Second
+	azureBlobIDPrefix   = "azblob:"
+	azureListPageBlobs  = 5000
+	azureMetadataPrefix = "x-ms-meta-"
+)
+
+// Azure is a job's Azure Blob container, read with a SAS token that
+// needs list, read, write and delete permissions.
+type Azure struct {
+	// ContainerURL is e.g. "https://acct.blob.core.windows.net/uploads".
+	ContainerURL string `json:"containerUrl"`
+	// SAS is the token; SASEnv names an environment variable holding it, which
+	// keeps the token out of JOBS_FILE.
+	SAS    string `json:"sas"`
+	SASEnv string `json:"sasEnv"`
+	// Prefix limits the listing, e.g. "susenas/". The virtual folder holding a
+	// blob is its kab, like the Drive folder of an upload.
+	Prefix string `json:"prefix"`
+}
+
+// azureBlob is a listed blob.
+type azureBlob struct {
+	src      *Azure
+	name     string
+	metadata map[string]string
+
+	mu    sync.Mutex
+	lease string
+	stop  chan struct{}
+}
+
+// Token returns the SAS token without its leading "?".
+func (s *Azure) Token() string {
+	t := s.SAS
+	if s.SASEnv != "" {
+		t = os.Getenv(s.SASEnv)
+	}
+	return strings.TrimPrefix(t, "?")
+}
+
+// blobURL returns the URL of a blob, or of the container when blob is empty,
+// with the query and the SAS token.
+func (s *Azure) blobURL(blob, query string) string {
+	u := strings.TrimRight(s.ContainerURL, "/")
+	if blob != "" {
+		parts := strings.Split(blob, "/")
+		for i, p := range parts {
+			parts[i] = url.PathEscape(p)
+		}
+		u += "/" + strings.Join(parts, "/")
+	}
+	q := query
+	if sas := s.Token(); sas != "" {
+		if q != "" {
+			q += "&"
+		}
+		q += sas
+	}
+	if q != "" {
+		u += "?" + q
+	}
+	return u
+}
+
+// do sends a request, retrying throttling, server errors and network failures
+// with backoff. A response with an unexpected status is returned as an error
+// with the service's error code.
+func (s *Azure) do(method, blob, query string, headers map[string]string, want ...int) (*http.Response, error) {
+	var err error
+	for attempt := 1; attempt <= azureAttempts; attempt++ {
+		var req *http.Request
+		req, err = http.NewRequest(method, s.blobURL(blob, query), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("x-ms-version", azureAPIVersion)
+		req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		var resp *http.Response
+		resp, err = http.DefaultClient.Do(req)
+		if err == nil {
+			for _, code := range want {
+				if resp.StatusCode == code {
+					return resp, nil
+				}
+			}
+			body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+			resp.Body.Close()
+			err = fmt.Errorf("azure blob %s %s: %s %s", method, blob, resp.Status, resp.Header.Get("x-ms-error-code"))
+			if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode < 500 {
+				log.Printf("Azure error body: %s", strings.TrimSpace(string(body)))
+				return nil, err
+			}
+		}
+		if attempt < azureAttempts {
+			wait := time.Duration(attempt*attempt) * 2 * time.Second
+			log.Printf("%v, retrying in %s", err, wait)
+			time.Sleep(wait)
+		}
+	}
+	return nil, err
+}
+
+// azureListing is the response of List Blobs.
+type azureListing struct {
+	Blobs []struct {
+		Name       string `xml:"Name"`
+		Properties struct {
+			CreationTime string `xml:"Creation-Time"`
+			LastModified string `xml:"Last-Modified"`
+			Length       int64  `xml:"Content-Length"`
+			ContentMD5   string `xml:"Content-MD5"`
+			LeaseState   string `xml:"LeaseState"`
+		} `xml:"Properties"`
+		Metadata struct {
+			Items []struct {
+				XMLName xml.Name
+				Value   string `xml:",chardata"`
+			} `xml:",any"`
+		} `xml:"Metadata"`
+	} `xml:"Blobs>Blob"`
+	NextMarker string `xml:"NextMarker"`
+}
+
+// List lists the job's backups in its container: blobs under the prefix
+// whose name contains namePattern, oldest first. Blobs marked processed or
+// leased by another server are left out.
+func (s *Azure) List(namePattern string) ([]*File, error) {
+	var files []*File
+	marker := ""
+	for {
+		q := url.Values{"restype": {"container"}, "comp": {"list"}, "include": {"metadata"},
+			"maxresults": {strconv.Itoa(azureListPageBlobs)}}
+		if s.Prefix != "" {
+			q.Set("prefix", s.Prefix)
+		}
+		if marker != "" {
+			q.Set("marker", marker)
+		}
+		resp, err := s.do(http.MethodGet, "", q.Encode(), nil, http.StatusOK)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list container: %v", err)
+		}
+		var l azureListing
+		err = xml.NewDecoder(resp.Body).Decode(&l)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse blob listing: %v", err)
+		}
+		for _, b := range l.Blobs {
+			if strings.HasSuffix(b.Name, "/") || !strings.Contains(path.Base(b.Name), namePattern) {
+				continue
+			}
+			meta := map[string]string{}
+			for _, m := range b.Metadata.Items {
+				meta[m.XMLName.Local] = m.Value
+			}
+			if meta[ProcessedProperty] == "true" {
+				continue
+			}
+			if b.Properties.LeaseState == "leased" {
+				log.Printf("Skipping %s: leased, probably being processed by another server", b.Name)
+				continue
+			}
+			id := azureBlobIDPrefix + strings.TrimRight(s.ContainerURL, "/") + "/" + b.Name
+			f := &File{ID: id, Name: path.Base(b.Name), Size: b.Properties.Length, Properties: meta,
+				CreatedTime: azureTime(b.Properties.CreationTime), ModifiedTime: azureTime(b.Properties.LastModified),
+				Object: &azureBlob{src: s, name: b.Name, metadata: meta}}
+			if md5, err := base64.StdEncoding.DecodeString(b.Properties.ContentMD5); err == nil && len(md5) > 0 {
+				f.MD5 = hex.EncodeToString(md5)
+			}
+			files = append(files, f)
+		}
+		if l.NextMarker == "" {
+			break
+		}
+		marker = l.NextMarker
+	}
+	sort.Slice(files, func(i, k int) bool { return files[i].CreatedTime < files[k].CreatedTime })
+	return files, nil
+}
+
+// azureTime converts a blob timestamp to RFC 3339, as Drive reports times.
+func azureTime(v string) string {
+	t, err := time.Parse(http.TimeFormat, v)
+	if err != nil {
+		return ""
+	}
+	return t.Format(time.RFC3339)
+}
+
+func (b *azureBlob) SourceName() string { return "Azure Blob" }
+
+// Kab returns the name of the virtual folder holding the blob.
+func (b *azureBlob) Kab() (string, error) {
+	dir := path.Base(path.Dir(b.name))
+	if dir == "." || dir == "/" {
+		return "", nil
+	}
+	return dir, nil
+}
+
+// Download writes the blob to destPath, starting over with backoff when the
+// transfer breaks off.
+func (b *azureBlob) Download(destPath string) error {
+	var err error
+	for attempt := 1; attempt <= azureAttempts; attempt++ {
+		resp, rErr := b.src.do(http.MethodGet, b.name, "", nil, http.StatusOK)
+		if rErr != nil {
+			return rErr
+		}
+		err = writeBody(resp.Body, destPath)
+		resp.Body.Close()
+		if err == nil {
+			return nil
+		}
+		err = fmt.Errorf("azure blob download %s: %v", b.name, err)
+		if attempt < azureAttempts {
+			wait := time.Duration(attempt*attempt) * 2 * time.Second
+			log.Printf("%v, retrying in %s", err, wait)
+			time.Sleep(wait)
+		}
+	}
+	return err
+}
+
+// leaseHeaders returns the lease header when this process holds the lease.
+func (b *azureBlob) leaseHeaders(extra map[string]string) map[string]string {
+	h := map[string]string{}
+	for k, v := range extra {
+		h[k] = v
+	}
+	b.mu.Lock()
+	if b.lease != "" {
+		h["x-ms-lease-id"] = b.lease
+	}
+	b.mu.Unlock()
+	return h
+}
+
+// Lease leases the blob for azureLeaseSeconds and keeps renewing the
+// lease until the returned function releases it. While leased, other servers
+// skip the blob and nobody can delete or change it. A crashed process loses
+// its lease within a minute.
+func (b *azureBlob) Lease() (func(), error) {
+	resp, err := b.src.do(http.MethodPut, b.name, "comp=lease", map[string]string{
+		"x-ms-lease-action": "acquire", "x-ms-lease-duration": strconv.Itoa(azureLeaseSeconds)}, http.StatusCreated)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lease %s, it may be processed elsewhere: %v", b.name, err)
+	}
+	resp.Body.Close()
+	b.mu.Lock()
+	b.lease = resp.Header.Get("x-ms-lease-id")
+	b.stop = make(chan struct{})
+	stop := b.stop
+	b.mu.Unlock()
+	go func() {
+		t := time.NewTicker(azureLeaseRenewal)
+		defer t.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-t.C:
+				if r, err := b.src.do(http.MethodPut, b.name, "comp=lease", b.leaseHeaders(map[string]string{"x-ms-lease-action": "renew"}), http.StatusOK); err != nil {
+					log.Printf("Warning: failed to renew lease of %s: %v", b.name, err)
+				} else {
+					r.Body.Close()
+				}
+			}
+		}
+	}()
+	return func() {
+		close(stop)
+		b.mu.Lock()
+		lease := b.lease
+		b.lease = ""
+		b.mu.Unlock()
+		if lease == "" {
+			return
+		}
+		// A deleted blob has no lease left to release.
+		r, err := b.src.do(http.MethodPut, b.name, "comp=lease", map[string]string{"x-ms-lease-action": "release", "x-ms-lease-id": lease}, http.StatusOK, http.StatusNotFound)
+		if err != nil {
+			log.Printf("Warning: failed to release lease of %s: %v", b.name, err)
+			return
+		}
+		r.Body.Close()
+	}, nil
+}
+
+// Delete removes the blob and its snapshots.
+func (b *azureBlob) Delete() error {
+	resp, err := b.src.do(http.MethodDelete, b.name, "", b.leaseHeaders(map[string]string{"x-ms-delete-snapshots": "include"}), http.StatusAccepted)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	b.mu.Lock()
+	b.lease = ""
+	b.mu.Unlock()
+	return nil
+}
+
+// MarkProcessed adds processed=true to the blob's metadata, keeping the rest.
+func (b *azureBlob) MarkProcessed() error {
+	h := map[string]string{}
+	for k, v := range b.metadata {
+		h[azureMetadataPrefix+k] = v
+	}
+	h[azureMetadataPrefix+ProcessedProperty] = "true"
+	resp, err := b.src.do(http.MethodPut, b.name, "comp=metadata", b.leaseHeaders(h), http.StatusOK)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
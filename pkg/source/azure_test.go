@@ -0,0 +1,43 @@
+package source
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+func TestAzureDownloadRetriesBrokenBody(t *testing.T) {
+	content := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		if atomic.AddInt32(&requests, 1) == 1 {
+			// Send part of the body, then drop the connection.
+			w.Write(content[:10])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+		w.Write(content)
+	}))
+	defer srv.Close()
+
+	b := &azureBlob{src: &Azure{ContainerURL: srv.URL + "/uploads"}, name: "kab/backup.7z"}
+	dest := filepath.Join(t.TempDir(), "backup.7z")
+	if err := b.Download(dest); err != nil {
+		t.Fatalf("Download: %v", err)
+	}
+	got, err := os.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(content) {
+		t.Errorf("downloaded %q, want %q", got, content)
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("%d requests, want 2", n)
+	}
+}
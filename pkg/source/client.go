@@ -0,0 +1,108 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+
+	"backup-otomatis/internal/env"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/option"
+	"google.golang.org/api/sheets/v4"
+	htransport "google.golang.org/api/transport/http"
+)
+
+// maxQuotaUserLen is the longest quotaUser value the Google APIs accept.
+const maxQuotaUserLen = 40
+
+// currentQuotaUser is the quotaUser attached to Google API requests; it is
+// switched whenever processing moves on to another job.
+var currentQuotaUser atomic.Value
+
+// SetQuotaUser tags subsequent Google API requests with name.
+func SetQuotaUser(name string) {
+	if len(name) > maxQuotaUserLen {
+		name = name[:maxQuotaUserLen]
+	}
+	currentQuotaUser.Store(name)
+}
+
+// UserAgent is the user agent sent with Google API requests unless
+// GOOGLE_USER_AGENT overrides it; the pipeline adds its version.
+var UserAgent = "backup-otomatis"
+
+// googleUserAgent returns the user agent sent with Google API requests.
+func googleUserAgent() string {
+	return env.Or("GOOGLE_USER_AGENT", UserAgent)
+}
+
+// quotaUserTransport adds the current quotaUser parameter to every request.
+type quotaUserTransport struct {
+	base http.RoundTripper
+}
+
+func (t *quotaUserTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	qu, _ := currentQuotaUser.Load().(string)
+	if qu == "" {
+		return t.base.RoundTrip(req)
+	}
+	r := req.Clone(req.Context())
+	q := r.URL.Query()
+	q.Set("quotaUser", qu)
+	r.URL.RawQuery = q.Encode()
+	return t.base.RoundTrip(r)
+}
+
+// ClientOptions returns the client options for a Google API service.
+//
+// When subject is empty the service account authenticates as itself. Otherwise it uses
+// domain-wide delegation to impersonate the given workspace user, which is required to
+// reach folders that were shared with a human account instead of the service account.
+// scopes must be authorized for the delegation in the workspace admin console.
+//
+// Every request carries the GOOGLE_USER_AGENT user agent and the quotaUser of the
+// current job, so quota dashboards can attribute usage.
+func ClientOptions(ctx context.Context, serviceAccountFile, subject string, scopes ...string) ([]option.ClientOption, error) {
+	var opts []option.ClientOption
+	if subject == "" {
+		opts = []option.ClientOption{option.WithCredentialsFile(serviceAccountFile), option.WithScopes(scopes...)}
+	} else {
+		data, err := os.ReadFile(serviceAccountFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read service account file: %v", err)
+		}
+		cfg, err := google.JWTConfigFromJSON(data, scopes...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse service account file: %v", err)
+		}
+		cfg.Subject = subject
+		opts = []option.ClientOption{option.WithTokenSource(cfg.TokenSource(ctx))}
+	}
+	opts = append(opts, option.WithUserAgent(googleUserAgent()))
+	trans, err := htransport.NewTransport(ctx, &quotaUserTransport{base: http.DefaultTransport}, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Google API transport: %v", err)
+	}
+	return []option.ClientOption{option.WithHTTPClient(&http.Client{Transport: trans})}, nil
+}
+
+// NewServices creates the Drive and Sheets clients from the service account file,
+// impersonating subject when it is not empty.
+func NewServices(ctx context.Context, serviceAccountFile, subject string) (*drive.Service, *sheets.Service, error) {
+	opts, err := ClientOptions(ctx, serviceAccountFile, subject, drive.DriveScope, sheets.SpreadsheetsScope)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to load Google credentials: %v", err)
+	}
+	srv, err := drive.NewService(ctx, opts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to retrieve Drive client: %v", err)
+	}
+	sheetsSrv, err := sheets.NewService(ctx, opts...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to retrieve Sheets client: %v", err)
+	}
+	return srv, sheetsSrv, nil
+}
@@ -0,0 +1,288 @@
+package source
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"backup-otomatis/internal/env"
+	"google.golang.org/api/drive/v3"
+	"google.golang.org/api/googleapi"
+)
+
+// DeleteAttempts bounds the retries of a delete failing with a transient error.
+const DeleteAttempts = 3
+
+// ProcessedProperty is the appProperties key set on files that were processed
+// but could not be deleted.
+const ProcessedProperty = "processed"
+
+// ErrorCode returns the HTTP status of a Drive API error, or 0.
+func ErrorCode(err error) int {
+	var gErr *googleapi.Error
+	if errors.As(err, &gErr) {
+		return gErr.Code
+	}
+	return 0
+}
+
+// processedFilter returns the Drive query clauses that exclude files already
+// marked or moved as processed.
+func processedFilter() string {
+	q := fmt.Sprintf(" and not appProperties has { key='%s' and value='true' }", ProcessedProperty)
+	if folderID := os.Getenv("PROCESSED_FOLDER_ID"); folderID != "" {
+		q += fmt.Sprintf(" and not '%s' in parents", folderID)
+	}
+	return q
+}
+
+// filterTimeLayouts are the accepted formats of FILE_CREATED_AFTER and
+// FILE_CREATED_BEFORE. Times without a zone are in SPREADSHEET_TIMEZONE.
+var filterTimeLayouts = []string{time.RFC3339, "2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"}
+
+// parseFilterTime parses a created-time filter value.
+func parseFilterTime(name, v string) (time.Time, error) {
+	for _, layout := range filterTimeLayouts {
+		if t, err := time.ParseInLocation(layout, v, env.LoadLocation(os.Getenv("SPREADSHEET_TIMEZONE"))); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid %s %q: use e.g. 2025-03-01 14:00", name, v)
+}
+
+// CreatedWindow returns FILE_CREATED_AFTER (inclusive) and
+// FILE_CREATED_BEFORE (exclusive); an unset bound is the zero time.
+func CreatedWindow() (after, before time.Time, err error) {
+	if v := os.Getenv("FILE_CREATED_AFTER"); v != "" {
+		if after, err = parseFilterTime("FILE_CREATED_AFTER", v); err != nil {
+			return
+		}
+	}
+	if v := os.Getenv("FILE_CREATED_BEFORE"); v != "" {
+		before, err = parseFilterTime("FILE_CREATED_BEFORE", v)
+	}
+	return
+}
+
+// createdTimeFilter returns the Drive query clauses for the CreatedWindow.
+func createdTimeFilter() (string, error) {
+	after, before, err := CreatedWindow()
+	if err != nil {
+		return "", err
+	}
+	var q string
+	if !after.IsZero() {
+		q += fmt.Sprintf(" and createdTime >= '%s'", after.UTC().Format(time.RFC3339))
+	}
+	if !before.IsZero() {
+		q += fmt.Sprintf(" and createdTime < '%s'", before.UTC().Format(time.RFC3339))
+	}
+	return q, nil
+}
+
+// Drive listing metrics, published through the standard expvar registry.
+var (
+	metricListRequests  = expvar.NewInt("drive_list_requests")
+	metricListCacheHits = expvar.NewInt("drive_list_cache_hits")
+)
+
+// FileFields are the file fields requested whenever backup files are listed.
+const FileFields = "id, name, createdTime, modifiedTime, md5Checksum, size, parents, appProperties, properties"
+
+// Drive is a Drive folder of backups, read as the account of Srv. Without
+// FolderID the whole Drive visible to the account is searched.
+type Drive struct {
+	Srv      *drive.Service
+	FolderID string
+	// Names caches the names of the folders holding the files, which are
+	// their kabs; nil looks every name up.
+	Names FolderNames
+}
+
+// FolderNames caches Drive folder names by folder ID.
+type FolderNames interface {
+	CachedName(folderID string) (string, bool)
+	CacheName(folderID, name string)
+}
+
+// DriveObject is a backup file on Drive.
+type DriveObject struct {
+	d    *Drive
+	file *File
+}
+
+// List lists the backup files whose name contains namePattern.
+func (d *Drive) List(namePattern string) ([]*File, error) {
+	query := fmt.Sprintf("trashed = false and mimeType != 'application/vnd.google-apps.folder' and name contains '%s'", namePattern)
+	if d.FolderID != "" {
+		query += fmt.Sprintf(" and '%s' in parents", d.FolderID)
+	}
+	query += processedFilter()
+	created, err := createdTimeFilter()
+	if err != nil {
+		return nil, err
+	}
+	query += created
+	log.Printf("Executing Drive query: %s", query)
+	req := d.Srv.Files.List().Q(query).PageSize(1000).Fields("files(" + FileFields + ")").OrderBy("createdTime")
+	cached, haveCache := listCache.get(query)
+	if haveCache {
+		req = req.IfNoneMatch(cached.etag)
+	}
+	metricListRequests.Add(1)
+	fileList, err := req.Do()
+	if haveCache && googleapi.IsNotModified(err) {
+		metricListCacheHits.Add(1)
+		log.Printf("Drive listing unchanged, reusing %d cached files", len(cached.files))
+		return d.Files(cached.files), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Drive API error: %v", err)
+	}
+	log.Printf("Drive API returned %d files", len(fileList.Files))
+	listCache.put(query, fileList.Header.Get("ETag"), fileList.Files)
+	return d.Files(fileList.Files), nil
+}
+
+// Files returns the backups behind Drive files fetched with FileFields.
+func (d *Drive) Files(listed []*drive.File) []*File {
+	files := make([]*File, len(listed))
+	for i, f := range listed {
+		files[i] = d.File(f)
+	}
+	return files
+}
+
+// File returns the backup behind a Drive file fetched with FileFields. Its
+// Properties are the appProperties, falling back to the public properties.
+func (d *Drive) File(f *drive.File) *File {
+	props := make(map[string]string, len(f.Properties)+len(f.AppProperties))
+	for k, v := range f.Properties {
+		props[k] = v
+	}
+	for k, v := range f.AppProperties {
+		props[k] = v
+	}
+	file := &File{ID: f.Id, Name: f.Name, Size: f.Size, CreatedTime: f.CreatedTime, ModifiedTime: f.ModifiedTime,
+		MD5: f.Md5Checksum, Properties: props, Parents: f.Parents}
+	file.Object = &DriveObject{d: d, file: file}
+	return file
+}
+
+func (o *DriveObject) SourceName() string { return "Google Drive" }
+
+// Kab returns the name of the file's parent folder, or "" when it has none.
+func (o *DriveObject) Kab() (string, error) {
+	parents := o.file.Parents
+	if len(parents) == 0 {
+		// fallback: try to retrieve parents via drive API
+		fi, err := o.d.Srv.Files.Get(o.file.ID).Fields("parents").Do()
+		if err != nil {
+			return "", err
+		}
+		parents = fi.Parents
+	}
+	if len(parents) == 0 {
+		return "", nil
+	}
+	return o.d.FolderName(parents[0])
+}
+
+// FolderName returns the name of a Drive folder, from Names when it is cached.
+func (d *Drive) FolderName(folderID string) (string, error) {
+	if d.Names != nil {
+		if name, ok := d.Names.CachedName(folderID); ok {
+			return name, nil
+		}
+	}
+	f, err := d.Srv.Files.Get(folderID).Fields("id, name").Do()
+	if err != nil {
+		return "", err
+	}
+	if d.Names != nil {
+		d.Names.CacheName(folderID, f.Name)
+	}
+	return f.Name, nil
+}
+
+// Download writes the file to destPath.
+func (o *DriveObject) Download(destPath string) error {
+	resp, err := o.d.Srv.Files.Get(o.file.ID).Download()
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	out, err := os.Create(destPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, resp.Body)
+	return err
+}
+
+// Delete deletes the file, retrying rate limiting and server errors with
+// backoff. Other errors, such as a refusal because the file belongs to
+// someone else (403/404), are returned at once.
+func (o *DriveObject) Delete() error {
+	var err error
+	for attempt := 1; attempt <= DeleteAttempts; attempt++ {
+		err = o.d.Srv.Files.Delete(o.file.ID).Do()
+		if err == nil {
+			return nil
+		}
+		code := ErrorCode(err)
+		if code != 429 && code < 500 {
+			return err
+		}
+		if attempt < DeleteAttempts {
+			wait := time.Duration(attempt*attempt) * 2 * time.Second
+			log.Printf("Deleting %s failed (%v), retrying in %s", o.file.Name, err, wait)
+			time.Sleep(wait)
+		}
+	}
+	return err
+}
+
+// MarkProcessed sets processed=true in the file's appProperties.
+func (o *DriveObject) MarkProcessed() error {
+	f := &drive.File{AppProperties: map[string]string{ProcessedProperty: "true"}}
+	_, err := o.d.Srv.Files.Update(o.file.ID, f).Fields("id").Do()
+	return err
+}
+
+// Move moves the file to a different folder by updating its parents.
+// It will set the parent to the given folder and remove existing parents.
+func (o *DriveObject) Move(folderID string) error {
+	// Get current parents
+	f, err := o.d.Srv.Files.Get(o.file.ID).Fields("parents").Do()
+	if err != nil {
+		return fmt.Errorf("failed to get file parents: %v", err)
+	}
+	var remove string
+	if len(f.Parents) > 0 {
+		remove = strings.Join(f.Parents, ",")
+	}
+	_, err = o.d.Srv.Files.Update(o.file.ID, &drive.File{}).AddParents(folderID).RemoveParents(remove).Fields("id, parents").Do()
+	if err != nil {
+		return fmt.Errorf("failed to move file to quarantine: %v", err)
+	}
+	return nil
+}
+
+// Rename renames the file by updating its name field.
+func (o *DriveObject) Rename(newName string) error {
+	f := &drive.File{Name: newName}
+	_, err := o.d.Srv.Files.Update(o.file.ID, f).Fields("id, name").Do()
+	if err != nil {
+		return fmt.Errorf("failed to rename file: %v", err)
+	}
+	return nil
+}
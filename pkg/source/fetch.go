@@ -0,0 +1,58 @@
+package source
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"google.golang.org/api/storage/v1"
+)
+
+// DownloadGCS downloads a Cloud Storage object as the service account.
+func DownloadGCS(serviceAccountFile, bucket, name, destPath string) error {
+	ctx := context.Background()
+	opts, err := ClientOptions(ctx, serviceAccountFile, "", storage.DevstorageReadOnlyScope)
+	if err != nil {
+		return err
+	}
+	srv, err := storage.NewService(ctx, opts...)
+	if err != nil {
+		return fmt.Errorf("unable to create Cloud Storage client: %v", err)
+	}
+	resp, err := srv.Objects.Get(bucket, name).Download()
+	if err != nil {
+		return fmt.Errorf("failed to download gs://%s/%s: %v", bucket, name, err)
+	}
+	defer resp.Body.Close()
+	return writeBody(resp.Body, destPath)
+}
+
+// DownloadURL downloads an http(s) URL.
+func DownloadURL(loc, destPath string) error {
+	client := &http.Client{Timeout: 2 * time.Hour}
+	resp, err := client.Get(loc)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned status %s", loc, resp.Status)
+	}
+	return writeBody(resp.Body, destPath)
+}
+
+// writeBody writes r to destPath.
+func writeBody(r io.Reader, destPath string) error {
+	out, err := os.Create(destPath)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
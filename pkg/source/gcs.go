@@ -0,0 +1,160 @@
+package source
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/api/storage/v1"
+)
+
+// gcsObjectIDPrefix starts the file IDs of Cloud Storage objects.
+const gcsObjectIDPrefix = "gcs:"
+
+// GCS is a job's Cloud Storage bucket, for provinces that push their
+// backups with gsutil. It is read as the service account of
+// GOOGLE_SERVICE_ACCOUNT_FILE, which needs the Storage Object Admin role on
+// the bucket.
+type GCS struct {
+	Bucket string `json:"bucket"`
+	// Prefix limits the listing, e.g. "susenas/". The folder holding an object
+	// is its kab, like the Drive folder of an upload.
+	Prefix string `json:"prefix"`
+}
+
+// gcsObject is a listed object. Every operation targets the listed
+// generation, so an object overwritten while it is processed is neither read nor deleted in its
+// new version, which is processed on its own by the next run.
+type gcsObject struct {
+	srv        *storage.Service
+	bucket     string
+	name       string
+	generation int64
+	metagen    int64
+}
+
+// gcsLister lists a bucket as the service account of serviceAccountFile.
+type gcsLister struct {
+	*GCS
+	serviceAccountFile string
+}
+
+// Lister returns the Lister of the bucket, read as the service account of
+// serviceAccountFile.
+func (s *GCS) Lister(serviceAccountFile string) Lister {
+	return gcsLister{GCS: s, serviceAccountFile: serviceAccountFile}
+}
+
+// List lists the job's backups in its bucket: objects under the prefix
+// whose name contains namePattern, oldest first. Objects marked processed
+// are left out. The file ID includes the generation, so a re-upload under
+// the same name is a new file.
+func (s gcsLister) List(namePattern string) ([]*File, error) {
+	ctx := context.Background()
+	opts, err := ClientOptions(ctx, s.serviceAccountFile, "", storage.DevstorageReadWriteScope)
+	if err != nil {
+		return nil, err
+	}
+	srv, err := storage.NewService(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create Cloud Storage client: %v", err)
+	}
+	var files []*File
+	err = srv.Objects.List(s.Bucket).Prefix(s.Prefix).Pages(ctx, func(l *storage.Objects) error {
+		for _, o := range l.Items {
+			if strings.HasSuffix(o.Name, "/") || !strings.Contains(path.Base(o.Name), namePattern) {
+				continue
+			}
+			if o.Metadata[ProcessedProperty] == "true" {
+				continue
+			}
+			id := gcsObjectIDPrefix + s.Bucket + "/" + o.Name + "#" + strconv.FormatInt(o.Generation, 10)
+			f := &File{ID: id, Name: path.Base(o.Name), Size: int64(o.Size), Properties: o.Metadata,
+				CreatedTime: o.TimeCreated, ModifiedTime: o.Updated,
+				Object: &gcsObject{srv: srv, bucket: s.Bucket, name: o.Name, generation: o.Generation, metagen: o.Metageneration}}
+			if md5, err := base64.StdEncoding.DecodeString(o.Md5Hash); err == nil && len(md5) > 0 {
+				f.MD5 = hex.EncodeToString(md5)
+			}
+			files = append(files, f)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list gs://%s/%s: %v", s.Bucket, s.Prefix, err)
+	}
+	sort.Slice(files, func(i, k int) bool { return files[i].CreatedTime < files[k].CreatedTime })
+	return files, nil
+}
+
+func (o *gcsObject) SourceName() string { return "Cloud Storage" }
+
+// Kab returns the name of the folder holding the object.
+func (o *gcsObject) Kab() (string, error) {
+	dir := path.Base(path.Dir(o.name))
+	if dir == "." || dir == "/" {
+		return "", nil
+	}
+	return dir, nil
+}
+
+// Download writes the listed generation of the object to destPath.
+func (o *gcsObject) Download(destPath string) error {
+	var err error
+	for attempt := 1; attempt <= DeleteAttempts; attempt++ {
+		err = o.downloadOnce(destPath)
+		if err == nil {
+			return nil
+		}
+		if code := ErrorCode(err); code != 0 && code != 429 && code < 500 {
+			return err
+		}
+		if attempt < DeleteAttempts {
+			wait := time.Duration(attempt*attempt) * 2 * time.Second
+			log.Printf("%v, retrying in %s", err, wait)
+			time.Sleep(wait)
+		}
+	}
+	return err
+}
+
+func (o *gcsObject) downloadOnce(destPath string) error {
+	resp, err := o.srv.Objects.Get(o.bucket, o.name).Generation(o.generation).Download()
+	if err != nil {
+		return fmt.Errorf("failed to download gs://%s/%s#%d: %w", o.bucket, o.name, o.generation, err)
+	}
+	defer resp.Body.Close()
+	return writeBody(resp.Body, destPath)
+}
+
+// Delete removes the listed generation only if it is still the live one. When
+// the object was overwritten meanwhile the newer upload is kept for the next
+// run and the processed generation is left to the bucket's lifecycle rules.
+func (o *gcsObject) Delete() error {
+	err := o.srv.Objects.Delete(o.bucket, o.name).IfGenerationMatch(o.generation).Do()
+	if code := ErrorCode(err); code == 412 || code == 404 {
+		log.Printf("gs://%s/%s changed since it was listed, keeping the newer upload", o.bucket, o.name)
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to delete gs://%s/%s: %v", o.bucket, o.name, err)
+	}
+	return nil
+}
+
+// MarkProcessed adds processed=true to the metadata of the listed generation,
+// failing if someone else changed the metadata meanwhile.
+func (o *gcsObject) MarkProcessed() error {
+	obj := &storage.Object{Metadata: map[string]string{ProcessedProperty: "true"}}
+	_, err := o.srv.Objects.Patch(o.bucket, o.name, obj).Generation(o.generation).IfMetagenerationMatch(o.metagen).Do()
+	if err != nil {
+		return fmt.Errorf("failed to mark gs://%s/%s as processed: %v", o.bucket, o.name, err)
+	}
+	return nil
+}
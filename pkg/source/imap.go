@@ -0,0 +1,391 @@
+package source
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// imapAttachmentIDPrefix starts the file IDs of mail attachments.
+const imapAttachmentIDPrefix = "imap:"
+
+// imapTimeout bounds every IMAP command, including fetching a message.
+const imapTimeout = 5 * time.Minute
+
+// IMAP is a job's mailbox folder, for regencies that email their backups.
+type IMAP struct {
+	// Addr is the IMAP server with implicit TLS, e.g. "imap.gmail.com:993".
+	Addr string `json:"addr"`
+	User string `json:"user"`
+	// PasswordEnv names an environment variable holding the password, e.g. an
+	// app password.
+	PasswordEnv string `json:"passwordEnv"`
+	// Folder is scanned; empty is INBOX.
+	Folder string `json:"folder"`
+	// SubjectPattern is a regular expression the subject must match; a group
+	// named kab, e.g. "Backup (?P<kab>\\w+)", gives the kab.
+	SubjectPattern string `json:"subjectPattern"`
+	// ProcessedFolder receives messages whose attachments were all processed;
+	// empty is "Processed".
+	ProcessedFolder string `json:"processedFolder"`
+}
+
+// imapMessage is a matching message whose attachments are being processed.
+type imapMessage struct {
+	src     *IMAP
+	uid     string
+	subject string
+
+	mu      sync.Mutex
+	pending int
+}
+
+// imapAttachment is a listed attachment. Its content is kept in memory,
+// which mail size limits keep small.
+type imapAttachment struct {
+	msg     *imapMessage
+	kabName string
+	data    []byte
+}
+
+// Mailbox returns the folder scanned for backups.
+func (s *IMAP) Mailbox() string {
+	if s.Folder == "" {
+		return "INBOX"
+	}
+	return s.Folder
+}
+
+func (s *IMAP) processedFolder() string {
+	if s.ProcessedFolder == "" {
+		return "Processed"
+	}
+	return s.ProcessedFolder
+}
+
+// List returns the attachments of the messages in the job's folder whose
+// subject matches and whose file name contains namePattern, oldest message
+// first.
+func (s *IMAP) List(namePattern string) ([]*File, error) {
+	subjectRE, err := regexp.Compile(s.SubjectPattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid subjectPattern: %v", err)
+	}
+	c, err := dialIMAP(s)
+	if err != nil {
+		return nil, err
+	}
+	defer c.logout()
+	resps, err := c.cmd("SELECT " + imapQuote(s.Mailbox()))
+	if err != nil {
+		return nil, err
+	}
+	validity := ""
+	for _, r := range resps {
+		if m := imapUIDValidityRE.FindStringSubmatch(r.text); m != nil {
+			validity = m[1]
+		}
+	}
+	resps, err = c.cmd("UID SEARCH UNDELETED")
+	if err != nil {
+		return nil, err
+	}
+	var uids []string
+	for _, r := range resps {
+		if strings.HasPrefix(r.text, "* SEARCH") {
+			uids = append(uids, strings.Fields(strings.TrimPrefix(r.text, "* SEARCH"))...)
+		}
+	}
+	if len(uids) == 0 {
+		return nil, nil
+	}
+	resps, err = c.cmd("UID FETCH " + strings.Join(uids, ",") + " (UID BODY.PEEK[HEADER.FIELDS (SUBJECT)])")
+	if err != nil {
+		return nil, err
+	}
+	subjects := map[string]string{}
+	for _, r := range resps {
+		m := imapUIDRE.FindStringSubmatch(r.text)
+		if m == nil || len(r.literals) == 0 {
+			continue
+		}
+		h, err := mail.ReadMessage(bytes.NewReader(append(r.literals[0], '\r', '\n')))
+		if err != nil {
+			continue
+		}
+		subjects[m[1]] = decodeMailHeader(h.Header.Get("Subject"))
+	}
+
+	var files []*File
+	for _, uid := range uids {
+		subject, ok := subjects[uid]
+		if !ok || !subjectRE.MatchString(subject) {
+			continue
+		}
+		kab := ""
+		if i := subjectRE.SubexpIndex("kab"); i > 0 {
+			kab = strings.TrimSpace(subjectRE.FindStringSubmatch(subject)[i])
+		}
+		resps, err := c.cmd("UID FETCH " + uid + " (UID BODY.PEEK[])")
+		if err != nil {
+			return nil, err
+		}
+		if len(resps) == 0 || len(resps[0].literals) == 0 {
+			continue
+		}
+		msg, err := mail.ReadMessage(bytes.NewReader(resps[0].literals[0]))
+		if err != nil {
+			log.Printf("Warning: skipping message %q: %v", subject, err)
+			continue
+		}
+		created := ""
+		if t, err := msg.Header.Date(); err == nil {
+			created = t.UTC().Format(time.RFC3339)
+		}
+		parts, err := mailAttachments(msg.Header.Get("Content-Type"), msg.Body)
+		if err != nil {
+			log.Printf("Warning: skipping message %q: %v", subject, err)
+			continue
+		}
+		m := &imapMessage{src: s, uid: uid, subject: subject}
+		for i, p := range parts {
+			if !strings.Contains(p.name, namePattern) {
+				continue
+			}
+			id := fmt.Sprintf("%s%s@%s/%s/%s.%s/%d", imapAttachmentIDPrefix, s.User, s.Addr, s.Mailbox(), validity, uid, i)
+			files = append(files, &File{ID: id, Name: p.name, Size: int64(len(p.data)), CreatedTime: created,
+				Object: &imapAttachment{msg: m, kabName: kab, data: p.data}})
+			m.pending++
+		}
+	}
+	sort.SliceStable(files, func(i, k int) bool { return files[i].CreatedTime < files[k].CreatedTime })
+	return files, nil
+}
+
+// mailPart is a decoded attachment.
+type mailPart struct {
+	name string
+	data []byte
+}
+
+// mailAttachments returns the parts of a message body that have a file name,
+// descending into nested multiparts.
+func mailAttachments(contentType string, body io.Reader) ([]mailPart, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return nil, nil
+	}
+	var parts []mailPart
+	mr := multipart.NewReader(body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err == io.EOF {
+			return parts, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		ct := p.Header.Get("Content-Type")
+		if strings.HasPrefix(strings.ToLower(ct), "multipart/") {
+			nested, err := mailAttachments(ct, p)
+			if err != nil {
+				return nil, err
+			}
+			parts = append(parts, nested...)
+			continue
+		}
+		name := decodeMailHeader(p.FileName())
+		if name == "" {
+			continue
+		}
+		var r io.Reader = p
+		if strings.EqualFold(strings.TrimSpace(p.Header.Get("Content-Transfer-Encoding")), "base64") {
+			r = base64.NewDecoder(base64.StdEncoding, p)
+		}
+		data, err := io.ReadAll(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode attachment %s: %v", name, err)
+		}
+		parts = append(parts, mailPart{name: name, data: data})
+	}
+}
+
+// decodeMailHeader decodes RFC 2047 encoded words, returning v when it is not
+// encoded or cannot be decoded.
+func decodeMailHeader(v string) string {
+	d, err := new(mime.WordDecoder).DecodeHeader(v)
+	if err != nil {
+		return v
+	}
+	return d
+}
+
+func (a *imapAttachment) SourceName() string { return "IMAP" }
+
+func (a *imapAttachment) Kab() (string, error) { return a.kabName, nil }
+
+// Download writes the attachment to destPath.
+func (a *imapAttachment) Download(destPath string) error {
+	return os.WriteFile(destPath, a.data, 0o644)
+}
+
+// Delete and markProcessed both record that the attachment was processed
+// and, once all attachments of its message are, move the message to the
+// processed folder. A message with a failed attachment stays and all its
+// attachments are listed again by the next run.
+func (a *imapAttachment) Delete() error { return a.done() }
+
+func (a *imapAttachment) MarkProcessed() error { return a.done() }
+
+func (a *imapAttachment) done() error {
+	m := a.msg
+	m.mu.Lock()
+	m.pending--
+	last := m.pending == 0
+	m.mu.Unlock()
+	if !last {
+		return nil
+	}
+	log.Printf("Moving message %q to %s", m.subject, m.src.processedFolder())
+	return m.move()
+}
+
+// move moves the message with UID MOVE or, on servers without it, copies it
+// and expunges the original.
+func (m *imapMessage) move() error {
+	c, err := dialIMAP(m.src)
+	if err != nil {
+		return err
+	}
+	defer c.logout()
+	if _, err := c.cmd("SELECT " + imapQuote(m.src.Mailbox())); err != nil {
+		return err
+	}
+	dest := imapQuote(m.src.processedFolder())
+	// Fails harmlessly when the folder exists.
+	c.cmd("CREATE " + dest)
+	if _, err := c.cmd("UID MOVE " + m.uid + " " + dest); err == nil {
+		return nil
+	}
+	if _, err := c.cmd("UID COPY " + m.uid + " " + dest); err != nil {
+		return fmt.Errorf("failed to move message %q: %v", m.subject, err)
+	}
+	if _, err := c.cmd("UID STORE " + m.uid + ` +FLAGS.SILENT (\Deleted)`); err != nil {
+		return fmt.Errorf("failed to remove message %q: %v", m.subject, err)
+	}
+	_, err = c.cmd("EXPUNGE")
+	return err
+}
+
+var (
+	imapLiteralRE     = regexp.MustCompile(`\{(\d+)\}$`)
+	imapUIDRE         = regexp.MustCompile(`\bUID (\d+)`)
+	imapUIDValidityRE = regexp.MustCompile(`\[UIDVALIDITY (\d+)\]`)
+)
+
+// imapConn is a minimal IMAP4rev1 client: enough to search, fetch and move.
+type imapConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	tag  int
+}
+
+// imapResponse is a response line with the literals embedded in it.
+type imapResponse struct {
+	text     string
+	literals [][]byte
+}
+
+// dialIMAP connects over TLS and logs in.
+func dialIMAP(s *IMAP) (*imapConn, error) {
+	host, _, _ := net.SplitHostPort(s.Addr)
+	conn, err := tls.DialWithDialer(&net.Dialer{Timeout: 30 * time.Second}, "tcp", s.Addr, &tls.Config{ServerName: host})
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", s.Addr, err)
+	}
+	c := &imapConn{conn: conn, r: bufio.NewReader(conn)}
+	conn.SetDeadline(time.Now().Add(imapTimeout))
+	if _, err := c.readResponse(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("no greeting from %s: %v", s.Addr, err)
+	}
+	if _, err := c.cmd("LOGIN " + imapQuote(s.User) + " " + imapQuote(os.Getenv(s.PasswordEnv))); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// cmd sends a command and returns its untagged responses. Errors name only
+// the command, so the LOGIN password never reaches the logs.
+func (c *imapConn) cmd(command string) ([]imapResponse, error) {
+	c.tag++
+	tag := fmt.Sprintf("a%03d", c.tag)
+	c.conn.SetDeadline(time.Now().Add(imapTimeout))
+	if _, err := fmt.Fprintf(c.conn, "%s %s\r\n", tag, command); err != nil {
+		return nil, err
+	}
+	name := strings.Fields(command)[0]
+	var out []imapResponse
+	for {
+		r, err := c.readResponse()
+		if err != nil {
+			return nil, fmt.Errorf("IMAP %s: %v", name, err)
+		}
+		if status, ok := strings.CutPrefix(r.text, tag+" "); ok {
+			if !strings.HasPrefix(status, "OK") {
+				return out, fmt.Errorf("IMAP %s: %s", name, status)
+			}
+			return out, nil
+		}
+		out = append(out, r)
+	}
+}
+
+// readResponse reads one response, following literals to its end.
+func (c *imapConn) readResponse() (imapResponse, error) {
+	var r imapResponse
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return r, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		r.text += line
+		m := imapLiteralRE.FindStringSubmatch(line)
+		if m == nil {
+			return r, nil
+		}
+		n, _ := strconv.Atoi(m[1])
+		buf := make([]byte, n)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return r, err
+		}
+		r.literals = append(r.literals, buf)
+	}
+}
+
+func (c *imapConn) logout() {
+	c.cmd("LOGOUT")
+	c.conn.Close()
+}
+
+// imapQuote quotes s as an IMAP string.
+func imapQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
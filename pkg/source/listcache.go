@@ -0,0 +1,38 @@
+package source
+
+import (
+	"sync"
+
+	"google.golang.org/api/drive/v3"
+)
+
+// listCacheEntry is the last Drive listing returned for one query.
+type listCacheEntry struct {
+	etag  string
+	files []*drive.File
+}
+
+// driveListCache remembers listings by query so repeated polls can be sent with
+// If-None-Match and answered by a cheap 304 Not Modified when nothing changed.
+type driveListCache struct {
+	mu      sync.Mutex
+	entries map[string]listCacheEntry
+}
+
+var listCache = &driveListCache{entries: map[string]listCacheEntry{}}
+
+func (c *driveListCache) get(query string) (listCacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[query]
+	return e, ok
+}
+
+func (c *driveListCache) put(query, etag string, files []*drive.File) {
+	if etag == "" {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[query] = listCacheEntry{etag: etag, files: files}
+}
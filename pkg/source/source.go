@@ -0,0 +1,91 @@
+// Package source lists and fetches the uploaded backups: from Google Drive,
+// and from the Azure Blob, Cloud Storage, URL list and IMAP sources a job may
+// name instead. Every source lists its backups as *File values carrying the
+// Object that reads and retires them, so callers treat every backup alike.
+package source
+
+import "fmt"
+
+// File is a listed backup. The fields are those the pipeline needs of any
+// source; Object performs the operations on the backup in its source.
+type File struct {
+	// ID is unique across sources: the Drive file ID, or a source-specific
+	// prefix and the name of the backup in its source.
+	ID   string
+	Name string
+	Size int64
+	// CreatedTime and ModifiedTime are RFC 3339, empty when unknown.
+	CreatedTime  string
+	ModifiedTime string
+	// MD5 is the hex MD5 checksum, empty when the source reports none.
+	MD5        string
+	Properties map[string]string
+	// Parents are the Drive folders holding the file, none for other sources.
+	Parents []string
+	Object
+}
+
+// Lister lists the backups of a source whose name contains namePattern,
+// oldest first.
+type Lister interface {
+	List(namePattern string) ([]*File, error)
+}
+
+// Downloader writes a backup to a local path.
+type Downloader interface {
+	Download(destPath string) error
+}
+
+// Object is a backup in its source.
+type Object interface {
+	Downloader
+	SourceName() string
+	// Kab returns the kab the backup belongs to: the name of the folder
+	// holding it or what the source says instead.
+	Kab() (string, error)
+	// Delete and MarkProcessed retire the backup after processing.
+	Delete() error
+	MarkProcessed() error
+}
+
+// Mover is implemented by the objects of sources whose backups can be moved
+// to another folder and renamed, which is Drive only.
+type Mover interface {
+	Move(folderID string) error
+	Rename(newName string) error
+}
+
+// Leaser is implemented by the objects of sources that let a server claim a
+// backup while it processes it, which is Azure Blob only.
+type Leaser interface {
+	// Lease claims the backup and returns the function releasing it.
+	Lease() (func(), error)
+}
+
+// Move moves f to the folder folderID, if its source has folders.
+func Move(f *File, folderID string) error {
+	m, ok := f.Object.(Mover)
+	if !ok {
+		return fmt.Errorf("moving files is not supported for %s sources", f.SourceName())
+	}
+	return m.Move(folderID)
+}
+
+// Rename renames f in its source, if the source allows it.
+func Rename(f *File, newName string) error {
+	m, ok := f.Object.(Mover)
+	if !ok {
+		return fmt.Errorf("renaming files is not supported for %s sources", f.SourceName())
+	}
+	return m.Rename(newName)
+}
+
+// Lease claims f for its processing when its source supports it and returns
+// the function releasing the claim; other files need nothing.
+func Lease(f *File) (func(), error) {
+	l, ok := f.Object.(Leaser)
+	if !ok {
+		return func() {}, nil
+	}
+	return l.Lease()
+}
@@ -0,0 +1,159 @@
+package source
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// urlEntryIDPrefix starts the file IDs of URL list entries.
+const urlEntryIDPrefix = "url:"
+
+// URLList is a job's manifest of download links, e.g. the pre-signed
+// links of the upload portal. Processed entries are acknowledged to AckURL.
+type URLList struct {
+	// ManifestURL returns a JSON array of urlEntry, or CSV with a header row
+	// naming the same fields, when its content type or path says csv.
+	ManifestURL string `json:"manifestUrl"`
+	// AckURL receives a POST of {"id": ..., "status": "processed"} for every
+	// entry processed successfully; empty does not acknowledge.
+	AckURL string `json:"ackUrl"`
+	// TokenEnv names an environment variable holding a bearer token sent to
+	// both endpoints, not to the download links.
+	TokenEnv string `json:"tokenEnv"`
+}
+
+// urlEntry is one backup in the manifest.
+type urlEntry struct {
+	ID          string            `json:"id"`
+	Name        string            `json:"name"`
+	URL         string            `json:"url"`
+	Kab         string            `json:"kab"`
+	Size        int64             `json:"size"`
+	MD5         string            `json:"md5"`
+	CreatedTime string            `json:"createdTime"`
+	Properties  map[string]string `json:"properties"`
+}
+
+// urlListEntry is a listed entry.
+type urlListEntry struct {
+	src   *URLList
+	entry urlEntry
+}
+
+// request sends a request with the source's bearer token.
+func (s *URLList) request(method, url string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if s.TokenEnv != "" {
+		req.Header.Set("Authorization", "Bearer "+os.Getenv(s.TokenEnv))
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	client := &http.Client{Timeout: time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%s returned status %s", url, resp.Status)
+	}
+	return resp, nil
+}
+
+// List fetches the job's manifest and returns its entries whose name
+// contains namePattern, oldest first.
+func (s *URLList) List(namePattern string) ([]*File, error) {
+	resp, err := s.request(http.MethodGet, s.ManifestURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch manifest: %v", err)
+	}
+	defer resp.Body.Close()
+	var entries []urlEntry
+	if strings.Contains(resp.Header.Get("Content-Type"), "csv") || strings.HasSuffix(strings.SplitN(s.ManifestURL, "?", 2)[0], ".csv") {
+		entries, err = parseURLManifestCSV(resp.Body)
+	} else {
+		err = json.NewDecoder(resp.Body).Decode(&entries)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse manifest %s: %v", s.ManifestURL, err)
+	}
+	var files []*File
+	for _, e := range entries {
+		if e.ID == "" || e.URL == "" || !strings.Contains(e.Name, namePattern) {
+			continue
+		}
+		files = append(files, &File{ID: urlEntryIDPrefix + e.ID, Name: e.Name, Size: e.Size, MD5: strings.ToLower(e.MD5),
+			CreatedTime: e.CreatedTime, Properties: e.Properties, Object: &urlListEntry{src: s, entry: e}})
+	}
+	sort.SliceStable(files, func(i, k int) bool { return files[i].CreatedTime < files[k].CreatedTime })
+	return files, nil
+}
+
+// parseURLManifestCSV reads a CSV manifest whose header names the urlEntry
+// fields; properties cannot be given in CSV.
+func parseURLManifestCSV(r io.Reader) ([]urlEntry, error) {
+	rows, err := csv.NewReader(r).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	col := map[string]int{}
+	for i, h := range rows[0] {
+		col[strings.ToLower(strings.TrimSpace(h))] = i
+	}
+	get := func(row []string, name string) string {
+		if i, ok := col[strings.ToLower(name)]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+	var entries []urlEntry
+	for _, row := range rows[1:] {
+		size, _ := strconv.ParseInt(get(row, "size"), 10, 64)
+		entries = append(entries, urlEntry{ID: get(row, "id"), Name: get(row, "name"), URL: get(row, "url"), Kab: get(row, "kab"),
+			Size: size, MD5: get(row, "md5"), CreatedTime: get(row, "createdTime")})
+	}
+	return entries, nil
+}
+
+func (e *urlListEntry) SourceName() string { return "URL list" }
+
+func (e *urlListEntry) Kab() (string, error) { return e.entry.Kab, nil }
+
+func (e *urlListEntry) Download(destPath string) error { return DownloadURL(e.entry.URL, destPath) }
+
+// Delete and markProcessed both acknowledge the entry; the portal decides
+// what happens to the upload.
+func (e *urlListEntry) Delete() error { return e.acknowledge() }
+
+func (e *urlListEntry) MarkProcessed() error { return e.acknowledge() }
+
+// acknowledge tells the portal the entry was processed, so it leaves the
+// manifest.
+func (e *urlListEntry) acknowledge() error {
+	if e.src.AckURL == "" {
+		return nil
+	}
+	body, _ := json.Marshal(map[string]string{"id": e.entry.ID, "status": "processed"})
+	resp, err := e.src.request(http.MethodPost, e.src.AckURL, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("failed to acknowledge %s: %v", e.entry.Name, err)
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,114 @@
+package track
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"google.golang.org/api/sheets/v4"
+)
+
+// Write is a tracking sheet update that failed and waits in a Buffer to be
+// replayed.
+type Write struct {
+	SpreadsheetID string                 `json:"spreadsheetId"`
+	Kab           string                 `json:"kab"`
+	CreatedTime   string                 `json:"createdTime"`
+	Extras        map[string]interface{} `json:"extras,omitempty"`
+	FailedAt      time.Time              `json:"failedAt"`
+	Attempts      int                    `json:"attempts"`
+}
+
+// SameRow reports whether w targets the same sheet row as the given kab.
+func (w Write) SameRow(spreadsheetID, kab string) bool {
+	return w.SpreadsheetID == spreadsheetID && strings.TrimSpace(w.Kab) == strings.TrimSpace(kab)
+}
+
+// Buffer keeps the tracking updates waiting to be written, across runs; the
+// pipeline's state file is one.
+type Buffer interface {
+	BufferSheetWrite(w Write) error
+	DropSheetWrites(spreadsheetID, kab string) error
+	PendingSheetWrites() []Write
+}
+
+// WriteRow upserts the tracking row and buffers the update in buf when the
+// Sheets API fails, so the sheet catches up on a later replay instead of
+// losing the update.
+//
+// With SHEET_WRITE_BATCH above 1 every update is buffered first and the buffer
+// is written in one go once it holds that many updates, at the end of the run
+// and in every listen iteration.
+func WriteRow(srv *sheets.Service, buf Buffer, spreadsheetID, kab, createdTime string, extras map[string]interface{}) error {
+	if batch := writeBatch(); batch > 1 {
+		w := Write{SpreadsheetID: spreadsheetID, Kab: kab, CreatedTime: createdTime, Extras: extras}
+		if err := buf.BufferSheetWrite(w); err != nil {
+			// Without the buffer the update would be lost; write it now.
+			log.Printf("Warning: failed to buffer spreadsheet update for %s: %v", kab, err)
+		} else {
+			if len(buf.PendingSheetWrites()) >= batch {
+				Replay(srv, buf)
+			}
+			return nil
+		}
+	}
+	err := UpsertRow(srv, spreadsheetID, kab, createdTime, extras)
+	if err != nil {
+		w := Write{SpreadsheetID: spreadsheetID, Kab: kab, CreatedTime: createdTime, Extras: extras, FailedAt: time.Now(), Attempts: 1}
+		if bErr := buf.BufferSheetWrite(w); bErr != nil {
+			log.Printf("Warning: failed to buffer spreadsheet update for %s: %v", kab, bErr)
+		} else {
+			log.Printf("Buffered spreadsheet update for %s for a later retry", kab)
+		}
+		return err
+	}
+	if dErr := buf.DropSheetWrites(spreadsheetID, kab); dErr != nil {
+		log.Printf("Warning: failed to save state: %v", dErr)
+	}
+	// The API answers again, so earlier failures can be caught up now.
+	Replay(srv, buf)
+	return nil
+}
+
+// Replay writes the updates buffered in buf, one batch per spreadsheet in the
+// order the spreadsheets were first buffered, and stops at the first failure
+// since the API is most likely still unavailable.
+func Replay(srv *sheets.Service, buf Buffer) {
+	pending := buf.PendingSheetWrites()
+	if len(pending) == 0 {
+		return
+	}
+	log.Printf("Writing %d buffered spreadsheet update(s)", len(pending))
+	var order []string
+	groups := map[string][]Write{}
+	for _, w := range pending {
+		if _, ok := groups[w.SpreadsheetID]; !ok {
+			order = append(order, w.SpreadsheetID)
+		}
+		groups[w.SpreadsheetID] = append(groups[w.SpreadsheetID], w)
+	}
+	for _, id := range order {
+		writes := groups[id]
+		if err := writeRows(srv, id, writes); err != nil {
+			log.Printf("Warning: writing %d buffered spreadsheet update(s) failed: %v", len(writes), err)
+			for _, w := range writes {
+				if w.FailedAt.IsZero() {
+					w.FailedAt = time.Now()
+				}
+				w.Attempts++
+				if bErr := buf.BufferSheetWrite(w); bErr != nil {
+					log.Printf("Warning: failed to save state: %v", bErr)
+				}
+			}
+			return
+		}
+		for _, w := range writes {
+			if !w.FailedAt.IsZero() {
+				log.Printf("Replayed spreadsheet update for %s (failed at %s)", w.Kab, w.FailedAt.Format(time.RFC3339))
+			}
+			if err := buf.DropSheetWrites(w.SpreadsheetID, w.Kab); err != nil {
+				log.Printf("Warning: failed to save state: %v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package track
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"backup-otomatis/internal/env"
+	"google.golang.org/api/sheets/v4"
+)
+
+// UpsertRow finds or creates a row in the spreadsheet for the given kab and createdTime.
+//
+// It looks up the row whose column A matches the kab value in the in-memory
+// index of the sheet (see writeRows). If found, it updates column B with
+// the createdTime. If not found, it appends a new row.
+//
+// Parameters:
+//   - srv: Google Sheets service client.
+//   - spreadsheetID: ID of the Google Sheet.
+//   - kab: value for column A (e.g., parent folder name).
+//   - createdTime: formatted time string for column B.
+//
+// Returns:
+//   - error: any error encountered during read, update, or append operations.
+//
+// extras maps further column letters (e.g. "C") to values written into the same row.
+func UpsertRow(srv *sheets.Service, spreadsheetID, kab, createdTime string, extras map[string]interface{}) error {
+	return writeRows(srv, spreadsheetID, []Write{{Kab: kab, CreatedTime: createdTime, Extras: extras}})
+}
+
+// defaultSheetIndexTTL bounds how long the kab rows of a tracking sheet are
+// trusted before column A is read again; SHEET_INDEX_TTL overrides it.
+const defaultSheetIndexTTL = 10 * time.Minute
+
+// sheetIndex maps the kabs of a tracking sheet to their 1-based rows, so rows
+// can be written without reading the sheet for every file.
+type sheetIndex struct {
+	mu       sync.Mutex
+	table    *Table
+	rows     map[string]int
+	loadedAt time.Time
+}
+
+// sheetIndexes holds the index of every tracking sheet written by this process.
+var sheetIndexes = struct {
+	sync.Mutex
+	m map[string]*sheetIndex
+}{m: map[string]*sheetIndex{}}
+
+// sheetIndexFor returns the index of the spreadsheet, which may not be loaded yet.
+func sheetIndexFor(spreadsheetID string) *sheetIndex {
+	sheetIndexes.Lock()
+	defer sheetIndexes.Unlock()
+	ix, ok := sheetIndexes.m[spreadsheetID]
+	if !ok {
+		ix = &sheetIndex{}
+		sheetIndexes.m[spreadsheetID] = ix
+	}
+	return ix
+}
+
+// load reads the tracking table when the index is empty, older than
+// SHEET_INDEX_TTL or force is set. Callers must hold ix.mu.
+func (ix *sheetIndex) load(srv *sheets.Service, spreadsheetID string, force bool) error {
+	if !force && ix.rows != nil && time.Since(ix.loadedAt) < env.Duration("SHEET_INDEX_TTL", defaultSheetIndexTTL) {
+		return nil
+	}
+	t, err := ReadTable(srv, spreadsheetID)
+	if err != nil {
+		return err
+	}
+	ix.table, ix.rows, ix.loadedAt = t, t.KabRows(), time.Now()
+	log.Printf("Indexed %d kab row(s) of spreadsheet %s", len(ix.rows), spreadsheetID)
+	return nil
+}
+
+// writeRows writes the tracking updates in at most two API calls: one
+// batch update for the kabs that have a row and one append for the others.
+// The sheet is only read again when the index is stale or a kab is missing,
+// since someone may have added its row since the index was loaded.
+func writeRows(srv *sheets.Service, spreadsheetID string, writes []Write) error {
+	ix := sheetIndexFor(spreadsheetID)
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if err := ix.load(srv, spreadsheetID, false); err != nil {
+		return err
+	}
+	for _, w := range writes {
+		if ix.rows[strings.TrimSpace(w.Kab)] == 0 {
+			if err := ix.load(srv, spreadsheetID, true); err != nil {
+				return err
+			}
+			break
+		}
+	}
+
+	t := ix.table
+	var data []*sheets.ValueRange
+	var appends [][]interface{}
+	var appendKabs []string
+	for _, w := range writes {
+		kab := strings.TrimSpace(w.Kab)
+		cells := map[int]interface{}{t.KabCol: w.Kab, t.UploadCol: w.CreatedTime}
+		for name, v := range w.Extras {
+			col, ok := t.column(name)
+			if !ok {
+				log.Printf("Warning: spreadsheet column %q not found, not writing it", name)
+				continue
+			}
+			cells[col] = v
+		}
+		row := ix.rows[kab]
+		if row == 0 {
+			appends = append(appends, t.NewRow(cells))
+			appendKabs = append(appendKabs, kab)
+			continue
+		}
+		delete(cells, t.KabCol)
+		for col, v := range cells {
+			data = append(data, &sheets.ValueRange{Range: t.a1(col, row), Values: [][]interface{}{{v}}})
+		}
+	}
+	if len(data) > 0 {
+		req := &sheets.BatchUpdateValuesRequest{ValueInputOption: "USER_ENTERED", Data: data}
+		if _, err := srv.Spreadsheets.Values.BatchUpdate(spreadsheetID, req).Do(); err != nil {
+			return fmt.Errorf("failed to update spreadsheet rows: %v", err)
+		}
+	}
+	if len(appends) == 0 {
+		return nil
+	}
+	vr := &sheets.ValueRange{Values: appends}
+	resp, err := srv.Spreadsheets.Values.Append(spreadsheetID, t.Range, vr).ValueInputOption("USER_ENTERED").InsertDataOption("INSERT_ROWS").Do()
+	if err != nil {
+		return fmt.Errorf("failed to append row to spreadsheet: %v", err)
+	}
+	first := 0
+	if resp.Updates != nil {
+		first = firstRowOfRange(resp.Updates.UpdatedRange)
+	}
+	if first == 0 {
+		// The rows are somewhere; read column A again on the next write.
+		ix.rows = nil
+		return nil
+	}
+	for i, kab := range appendKabs {
+		ix.rows[kab] = first + i
+	}
+	return nil
+}
+
+// firstRowOfRange returns the first row number of an A1 range such as
+// "Sheet1!A15:D16", or 0 when it has none.
+func firstRowOfRange(a1 string) int {
+	if i := strings.LastIndex(a1, "!"); i >= 0 {
+		a1 = a1[i+1:]
+	}
+	if i := strings.Index(a1, ":"); i >= 0 {
+		a1 = a1[:i]
+	}
+	n, err := strconv.Atoi(strings.TrimLeft(a1, "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz$"))
+	if err != nil {
+		return 0
+	}
+	return n
+}
+
+// writeBatch returns SHEET_WRITE_BATCH, the number of tracking updates
+// collected before they are written together; 1 writes every update at once.
+func writeBatch() int {
+	v := os.Getenv("SHEET_WRITE_BATCH")
+	if v == "" {
+		return 1
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 {
+		log.Printf("Warning: invalid SHEET_WRITE_BATCH %q, writing every update at once", v)
+		return 1
+	}
+	return n
+}
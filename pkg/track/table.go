@@ -0,0 +1,263 @@
+// Package track writes the tracking spreadsheet: one row per kab holding the
+// time of its latest restored backup, plus any extra columns a job fills in.
+// Updates that fail are kept in a Buffer and replayed on a later run.
+package track
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"backup-otomatis/internal/env"
+	"google.golang.org/api/sheets/v4"
+)
+
+// SheetRange returns an A1 range on the named sheet, quoting the sheet name.
+func SheetRange(sheet, a1 string) string {
+	return fmt.Sprintf("'%s'!%s", strings.ReplaceAll(sheet, "'", "''"), a1)
+}
+
+// ReadUrgentKabs returns the kabs flagged as urgent in the tracking sheet.
+//
+// column is the letter (e.g. "C") or header name of the column holding the flag;
+// any other name is an error. A cell counts as flagged when it reads TRUE, YES,
+// Y, 1, X or URGENT, ignoring case.
+func ReadUrgentKabs(srv *sheets.Service, spreadsheetID, column string) (map[string]bool, error) {
+	t, err := ReadTable(srv, spreadsheetID)
+	if err != nil {
+		return nil, err
+	}
+	return t.urgentKabs(column)
+}
+
+// urgentKabs returns the kabs flagged in column of the table.
+func (t *Table) urgentKabs(column string) (map[string]bool, error) {
+	col, ok := t.column(column)
+	if !ok {
+		return nil, fmt.Errorf("no column %q: neither a header of the tracking sheet nor a column letter", column)
+	}
+	kabHeader := env.Or("SPREADSHEET_KAB_HEADER", DefaultKabHeader)
+	urgent := map[string]bool{}
+	for i := range t.Values {
+		// Without SPREADSHEET_RANGE the header row is among the values.
+		if strings.EqualFold(t.Cell(i, t.KabCol), kabHeader) {
+			continue
+		}
+		switch strings.ToUpper(t.Cell(i, col)) {
+		case "TRUE", "YES", "Y", "1", "X", "URGENT":
+			urgent[t.Cell(i, t.KabCol)] = true
+		}
+	}
+	log.Printf("Spreadsheet flags %d kab(s) as urgent", len(urgent))
+	return urgent, nil
+}
+
+// ColumnIndex converts a column letter such as "A" or "AB" to a 0-based index.
+// It returns -1 for anything that is not a column letter.
+func ColumnIndex(column string) int {
+	column = strings.ToUpper(strings.TrimSpace(column))
+	if column == "" {
+		return -1
+	}
+	idx := 0
+	for _, c := range column {
+		if c < 'A' || c > 'Z' {
+			return -1
+		}
+		idx = idx*26 + int(c-'A') + 1
+	}
+	return idx - 1
+}
+
+// Default headers looked up when the tracking sheet is addressed through
+// SPREADSHEET_RANGE.
+const (
+	DefaultKabHeader    = "Kab"
+	DefaultUploadHeader = "Last Upload"
+	// headerSearchRows bounds how far down the range the header row is searched.
+	headerSearchRows = 10
+)
+
+// Table is the tracking sheet as read once: where its kab and upload columns
+// are and which header names the other columns carry. Column and row numbers
+// are absolute within the sheet, so cells can be addressed directly.
+//
+// Without SPREADSHEET_RANGE the table is columns A onwards of the first sheet
+// with the kab in A and the upload time in B, as always. With it, the named
+// range or A1 range is read and its header row located by SPREADSHEET_KAB_HEADER,
+// so columns can be inserted or moved in the sheet without breaking the tool.
+type Table struct {
+	Range    string // range read and appended to
+	sheet    string // sheet name, empty for the first sheet
+	firstCol int    // 0-based column of the first value of each row
+	// Values are the data rows, the first one being row dataRow.
+	Values    [][]interface{}
+	dataRow   int
+	KabCol    int
+	UploadCol int
+	headers   map[string]int
+}
+
+// ReadTable reads the tracking table of the spreadsheet.
+func ReadTable(srv *sheets.Service, spreadsheetID string) (*Table, error) {
+	rng := os.Getenv("SPREADSHEET_RANGE")
+	if rng == "" {
+		resp, err := srv.Spreadsheets.Values.Get(spreadsheetID, "A:ZZ").Do()
+		if err != nil {
+			return nil, fmt.Errorf("failed to read spreadsheet: %v", err)
+		}
+		return defaultTable(resp.Values), nil
+	}
+	resp, err := srv.Spreadsheets.Values.Get(spreadsheetID, rng).Do()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spreadsheet range %s: %v", rng, err)
+	}
+	sheet, col, row := splitA1Start(resp.Range)
+	t := &Table{Range: rng, sheet: sheet, firstCol: col, headers: map[string]int{}}
+
+	kabHeader := env.Or("SPREADSHEET_KAB_HEADER", DefaultKabHeader)
+	header := -1
+	for i := 0; i < len(resp.Values) && i < headerSearchRows && header < 0; i++ {
+		for _, v := range resp.Values[i] {
+			if s, _ := v.(string); strings.EqualFold(strings.TrimSpace(s), kabHeader) {
+				header = i
+				break
+			}
+		}
+	}
+	if header < 0 {
+		return nil, fmt.Errorf("no header row with %q found in spreadsheet range %s", kabHeader, rng)
+	}
+	t.addHeaders(resp.Values[header], col)
+	t.KabCol = t.headers[strings.ToLower(kabHeader)]
+	uploadHeader := env.Or("SPREADSHEET_UPLOAD_HEADER", DefaultUploadHeader)
+	var ok bool
+	if t.UploadCol, ok = t.headers[strings.ToLower(uploadHeader)]; !ok {
+		return nil, fmt.Errorf("no %q column found in spreadsheet range %s", uploadHeader, rng)
+	}
+	t.Values = resp.Values[header+1:]
+	t.dataRow = row + header + 1
+	return t, nil
+}
+
+// defaultTable is the table of a sheet read without SPREADSHEET_RANGE: every
+// row from row 1, with the kab in A and the upload time in B. The cells of row
+// 1 name the columns, so they can be configured by header as well.
+func defaultTable(values [][]interface{}) *Table {
+	t := &Table{Range: "A:B", Values: values, dataRow: 1, KabCol: 0, UploadCol: 1, headers: map[string]int{}}
+	if len(values) > 0 {
+		t.addHeaders(values[0], 0)
+	}
+	return t
+}
+
+// addHeaders records the header names of row, whose first cell is in sheet
+// column col; the first column of a name wins.
+func (t *Table) addHeaders(row []interface{}, col int) {
+	for i, v := range row {
+		if s, _ := v.(string); strings.TrimSpace(s) != "" {
+			name := strings.ToLower(strings.TrimSpace(s))
+			if _, dup := t.headers[name]; !dup {
+				t.headers[name] = col + i
+			}
+		}
+	}
+}
+
+// maxColumnLetters is the length of the last column letter of a sheet, ZZZ.
+const maxColumnLetters = 3
+
+// column resolves a configured column, given either as a header name of the
+// table or as a column letter, to a 0-based sheet column. Longer names are
+// never taken for letters, so a misspelt header is not read as a far column.
+func (t *Table) column(name string) (int, bool) {
+	if c, ok := t.headers[strings.ToLower(strings.TrimSpace(name))]; ok {
+		return c, true
+	}
+	if len(strings.TrimSpace(name)) > maxColumnLetters {
+		return -1, false
+	}
+	c := ColumnIndex(name)
+	return c, c >= 0
+}
+
+// Cell returns the value of row i of values in sheet column col.
+func (t *Table) Cell(i, col int) string {
+	c := col - t.firstCol
+	if c < 0 || c >= len(t.Values[i]) {
+		return ""
+	}
+	s, _ := t.Values[i][c].(string)
+	return strings.TrimSpace(s)
+}
+
+// KabRows maps every kab to its sheet row; the first row of a kab wins.
+func (t *Table) KabRows() map[string]int {
+	rows := make(map[string]int, len(t.Values))
+	for i := range t.Values {
+		if k := t.Cell(i, t.KabCol); k != "" && rows[k] == 0 {
+			rows[k] = t.dataRow + i
+		}
+	}
+	return rows
+}
+
+// a1 returns the address of one cell of the table's sheet.
+func (t *Table) a1(col, row int) string {
+	cell := fmt.Sprintf("%s%d", columnLetter(col), row)
+	if t.sheet == "" {
+		return cell
+	}
+	return SheetRange(t.sheet, cell)
+}
+
+// NewRow returns a row to append, laid out from the table's first column,
+// with the given values by sheet column.
+func (t *Table) NewRow(cells map[int]interface{}) []interface{} {
+	var row []interface{}
+	for col, v := range cells {
+		idx := col - t.firstCol
+		if idx < 0 {
+			continue
+		}
+		for len(row) <= idx {
+			row = append(row, "")
+		}
+		row[idx] = v
+	}
+	return row
+}
+
+// splitA1Start returns the sheet name and the 0-based column and 1-based row
+// of the first cell of an A1 range such as "'Monitoring'!C3:H40".
+func splitA1Start(a1 string) (string, int, int) {
+	sheet := ""
+	if i := strings.LastIndex(a1, "!"); i >= 0 {
+		sheet = strings.ReplaceAll(strings.Trim(a1[:i], "'"), "''", "'")
+		a1 = a1[i+1:]
+	}
+	if i := strings.Index(a1, ":"); i >= 0 {
+		a1 = a1[:i]
+	}
+	a1 = strings.ReplaceAll(a1, "$", "")
+	letters := strings.TrimRight(a1, "0123456789")
+	col := ColumnIndex(letters)
+	if col < 0 {
+		col = 0
+	}
+	row := firstRowOfRange(a1)
+	if row == 0 {
+		row = 1
+	}
+	return sheet, col, row
+}
+
+// columnLetter converts a 0-based column index to its letter, e.g. 27 to "AB".
+func columnLetter(idx int) string {
+	s := ""
+	for idx++; idx > 0; idx = (idx - 1) / 26 {
+		s = string(rune('A'+(idx-1)%26)) + s
+	}
+	return s
+}
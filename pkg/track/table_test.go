@@ -0,0 +1,29 @@
+package track
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUrgentKabsByHeaderInDefaultLayout(t *testing.T) {
+	table := defaultTable([][]interface{}{
+		{"Kab", "Last Upload", "Urgent"},
+		{"Aceh Besar", "3/1/2025 08:00:00", "yes"},
+		{"Pidie", "3/1/2025 09:00:00"},
+		{"Bireuen", "", "X"},
+		{"Sabang", "", "Urgent"},
+	})
+	want := map[string]bool{"Aceh Besar": true, "Bireuen": true, "Sabang": true}
+	for _, column := range []string{"Urgent", " urgent ", "C"} {
+		got, err := table.urgentKabs(column)
+		if err != nil {
+			t.Fatalf("urgentKabs(%q): %v", column, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("urgentKabs(%q) = %v, want %v", column, got, want)
+		}
+	}
+	if _, err := table.urgentKabs("Priority"); err == nil {
+		t.Error("urgentKabs(\"Priority\") succeeded for a header the sheet does not have")
+	}
+}